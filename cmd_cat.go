@@ -0,0 +1,75 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gwatts/dyndump/dyndump"
+)
+
+type catter struct {
+	// options
+	filename     *string
+	s3BucketName *string
+	s3Prefix     *string
+	maxItems     *int
+}
+
+// open returns a reader for the backup's data, along with the number of
+// items it should hold if recorded in its metadata.
+func (c *catter) open() (io.ReadCloser, io.Reader, int64) {
+	if *c.filename != "" {
+		f, err := os.Open(*c.filename)
+		if err != nil {
+			fail("Failed to open file for read: %v", err)
+		}
+		r, err := maybeGunzip(f)
+		if err != nil {
+			fail("Failed to read file: %v", err)
+		}
+		return f, r, 0
+	}
+	sr := &dyndump.S3Reader{
+		S3:         s3.New(newSession()),
+		Bucket:     *c.s3BucketName,
+		PathPrefix: *c.s3Prefix,
+	}
+	md, err := sr.Metadata()
+	if err != nil {
+		fail("Failed to read metadata from S3: %v", err)
+	}
+	return sr, sr, md.ItemCount
+}
+
+// run decodes each item in the backup and writes it to stdout, one per
+// line, stopping after maxItems if set.
+func (c *catter) run() {
+	closer, r, itemCount := c.open()
+	defer closer.Close()
+
+	dec := dyndump.NewSimpleDecoder(r)
+	dec.ExpectedItems = itemCount
+	out := bufio.NewWriter(os.Stdout)
+	enc := dyndump.NewSimpleEncoder(out)
+	for n := 0; *c.maxItems == 0 || n < *c.maxItems; n++ {
+		item, err := dec.ReadItem()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			out.Flush()
+			fail("Failed to read item %d: %v", n+1, err)
+		}
+		if err := enc.WriteItem(item); err != nil {
+			fail("Failed to write item %d: %v", n+1, err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		fail("Failed to write output: %v", err)
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"io"
 
 	"github.com/Bowery/prompt"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gwatts/dyndump/dyndump"
 	"gopkg.in/cheggaaa/pb.v1"
@@ -26,7 +25,7 @@ type deleter struct {
 }
 
 func (d *deleter) init() error {
-	del, err := dyndump.NewS3Deleter(s3.New(session.New()), *d.s3BucketName, *d.s3Prefix)
+	del, err := dyndump.NewS3Deleter(s3.New(newSession()), *d.s3BucketName, *d.s3Prefix)
 	if err != nil {
 		return err
 	}
@@ -68,6 +67,10 @@ func (d *deleter) updateProgress(bar *pb.ProgressBar) {
 	bar.Set64(d.del.Completed())
 }
 
+func (d *deleter) progress() progressStats {
+	return progressStats{items: d.del.Completed()}
+}
+
 func (d *deleter) abort() {
 	d.del.Abort()
 }
@@ -5,15 +5,16 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gwatts/dyndump/dyndump"
@@ -22,42 +23,164 @@ import (
 
 const (
 	s3ObjectNotFound = "NoSuchKey"
+
+	// cardinalityTopN is the number of most frequent values reported by
+	// --cardinality.
+	cardinalityTopN = 10
 )
 
+// s3CannedACLs lists the canned ACLs accepted by --s3-acl.
+var s3CannedACLs = []string{
+	s3.ObjectCannedACLPrivate,
+	s3.ObjectCannedACLPublicRead,
+	s3.ObjectCannedACLPublicReadWrite,
+	s3.ObjectCannedACLAuthenticatedRead,
+	s3.ObjectCannedACLAwsExecRead,
+	s3.ObjectCannedACLBucketOwnerRead,
+	s3.ObjectCannedACLBucketOwnerFullControl,
+}
+
+func isCannedACL(acl string) bool {
+	for _, canned := range s3CannedACLs {
+		if acl == canned {
+			return true
+		}
+	}
+	return false
+}
+
+// s3SSEModes lists the server side encryption modes accepted by --sse.
+var s3SSEModes = []string{
+	s3.ServerSideEncryptionAes256,
+	s3.ServerSideEncryptionAwsKms,
+}
+
+func isSSEMode(sse string) bool {
+	for _, mode := range s3SSEModes {
+		if sse == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// s3StorageClasses lists the storage classes accepted by --s3-storage-class.
+var s3StorageClasses = []string{
+	s3.StorageClassStandard,
+	s3.StorageClassReducedRedundancy,
+	s3.StorageClassStandardIa,
+	s3.StorageClassOnezoneIa,
+	s3.StorageClassIntelligentTiering,
+	s3.StorageClassGlacier,
+	"GLACIER_IR",   // not yet defined by the SDK
+	"DEEP_ARCHIVE", // not yet defined by the SDK
+}
+
+func isStorageClass(class string) bool {
+	for _, known := range s3StorageClasses {
+		if class == known {
+			return true
+		}
+	}
+	return false
+}
+
+// s3Compressions lists the part compressions accepted by --s3-compression.
+var s3Compressions = []string{
+	string(dyndump.CompressionGzip),
+	string(dyndump.CompressionZlib),
+	string(dyndump.CompressionZstd),
+	string(dyndump.CompressionNone),
+}
+
+func isPartCompression(compression string) bool {
+	for _, known := range s3Compressions {
+		if compression == known {
+			return true
+		}
+	}
+	return false
+}
+
 type writers struct {
 	io.Writer
 	fileWriter io.WriteCloser
 	s3Writer   *dyndump.S3Writer
 	s3RunErr   chan error
+	tarFile    io.Closer // archive written by s3Writer in place of S3, if any
+	fifo       bool      // fileWriter writes to a named pipe
 }
 
 func (w *writers) Close() error {
+	var ferr error
 	if w.fileWriter != nil {
-		if w, ok := w.Writer.(io.Closer); ok {
-			w.Close()
-		}
+		ferr = w.fileWriter.Close()
 	}
 	if w.s3Writer != nil {
 		if err := w.s3Writer.Close(); err != nil {
 			return err
 		}
-		return <-w.s3RunErr
+		err := <-w.s3RunErr
+		if w.tarFile != nil {
+			if terr := w.tarFile.Close(); err == nil {
+				err = terr
+			}
+		}
+		if err != nil {
+			if merr, ok := err.(*dyndump.MetadataError); ok {
+				// give the user the means to complete the backup by hand
+				data, _ := json.MarshalIndent(merr.Metadata, "", "  ")
+				return fmt.Errorf("%v\nThe backup may be completed by uploading the following to s3://%s/%s\n%s",
+					err, w.s3Writer.Bucket, merr.Key, data)
+			}
+			return err
+		}
 	}
-	return nil
+	return ferr
 }
 
 func (w *writers) Abort() {
-	if w.fileWriter != nil {
-		if w, ok := w.Writer.(io.Closer); ok {
-			w.Close()
-		}
-	}
+	w.abortFile()
 	if w.s3Writer != nil {
 		w.s3Writer.Abort()
 		<-w.s3RunErr
+		if w.tarFile != nil {
+			w.tarFile.Close()
+		}
 	}
 }
 
+// abortFile closes the file output.  Output to a fifo is abandoned without
+// waiting for a reader to consume it, killing any compress command.
+func (w *writers) abortFile() {
+	if w.fileWriter == nil {
+		return
+	}
+	if cw, ok := w.fileWriter.(*cmdWriter); ok && w.fifo {
+		cw.Abort()
+	} else {
+		w.fileWriter.Close()
+	}
+	w.fileWriter = nil
+}
+
+// csvColumns splits a comma separated list of column names.
+func csvColumns(list string) []string {
+	var columns []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			columns = append(columns, name)
+		}
+	}
+	return columns
+}
+
+// isFifo reports whether filename is an existing named pipe.
+func isFifo(filename string) bool {
+	fi, err := os.Stat(filename)
+	return err == nil && fi.Mode()&os.ModeNamedPipe != 0
+}
+
 type dumper struct {
 	f          *dyndump.Fetcher
 	abortChan  chan struct{}
@@ -66,6 +189,13 @@ type dumper struct {
 
 	dyn       *dynamodb.DynamoDB
 	tableInfo *dynamodb.TableDescription
+	throttles throttleCounter
+	s3Writer  *dyndump.S3Writer
+	itemCount int64 // exact item count, if counted by --precount
+	keyNames  map[string]*string
+	ttlAttr   string // TTL attribute of the table, if enabled
+	keyValues map[string]*dynamodb.AttributeValue
+	values    *dyndump.CardinalityCollector // set if --cardinality is used
 
 	// options
 	tableName      *string
@@ -75,13 +205,55 @@ type dumper struct {
 	maxItems       *int
 	parallel       *int
 	readCapacity   *int
+	adaptive       *bool
+	precount       *bool
+	keyCondition   *string
+	filter         *string
+	projection     *string
+	printKeys      *bool
+	hashKey        *string
+	rangeKey       *string
+	keyNamesJSON   *string
+	keyValuesJSON  *string
+	rotateItems    *int
+	rotateBytes    *int
 	s3BucketName   *string
 	s3Prefix       *string
+	mdTableARN     *string
+	mdTableName    *string
+	noChecksum     *bool
+	compressCmd    *string
+	createdBy      *string
+	datePartition  *bool
+	sequence       *bool
+	omitNulls      *bool
+	bufferOutput   *bool
+	format         *string
+	formatPlugin   *string
+	columns        *string
+	csvJSON        *bool
+	s3Bandwidth    *int
+	maxRetries     *int
+	cleanupAbort   *bool
+	checkpointFile *string
+	deferMetadata  *bool
+	writeOnce      *bool
+	noFlushTuning  *bool
+	s3Multipart    *bool
+	partRetries    *int
+	s3ACL          *string
+	sse            *string
+	sseKMSKeyID    *string
+	storageClass   *string
+	compression    *string
+	compressLevel  *int
+	sizeHistogram  *bool
+	cardinality    *string
 }
 
 func (d *dumper) openS3Writer() (*dyndump.S3Writer, error) {
 	// check if already exists
-	svc := s3.New(session.New())
+	svc := s3.New(newSession())
 	r := dyndump.S3Reader{
 		S3:         svc,
 		Bucket:     *d.s3BucketName,
@@ -89,47 +261,179 @@ func (d *dumper) openS3Writer() (*dyndump.S3Writer, error) {
 	}
 	md, err := r.Metadata()
 	if err == nil {
-		// no error; successfully pulled existing metadata
-		return nil, fmt.Errorf("backup already exists for path prefix=%q table_name=%q",
-			*d.s3Prefix, md.TableName)
-	}
-	if aerr, ok := err.(awserr.Error); !ok || (ok && aerr.Code() != s3ObjectNotFound) {
+		// no error; successfully pulled existing metadata.  It may only be
+		// replaced if resuming an interrupted dump.
+		if !d.resuming() {
+			return nil, fmt.Errorf("backup already exists for path prefix=%q table_name=%q",
+				*d.s3Prefix, md.TableName)
+		}
+	} else if aerr, ok := err.(awserr.Error); !ok || (ok && aerr.Code() != s3ObjectNotFound) {
 		return nil, err
 	}
 
-	// metadata wasn't found; ok to continue
-	md = dyndump.Metadata{
-		TableName: *d.tableName,
-		TableARN:  aws.StringValue(d.tableInfo.TableArn),
+	// metadata wasn't found, or is being replaced; ok to continue
+	return dyndump.NewS3Writer(svc, *d.s3BucketName, *d.s3Prefix, d.backupMetadata()), nil
+}
+
+// backupMetadata returns the initial metadata of a backup written to S3 or
+// to a tar archive.
+func (d *dumper) backupMetadata() dyndump.Metadata {
+	md := dyndump.Metadata{
+		TableName:   *d.tableName,
+		TableARN:    aws.StringValue(d.tableInfo.TableArn),
+		CreatedBy:   *d.createdBy,
+		ToolVersion: "dyndump " + version,
+	}
+	if *d.keyCondition != "" || *d.filter != "" || *d.projection != "" {
+		md.Type = dyndump.BackupQuery // a selective backup
 	}
-	return dyndump.NewS3Writer(svc, *d.s3BucketName, *d.s3Prefix, md), nil
+	md.TTLAttribute = d.ttlAttr
+	if md.CreatedBy == "" {
+		md.CreatedBy = defaultCreatedBy()
+	}
+	md.HashKey, md.RangeKey = dyndump.KeySchemaNames(d.tableInfo.KeySchema)
+	md.SetTableSchema(d.tableInfo)
+	if *d.mdTableName != "" {
+		md.TableName = *d.mdTableName
+	}
+	if *d.mdTableARN != "" {
+		md.TableARN = *d.mdTableARN
+	}
+	return md
 }
 
-func (d *dumper) openWriters() *writers {
+// resuming returns true if a checkpoint file was left by an interrupted dump.
+func (d *dumper) resuming() bool {
+	if *d.checkpointFile == "" {
+		return false
+	}
+	_, err := os.Stat(*d.checkpointFile)
+	return err == nil
+}
+
+// defaultCreatedBy returns a "user@host" string identifying who is running
+// the dump, falling back to whichever part is available.
+func defaultCreatedBy() string {
+	user := os.Getenv("USER")
+	host := os.Getenv("HOSTNAME")
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	switch {
+	case user != "" && host != "":
+		return user + "@" + host
+	case user != "":
+		return user
+	}
+	return host
+}
+
+// openFile creates filename, piping its output through the compress
+// command if one is set.
+func (d *dumper) openFile(filename string) (io.WriteCloser, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open file for write: %s", err)
+	}
+	if *d.compressCmd == "" {
+		return f, nil
+	}
+	cw, err := newCmdWriter(*d.compressCmd, f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed to start compress command: %s", err)
+	}
+	return cw, nil // closes the file too
+}
+
+func (d *dumper) openWriters(infoWriter io.Writer) *writers {
 	var fout io.Writer
 	ws := new(writers)
 
 	if *d.stdout {
 		fout = os.Stdout
+		if *d.compressCmd != "" {
+			cw, err := newCmdWriter(*d.compressCmd, fout)
+			if err != nil {
+				fail("Failed to start compress command: %s", err)
+			}
+			fout = cw
+			ws.fileWriter = cw
+		}
 
-	} else if *d.filename != "" {
-		var err error
-		fout, err = os.Create(*d.filename)
+	} else if *d.filename != "" && (*d.rotateItems > 0 || *d.rotateBytes > 0) {
+		rw, err := newRotatingWriter(*d.filename, int64(*d.rotateItems), int64(*d.rotateBytes), d.openFile)
+		if err != nil {
+			fail("%s", err)
+		}
+		fout = rw
+		ws.fileWriter = rw
+
+	} else if *d.filename != "" && isTarFilename(*d.filename) {
+		// the backup is written as it would be to S3, into an archive
+		tw, err := newTarFileWriter(*d.filename)
 		if err != nil {
 			fail("Failed to open file for write: %s", err)
 		}
+		ws.tarFile = tw
+		ws.s3Writer = dyndump.NewS3Writer(tw, "", tarPathPrefix, d.backupMetadata())
+		ws.s3Writer.KeyNamer = tarKeyNamer
+		ws.s3Writer.MaxParallel = *d.parallel
+		ws.s3Writer.SkipHashing = *d.noChecksum
+		ws.s3RunErr = make(chan error)
+		ws.Writer = ws.s3Writer
+		go func() { ws.s3RunErr <- ws.s3Writer.Run() }()
+		return ws
+
+	} else if *d.filename != "" {
+		if isFifo(*d.filename) {
+			// opening a fifo blocks until it has a reader
+			ws.fifo = true
+			fmt.Fprintf(infoWriter, "Waiting for a reader to open fifo %s\n", *d.filename)
+		}
+		f, err := d.openFile(*d.filename)
+		if err != nil {
+			fail("%s", err)
+		}
+		fout = f
+		ws.fileWriter = f
 	}
 
 	if *d.s3BucketName != "" {
 		if *d.s3Prefix == "" {
 			fail("s3-prefix not set")
 		}
+		if p := *d.s3Prefix; p != "/" && (strings.HasSuffix(p, "/") || strings.HasSuffix(p, "-")) {
+			fmt.Fprintf(os.Stderr, "Warning: a \"-\" is appended to s3-prefix; the metadata will be stored at %q\n",
+				dyndump.DefaultKeyNamer{}.MetaKey(p))
+		}
 		w, err := d.openS3Writer()
 		if err != nil {
 			fail("Failed: %v", err)
 		}
 		ws.s3Writer = w
 		ws.s3Writer.MaxParallel = *d.parallel // match fetcher parallelism
+		ws.s3Writer.SkipHashing = *d.noChecksum
+		ws.s3Writer.DatePartition = *d.datePartition
+		ws.s3Writer.UploadBandwidth = int64(*d.s3Bandwidth)
+		ws.s3Writer.CleanupOnAbort = *d.cleanupAbort
+		ws.s3Writer.CheckpointFile = *d.checkpointFile
+		ws.s3Writer.DeferMetadata = *d.deferMetadata
+		ws.s3Writer.WriteOnce = *d.writeOnce
+		ws.s3Writer.UseMultipartUpload = *d.s3Multipart
+		ws.s3Writer.PartRetries = *d.partRetries
+		if *d.noFlushTuning {
+			ws.s3Writer.GzipFlushInterval = -1
+		}
+		ws.s3Writer.ACL = *d.s3ACL
+		ws.s3Writer.ServerSideEncryption = *d.sse
+		ws.s3Writer.SSEKMSKeyID = *d.sseKMSKeyID
+		if *d.sseKMSKeyID != "" {
+			ws.s3Writer.ServerSideEncryption = s3.ServerSideEncryptionAwsKms
+		}
+		ws.s3Writer.StorageClass = *d.storageClass
+		ws.s3Writer.Compression = dyndump.PartCompression(*d.compression)
+		ws.s3Writer.CompressionLevel = *d.compressLevel
 		ws.s3RunErr = make(chan error)
 		if fout != nil {
 			// stream to both
@@ -145,40 +449,173 @@ func (d *dumper) openWriters() *writers {
 		fail("Either s3-bucket & s3-prefix, or filename must be set")
 	}
 
+	if *d.formatPlugin != "" {
+		// the items are piped through the plugin and its output written in
+		// their place; closing the plugin's writer waits for it to finish
+		// writing before closing the file
+		pw, err := newCmdWriter(*d.formatPlugin, fout)
+		if err != nil {
+			fail("Failed to start format plugin: %s", err)
+		}
+		fout = pw
+		ws.fileWriter = pw
+	}
+
 	// no s3
 	ws.Writer = fout
 	return ws
 }
 
 func (d *dumper) init() error {
-	d.dyn = dynamodb.New(session.New())
-	resp, err := d.dyn.DescribeTable(&dynamodb.DescribeTableInput{
-		TableName: d.tableName,
-	})
+	d.dyn = dynamodb.New(newSession(aws.NewConfig().WithMaxRetries(*d.maxRetries)))
+	d.throttles.install(&d.dyn.Handlers)
+	tableInfo, err := describeTable(d.dyn, *d.tableName, false)
 	if err != nil {
+		// the table description is only used for display and metadata;
+		// the scan itself may still succeed without it.
+		fmt.Fprintf(os.Stderr, "Warning: failed to describe table; size and ARN will be unknown: %v\n", err)
+		tableInfo = &dynamodb.TableDescription{}
+	}
+	d.tableInfo = tableInfo
+	if d.ttlAttr, err = describeTTL(d.dyn, *d.tableName); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to describe table TTL; it won't be recorded: %v\n", err)
+	}
+	if err := d.parseKeyCondition(); err != nil {
 		return err
 	}
-	d.tableInfo = resp.Table
+	if *d.printKeys {
+		if err := d.projectKeys(); err != nil {
+			return err
+		}
+	}
+	if *d.precount {
+		return d.countItems()
+	}
 	return nil
 }
 
-func (d *dumper) start(infoWriter io.Writer) (done chan error, err error) {
-	out := d.openWriters()
-	w := dyndump.NewSimpleEncoder(out)
+// parseKeyCondition decodes the attribute names and values used by
+// --key-condition, --filter and --projection.  Values are given in the same JSON format as
+// dumped items.
+func (d *dumper) parseKeyCondition() error {
+	if *d.keyNamesJSON != "" {
+		if err := json.Unmarshal([]byte(*d.keyNamesJSON), &d.keyNames); err != nil {
+			return fmt.Errorf("Failed to decode --key-names: %v", err)
+		}
+	}
+	if *d.keyValuesJSON != "" {
+		if err := json.Unmarshal([]byte(*d.keyValuesJSON), &d.keyValues); err != nil {
+			return fmt.Errorf("Failed to decode --key-values: %v", err)
+		}
+	}
+	return nil
+}
 
-	fmt.Fprintf(infoWriter, "Beginning scan: table=%q readCapacity=%d parallel=%d itemCount=%d totalSize=%s\n",
-		*d.tableName, *d.readCapacity, *d.parallel,
-		aws.Int64Value(d.tableInfo.ItemCount), fmtBytes(aws.Int64Value(d.tableInfo.TableSizeBytes)))
+// projectKeys sets the projection to the table's key attributes, named by
+// --hash-key and --range-key or else by the table's key schema.
+func (d *dumper) projectKeys() error {
+	hashKey, rangeKey := *d.hashKey, *d.rangeKey
+	if hashKey == "" {
+		hashKey, rangeKey = dyndump.KeySchemaNames(d.tableInfo.KeySchema)
+	}
+	if hashKey == "" {
+		return errors.New("--print-keys requires the table's key schema; set --hash-key if the table can't be described")
+	}
+	if d.keyNames == nil {
+		d.keyNames = make(map[string]*string)
+	}
+	// placeholders avoid clashes with reserved words
+	projection := "#dyndumpHK"
+	d.keyNames["#dyndumpHK"] = aws.String(hashKey)
+	if rangeKey != "" {
+		projection += ", #dyndumpRK"
+		d.keyNames["#dyndumpRK"] = aws.String(rangeKey)
+	}
+	*d.projection = projection
+	return nil
+}
 
-	d.f = &dyndump.Fetcher{
+// newFetcher returns a fetcher for the table, which queries it rather than
+// scanning it if --key-condition is set, returning only the items matching
+// --filter if it's set and only the attributes named by --projection.
+func (d *dumper) newFetcher() *dyndump.Fetcher {
+	f := &dyndump.Fetcher{
 		Dyn:            d.dyn,
 		TableName:      *d.tableName,
 		ConsistentRead: *d.consistentRead,
 		MaxParallel:    *d.parallel,
 		MaxItems:       int64(*d.maxItems),
 		ReadCapacity:   float64(*d.readCapacity),
-		Writer:         w,
+
+		FilterExpression:          *d.filter,
+		ProjectionExpression:      *d.projection,
+		ExpressionAttributeNames:  d.keyNames,
+		ExpressionAttributeValues: d.keyValues,
 	}
+	if *d.keyCondition != "" {
+		f.MaxParallel = 1 // a query can't be split into segments
+		f.KeyConditionExpression = *d.keyCondition
+	}
+	return f
+}
+
+// countItems scans the table to count its items exactly, as the count
+// returned by DescribeTable is only updated every six hours or so.
+func (d *dumper) countItems() error {
+	f := d.newFetcher()
+	f.CountOnly = true
+	if err := f.Run(); err != nil {
+		return fmt.Errorf("Failed to count items: %v", err)
+	}
+	d.itemCount = f.Stats().ItemsRead
+	if *d.maxItems > 0 && d.itemCount > int64(*d.maxItems) {
+		d.itemCount = int64(*d.maxItems)
+	}
+	return nil
+}
+
+func (d *dumper) start(infoWriter io.Writer) (done chan error, err error) {
+	out := d.openWriters(infoWriter)
+	d.s3Writer = out.s3Writer
+	d.f = d.newFetcher()
+	var w dyndump.ItemWriter
+	var buffered *dyndump.BufferedEncoder
+	if *d.format == "csv" {
+		enc := dyndump.NewCSVItemEncoder(out, csvColumns(*d.columns))
+		enc.EncodeComplex = *d.csvJSON
+		w = enc
+	} else if *d.bufferOutput {
+		// a buffer for each segment the fetcher scans concurrently
+		buffered = dyndump.NewBufferedEncoder(out, d.f.MaxParallel)
+		buffered.OmitNulls = *d.omitNulls
+		w = buffered
+	} else {
+		enc := dyndump.NewSimpleEncoder(out)
+		enc.Sequence = *d.sequence
+		enc.OmitNulls = *d.omitNulls
+		w = enc
+	}
+	d.f.Writer = w
+	if *d.cardinality != "" {
+		d.values = dyndump.NewCardinalityCollector(*d.cardinality, cardinalityTopN)
+		d.values.Writer = w
+		d.f.Writer = d.values
+	}
+	d.f.CollectItemSizes = *d.sizeHistogram
+	d.f.AdaptiveCapacity = *d.adaptive
+	d.f.Throttles = d.throttles.Count
+
+	mode := "scan"
+	if *d.keyCondition != "" {
+		mode = "query"
+	}
+	itemCount := aws.Int64Value(d.tableInfo.ItemCount)
+	if *d.precount {
+		itemCount = d.itemCount
+	}
+	fmt.Fprintf(infoWriter, "Beginning %s: table=%q readCapacity=%d parallel=%d itemCount=%d totalSize=%s\n",
+		mode, *d.tableName, *d.readCapacity, d.f.MaxParallel,
+		itemCount, fmtBytes(aws.Int64Value(d.tableInfo.TableSizeBytes)))
 
 	done = make(chan error)
 	d.abortChan = make(chan struct{}, 1)
@@ -190,16 +627,27 @@ func (d *dumper) start(infoWriter io.Writer) (done chan error, err error) {
 
 		select {
 		case <-d.abortChan:
+			if out.fifo {
+				// a write to a fifo blocks until it's read; closing the
+				// fifo first ensures the fetcher can stop
+				out.abortFile()
+			}
 			d.f.Stop()
 			<-rerr
 			out.Abort()
 			done <- errors.New("Aborted")
 
 		case err := <-rerr:
+			if err == nil && buffered != nil {
+				err = buffered.Flush()
+			}
 			if err != nil {
 				out.Abort()
 				done <- err
 			} else {
+				if d.s3Writer != nil && *d.sizeHistogram {
+					d.s3Writer.SetItemSizes(d.f.Stats().ItemSizes)
+				}
 				done <- out.Close()
 			}
 		}
@@ -209,14 +657,69 @@ func (d *dumper) start(infoWriter io.Writer) (done chan error, err error) {
 }
 
 func (d *dumper) newProgressBar() *pb.ProgressBar {
+	if *d.precount {
+		bar := pb.New64(d.itemCount)
+		bar.ShowSpeed = true
+		return bar
+	}
 	bar := pb.New64(aws.Int64Value(d.tableInfo.TableSizeBytes))
 	bar.ShowSpeed = true
 	bar.SetUnits(pb.U_BYTES)
+	// the table size may be stale, so the time left is shown by
+	// updateProgress rather than the bar's own estimate
+	bar.ShowTimeLeft = false
 	return bar
 }
 
 func (d *dumper) updateProgress(bar *pb.ProgressBar) {
+	if *d.precount {
+		bar.Set64(d.f.Stats().ItemsRead)
+		return
+	}
 	bar.Set64(d.f.Stats().BytesRead)
+	if eta := d.ETA(); eta >= 0 {
+		bar.Postfix(" ETA " + eta.Round(time.Second).String())
+	} else {
+		bar.Postfix(" ETA unknown")
+	}
+}
+
+// ETA estimates the time remaining until the dump completes from the
+// table's size and the rate data has been read at so far.  It returns a
+// negative duration if it can't be estimated, as no data has been read yet
+// or the size reported by DescribeTable, which is only updated every six
+// hours or so, is zero or has already been exceeded.
+func (d *dumper) ETA() time.Duration {
+	total := aws.Int64Value(d.tableInfo.TableSizeBytes)
+	read := d.f.Stats().BytesRead
+	elapsed := time.Since(d.startTime)
+	if total <= 0 || read <= 0 || read >= total || elapsed <= 0 {
+		return -1
+	}
+	rate := float64(read) / elapsed.Seconds()
+	return time.Duration(float64(total-read) / rate * float64(time.Second))
+}
+
+func (d *dumper) progress() progressStats {
+	stats := d.f.Stats()
+	ps := progressStats{items: stats.ItemsRead, bytes: stats.BytesRead, capacity: stats.CapacityUsed}
+	if segments := d.f.SegmentStats(); len(segments) > 1 {
+		ps.segments = len(segments)
+		ps.slowest = slowestSegment(segments)
+	}
+	return ps
+}
+
+// slowestSegment returns the unfinished segment that has read the fewest
+// bytes, or the last segment if all have finished.
+func slowestSegment(segments []dyndump.SegmentStat) int64 {
+	slowest := segments[0]
+	for _, seg := range segments[1:] {
+		if slowest.Done || (!seg.Done && seg.BytesRead < slowest.BytesRead) {
+			slowest = seg
+		}
+	}
+	return slowest.Segment
 }
 
 func (d *dumper) abort() {
@@ -230,4 +733,33 @@ func (d *dumper) printFinalStats(w io.Writer) {
 	fmt.Fprintf(w, "Avg items/sec: %.2f\n", float64(finalStats.ItemsRead)/deltaSeconds)
 	fmt.Fprintf(w, "Avg capacity/sec: %.2f\n", finalStats.CapacityUsed/deltaSeconds)
 	fmt.Fprintln(w, "Total items read: ", finalStats.ItemsRead)
+	fmt.Fprintln(w, "Total throttled requests: ", d.throttles.Count())
+	if *d.adaptive {
+		fmt.Fprintf(w, "Peak read capacity: %.0f\n", finalStats.PeakReadCapacity)
+	}
+	if *d.sizeHistogram {
+		fmt.Fprintln(w, "Item size histogram:")
+		for i, n := range finalStats.ItemSizes {
+			fmt.Fprintf(w, "  %-9s %d\n", dyndump.SizeBucketLabel(i)+":", n)
+		}
+	}
+	if d.values != nil {
+		s := d.values.Summary()
+		fmt.Fprintf(w, "Attribute %q: items=%d missing=%d distinct values=~%d\n", s.Attribute, s.Items, s.Missing, s.Distinct)
+		for _, vc := range s.Top {
+			fmt.Fprintf(w, "  %-9d %s\n", vc.Count, vc.Value)
+		}
+	}
+	if d.s3Writer != nil {
+		s3Stats := d.s3Writer.Stats()
+		fmt.Fprintln(w, "Total S3 parts written: ", s3Stats.PartCount)
+		fmt.Fprintln(w, "Total bytes uncompressed: ", fmtBytes(s3Stats.UncompressedBytes))
+		fmt.Fprintln(w, "Total bytes compressed: ", fmtBytes(s3Stats.CompressedBytes))
+		if s3Stats.CompressedBytes > 0 {
+			fmt.Fprintf(w, "Compression ratio: %.2f:1\n", float64(s3Stats.UncompressedBytes)/float64(s3Stats.CompressedBytes))
+		}
+	}
+	if d.s3Writer != nil && *d.checkpointFile != "" {
+		fmt.Fprintln(w, "Total parts resumed: ", d.s3Writer.SkippedParts())
+	}
 }
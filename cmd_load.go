@@ -5,26 +5,84 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gwatts/dyndump/dyndump"
 	"gopkg.in/cheggaaa/pb.v1"
 )
 
-type loader struct {
+var verifyModes = map[string]dyndump.VerifyMode{
+	"all":    dyndump.VerifyAll,
+	"parts":  dyndump.VerifyParts,
+	"master": dyndump.VerifyMaster,
+	"none":   dyndump.VerifyNone,
+}
+
+var utf8Modes = map[string]dyndump.UTF8Mode{
+	"none": dyndump.UTF8NoCheck,
+	"fail": dyndump.UTF8Fail,
+	"skip": dyndump.UTF8Skip,
+}
+
+// retryRunDelay is the delay before a load that failed due to throttling
+// is first run again, doubling with each further retry up to
+// maxRetryRunDelay; an auto scaled table takes several minutes to scale up.
+var (
+	retryRunDelay    = time.Minute
+	maxRetryRunDelay = 15 * time.Minute
+)
+
+var compareOps = map[string]dyndump.CompareOp{
+	"gt": dyndump.CompareGreater,
+	"ge": dyndump.CompareGreaterEqual,
+	"lt": dyndump.CompareLess,
+	"le": dyndump.CompareLessEqual,
+}
+
+// loadTarget is a table to load items into.  A single load may write to
+// tables in several regions.
+type loadTarget struct {
+	region    string // empty for the default region
 	loader    *dyndump.Loader
+	dyn       *dynamodb.DynamoDB
+	tableInfo *dynamodb.TableDescription
+	created   bool // set if the table was created by --create-table
+	hashKey   string
+	rangeKey  string
+	throttles throttleCounter
+	err       error // set once the target's load has finished
+}
+
+// name returns the target's region for display.
+func (t *loadTarget) name() string {
+	if t.region == "" {
+		return "default"
+	}
+	return t.region
+}
+
+type loader struct {
+	targets   []*loadTarget
+	s3Reader  *dyndump.S3Reader
 	r         *readWatcher
+	in        io.Reader
 	md        dyndump.Metadata
 	startTime time.Time
-	dyn       *dynamodb.DynamoDB
-	tableInfo *dynamodb.TableDescription
 	source    string
 
 	// options
@@ -32,29 +90,124 @@ type loader struct {
 	allowOverwrite *bool
 	filename       *string
 	stdin          *bool
+	url            *string
 	maxItems       *int
 	parallel       *int
 	writeCapacity  *int
 	s3BucketName   *string
 	s3Prefix       *string
+	verify         *string
+	decompressCmd  *string
+	hashKey        *string
+	rangeKey       *string
+	maxRetries     *int
+	envelope       *bool
+	validateUTF8   *string
+	continueOnErr  *bool
+	deadLetterFile *string
+	maxFailures    *int
+	force          *bool
+	targetRegions  *[]string
+	restoreTTL     *bool
+	createTable    *bool
+	restoreRCU     *int
+	restoreWCU     *int
+	resetCapacity  *bool
+	useBackupName  *bool
+	tablePrefix    *string
+	tableSuffix    *string
+	condAttr       *string
+	condOp         *string
+	resumeFile     *string
+	s3Parallel     *int
+	batchSize      *int
+	retryRun       *int
+	verifyAfter    *int
+	verifySeed     *int
+
+	sampler *dyndump.ItemSampler // samples the items loaded with --verify-after
+	seed    int64                // seed used to choose the sample
+
+	m       sync.Mutex    // guards the source and loaders, replaced when the load is retried
+	runs    int           // number of times the load has been run
+	running bool          // set while the loaders are running
+	aborted chan struct{} // closed by abort
 }
 
 func (ld *loader) init() error {
-	ld.dyn = dynamodb.New(session.New())
-	resp, err := ld.dyn.DescribeTable(&dynamodb.DescribeTableInput{
-		TableName: ld.tableName,
-	})
-	if err != nil {
+	var err error
+	if err = ld.openSource(); err != nil {
 		return err
 	}
-	ld.tableInfo = resp.Table
+	if *ld.useBackupName {
+		// the metadata is read by openSource
+		if ld.md.TableName == "" {
+			return errors.New("The backup's metadata doesn't record a table name")
+		}
+		*ld.tableName = *ld.tablePrefix + ld.md.TableName + *ld.tableSuffix
+	}
+	if ld.seed = int64(*ld.verifySeed); ld.seed == 0 {
+		ld.seed = time.Now().UnixNano()
+	}
 
+	regions := *ld.targetRegions
+	if len(regions) == 0 {
+		regions = []string{""}
+	}
+	for _, region := range regions {
+		t := &loadTarget{region: region}
+		cfg := aws.NewConfig().WithMaxRetries(*ld.maxRetries)
+		if region != "" {
+			cfg = cfg.WithRegion(region)
+		}
+		t.dyn = dynamodb.New(newSession(cfg))
+		t.throttles.install(&t.dyn.Handlers)
+		if *ld.hashKey == "" && !*ld.createTable {
+			// the table's key schema is only needed if not supplied by the
+			// user; a table that's to be created is described once it is
+			if t.tableInfo, err = describeTable(t.dyn, *ld.tableName, true); err != nil {
+				return fmt.Errorf("region %s: %v", t.name(), err)
+			}
+		}
+		ld.targets = append(ld.targets, t)
+	}
+	return nil
+}
+
+// openSource opens the source of the items to load, reopening it from the
+// start if it was already open.
+func (ld *loader) openSource() error {
+	ld.m.Lock()
+	defer ld.m.Unlock()
+	if ld.r != nil {
+		if c, ok := ld.r.Reader.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	if cr, ok := ld.in.(*cmdReader); ok {
+		cr.Close() // the previous run's --decompress-cmd
+	}
+	ld.in = nil
+	var err error
 	switch {
 	case *ld.stdin:
 		ld.r = newReadWatcher(os.Stdin)
 		ld.source = "stdin"
 		ld.md.UncompressedBytes = -1 // unknown
 
+	case *ld.filename != "" && isTarFilename(*ld.filename):
+		tr, err := openTarFile(*ld.filename)
+		if err != nil {
+			return fmt.Errorf("Failed to open archive for read: %v", err)
+		}
+		ld.source = *ld.filename
+		tr.VerifyMode = verifyModes[*ld.verify]
+		ld.s3Reader = tr.S3Reader
+		ld.r = newReadWatcher(tr)
+		if ld.md, err = tr.Metadata(); err != nil {
+			return fmt.Errorf("Failed to read metadata from archive: %v", err)
+		}
+
 	case *ld.filename != "":
 		f, err := os.Open(*ld.filename)
 		if err != nil {
@@ -66,64 +219,546 @@ func (ld *loader) init() error {
 			ld.md.UncompressedBytes = fi.Size()
 		}
 
+	case *ld.url != "":
+		body, size, err := openURL(*ld.url)
+		if err != nil {
+			return fmt.Errorf("Failed to open URL for read: %v", err)
+		}
+		ld.source = *ld.url
+		// progress is tracked against the bytes received, which may be compressed
+		ld.r = newReadWatcher(body)
+		ld.md.UncompressedBytes = size
+		if ld.in, err = maybeGunzip(ld.r); err != nil {
+			return fmt.Errorf("Failed to read from URL: %v", err)
+		}
+
 	case *ld.s3BucketName != "":
 		ld.source = fmt.Sprintf("s3://%s/%s", *ld.s3BucketName, *ld.s3Prefix)
 		sr := &dyndump.S3Reader{
-			S3:         s3.New(session.New()),
-			Bucket:     *ld.s3BucketName,
-			PathPrefix: *ld.s3Prefix,
+			S3:          s3.New(newSession()),
+			Bucket:      *ld.s3BucketName,
+			PathPrefix:  *ld.s3Prefix,
+			VerifyMode:  verifyModes[*ld.verify],
+			MaxParallel: *ld.s3Parallel,
 		}
+		ld.s3Reader = sr
 		ld.r = newReadWatcher(sr)
 		ld.md, err = sr.Metadata()
 		if err != nil {
-			fail("Failed to read metadata from S3: %v", err)
+			return fmt.Errorf("Failed to read metadata from S3: %v", err)
+		}
+		if *ld.resumeFile != "" {
+			if sr.SkipParts, err = readLoadCheckpoint(*ld.resumeFile, sr.Bucket, sr.PathPrefix); err != nil {
+				return err
+			}
 		}
 
 	default:
 		panic("Either s3-bucket & s3-prefix, or filename must be set")
 	}
 
+	if ld.in == nil {
+		ld.in = ld.r
+	}
+
+	if *ld.decompressCmd != "" {
+		if ld.in, err = newCmdReader(*ld.decompressCmd, ld.in); err != nil {
+			return fmt.Errorf("Failed to start decompress command: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// enableTTL enables time to live on each target table using the attribute
+// recorded in the backup's metadata.
+func (ld *loader) enableTTL(infoWriter io.Writer) error {
+	attr := ld.md.TTLAttribute
+	if attr == "" {
+		fmt.Fprintln(infoWriter, "Warning: the backup records no TTL attribute; TTL is unchanged")
+		return nil
+	}
+	for _, t := range ld.targets {
+		enabled, err := enableTTL(t.dyn, *ld.tableName, attr)
+		if err != nil {
+			return fmt.Errorf("region %s: failed to enable TTL: %v", t.name(), err)
+		}
+		if enabled {
+			fmt.Fprintf(infoWriter, "Enabled TTL on attribute %q in region %s\n", attr, t.name())
+		}
+	}
+	return nil
+}
+
+// checkTTL fails if TTL is enabled on any target table using an attribute
+// other than the one recorded in the backup's metadata, so that the load
+// isn't run only for enableTTL to fail once it has finished.
+func (ld *loader) checkTTL() error {
+	attr := ld.md.TTLAttribute
+	if attr == "" {
+		return nil
+	}
+	for _, t := range ld.targets {
+		current, err := describeTTL(t.dyn, *ld.tableName)
+		if err != nil {
+			return fmt.Errorf("region %s: failed to describe TTL: %v", t.name(), err)
+		}
+		if current != "" && current != attr {
+			return fmt.Errorf("region %s: TTL is already enabled on attribute %q", t.name(), current)
+		}
+	}
+	return nil
+}
+
+// createTables creates each target table that doesn't exist using the
+// schema recorded in the backup's metadata.
+func (ld *loader) createTables(infoWriter io.Writer) error {
+	if len(ld.md.KeySchema) == 0 {
+		return errors.New("the backup records no key schema; the table must be created before loading")
+	}
+	var capacity *dynamodb.ProvisionedThroughput
+	if *ld.restoreRCU > 0 {
+		capacity = &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(int64(*ld.restoreRCU)),
+			WriteCapacityUnits: aws.Int64(int64(*ld.restoreWCU)),
+		}
+	}
+	for _, t := range ld.targets {
+		created, err := dyndump.CreateTableWithCapacity(t.dyn, *ld.tableName, ld.md, capacity)
+		if err != nil {
+			return fmt.Errorf("region %s: failed to create table: %v", t.name(), err)
+		}
+		if t.created = created; created {
+			fmt.Fprintf(infoWriter, "Created table %q in region %s\n", *ld.tableName, t.name())
+		}
+		if t.tableInfo, err = describeTable(t.dyn, *ld.tableName, true); err != nil {
+			return fmt.Errorf("region %s: %v", t.name(), err)
+		}
+	}
+	return nil
+}
+
+// resetCapacities sets each table created by --create-table to the
+// capacity recorded in the backup's metadata.
+func (ld *loader) resetCapacities(infoWriter io.Writer) error {
+	for _, t := range ld.targets {
+		if !t.created {
+			continue
+		}
+		updated, err := dyndump.ResetCapacity(t.dyn, *ld.tableName, ld.md)
+		if err != nil {
+			return fmt.Errorf("region %s: failed to reset the table's capacity: %v", t.name(), err)
+		}
+		if updated {
+			fmt.Fprintf(infoWriter, "Reset the capacity of table %q in region %s to the backup's\n", *ld.tableName, t.name())
+		}
+	}
 	return nil
 }
 
 func (ld *loader) start(infoWriter io.Writer) (done chan error, err error) {
-	var hashKey string
-	for _, s := range ld.tableInfo.KeySchema {
-		if aws.StringValue(s.KeyType) == "HASH" {
-			hashKey = aws.StringValue(s.AttributeName)
+	if *ld.createTable {
+		if err := ld.createTables(infoWriter); err != nil {
+			return nil, err
 		}
 	}
-	if hashKey == "" {
-		fail("Failed to find hash key for table")
+	for _, t := range ld.targets {
+		t.hashKey, t.rangeKey = *ld.hashKey, *ld.rangeKey
+		if t.tableInfo != nil {
+			t.hashKey, t.rangeKey = dyndump.KeySchemaNames(t.tableInfo.KeySchema)
+		}
+		if t.hashKey == "" {
+			fail("Failed to find hash key for table in region %s", t.name())
+		}
+		if err := ld.checkKeySchema(t.hashKey, t.rangeKey); err != nil {
+			if !*ld.force {
+				return nil, fmt.Errorf("region %s: %v; use --force to load anyway", t.name(), err)
+			}
+			fmt.Fprintf(infoWriter, "Warning: region %s: %v\n", t.name(), err)
+		}
+	}
+
+	if *ld.restoreTTL {
+		if err := ld.checkTTL(); err != nil {
+			return nil, err
+		}
 	}
 
-	fmt.Fprintf(infoWriter, "Beginning restore: table=%q source=%q writeCapacity=%d parallel=%d totalSize=%s allow-overwrite=%t\n",
-		*ld.tableName, ld.source, *ld.writeCapacity, *ld.parallel, fmtBytes(ld.md.UncompressedBytes), *ld.allowOverwrite)
+	regions := "default"
+	if len(*ld.targetRegions) > 0 {
+		regions = strings.Join(*ld.targetRegions, ",")
+	}
+	fmt.Fprintf(infoWriter, "Beginning restore: table=%q regions=%s source=%q writeCapacity=%d parallel=%d totalSize=%s allow-overwrite=%t\n",
+		*ld.tableName, regions, ld.source, *ld.writeCapacity, *ld.parallel, fmtBytes(ld.md.UncompressedBytes), *ld.allowOverwrite)
+	if ld.s3Reader != nil && ld.s3Reader.SkipParts > 0 {
+		fmt.Fprintf(infoWriter, "Resuming after %d of %d parts; the master hash will not be verified\n",
+			ld.s3Reader.SkipParts, ld.md.PartCount)
+	}
 
-	dynLoader := &dyndump.Loader{
-		Dyn:            ld.dyn,
-		TableName:      *ld.tableName,
-		MaxParallel:    *ld.parallel,
-		MaxItems:       int64(*ld.maxItems),
-		WriteCapacity:  float64(*ld.writeCapacity),
-		Source:         dyndump.NewSimpleDecoder(ld.r),
-		HashKey:        hashKey,
-		AllowOverwrite: *ld.allowOverwrite,
+	deadLetters, err := ld.prepareRun(infoWriter)
+	if err != nil {
+		return nil, err
 	}
 
-	ld.loader = dynLoader
 	done = make(chan error, 1)
+	ld.aborted = make(chan struct{})
 	ld.startTime = time.Now()
-
 	go func() {
-		done <- dynLoader.Run()
+		err := ld.runWithRetries(infoWriter, deadLetters)
+		if err == nil && ld.sampler != nil {
+			err = ld.verifyRestore(infoWriter)
+		}
+		if err == nil && *ld.restoreTTL {
+			// enabled once loaded so that expired items aren't deleted
+			// while the load is still writing them
+			err = ld.enableTTL(infoWriter)
+		}
+		if err == nil && *ld.resetCapacity {
+			err = ld.resetCapacities(infoWriter)
+		}
+		done <- err
 	}()
 
 	return done, nil
 }
 
+// prepareRun creates a loader for each target, reading from the source,
+// and opens any dead letter files.
+func (ld *loader) prepareRun(infoWriter io.Writer) (deadLetters []*os.File, err error) {
+	ld.m.Lock()
+	defer ld.m.Unlock()
+	ld.runs++
+	for _, t := range ld.targets {
+		t.err = nil
+		t.loader = &dyndump.Loader{
+			Dyn:             t.dyn,
+			TableName:       *ld.tableName,
+			MaxParallel:     *ld.parallel,
+			MaxItems:        int64(*ld.maxItems),
+			WriteCapacity:   float64(*ld.writeCapacity),
+			HashKey:         t.hashKey,
+			AllowOverwrite:  *ld.allowOverwrite,
+			ContinueOnError: *ld.continueOnErr,
+			MaxFailures:     *ld.maxFailures,
+			ValidateUTF8:    utf8Modes[*ld.validateUTF8],
+			ConditionalAttr: *ld.condAttr,
+			ConditionalOp:   compareOps[*ld.condOp],
+			BatchSize:       *ld.batchSize,
+		}
+	}
+
+	// the source is read once; the key check uses the last target's keys,
+	// which are the same for each replica of a table
+	last := ld.targets[len(ld.targets)-1]
+	source := ld.newSource(last.hashKey, last.rangeKey, infoWriter)
+	if len(ld.targets) == 1 {
+		ld.targets[0].loader.Source = source
+	} else {
+		fan := dyndump.NewFanoutReader(source, len(ld.targets))
+		for i, t := range ld.targets {
+			t.loader.Source = fan.Reader(i)
+		}
+	}
+	if *ld.verifyAfter > 0 {
+		// each target loads the same items, so sampling those read by the
+		// first is enough; sampling the source would include any item a
+		// fanout read beyond --maxitems
+		ld.sampler = dyndump.NewItemSampler(ld.targets[0].loader.Source, *ld.verifyAfter, ld.seed)
+		ld.targets[0].loader.Source = ld.sampler
+	}
+
+	if *ld.continueOnErr && *ld.deadLetterFile != "" {
+		for _, t := range ld.targets {
+			fn := *ld.deadLetterFile
+			if len(ld.targets) > 1 {
+				fn += "." + t.region
+			}
+			f, err := os.Create(fn)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to open dead letter file for write: %v", err)
+			}
+			deadLetters = append(deadLetters, f)
+			t.loader.FailedItems = dyndump.NewDeadLetterEncoder(f)
+		}
+	}
+	return deadLetters, nil
+}
+
+// run loads the items into every target, returning once all have
+// finished.
+func (ld *loader) run(deadLetters []*os.File) error {
+	ld.m.Lock()
+	if ld.isAborted() {
+		ld.m.Unlock()
+		for _, f := range deadLetters {
+			f.Close()
+		}
+		return errors.New("Aborted")
+	}
+	ld.running = true
+	ld.m.Unlock()
+
+	var wg sync.WaitGroup
+	for i, t := range ld.targets {
+		wg.Add(1)
+		go func(i int, t *loadTarget) {
+			defer wg.Done()
+			t.err = t.loader.Run()
+			if c, ok := t.loader.Source.(io.Closer); ok {
+				c.Close() // don't hold up the other regions
+			}
+			if deadLetters != nil {
+				if cerr := deadLetters[i].Close(); t.err == nil {
+					t.err = cerr
+				}
+			}
+		}(i, t)
+	}
+
+	stopCheckpoints := make(chan struct{})
+	if *ld.resumeFile != "" {
+		go ld.saveCheckpoints(stopCheckpoints)
+	}
+
+	wg.Wait()
+	ld.m.Lock()
+	ld.running = false
+	ld.m.Unlock()
+	ld.closeS3Reader() // the loaders may have stopped before the end
+	err := ld.targetsErr()
+	if *ld.resumeFile != "" {
+		close(stopCheckpoints)
+		if cerr := ld.finishCheckpoint(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// runWithRetries runs the load, running it again from the start of the
+// source up to --retry-run times, with an increasing delay, if it fails
+// because the targets' requests were throttled.
+func (ld *loader) runWithRetries(infoWriter io.Writer, deadLetters []*os.File) error {
+	err := ld.run(deadLetters)
+	delay := retryRunDelay
+	for retry := 1; retry <= *ld.retryRun && ld.throttled(); retry++ {
+		fmt.Fprintf(infoWriter, "\nLoad failed as requests were throttled: %v\nRetrying the load in %s (retry %d of %d)\n",
+			err, delay, retry, *ld.retryRun)
+		select {
+		case <-time.After(delay):
+		case <-ld.aborted:
+			return err
+		}
+		if delay *= 2; delay > maxRetryRunDelay {
+			delay = maxRetryRunDelay
+		}
+
+		if err := ld.openSource(); err != nil {
+			return fmt.Errorf("Failed to reopen source: %v", err)
+		}
+		if deadLetters, err = ld.prepareRun(infoWriter); err != nil {
+			return err
+		}
+		err = ld.run(deadLetters)
+	}
+	return err
+}
+
+// verifyRestore checks that the items sampled from those loaded are held
+// by each target's table, reporting any that are missing or differ.
+func (ld *loader) verifyRestore(infoWriter io.Writer) error {
+	sample := ld.sampler.Sample()
+	fmt.Fprintf(infoWriter, "\nVerifying a sample of %d of the %d items loaded (--verify-seed=%d)\n",
+		len(sample), ld.sampler.ItemsRead(), ld.seed)
+	var failed []string
+	for _, t := range ld.targets {
+		checker := &dyndump.ItemChecker{
+			Dyn:            t.dyn,
+			TableName:      *ld.tableName,
+			HashKey:        t.hashKey,
+			RangeKey:       t.rangeKey,
+			ConsistentRead: true,
+		}
+		mismatches, err := checker.Check(sample)
+		if err != nil {
+			return fmt.Errorf("region %s: verification failed: %v", t.name(), err)
+		}
+		for _, m := range mismatches {
+			fmt.Fprintf(infoWriter, "Region %s: %v\n", t.name(), m)
+		}
+		if len(mismatches) > 0 {
+			failed = append(failed, fmt.Sprintf("%d of %d in region %s", len(mismatches), len(sample), t.name()))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("sampled items were missing or differed after the load: %s", strings.Join(failed, "; "))
+	}
+	fmt.Fprintln(infoWriter, "All sampled items matched")
+	return nil
+}
+
+// throttled returns true if every target that failed did so because its
+// requests were throttled.
+func (ld *loader) throttled() bool {
+	var failed bool
+	for _, t := range ld.targets {
+		if t.err == nil {
+			continue
+		}
+		err := t.err
+		if lerr, ok := err.(*dyndump.LoadError); ok {
+			err = lerr.Err
+		}
+		if !request.IsErrorThrottle(err) {
+			return false
+		}
+		failed = true
+	}
+	return failed
+}
+
+// loadCheckpoint is stored in the --resume-file to record the number of
+// parts of an S3 backup whose items have all been loaded.
+type loadCheckpoint struct {
+	Bucket         string `json:"bucket"`
+	PathPrefix     string `json:"path_prefix"`
+	PartsCompleted int64  `json:"parts_completed"`
+}
+
+// readLoadCheckpoint returns the number of parts recorded as loaded in
+// filename, or 0 if the file doesn't exist yet.
+func readLoadCheckpoint(filename, bucket, prefix string) (int64, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var cp loadCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return 0, fmt.Errorf("Failed to decode resume file: %v", err)
+	}
+	if cp.Bucket != bucket || cp.PathPrefix != prefix {
+		return 0, fmt.Errorf("Resume file is for bucket=%q prefix=%q", cp.Bucket, cp.PathPrefix)
+	}
+	return cp.PartsCompleted, nil
+}
+
+// partsCompleted returns the number of parts whose items have been loaded
+// into every target.
+func (ld *loader) partsCompleted() int64 {
+	items := int64(-1)
+	for _, t := range ld.targets {
+		if n := t.loader.Stats().ItemsCompleted; items < 0 || n < items {
+			items = n
+		}
+	}
+	return ld.s3Reader.PartsCompleted(items)
+}
+
+// saveCheckpoint writes the number of parts loaded to the resume file,
+// replacing it atomically.
+func (ld *loader) saveCheckpoint(parts int64) error {
+	data, err := json.MarshalIndent(loadCheckpoint{
+		Bucket:         ld.s3Reader.Bucket,
+		PathPrefix:     ld.s3Reader.PathPrefix,
+		PartsCompleted: parts,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpName := *ld.resumeFile + ".tmp"
+	if err := ioutil.WriteFile(tmpName, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, *ld.resumeFile)
+}
+
+// saveCheckpoints updates the resume file as parts are loaded until stop
+// is closed.
+func (ld *loader) saveCheckpoints(stop chan struct{}) {
+	saved := ld.s3Reader.SkipParts
+	ticker := time.NewTicker(statsFrequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if parts := ld.partsCompleted(); parts > saved {
+				if err := ld.saveCheckpoint(parts); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: failed to update resume file: %v\n", err)
+					continue
+				}
+				saved = parts
+			}
+		}
+	}
+}
+
+// finishCheckpoint removes the resume file once every part has been
+// loaded, or records the parts loaded so far if the load stopped early.
+func (ld *loader) finishCheckpoint() error {
+	parts := ld.partsCompleted()
+	if ld.md.PartCount > 0 && parts >= ld.md.PartCount {
+		if err := os.Remove(*ld.resumeFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := ld.saveCheckpoint(parts); err != nil {
+		return fmt.Errorf("Failed to write resume file: %v", err)
+	}
+	return nil
+}
+
+// targetsErr returns an error listing the targets that failed, if any.
+func (ld *loader) targetsErr() error {
+	if len(ld.targets) == 1 {
+		return ld.targets[0].err
+	}
+	var failed []string
+	for _, t := range ld.targets {
+		if t.err != nil {
+			failed = append(failed, fmt.Sprintf("region %s: %v", t.name(), t.err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("load failed for %d of %d regions; %s", len(failed), len(ld.targets), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
 func (ld *loader) abort() {
-	ld.loader.Stop()
+	ld.m.Lock()
+	defer ld.m.Unlock()
+	close(ld.aborted)
+	if ld.running {
+		for _, t := range ld.targets {
+			t.loader.Stop()
+		}
+	}
+	if ld.s3Reader != nil {
+		ld.s3Reader.Close()
+	}
+}
+
+func (ld *loader) isAborted() bool {
+	select {
+	case <-ld.aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeS3Reader stops the S3 reader from fetching any more parts.
+func (ld *loader) closeS3Reader() {
+	ld.m.Lock()
+	defer ld.m.Unlock()
+	if ld.s3Reader != nil {
+		ld.s3Reader.Close()
+	}
 }
 
 func (ld *loader) newProgressBar() *pb.ProgressBar {
@@ -134,15 +769,187 @@ func (ld *loader) newProgressBar() *pb.ProgressBar {
 }
 
 func (ld *loader) updateProgress(bar *pb.ProgressBar) {
+	ld.m.Lock()
+	defer ld.m.Unlock()
 	bar.Set64(ld.r.BytesRead())
 }
 
+func (ld *loader) progress() progressStats {
+	ld.m.Lock()
+	defer ld.m.Unlock()
+	// items and capacity are totalled across all target regions
+	ps := progressStats{bytes: ld.r.BytesRead()}
+	for _, t := range ld.targets {
+		stats := t.loader.Stats()
+		ps.items += stats.ItemsWritten
+		ps.capacity += stats.CapacityUsed
+	}
+	return ps
+}
+
 func (ld *loader) printFinalStats(w io.Writer) {
-	finalStats := ld.loader.Stats()
+	if ld.runs > 1 {
+		fmt.Fprintf(w, "Load was run %d times; the stats are those of the final run\n", ld.runs)
+	}
+	for _, t := range ld.targets {
+		if len(ld.targets) > 1 {
+			status := "ok"
+			if t.err != nil {
+				status = "failed"
+			}
+			fmt.Fprintf(w, "Region %s (%s):\n", t.name(), status)
+		}
+		ld.printTargetStats(w, t)
+	}
+}
+
+func (ld *loader) printTargetStats(w io.Writer, t *loadTarget) {
+	finalStats := t.loader.Stats()
 	deltaSeconds := float64(time.Since(ld.startTime) / time.Second)
 
 	fmt.Fprintf(w, "Avg items/sec: %.2f\n", float64(finalStats.ItemsWritten)/deltaSeconds)
 	fmt.Fprintf(w, "Avg capacity/sec: %.2f\n", finalStats.CapacityUsed/deltaSeconds)
 	fmt.Fprintln(w, "Total items written: ", finalStats.ItemsWritten)
 	fmt.Fprintln(w, "Total items skipped: ", finalStats.ItemsSkipped)
+	if *ld.condAttr != "" {
+		fmt.Fprintln(w, "Total items skipped as stale: ", finalStats.ItemsStale)
+	}
+	if *ld.continueOnErr {
+		fmt.Fprintln(w, "Total items failed: ", finalStats.ItemsFailed)
+	}
+	if utf8Modes[*ld.validateUTF8] == dyndump.UTF8Skip {
+		fmt.Fprintln(w, "Total items with invalid UTF-8 skipped: ", finalStats.ItemsInvalid)
+	}
+	throttles := t.throttles.Count()
+	fmt.Fprintln(w, "Total throttled requests: ", throttles)
+	if throttles > 0 && finalStats.ItemsWritten > 0 {
+		fmt.Fprintf(w, "Throttled requests per item written: %.2f (consider lowering --write-capacity or --parallel)\n",
+			float64(throttles)/float64(finalStats.ItemsWritten))
+	}
+}
+
+// checkKeySchema returns an error if the backup records a key schema that
+// differs from the table's.  Only backups read from S3 record their schema.
+func (ld *loader) checkKeySchema(hashKey, rangeKey string) error {
+	if ld.md.HashKey == "" {
+		return nil
+	}
+	if ld.md.HashKey != hashKey || ld.md.RangeKey != rangeKey {
+		return fmt.Errorf("table key schema (hash=%q range=%q) does not match the backup's (hash=%q range=%q)",
+			hashKey, rangeKey, ld.md.HashKey, ld.md.RangeKey)
+	}
+	return nil
+}
+
+// newSource returns the reader to load items from.  Envelope encoded items
+// are read with any condition they carry.
+func (ld *loader) newSource(hashKey, rangeKey string, infoWriter io.Writer) dyndump.ItemReader {
+	keys := []string{hashKey, rangeKey}
+	if *ld.envelope {
+		return &condKeyCheckReader{
+			ConditionalItemReader: dyndump.NewEnvelopeDecoder(ld.in),
+			kc:                    keyCheckReader{keys: keys, w: infoWriter},
+		}
+	}
+	dec := dyndump.NewSimpleDecoder(ld.in)
+	if ld.s3Reader != nil && ld.s3Reader.SkipParts == 0 {
+		// confirm any truncation against the item count in the metadata
+		dec.ExpectedItems = ld.md.ItemCount
+	}
+	return &keyCheckReader{ItemReader: dec, keys: keys, w: infoWriter}
+}
+
+// keyCheckReader warns if the first item read from the source is missing
+// any of the table's key attributes, which usually means the wrong key
+// names were supplied.
+type keyCheckReader struct {
+	dyndump.ItemReader
+	keys    []string
+	w       io.Writer
+	checked bool
+}
+
+func (r *keyCheckReader) ReadItem() (map[string]*dynamodb.AttributeValue, error) {
+	item, err := r.ItemReader.ReadItem()
+	r.check(item, err)
+	return item, err
+}
+
+func (r *keyCheckReader) check(item map[string]*dynamodb.AttributeValue, err error) {
+	if err == nil && !r.checked {
+		r.checked = true
+		for _, key := range r.keys {
+			if _, ok := item[key]; key != "" && !ok {
+				fmt.Fprintf(r.w, "Warning: key attribute %q not found in first item\n", key)
+			}
+		}
+	}
+}
+
+// condKeyCheckReader performs the same check as keyCheckReader for a
+// ConditionalItemReader.
+type condKeyCheckReader struct {
+	dyndump.ConditionalItemReader
+	kc keyCheckReader
+}
+
+func (r *condKeyCheckReader) ReadItem() (map[string]*dynamodb.AttributeValue, error) {
+	item, err := r.ConditionalItemReader.ReadItem()
+	r.kc.check(item, err)
+	return item, err
+}
+
+func (r *condKeyCheckReader) ReadConditionalItem() (map[string]*dynamodb.AttributeValue, *dyndump.ItemCondition, error) {
+	item, cond, err := r.ConditionalItemReader.ReadConditionalItem()
+	r.kc.check(item, err)
+	return item, cond, err
+}
+
+// openURL fetches a dump from an HTTP(S) URL, returning the response body
+// and its size in bytes, or -1 if unknown.
+func openURL(url string) (body io.ReadCloser, size int64, err error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("unexpected response from server: %s", resp.Status)
+	}
+
+	// net/http transparently decodes a gzip content-encoding it requested
+	// itself; anything else left in the header must be handled here.
+	switch enc := resp.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, 0, err
+		}
+		return readCloser{Reader: gz, Closer: resp.Body}, -1, nil
+	default:
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("unsupported content encoding %q", enc)
+	}
+
+	size = resp.ContentLength
+	if resp.Uncompressed {
+		size = -1
+	}
+	return resp.Body, size, nil
+}
+
+// maybeGunzip returns a reader that decompresses r if it holds gzip data,
+// or r itself otherwise.
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
 }
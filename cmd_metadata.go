@@ -5,15 +5,24 @@
 package main
 
 import (
+	"fmt"
 	"html/template"
 	"os"
+	"strings"
 
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gwatts/dyndump/dyndump"
 )
 
-var metadataTmpl = template.Must(template.New("md").Parse(`
+var metadataFuncs = template.FuncMap{
+	"keySchema": fmtKeySchema,
+	"gsiNames":  fmtGSINames,
+	"lsiNames":  fmtLSINames,
+}
+
+var metadataTmpl = template.Must(template.New("md").Funcs(metadataFuncs).Parse(`
 Table Name...........: {{ .TableName }}
 Table ARN............: {{ .TableARN }}
 Status ..............: {{ .Status }}
@@ -24,8 +33,63 @@ Compressed (bytes) ..: {{ .CompressedBytes }}
 Uncompressed (bytes) : {{ .UncompressedBytes }}
 Item Count ..........: {{ .ItemCount }}
 Part Count ..........: {{ .PartCount }}
+Master Hash .........: {{ .MasterHash }}
+Created By ..........: {{ .CreatedBy }}
+Tool Version ........: {{ .ToolVersion }}
+Part Path ...........: {{ .PartPath }}
+Compression .........: {{ .Compression }}
+Dictionary (bytes) ..: {{ len .CompressionDict }}
+Hash Key ............: {{ .HashKey }}
+Range Key ...........: {{ .RangeKey }}
+Item Sizes ..........: {{ with .ItemSizes }}{{ . }} (<1K, 1K-4K, 4K-16K, 16K-64K, 64K-256K, 256K+){{ end }}
+TTL Attribute .......: {{ .TTLAttribute }}
+Key Schema ..........: {{ keySchema .KeySchema .AttributeDefinitions }}
+Global Indexes ......: {{ gsiNames .GlobalSecondaryIndexes }}
+Local Indexes .......: {{ lsiNames .LocalSecondaryIndexes }}
 `))
 
+// fmtKeySchema formats a key schema as a list of attribute names with
+// their types, eg. "id (S, HASH), ts (N, RANGE)".
+func fmtKeySchema(schema []*dynamodb.KeySchemaElement, defs []*dynamodb.AttributeDefinition) string {
+	var keys []string
+	for _, s := range schema {
+		name := aws.StringValue(s.AttributeName)
+		attrType := "?"
+		for _, def := range defs {
+			if aws.StringValue(def.AttributeName) == name {
+				attrType = aws.StringValue(def.AttributeType)
+			}
+		}
+		keys = append(keys, fmt.Sprintf("%s (%s, %s)", name, attrType, aws.StringValue(s.KeyType)))
+	}
+	return strings.Join(keys, ", ")
+}
+
+// fmtIndexName formats an index's name with its key attributes.
+func fmtIndexName(name *string, schema []*dynamodb.KeySchemaElement) string {
+	var keys []string
+	for _, s := range schema {
+		keys = append(keys, aws.StringValue(s.AttributeName))
+	}
+	return fmt.Sprintf("%s (%s)", aws.StringValue(name), strings.Join(keys, ", "))
+}
+
+func fmtGSINames(indexes []*dynamodb.GlobalSecondaryIndex) string {
+	var names []string
+	for _, index := range indexes {
+		names = append(names, fmtIndexName(index.IndexName, index.KeySchema))
+	}
+	return strings.Join(names, ", ")
+}
+
+func fmtLSINames(indexes []*dynamodb.LocalSecondaryIndex) string {
+	var names []string
+	for _, index := range indexes {
+		names = append(names, fmtIndexName(index.IndexName, index.KeySchema))
+	}
+	return strings.Join(names, ", ")
+}
+
 type metadataDumper struct {
 	// options
 	s3BucketName *string
@@ -34,7 +98,7 @@ type metadataDumper struct {
 
 func (md *metadataDumper) run() {
 	sr := &dyndump.S3Reader{
-		S3:         s3.New(session.New()),
+		S3:         s3.New(newSession()),
 		Bucket:     *md.s3BucketName,
 		PathPrefix: *md.s3Prefix,
 	}
@@ -0,0 +1,72 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gwatts/dyndump/dyndump"
+	"gopkg.in/cheggaaa/pb.v1"
+)
+
+type refresher struct {
+	ref    *dyndump.S3Refresher
+	before dyndump.Metadata
+	after  dyndump.Metadata
+
+	// options
+	s3BucketName *string
+	s3Prefix     *string
+	force        *bool
+}
+
+func (r *refresher) init() error {
+	ref, err := dyndump.NewS3Refresher(s3.New(newSession()), *r.s3BucketName, *r.s3Prefix)
+	if err != nil {
+		return fmt.Errorf("Failed to read metadata from S3: %v", err)
+	}
+	ref.Force = *r.force
+	r.ref = ref
+	r.before = ref.Metadata()
+	return nil
+}
+
+func (r *refresher) start(infoWriter io.Writer) (done chan error, err error) {
+	fmt.Fprintf(infoWriter, "Beginning refresh: source=s3://%s/%s parts=%d\n",
+		*r.s3BucketName, *r.s3Prefix, r.before.PartCount)
+
+	done = make(chan error, 1)
+	go func() {
+		md, err := r.ref.Refresh()
+		r.after = md
+		done <- err
+	}()
+
+	return done, nil
+}
+
+func (r *refresher) newProgressBar() *pb.ProgressBar {
+	return pb.New64(r.before.PartCount)
+}
+
+func (r *refresher) updateProgress(bar *pb.ProgressBar) {
+	bar.Set64(r.ref.Completed())
+}
+
+func (r *refresher) progress() progressStats {
+	return progressStats{items: r.ref.Completed()}
+}
+
+func (r *refresher) abort() {
+	r.ref.Abort()
+}
+
+func (r *refresher) printFinalStats(w io.Writer) {
+	fmt.Fprintf(w, "Part count: %d -> %d\n", r.before.PartCount, r.after.PartCount)
+	fmt.Fprintf(w, "Item count: %d -> %d\n", r.before.ItemCount, r.after.ItemCount)
+	fmt.Fprintf(w, "Compressed bytes: %d -> %d\n", r.before.CompressedBytes, r.after.CompressedBytes)
+}
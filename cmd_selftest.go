@@ -0,0 +1,166 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/gwatts/dyndump/dyndump"
+	"gopkg.in/cheggaaa/pb.v1"
+)
+
+const (
+	maxScanPageBytes = 1024 * 1024 // DynamoDB returns at most 1MB per scan request
+)
+
+// fakeScanner simulates scanning an infinitely large table holding items
+// of a fixed size, returning the read capacity that DynamoDB would consume.
+type fakeScanner struct {
+	item     map[string]*dynamodb.AttributeValue
+	itemSize int
+}
+
+func newFakeScanner(itemSize int) *fakeScanner {
+	padSize := itemSize - len("data")
+	if padSize < 1 {
+		padSize = 1
+	}
+	return &fakeScanner{
+		item: map[string]*dynamodb.AttributeValue{
+			"data": {S: aws.String(strings.Repeat("x", padSize))},
+		},
+		itemSize: itemSize,
+	}
+}
+
+func (s *fakeScanner) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	count := maxScanPageBytes / s.itemSize
+	if limit := int(aws.Int64Value(input.Limit)); limit > 0 && limit < count {
+		count = limit
+	}
+	if count < 1 {
+		count = 1
+	}
+
+	items := make([]map[string]*dynamodb.AttributeValue, count)
+	for i := range items {
+		items[i] = s.item
+	}
+
+	capacity := math.Ceil(float64(count*s.itemSize) / 4096)
+	if !aws.BoolValue(input.ConsistentRead) {
+		capacity /= 2
+	}
+
+	return &dynamodb.ScanOutput{
+		Items:            items,
+		Count:            aws.Int64(int64(count)),
+		ScannedCount:     aws.Int64(int64(count)),
+		ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(capacity)},
+		LastEvaluatedKey: map[string]*dynamodb.AttributeValue{
+			"data": {S: aws.String("last")},
+		},
+	}, nil
+}
+
+type discardItemWriter struct{}
+
+func (discardItemWriter) WriteItem(item map[string]*dynamodb.AttributeValue) error { return nil }
+
+// selfTester runs a Fetcher against a fake scanner for a fixed duration
+// to check that the rate limiter holds the requested read capacity.
+type selfTester struct {
+	f         *dyndump.Fetcher
+	abortChan chan struct{}
+	startTime time.Time
+
+	// options
+	consistentRead *bool
+	parallel       *int
+	readCapacity   *int
+	itemSize       *int
+	duration       *int
+}
+
+func (st *selfTester) init() error {
+	return nil
+}
+
+func (st *selfTester) start(infoWriter io.Writer) (done chan error, err error) {
+	fmt.Fprintf(infoWriter, "Beginning self test: readCapacity=%d parallel=%d itemSize=%d duration=%ds\n",
+		*st.readCapacity, *st.parallel, *st.itemSize, *st.duration)
+
+	st.f = &dyndump.Fetcher{
+		Dyn:            newFakeScanner(*st.itemSize),
+		TableName:      "selftest",
+		ConsistentRead: *st.consistentRead,
+		MaxParallel:    *st.parallel,
+		ReadCapacity:   float64(*st.readCapacity),
+		Writer:         discardItemWriter{},
+	}
+
+	done = make(chan error)
+	st.abortChan = make(chan struct{}, 1)
+	st.startTime = time.Now()
+
+	go func() {
+		rerr := make(chan error)
+		go func() { rerr <- st.f.Run() }()
+
+		select {
+		case <-st.abortChan:
+			st.f.Stop()
+			<-rerr
+			done <- errors.New("Aborted")
+
+		case <-time.After(time.Duration(*st.duration) * time.Second):
+			st.f.Stop()
+			done <- <-rerr
+
+		case err := <-rerr:
+			done <- err
+		}
+	}()
+
+	return done, nil
+}
+
+func (st *selfTester) newProgressBar() *pb.ProgressBar {
+	return pb.New(*st.duration)
+}
+
+func (st *selfTester) updateProgress(bar *pb.ProgressBar) {
+	bar.Set(int(time.Since(st.startTime) / time.Second))
+}
+
+func (st *selfTester) progress() progressStats {
+	stats := st.f.Stats()
+	return progressStats{items: stats.ItemsRead, bytes: stats.BytesRead, capacity: stats.CapacityUsed}
+}
+
+func (st *selfTester) abort() {
+	st.abortChan <- struct{}{}
+}
+
+func (st *selfTester) printFinalStats(w io.Writer) {
+	finalStats := st.f.Stats()
+	deltaSeconds := time.Since(st.startTime).Seconds()
+	achieved := finalStats.CapacityUsed / deltaSeconds
+
+	fmt.Fprintf(w, "Avg items/sec: %.2f\n", float64(finalStats.ItemsRead)/deltaSeconds)
+	fmt.Fprintf(w, "Target capacity/sec: %d\n", *st.readCapacity)
+	fmt.Fprintf(w, "Achieved capacity/sec: %.2f", achieved)
+	if *st.readCapacity > 0 {
+		fmt.Fprintf(w, " (%.1f%% of target)", achieved/float64(*st.readCapacity)*100)
+	}
+	fmt.Fprintln(w)
+}
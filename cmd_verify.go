@@ -0,0 +1,90 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gwatts/dyndump/dyndump"
+	"gopkg.in/cheggaaa/pb.v1"
+)
+
+type verifier struct {
+	sr      *dyndump.S3Reader
+	md      dyndump.Metadata
+	aborted int64
+
+	// options
+	s3BucketName *string
+	s3Prefix     *string
+	deep         *bool
+}
+
+func (v *verifier) init() error {
+	sr := &dyndump.S3Reader{
+		S3:         s3.New(newSession()),
+		Bucket:     *v.s3BucketName,
+		PathPrefix: *v.s3Prefix,
+		DeepVerify: *v.deep,
+	}
+	md, err := sr.Metadata()
+	if err != nil {
+		return fmt.Errorf("Failed to read metadata from S3: %v", err)
+	}
+	if md.MasterHash == "" {
+		return errors.New("Backup has no integrity hashes to verify")
+	}
+	v.md = md
+	v.sr = sr
+	return nil
+}
+
+func (v *verifier) start(infoWriter io.Writer) (done chan error, err error) {
+	fmt.Fprintf(infoWriter, "Beginning verify: source=s3://%s/%s parts=%d totalSize=%s deep=%t\n",
+		*v.s3BucketName, *v.s3Prefix, v.md.PartCount, fmtBytes(v.md.UncompressedBytes), *v.deep)
+
+	done = make(chan error, 1)
+	go func() {
+		err := v.sr.Verify()
+		if atomic.LoadInt64(&v.aborted) != 0 {
+			err = errors.New("Aborted")
+		}
+		done <- err
+	}()
+
+	return done, nil
+}
+
+func (v *verifier) newProgressBar() *pb.ProgressBar {
+	return pb.New64(v.md.PartCount)
+}
+
+// partsVerified returns the number of parts read and checked so far.
+func (v *verifier) partsVerified() int64 {
+	return v.sr.PartsCompleted(math.MaxInt64)
+}
+
+func (v *verifier) updateProgress(bar *pb.ProgressBar) {
+	bar.Set64(v.partsVerified())
+}
+
+func (v *verifier) progress() progressStats {
+	return progressStats{items: v.partsVerified()}
+}
+
+func (v *verifier) abort() {
+	atomic.StoreInt64(&v.aborted, 1)
+	v.sr.Close()
+}
+
+func (v *verifier) printFinalStats(w io.Writer) {
+	fmt.Fprintf(w, "Verified %d of %d parts from s3://%s/%s\n",
+		v.partsVerified(), v.md.PartCount, *v.s3BucketName, *v.s3Prefix)
+}
@@ -0,0 +1,160 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// newCommand creates a command from a string holding the program name
+// followed by its arguments separated by spaces.  The string is not
+// interpreted by a shell.
+func newCommand(command string) (*exec.Cmd, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("no command supplied")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	return cmd, nil
+}
+
+// cmdWriter pipes data written to it through an external command,
+// sending the command's output to another writer.
+type cmdWriter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	out   io.Writer
+
+	waitOnce sync.Once
+	waitErr  error
+}
+
+func newCmdWriter(command string, out io.Writer) (*cmdWriter, error) {
+	cmd, err := newCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = out
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdWriter{cmd: cmd, stdin: stdin, out: out}, nil
+}
+
+// Write writes to the command's input.  If the command has stopped reading
+// its input, usually because it exited early, the error returned is that
+// of the command rather than of the write.
+func (c *cmdWriter) Write(p []byte) (n int, err error) {
+	n, err = c.stdin.Write(p)
+	if err != nil {
+		c.stdin.Close()
+		if werr := c.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Close closes the command's input and waits for it to write all of its
+// output before closing the output writer, if it's closable.
+func (c *cmdWriter) Close() error {
+	c.stdin.Close()
+	err := c.wait()
+	if out, ok := c.out.(io.Closer); ok && c.out != os.Stdout {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// wait waits for the command to exit, once, returning an error if it
+// failed.
+func (c *cmdWriter) wait() error {
+	c.waitOnce.Do(func() {
+		if err := c.cmd.Wait(); err != nil {
+			c.waitErr = fmt.Errorf("command %q failed: %v", strings.Join(c.cmd.Args, " "), err)
+		}
+	})
+	return c.waitErr
+}
+
+// Abort kills the command rather than waiting for it to write its output,
+// which may never complete if the output is a fifo that isn't being read.
+func (c *cmdWriter) Abort() {
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.wait()
+	if cw, ok := c.out.(*cmdWriter); ok {
+		cw.Abort() // a chained command, such as --compress-cmd after --format-plugin
+	} else if out, ok := c.out.(io.Closer); ok && c.out != os.Stdout {
+		out.Close()
+	}
+}
+
+// cmdReader pipes data read from another reader through an external
+// command, returning the command's output.
+type cmdReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	err    error
+}
+
+func newCmdReader(command string, in io.Reader) (*cmdReader, error) {
+	cmd, err := newCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdin = in
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdReader{cmd: cmd, stdout: stdout}, nil
+}
+
+// Read reads the command's output.  Once the output is exhausted it waits
+// for the command to exit and returns an error if it failed.
+func (c *cmdReader) Read(p []byte) (n int, err error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err = c.stdout.Read(p)
+	if err == io.EOF {
+		if werr := c.cmd.Wait(); werr != nil {
+			err = fmt.Errorf("command %q failed: %v", strings.Join(c.cmd.Args, " "), werr)
+		}
+	}
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// Close stops the command if it hasn't already exited, such as when its
+// output is abandoned before it's exhausted.
+func (c *cmdReader) Close() error {
+	if c.cmd.ProcessState != nil {
+		return nil // already waited for by Read
+	}
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	c.err = errors.New("command closed")
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAdaptiveWindow is the default period without throttling after
+	// which an adaptive read capacity is raised.
+	DefaultAdaptiveWindow = 10 * time.Second
+
+	// DefaultMaxCapacityFactor is the default multiple of the configured
+	// read capacity that an adaptive read capacity may be raised to.
+	DefaultMaxCapacityFactor = 2
+
+	// adaptiveStepFactor is the fraction of the configured capacity that
+	// an adaptive capacity is raised by after each window without
+	// throttling.
+	adaptiveStepFactor = 0.1
+)
+
+// adaptiveCapacity adjusts a read capacity based on throttling feedback.
+//
+// The capacity is raised by a step towards max after each window in which
+// no requests were throttled, making use of any burst capacity the table
+// has accumulated, and returns to base as soon as a throttled request is
+// seen.
+type adaptiveCapacity struct {
+	m             sync.Mutex
+	base          float64
+	max           float64
+	current       float64
+	peak          float64
+	window        time.Duration
+	lastChange    time.Time
+	lastThrottles int64
+}
+
+func newAdaptiveCapacity(base, max float64, window time.Duration, now time.Time, throttles int64) *adaptiveCapacity {
+	if max < base {
+		max = base
+	}
+	return &adaptiveCapacity{
+		base:          base,
+		max:           max,
+		current:       base,
+		peak:          base,
+		window:        window,
+		lastChange:    now,
+		lastThrottles: throttles,
+	}
+}
+
+// update checks the total number of throttled requests seen so far,
+// returning the capacity to use and whether it changed.
+func (a *adaptiveCapacity) update(now time.Time, throttles int64) (capacity float64, changed bool) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	switch {
+	case throttles > a.lastThrottles:
+		a.lastThrottles = throttles
+		a.lastChange = now
+		if a.current > a.base {
+			a.current = a.base
+			changed = true
+		}
+
+	case now.Sub(a.lastChange) >= a.window && a.current < a.max:
+		step := a.base * adaptiveStepFactor
+		if step < 1 {
+			step = 1
+		}
+		a.current += step
+		if a.current > a.max {
+			a.current = a.max
+		}
+		if a.current > a.peak {
+			a.peak = a.current
+		}
+		a.lastChange = now
+		changed = true
+	}
+	return a.current, changed
+}
+
+// capacity returns the current and peak capacity.
+func (a *adaptiveCapacity) capacity() (current, peak float64) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.current, a.peak
+}
@@ -0,0 +1,106 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Check that the capacity is raised in steps after each window without
+// throttling, is capped at the maximum and drops back to the base on the
+// first throttle.
+func TestAdaptiveCapacity(t *testing.T) {
+	start := time.Now()
+	at := func(secs int) time.Time { return start.Add(time.Duration(secs) * time.Second) }
+	a := newAdaptiveCapacity(10, 12, 10*time.Second, start, 5)
+
+	tests := []struct {
+		secs      int
+		throttles int64
+		expected  float64
+		changed   bool
+	}{
+		{5, 5, 10, false},  // within the window
+		{10, 5, 11, true},  // raised by a step
+		{15, 5, 11, false}, // window restarted
+		{20, 5, 12, true},
+		{30, 5, 12, false}, // capped at max
+		{31, 6, 10, true},  // throttled; back off immediately
+		{40, 6, 10, false}, // window restarted by the throttle
+		{41, 6, 11, true},
+	}
+
+	for _, test := range tests {
+		capacity, changed := a.update(at(test.secs), test.throttles)
+		if capacity != test.expected || changed != test.changed {
+			t.Errorf("secs=%d expected=%.0f,%t actual=%.0f,%t",
+				test.secs, test.expected, test.changed, capacity, changed)
+		}
+	}
+	if _, peak := a.capacity(); peak != 12 {
+		t.Error("Incorrect peak capacity", peak)
+	}
+}
+
+// Check that the fetcher requires throttling feedback to adapt.
+func TestFetcherAdaptiveNoThrottles(t *testing.T) {
+	f := &Fetcher{
+		Dyn:              &fakeDynamo{},
+		TableName:        "table-name",
+		MaxParallel:      1,
+		ReadCapacity:     10,
+		AdaptiveCapacity: true,
+	}
+	if err := f.Run(); err == nil {
+		t.Error("No error returned from Run")
+	}
+}
+
+// throttleDynamo applies the request options it's passed to a fake
+// request, retrying it once as throttled before serving a single page.
+type throttleDynamo struct {
+	fakeDynamo
+}
+
+func (td *throttleDynamo) ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	r := new(request.Request)
+	r.ApplyOptions(opts...)
+	r.Error = awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "throttled", nil)
+	r.Handlers.Retry.Run(r)
+	return &dynamodb.ScanOutput{
+		Items:            []map[string]*dynamodb.AttributeValue{makeIntItem("key", 1)},
+		Count:            aws.Int64(1),
+		ScannedCount:     aws.Int64(1),
+		ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(0.5)},
+	}, nil
+}
+
+// Check that the fetcher counts throttled retries itself if Throttles
+// isn't set and Dyn accepts request options.
+func TestFetcherAdaptiveCountThrottles(t *testing.T) {
+	f := &Fetcher{
+		Dyn:              new(throttleDynamo),
+		TableName:        "table-name",
+		MaxParallel:      1,
+		ReadCapacity:     10,
+		AdaptiveCapacity: true,
+		Writer:           new(testItemWriter),
+	}
+	if err := f.Run(); err != nil {
+		t.Fatal("Run failed", err)
+	}
+	if n := f.throttleCount(); n != 1 {
+		t.Error("Incorrect throttle count", n)
+	}
+	if stats := f.Stats(); stats.ReadCapacity != 10 {
+		t.Error("Incorrect read capacity", stats.ReadCapacity)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/juju/ratelimit"
+)
+
+const (
+	// MaxBatchGetKeys is the maximum number of keys DynamoDB accepts in a
+	// single BatchGetItem request.
+	MaxBatchGetKeys = 100
+
+	minUnprocessedBackoff = 50 * time.Millisecond
+	maxUnprocessedBackoff = 5 * time.Second
+)
+
+// DynBatchGetter defines the portion of the DynamoDB service that
+// BatchGetter requires.
+type DynBatchGetter interface {
+	BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error)
+}
+
+// BatchGetter fetches a specific set of items by primary key from DynamoDB
+// at a specified capacity and writes them to a writer implementing the
+// ItemWriter interface.
+//
+// The keys are split into batches of up to MaxBatchGetKeys which are
+// requested in parallel.  Any keys DynamoDB returns as unprocessed are
+// retried with a backoff until they have all been fetched.  Keys that do
+// not exist in the table are silently skipped.
+type BatchGetter struct {
+	Dyn            DynBatchGetter
+	TableName      string
+	ConsistentRead bool                                  // Setting to true will use double the read capacity.
+	MaxParallel    int                                   // Maximum number of parallel requests to make to Dynamo.
+	ReadCapacity   float64                               // Average global read capacity to use.
+	Keys           []map[string]*dynamodb.AttributeValue // Primary keys of the items to fetch.
+	Writer         ItemWriter                            // Retrieved items are sent to this ItemWriter.
+
+	rateLimit    *rateLimitWaiter
+	itemsRead    int64
+	bytesRead    int64
+	capacityUsed int64 // multiplied by 10
+	stopRequest  chan struct{}
+	stopNotify   chan struct{}
+}
+
+// Run executes the getter, starting as many parallel requests as specified
+// by the MaxParallel option and returns when all keys have been fetched,
+// a request failed, or the getter was stopped.
+func (g *BatchGetter) Run() error {
+	errChan := make(chan error, g.MaxParallel)
+	batches := make(chan []map[string]*dynamodb.AttributeValue)
+
+	g.stopRequest = make(chan struct{}, 2)
+	g.stopNotify = make(chan struct{})
+
+	if g.ReadCapacity > 0 {
+		n := int64(g.ReadCapacity)
+		if n < 1 {
+			n = 1
+		}
+		g.rateLimit = &rateLimitWaiter{
+			Bucket:     ratelimit.NewBucketWithQuantum(time.Second, n, n),
+			stopNotify: g.stopNotify,
+		}
+	}
+
+	go func() {
+		<-g.stopRequest
+		close(g.stopNotify) // fanout
+	}()
+
+	go func() {
+		defer close(batches)
+		for start := 0; start < len(g.Keys); start += MaxBatchGetKeys {
+			end := start + MaxBatchGetKeys
+			if end > len(g.Keys) {
+				end = len(g.Keys)
+			}
+			select {
+			case batches <- g.Keys[start:end]:
+			case <-g.stopNotify:
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < g.MaxParallel; i++ {
+		go g.fetch(batches, errChan)
+	}
+
+	var err error
+	// wait for all workers to shutdown
+	for i := 0; i < g.MaxParallel; i++ {
+		if werr := <-errChan; werr != nil {
+			if err == nil {
+				err = werr
+				g.stopRequest <- struct{}{}
+			}
+		}
+	}
+	return err
+}
+
+// Stop requests a clean shutdown of active requests.
+// Active workers will complete the current request and then exit.
+func (g *BatchGetter) Stop() {
+	g.stopRequest <- struct{}{}
+}
+
+// Stats returns current aggregate statistics about an ongoing or completed run.
+// It is safe to call from concurrent goroutines.
+func (g *BatchGetter) Stats() FetcherStats {
+	return FetcherStats{
+		ItemsRead:    atomic.LoadInt64(&g.itemsRead),
+		BytesRead:    atomic.LoadInt64(&g.bytesRead),
+		CapacityUsed: float64(atomic.LoadInt64(&g.capacityUsed)) / 10,
+	}
+}
+
+func (g *BatchGetter) isStopped() bool {
+	select {
+	case <-g.stopNotify:
+		return true
+	default:
+		return false
+	}
+}
+
+// fetch reads batches of keys and requests them from DynamoDB.  executed
+// in a separate goroutine by Run for parallel requests.
+func (g *BatchGetter) fetch(batches <-chan []map[string]*dynamodb.AttributeValue, doneChan chan<- error) {
+	usedCapacity := int64(1)
+
+	for keys := range batches {
+		backoff := minUnprocessedBackoff
+		for len(keys) > 0 {
+			if g.rateLimit != nil {
+				if isStopped := g.rateLimit.waitForRateLimit(usedCapacity); isStopped {
+					doneChan <- nil
+					return
+				}
+			}
+
+			if g.isStopped() {
+				doneChan <- nil
+				return
+			}
+
+			resp, err := g.Dyn.BatchGetItem(&dynamodb.BatchGetItemInput{
+				RequestItems: map[string]*dynamodb.KeysAndAttributes{
+					g.TableName: {
+						Keys:           keys,
+						ConsistentRead: aws.Bool(g.ConsistentRead),
+					},
+				},
+				ReturnConsumedCapacity: aws.String("TOTAL"),
+			})
+			if err != nil {
+				doneChan <- fmt.Errorf("read from DynamoDB failed: %s", err)
+				return
+			}
+
+			items := resp.Responses[g.TableName]
+			var respSize int64
+			for _, item := range items {
+				if err := g.Writer.WriteItem(item); err != nil {
+					doneChan <- fmt.Errorf("write failed: %s", err)
+					return
+				}
+				respSize += int64(calcItemSize(item))
+			}
+
+			var capacity float64
+			for _, cc := range resp.ConsumedCapacity {
+				if cc != nil {
+					capacity += aws.Float64Value(cc.CapacityUnits)
+				}
+			}
+
+			atomic.AddInt64(&g.itemsRead, int64(len(items)))
+			atomic.AddInt64(&g.bytesRead, respSize)
+			atomic.AddInt64(&g.capacityUsed, int64(capacity*10))
+			usedCapacity = int64(math.Ceil(capacity))
+
+			keys = nil
+			if unprocessed := resp.UnprocessedKeys[g.TableName]; unprocessed != nil && len(unprocessed.Keys) > 0 {
+				keys = unprocessed.Keys
+				if len(items) > 0 {
+					backoff = minUnprocessedBackoff // made progress
+				}
+				select {
+				case <-time.After(backoff):
+				case <-g.stopNotify:
+					doneChan <- nil
+					return
+				}
+				if backoff *= 2; backoff > maxUnprocessedBackoff {
+					backoff = maxUnprocessedBackoff
+				}
+			}
+		}
+	}
+	doneChan <- nil
+}
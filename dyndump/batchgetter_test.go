@@ -0,0 +1,197 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Test that keys are split into batches and that any unprocessed keys
+// are retried until all items have been fetched.
+func TestBatchGetUnprocessed(t *testing.T) {
+	var m sync.Mutex
+	seen := make(map[int]int) // number of times each key has been requested
+	var maxBatch int
+
+	dyn := &fakeBatchGetter{
+		get: func(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+			req, ok := input.RequestItems["table-name"]
+			if !ok {
+				return nil, errors.New("incorrect table name")
+			}
+			if !aws.BoolValue(req.ConsistentRead) {
+				t.Error("ConsistentRead was false")
+			}
+
+			m.Lock()
+			defer m.Unlock()
+			if len(req.Keys) > maxBatch {
+				maxBatch = len(req.Keys)
+			}
+
+			// return every other key as unprocessed the first time it's seen
+			var items, unprocessed []map[string]*dynamodb.AttributeValue
+			for i, key := range req.Keys {
+				k := intItemValue("key", key)
+				seen[k]++
+				if seen[k] == 1 && i%2 == 1 {
+					unprocessed = append(unprocessed, key)
+					continue
+				}
+				items = append(items, key)
+			}
+
+			resp := &dynamodb.BatchGetItemOutput{
+				Responses: map[string][]map[string]*dynamodb.AttributeValue{
+					"table-name": items,
+				},
+				ConsumedCapacity: []*dynamodb.ConsumedCapacity{
+					{CapacityUnits: aws.Float64(1)},
+				},
+			}
+			if len(unprocessed) > 0 {
+				resp.UnprocessedKeys = map[string]*dynamodb.KeysAndAttributes{
+					"table-name": {Keys: unprocessed},
+				}
+			}
+			return resp, nil
+		},
+	}
+
+	iw := new(testItemWriter)
+	g := &BatchGetter{
+		Dyn:            dyn,
+		TableName:      "table-name",
+		ConsistentRead: true,
+		MaxParallel:    3,
+		Keys:           makeItems(0, 250),
+		Writer:         iw,
+	}
+
+	done := make(chan error)
+	go func() { done <- g.Run() }()
+
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for Run to complete")
+	case err := <-done:
+		if err != nil {
+			t.Fatal("Unexpected error from Run", err)
+		}
+	}
+
+	if maxBatch > MaxBatchGetKeys {
+		t.Error("Batch size exceeded", maxBatch)
+	}
+
+	var expected, actual []int
+	for i := 0; i < 250; i++ {
+		expected = append(expected, i)
+	}
+	for _, item := range iw.items {
+		actual = append(actual, intItemValue("key", item))
+	}
+	sort.Ints(actual)
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected=%#v actual=%#v", expected, actual)
+	}
+
+	for k, count := range seen {
+		if k%2 == 1 && count != 2 {
+			t.Errorf("key %d requested %d times", k, count)
+		}
+	}
+
+	if stats := g.Stats(); stats.ItemsRead != 250 {
+		t.Error("Incorrect items read", stats.ItemsRead)
+	}
+}
+
+// Test that a failed request causes Run to exit with an error
+func TestBatchGetFailed(t *testing.T) {
+	dyn := &fakeBatchGetter{
+		get: func(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+			return nil, errors.New("test error")
+		},
+	}
+
+	g := &BatchGetter{
+		Dyn:         dyn,
+		TableName:   "table-name",
+		MaxParallel: 2,
+		Keys:        makeItems(0, 500),
+		Writer:      new(testItemWriter),
+	}
+
+	done := make(chan error)
+	go func() { done <- g.Run() }()
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for Run to complete")
+	case err := <-done:
+		if err == nil {
+			t.Fatal("No error returned from Run")
+		}
+	}
+}
+
+// Test that a read capacity of less than one unit is rounded up rather than
+// creating an empty rate limit bucket.
+func TestBatchGetFractionalCapacity(t *testing.T) {
+	dyn := &fakeBatchGetter{
+		get: func(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+			return &dynamodb.BatchGetItemOutput{
+				Responses: map[string][]map[string]*dynamodb.AttributeValue{
+					"table-name": input.RequestItems["table-name"].Keys,
+				},
+				ConsumedCapacity: []*dynamodb.ConsumedCapacity{
+					{CapacityUnits: aws.Float64(1)},
+				},
+			}, nil
+		},
+	}
+
+	iw := new(testItemWriter)
+	g := &BatchGetter{
+		Dyn:          dyn,
+		TableName:    "table-name",
+		MaxParallel:  1,
+		ReadCapacity: 0.5,
+		Keys:         makeItems(0, 50),
+		Writer:       iw,
+	}
+
+	done := make(chan error)
+	go func() { done <- g.Run() }()
+
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for Run to complete")
+	case err := <-done:
+		if err != nil {
+			t.Fatal("Unexpected error from Run", err)
+		}
+	}
+	if len(iw.items) != 50 {
+		t.Error("Incorrect item count", len(iw.items))
+	}
+}
+
+type fakeBatchGetter struct {
+	get func(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error)
+}
+
+func (d *fakeBatchGetter) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	return d.get(input)
+}
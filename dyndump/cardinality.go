@@ -0,0 +1,233 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// hllPrecision is the number of hash bits used to select a
+	// HyperLogLog register, giving a standard error of about 0.8%.
+	hllPrecision = 14
+	hllRegisters = 1 << hllPrecision
+
+	// cmsDepth and cmsWidth size the count-min sketch; a value's count is
+	// overestimated by at most e/cmsWidth of the items counted, with a
+	// probability of 1-e^-cmsDepth.
+	cmsDepth = 4
+	cmsWidth = 4096
+
+	// topCandidateFactor sets how many candidate values are tracked for
+	// each of the top values requested.
+	topCandidateFactor = 4
+)
+
+// ValueCount is the estimated number of items holding a value.
+type ValueCount struct {
+	Value string // The value encoded as DynamoDB JSON, eg. {"S":"foo"}
+	Count int64  // Estimated number of items holding the value; may be an overcount
+}
+
+// CardinalitySummary describes the values held by an attribute across the
+// items written to a CardinalityCollector.
+type CardinalitySummary struct {
+	Attribute string
+	Items     int64        // Number of items holding the attribute
+	Missing   int64        // Number of items without the attribute
+	Distinct  int64        // Estimated number of distinct values
+	Top       []ValueCount // Most frequent values, most frequent first
+}
+
+// CardinalityCollector implements the ItemWriter interface to estimate the
+// number of distinct values of one attribute, and its most frequent values,
+// as items are dumped.  Each item is passed on to Writer, if set, so the
+// collector can be placed in front of an encoder.
+//
+// Memory use is fixed regardless of the number of items or distinct
+// values, at the cost of the results being approximate:
+//
+// The distinct count is estimated with a HyperLogLog, with a standard error
+// of about 0.8%.  Counts of up to a few thousand are close to exact.
+//
+// The count of each value is estimated with a count-min sketch, which never
+// undercounts, but may overcount a value by up to 0.07% of the items
+// written.  The sketch can't list the values it has counted, so a set of
+// topN*4 candidate values with the highest counts seen so far is kept
+// alongside it.  Values that are frequent throughout the dump are reliably
+// reported, while a value that only becomes frequent late in a dump of a
+// high cardinality attribute may be missed.
+//
+// Values are compared by their DynamoDB JSON encoding, so the number 1 and
+// the string "1" are distinct values.
+type CardinalityCollector struct {
+	Writer ItemWriter // Items are passed on to Writer, if set
+
+	attr    string
+	topN    int
+	m       sync.Mutex
+	items   int64
+	missing int64
+	hll     [hllRegisters]uint8
+	sketch  [cmsDepth][cmsWidth]int64
+	top     map[string]int64 // candidate top values and their estimated counts
+}
+
+// NewCardinalityCollector creates a CardinalityCollector for the named
+// top level attribute, reporting up to topN of its most frequent values.
+func NewCardinalityCollector(attr string, topN int) *CardinalityCollector {
+	return &CardinalityCollector{
+		attr: attr,
+		topN: topN,
+		top:  make(map[string]int64),
+	}
+}
+
+// WriteItem implements ItemWriter.
+func (c *CardinalityCollector) WriteItem(item map[string]*dynamodb.AttributeValue) error {
+	if err := c.add(item); err != nil {
+		return err
+	}
+	if c.Writer != nil {
+		return c.Writer.WriteItem(item)
+	}
+	return nil
+}
+
+// add counts the item's value of the attribute.
+func (c *CardinalityCollector) add(item map[string]*dynamodb.AttributeValue) error {
+	av, ok := item[c.attr]
+	if !ok {
+		c.m.Lock()
+		c.missing++
+		c.m.Unlock()
+		return nil
+	}
+	v, err := toAttribute(c.attr, av)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	value := string(data)
+	h := valueHash(data)
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.items++
+
+	// HyperLogLog: the top bits select a register, which records the
+	// longest run of leading zeros seen in the remaining bits
+	reg := h >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(h<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > c.hll[reg] {
+		c.hll[reg] = rank
+	}
+
+	// count-min sketch: the estimate is the smallest of the value's counters
+	h1, h2 := uint32(h), uint32(h>>32)
+	count := int64(math.MaxInt64)
+	for i := range c.sketch {
+		col := (h1 + uint32(i)*h2) % cmsWidth
+		c.sketch[i][col]++
+		if n := c.sketch[i][col]; n < count {
+			count = n
+		}
+	}
+	c.addCandidate(value, count)
+	return nil
+}
+
+// addCandidate records the estimated count of a value if it's among the
+// most frequent seen so far, evicting the least frequent candidate if the
+// candidate set is full.
+func (c *CardinalityCollector) addCandidate(value string, count int64) {
+	if _, ok := c.top[value]; ok || len(c.top) < c.topN*topCandidateFactor {
+		c.top[value] = count
+		return
+	}
+	var minValue string
+	minCount := int64(math.MaxInt64)
+	for v, n := range c.top {
+		if n < minCount {
+			minValue, minCount = v, n
+		}
+	}
+	if count > minCount {
+		delete(c.top, minValue)
+		c.top[value] = count
+	}
+}
+
+// Summary returns the results for the items written so far.
+func (c *CardinalityCollector) Summary() CardinalitySummary {
+	c.m.Lock()
+	defer c.m.Unlock()
+	s := CardinalitySummary{
+		Attribute: c.attr,
+		Items:     c.items,
+		Missing:   c.missing,
+		Distinct:  c.distinct(),
+	}
+	for v, n := range c.top {
+		s.Top = append(s.Top, ValueCount{Value: v, Count: n})
+	}
+	sort.Slice(s.Top, func(i, j int) bool {
+		if s.Top[i].Count != s.Top[j].Count {
+			return s.Top[i].Count > s.Top[j].Count
+		}
+		return s.Top[i].Value < s.Top[j].Value
+	})
+	if len(s.Top) > c.topN {
+		s.Top = s.Top[:c.topN]
+	}
+	return s
+}
+
+// distinct returns the HyperLogLog estimate of the number of distinct
+// values, using linear counting for small cardinalities where the raw
+// estimate is biased.
+func (c *CardinalityCollector) distinct() int64 {
+	if c.items == 0 {
+		return 0
+	}
+	const m = float64(hllRegisters)
+	var sum float64
+	var zeros int
+	for _, rank := range c.hll {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+// valueHash returns a well mixed 64 bit hash of data.
+func valueHash(data []byte) uint64 {
+	f := fnv.New64a()
+	f.Write(data)
+	// the splitmix64 finalizer spreads fnv's output across all bits
+	h := f.Sum64()
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
@@ -0,0 +1,96 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+type countingWriter struct {
+	m     sync.Mutex
+	count int
+}
+
+func (w *countingWriter) WriteItem(item map[string]*dynamodb.AttributeValue) error {
+	w.m.Lock()
+	w.count++
+	w.m.Unlock()
+	return nil
+}
+
+func TestCardinalityCollector(t *testing.T) {
+	out := new(countingWriter)
+	c := NewCardinalityCollector("color", 3)
+	c.Writer = out
+
+	// value i is held by 1000/(i+1) items, spread across writers
+	var wg sync.WaitGroup
+	var expectedItems int64
+	for i := 0; i < 200; i++ {
+		n := 1000 / (i + 1)
+		expectedItems += int64(n)
+		wg.Add(1)
+		go func(i, n int) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				c.WriteItem(map[string]*dynamodb.AttributeValue{
+					"color": {S: aws.String(fmt.Sprintf("value-%d", i))},
+				})
+			}
+		}(i, n)
+	}
+	wg.Wait()
+	c.WriteItem(map[string]*dynamodb.AttributeValue{"other": {N: aws.String("1")}})
+
+	s := c.Summary()
+	if s.Attribute != "color" || s.Items != expectedItems || s.Missing != 1 {
+		t.Errorf("Incorrect counts %#v", s)
+	}
+	if s.Distinct != 200 {
+		t.Errorf("Incorrect distinct count %d", s.Distinct)
+	}
+	expected := []ValueCount{{`{"S":"value-0"}`, 1000}, {`{"S":"value-1"}`, 500}, {`{"S":"value-2"}`, 333}}
+	if len(s.Top) != len(expected) {
+		t.Fatalf("Incorrect top values %v", s.Top)
+	}
+	for i, vc := range s.Top {
+		if vc.Value != expected[i].Value || vc.Count < expected[i].Count || vc.Count > expected[i].Count+5 {
+			t.Errorf("Incorrect top value %d: %v", i, vc)
+		}
+	}
+	if out.count != int(expectedItems)+1 {
+		t.Errorf("Incorrect number of items passed on %d", out.count)
+	}
+}
+
+// Check the distinct estimate stays within a few standard errors for a
+// high cardinality attribute.
+func TestCardinalityCollectorDistinct(t *testing.T) {
+	c := NewCardinalityCollector("id", 5)
+	const n = 200000
+	for i := 0; i < n; i++ {
+		c.WriteItem(map[string]*dynamodb.AttributeValue{"id": {N: aws.String(fmt.Sprint(i))}})
+	}
+	s := c.Summary()
+	if e := math.Abs(float64(s.Distinct-n)) / n; e > 0.03 {
+		t.Errorf("Distinct estimate %d has error %.3f", s.Distinct, e)
+	}
+	if len(s.Top) != 5 {
+		t.Errorf("Incorrect number of top values %d", len(s.Top))
+	}
+}
+
+func TestCardinalityCollectorInvalid(t *testing.T) {
+	c := NewCardinalityCollector("id", 5)
+	if err := c.WriteItem(map[string]*dynamodb.AttributeValue{"id": {}}); err == nil {
+		t.Error("Expected error for an attribute without a type")
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// CSVItemEncoder implements the ItemWriter interface to write DynamoDB
+// items as CSV rows, for use with spreadsheets and other tools that don't
+// read JSON.
+//
+// A header row naming the Columns is written before the first item.  Each
+// item is then written as a row holding the value of each column's
+// attribute in turn; a missing or NULL attribute is written as an empty
+// cell.  Strings and numbers are written as is, booleans as true or false
+// and binary values base64 encoded.
+//
+// Lists, maps and sets can't be written as a single cell, so WriteItem
+// returns an error for an item holding one in any of the columns, unless
+// EncodeComplex is set, in which case they're written in the JSON form
+// SimpleEncoder uses, eg. {"SS":["a","b"]}.
+type CSVItemEncoder struct {
+	Columns       []string // Attribute names to write, in order
+	EncodeComplex bool     // If true then write lists, maps and sets as JSON rather than failing
+
+	w         *csv.Writer
+	m         sync.Mutex
+	wroteHead bool
+}
+
+// NewCSVItemEncoder creates and initializes a new CSVItemEncoder that
+// writes the given columns.
+func NewCSVItemEncoder(w io.Writer, columns []string) *CSVItemEncoder {
+	return &CSVItemEncoder{
+		Columns: columns,
+		w:       csv.NewWriter(w),
+	}
+}
+
+// WriteItem implements ItemWriter.
+func (e *CSVItemEncoder) WriteItem(item map[string]*dynamodb.AttributeValue) error {
+	row := make([]string, len(e.Columns))
+	for i, name := range e.Columns {
+		cell, err := e.cell(name, item[name])
+		if err != nil {
+			return err
+		}
+		row[i] = cell
+	}
+
+	e.m.Lock()
+	defer e.m.Unlock()
+	if !e.wroteHead {
+		if err := e.w.Write(e.Columns); err != nil {
+			return err
+		}
+		e.wroteHead = true
+	}
+	if err := e.w.Write(row); err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// cell returns the text of an attribute's cell.
+func (e *CSVItemEncoder) cell(name string, v *dynamodb.AttributeValue) (string, error) {
+	switch {
+	case v == nil || v.NULL != nil:
+		return "", nil
+	case v.S != nil:
+		return *v.S, nil
+	case v.N != nil:
+		return *v.N, nil
+	case v.BOOL != nil:
+		return strconv.FormatBool(*v.BOOL), nil
+	case v.B != nil:
+		return base64.StdEncoding.EncodeToString(v.B), nil
+	}
+	if !e.EncodeComplex {
+		return "", fmt.Errorf("attribute %q is a list, map or set, which can't be written to a CSV cell", name)
+	}
+	attr, err := toAttribute(name, v)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(attr)
+	return string(data), err
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Check that each scalar type is written to its own cell, with a header
+// row, and that missing attributes are left empty.
+func TestCSVItemEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewCSVItemEncoder(&buf, []string{"id", "name", "active", "data", "gone"})
+	items := []map[string]*dynamodb.AttributeValue{
+		{
+			"id":     {N: aws.String("1")},
+			"name":   {S: aws.String("plain")},
+			"active": {BOOL: aws.Bool(true)},
+			"data":   {B: []byte("foo")},
+			"other":  {S: aws.String("not a column")},
+		},
+		{
+			"id":     {N: aws.String("2")},
+			"active": {NULL: aws.Bool(true)},
+		},
+	}
+	for _, item := range items {
+		if err := enc.WriteItem(item); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+	}
+	expected := "id,name,active,data,gone\n" +
+		"1,plain,true,Zm9v,\n" +
+		"2,,,,\n"
+	if actual := buf.String(); actual != expected {
+		t.Errorf("expected=%q actual=%q", expected, actual)
+	}
+}
+
+// Check that cells holding separators, quotes and newlines are quoted.
+func TestCSVItemEncoderQuoting(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"a,b", `"a,b"`},
+		{`say "hi"`, `"say ""hi"""`},
+		{"two\nlines", "\"two\nlines\""},
+		{" padded ", `" padded "`},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		enc := NewCSVItemEncoder(&buf, []string{"k"})
+		if err := enc.WriteItem(map[string]*dynamodb.AttributeValue{"k": {S: aws.String(test.value)}}); err != nil {
+			t.Fatalf("value=%q unexpected error %v", test.value, err)
+		}
+		if actual := strings.TrimPrefix(buf.String(), "k\n"); actual != test.expected+"\n" {
+			t.Errorf("value=%q expected=%q actual=%q", test.value, test.expected, actual)
+		}
+	}
+}
+
+// Check that lists, maps and sets fail unless EncodeComplex is set, in
+// which case they're written as JSON.
+func TestCSVItemEncoderComplex(t *testing.T) {
+	item := map[string]*dynamodb.AttributeValue{
+		"tags": {SS: []*string{aws.String("a"), aws.String("b")}},
+	}
+
+	var buf bytes.Buffer
+	enc := NewCSVItemEncoder(&buf, []string{"tags"})
+	if err := enc.WriteItem(item); err == nil || !strings.Contains(err.Error(), `"tags"`) {
+		t.Error("Incorrect error", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Unexpected output %q", buf.String())
+	}
+
+	enc.EncodeComplex = true
+	if err := enc.WriteItem(item); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	expected := "tags\n" + `"{""SS"":[""a"",""b""]}"` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Errorf("expected=%q actual=%q", expected, actual)
+	}
+}
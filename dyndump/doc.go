@@ -13,5 +13,14 @@ or the Stop method is called.
 
 It also provides an S3Writer type that can be passed to a Fetcher to stream
 received data to an S3 bucket.
+
+A BatchGetter may be used in place of a Fetcher to retrieve a specific set
+of items by primary key rather than scanning the entire table.
+
+Items are normally encoded one JSON object per item by SimpleEncoder, which
+can also indent each item or write the items as a single JSON array.  The
+EnvelopeEncoder and EnvelopeDecoder types instead wrap each item in an
+envelope that can carry a condition expression for a Loader to apply when
+the item is restored.
 */
 package dyndump
@@ -0,0 +1,122 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// FanoutReader reads each item from a source once and delivers a copy of it
+// to each of several readers, allowing multiple Loaders, such as one per
+// region, to load the same items.
+//
+// Items are delivered to all readers in step, so the slowest reader limits
+// the rate of the others.  Each reader must be closed once its consumer
+// stops reading from it, such as when its Loader's Run returns, so that
+// the remaining readers aren't blocked waiting for it.
+type FanoutReader struct {
+	src     ItemReader
+	outputs []*fanoutOutput
+	once    sync.Once
+	err     error // the error that ended the source; set before outputs are closed
+}
+
+type fanoutItem struct {
+	item map[string]*dynamodb.AttributeValue
+	cond *ItemCondition
+}
+
+// NewFanoutReader creates a FanoutReader delivering the items read from src
+// to n readers.  If src implements ConditionalItemReader then the condition
+// read with each item is delivered with it.
+func NewFanoutReader(src ItemReader, n int) *FanoutReader {
+	f := &FanoutReader{src: src}
+	for i := 0; i < n; i++ {
+		f.outputs = append(f.outputs, &fanoutOutput{
+			f:      f,
+			items:  make(chan fanoutItem),
+			closed: make(chan struct{}),
+		})
+	}
+	return f
+}
+
+// Reader returns the i'th reader.  The reader implements
+// ConditionalItemReader and io.Closer.
+func (f *FanoutReader) Reader(i int) ConditionalItemReader {
+	return f.outputs[i]
+}
+
+// run reads items from the source until it fails or all outputs are
+// closed.
+func (f *FanoutReader) run() {
+	condSource, _ := f.src.(ConditionalItemReader)
+	defer func() {
+		for _, o := range f.outputs {
+			close(o.items)
+		}
+	}()
+
+	for {
+		var item fanoutItem
+		var err error
+		if condSource != nil {
+			item.item, item.cond, err = condSource.ReadConditionalItem()
+		} else {
+			item.item, err = f.src.ReadItem()
+		}
+		if err != nil {
+			f.err = err
+			return
+		}
+
+		var delivered int
+		for _, o := range f.outputs {
+			// each loader may modify its copy of the item
+			copied := item
+			copied.item = make(map[string]*dynamodb.AttributeValue, len(item.item))
+			for k, v := range item.item {
+				copied.item[k] = v
+			}
+			select {
+			case o.items <- copied:
+				delivered++
+			case <-o.closed:
+			}
+		}
+		if delivered == 0 {
+			return // all outputs closed
+		}
+	}
+}
+
+type fanoutOutput struct {
+	f         *FanoutReader
+	items     chan fanoutItem
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (o *fanoutOutput) ReadItem() (item map[string]*dynamodb.AttributeValue, err error) {
+	item, _, err = o.ReadConditionalItem()
+	return item, err
+}
+
+func (o *fanoutOutput) ReadConditionalItem() (item map[string]*dynamodb.AttributeValue, cond *ItemCondition, err error) {
+	o.f.once.Do(func() { go o.f.run() })
+	fi, ok := <-o.items
+	if !ok {
+		return nil, nil, o.f.err
+	}
+	return fi.item, fi.cond, nil
+}
+
+// Close detaches the reader from the source.
+func (o *fanoutOutput) Close() error {
+	o.closeOnce.Do(func() { close(o.closed) })
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Check that every reader receives every item, and that loaders writing to
+// each don't interfere with each other's copies.
+func TestFanoutLoad(t *testing.T) {
+	var items []map[string]*dynamodb.AttributeValue
+	for i := 1; i <= 10; i++ {
+		item := makeIntItem("v", i)
+		item[SequenceKey] = &dynamodb.AttributeValue{N: aws.String("1")}
+		items = append(items, item)
+	}
+	f := NewFanoutReader(newLoadItems(items...), 3)
+
+	var written [3]stringVals
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		vals := &written[i]
+		ld := &Loader{
+			Dyn: &fakeDynPuter{
+				put: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+					vals.Add(aws.StringValue(input.Item["v"].N))
+					return &dynamodb.PutItemOutput{
+						ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+					}, nil
+				},
+			},
+			TableName:   "test-table",
+			MaxParallel: 2,
+			Source:      f.Reader(i),
+			HashKey:     "v",
+		}
+		go func(r io.Closer) {
+			err := ld.Run()
+			r.Close()
+			errs <- err
+		}(f.Reader(i).(io.Closer))
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Error("Unexpected error", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for loaders")
+		}
+	}
+
+	expected := []string{"1", "10", "2", "3", "4", "5", "6", "7", "8", "9"}
+	for i := range written {
+		if actual := written[i].Sorted(); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("reader=%d expected=%v actual=%v", i, expected, actual)
+		}
+	}
+}
+
+// Check that closing one reader doesn't block the others, and that a
+// source error is returned by every remaining reader.
+func TestFanoutClose(t *testing.T) {
+	src := newLoadItems(makeItems(0, 3)...)
+	src.appendError(errors.New("read failed"))
+	f := NewFanoutReader(src, 2)
+
+	f.Reader(0).(io.Closer).Close()
+	r := f.Reader(1)
+	for i := 0; i < 3; i++ {
+		if item, err := r.ReadItem(); err != nil || intItemValue("key", item) != i {
+			t.Fatalf("Incorrect item %d: %v %v", i, item, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := r.ReadItem(); err == nil || !strings.Contains(err.Error(), "read failed") {
+			t.Error("Incorrect error", err)
+		}
+	}
+}
@@ -5,19 +5,28 @@
 package dyndump
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/juju/ratelimit"
 )
 
-var (
-	limitCalcSize = 50 // number of item sizes to collect when calculating an average
-	initialLimit  = 20 // Iniital number of items to request when size is unknown
+const (
+	// DefaultLimitCalcSize is the default number of recent item sizes used
+	// to calculate the number of items to request.
+	DefaultLimitCalcSize = 50
+
+	// DefaultInitialLimit is the default number of items to request before
+	// the size of items is known.
+	DefaultInitialLimit = 20
 )
 
 // ItemWriter is the interface expected by a Fetcher when writing retrieved
@@ -32,11 +41,56 @@ type DynScanner interface {
 	Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error)
 }
 
+// DynContextScanner may optionally be implemented by the DynScanner passed
+// to a Fetcher, allowing RunContext to cancel scan requests in progress.
+// It's implemented by the dynamodb service.
+type DynContextScanner interface {
+	ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error)
+}
+
+// DynQuerier defines the portion of the dynamodb service that Fetcher
+// requires when KeyConditionExpression is set.
+type DynQuerier interface {
+	Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error)
+}
+
+// DynContextQuerier may optionally be implemented by a DynQuerier, allowing
+// RunContext to cancel query requests in progress.
+type DynContextQuerier interface {
+	QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error)
+}
+
 // FetcherStats is returned by Fetcher.Stats to return current global throughput statistics.
 type FetcherStats struct {
 	ItemsRead    int64
 	BytesRead    int64
 	CapacityUsed float64
+	ItemSizes    SizeHistogram // Only counted if CollectItemSizes is set
+
+	// ReadCapacity and PeakReadCapacity hold the current and highest read
+	// capacity targeted by the fetcher, which differ from the configured
+	// capacity if AdaptiveCapacity is set.
+	ReadCapacity     float64
+	PeakReadCapacity float64
+}
+
+// SegmentStat is returned by Fetcher.SegmentStats to report the progress of
+// a single segment of a parallel scan.
+type SegmentStat struct {
+	Segment      int64
+	ItemsRead    int64
+	BytesRead    int64
+	CapacityUsed float64
+	Done         bool // True once the segment has finished reading
+}
+
+// segmentCounters holds the running totals of a single segment, updated
+// atomically.
+type segmentCounters struct {
+	itemsRead    int64
+	bytesRead    int64
+	capacityUsed int64 // multiplied by 10
+	done         int32
 }
 
 // Fetcher fetches data from DynamoDB at a specified capacity and writes
@@ -47,29 +101,139 @@ type Fetcher struct {
 	ConsistentRead bool       // Setting to true will use double the read capacity.
 	MaxParallel    int        // Maximum number of parallel requests to make to Dynamo.
 	MaxItems       int64      // Maximum (approximately) number of items to read from Dynamo.
+	MaxBytes       int64      // Maximum (approximately) number of bytes to read from Dynamo.
 	ReadCapacity   float64    // Average global read capacity to use for the scan.
 	Writer         ItemWriter // Retrieved items are sent to this ItemWriter.
 
-	rateLimit    *ratelimit.Bucket
-	itemsRead    int64
-	bytesRead    int64
-	capacityUsed int64 // multiplied by 10
-	stopRequest  chan struct{}
-	stopNotify   chan struct{}
-	limitCalc    *limitCalc
+	// ProjectionExpression, if set, limits the attributes returned for each
+	// item.  Capacity is still consumed based on the size of the entire item.
+	ProjectionExpression string
+
+	// FilterExpression, if set, limits the items returned to those matching
+	// the expression.  Capacity is still consumed by every item read,
+	// including those that don't match, so ItemsRead counts only the items
+	// returned while CapacityUsed counts the capacity consumed by all.
+	FilterExpression string
+
+	// ExpressionAttributeNames holds substitution tokens for attribute names
+	// used in ProjectionExpression, KeyConditionExpression or
+	// FilterExpression.
+	ExpressionAttributeNames map[string]*string
+
+	// KeyConditionExpression, if set, causes the fetcher to query the table
+	// for the items matching the condition rather than scanning the entire
+	// table.  Dyn must implement DynQuerier, and as a query can't be split
+	// into segments MaxParallel must be 1.
+	KeyConditionExpression string
+
+	// ExpressionAttributeValues holds substitution tokens for values used
+	// in KeyConditionExpression or FilterExpression.
+	ExpressionAttributeValues map[string]*dynamodb.AttributeValue
+
+	// CountOnly causes the fetcher to count the items in the table without
+	// retrieving them.  No items are sent to Writer, which may be nil.
+	CountOnly bool
+
+	// LimitCalcSize sets the number of recent item sizes used to calculate
+	// the number of items to request; defaults to DefaultLimitCalcSize.
+	LimitCalcSize int
+
+	// InitialLimit sets the number of items to request before the size of
+	// items is known; defaults to DefaultInitialLimit.
+	InitialLimit int
+
+	// CollectItemSizes causes the size of each item read to be counted in
+	// the ItemSizes histogram returned by Stats.  Items read with a
+	// ProjectionExpression or CountOnly are not counted.
+	CollectItemSizes bool
+
+	// AdaptiveCapacity causes the read capacity to be raised above
+	// ReadCapacity, up to MaxReadCapacity, while requests are not being
+	// throttled, to make use of any burst capacity accumulated by the
+	// table.  It returns to ReadCapacity as soon as a throttled request is
+	// seen.  ReadCapacity must be greater than zero.
+	AdaptiveCapacity bool
+
+	// Throttles returns the total number of requests made to Dyn that have
+	// been throttled so far, including those that were retried
+	// successfully.  If it's not set then AdaptiveCapacity requires Dyn to
+	// implement DynContextScanner, or DynContextQuerier if
+	// KeyConditionExpression is set, as the dynamodb service does, and the
+	// fetcher counts the throttled retries of its own requests.
+	Throttles func() int64
+
+	// AdaptiveWindow sets the period without throttling after which the
+	// read capacity is raised; defaults to DefaultAdaptiveWindow.
+	AdaptiveWindow time.Duration
+
+	// MaxReadCapacity limits the read capacity used with AdaptiveCapacity;
+	// defaults to DefaultMaxCapacityFactor times ReadCapacity.
+	MaxReadCapacity float64
+
+	// CheckpointWriter, if set, is called after each page of items read by
+	// a segment has been sent to Writer, with the LastEvaluatedKey returned
+	// for the page.  The key is nil once the segment is complete.  It may be
+	// called by several segments concurrently.
+	CheckpointWriter func(segment int64, key map[string]*dynamodb.AttributeValue)
+
+	// StartKeys holds the keys previously passed to CheckpointWriter,
+	// indexed by segment, to resume an interrupted read.  Each segment
+	// starts after its key; segments with a nil key are skipped as complete
+	// and those without an entry are read from the beginning.  MaxParallel
+	// must match that of the interrupted read.
+	StartKeys map[int64]map[string]*dynamodb.AttributeValue
+
+	rateMu      sync.Mutex // guards rateLimit
+	rateLimit   *ratelimit.Bucket
+	adaptive    *adaptiveCapacity
+	throttles   int64      // throttled retries counted if Throttles is nil
+	segMu       sync.Mutex // guards segments
+	segments    []segmentCounters
+	itemSizes   SizeHistogram
+	stopRequest chan struct{}
+	stopNotify  chan struct{}
+	limitCalc   *limitCalc
 }
 
 // Run executes the fetcher, starting as many parallel reads as specified by
 // the MaxParallel option and returns when the read has finished, failed, or
 // been stopped.
 func (f *Fetcher) Run() error {
+	return f.RunContext(context.Background())
+}
+
+// RunContext executes the fetcher as Run does, additionally stopping all
+// reads if ctx is cancelled, in which case it returns ctx.Err().  If Dyn
+// implements DynContextScanner then scan requests in progress are
+// cancelled too, otherwise they're allowed to complete.
+func (f *Fetcher) RunContext(ctx context.Context) error {
+	if f.KeyConditionExpression != "" {
+		if _, ok := f.Dyn.(DynQuerier); !ok {
+			return errors.New("KeyConditionExpression requires a DynamoDB service that supports Query")
+		}
+		if f.MaxParallel != 1 {
+			return errors.New("KeyConditionExpression requires MaxParallel to be 1")
+		}
+	}
+	if f.AdaptiveCapacity {
+		if f.Throttles == nil && !f.canCountThrottles() {
+			return errors.New("AdaptiveCapacity requires Throttles to be set, or a DynamoDB service that accepts request options")
+		}
+		if f.ReadCapacity <= 0 {
+			return errors.New("AdaptiveCapacity requires ReadCapacity to be set")
+		}
+		f.adaptive = newAdaptiveCapacity(f.ReadCapacity, f.maxReadCapacity(), f.adaptiveWindow(), time.Now(), f.throttleCount())
+	}
 	errChan := make(chan error, f.MaxParallel)
 	f.stopRequest = make(chan struct{}, 2)
 	f.stopNotify = make(chan struct{})
-	f.limitCalc = newLimitCalc(limitCalcSize)
+	f.limitCalc = newLimitCalc(f.limitCalcSize())
+	f.segMu.Lock()
+	f.segments = make([]segmentCounters, f.MaxParallel)
+	f.segMu.Unlock()
 
 	if f.ReadCapacity > 0 {
-		f.rateLimit = ratelimit.NewBucketWithQuantum(time.Second, int64(f.ReadCapacity), int64(f.ReadCapacity))
+		f.setRateLimit(f.ReadCapacity)
 	}
 
 	go func() {
@@ -78,7 +242,7 @@ func (f *Fetcher) Run() error {
 	}()
 
 	for i := int64(0); i < int64(f.MaxParallel); i++ {
-		go f.processSegment(i, errChan)
+		go f.processSegment(ctx, i, errChan)
 	}
 
 	var err error
@@ -103,11 +267,62 @@ func (f *Fetcher) Stop() {
 // Stats returns current aggregate statistics about an ongoing or completed run.
 // It is safe to call from concurrent goroutines.
 func (f *Fetcher) Stats() FetcherStats {
-	return FetcherStats{
-		ItemsRead:    atomic.LoadInt64(&f.itemsRead),
-		BytesRead:    atomic.LoadInt64(&f.bytesRead),
-		CapacityUsed: float64(atomic.LoadInt64(&f.capacityUsed)) / 10,
+	stats := FetcherStats{
+		ItemSizes:        f.itemSizes.load(),
+		ReadCapacity:     f.ReadCapacity,
+		PeakReadCapacity: f.ReadCapacity,
+	}
+	for _, seg := range f.SegmentStats() {
+		stats.ItemsRead += seg.ItemsRead
+		stats.BytesRead += seg.BytesRead
+		stats.CapacityUsed += seg.CapacityUsed
 	}
+	if f.adaptive != nil {
+		stats.ReadCapacity, stats.PeakReadCapacity = f.adaptive.capacity()
+	}
+	return stats
+}
+
+// SegmentStats returns the current statistics of each segment of an
+// ongoing or completed run, indexed by segment number, to help spot a
+// segment lagging behind the others.  It is safe to call from concurrent
+// goroutines.
+func (f *Fetcher) SegmentStats() []SegmentStat {
+	f.segMu.Lock()
+	segments := f.segments
+	f.segMu.Unlock()
+
+	stats := make([]SegmentStat, len(segments))
+	for i := range segments {
+		seg := &segments[i]
+		stats[i] = SegmentStat{
+			Segment:      int64(i),
+			ItemsRead:    atomic.LoadInt64(&seg.itemsRead),
+			BytesRead:    atomic.LoadInt64(&seg.bytesRead),
+			CapacityUsed: float64(atomic.LoadInt64(&seg.capacityUsed)) / 10,
+			Done:         atomic.LoadInt32(&seg.done) == 1,
+		}
+	}
+	return stats
+}
+
+// totalRead returns the total number of items and bytes read by all
+// segments so far.
+func (f *Fetcher) totalRead() (items, bytes int64) {
+	for i := range f.segments {
+		items += atomic.LoadInt64(&f.segments[i].itemsRead)
+		bytes += atomic.LoadInt64(&f.segments[i].bytesRead)
+	}
+	return items, bytes
+}
+
+// limitReached returns true once MaxItems or MaxBytes has been reached.
+func (f *Fetcher) limitReached() bool {
+	if f.MaxItems <= 0 && f.MaxBytes <= 0 {
+		return false
+	}
+	items, bytes := f.totalRead()
+	return (f.MaxItems > 0 && items >= f.MaxItems) || (f.MaxBytes > 0 && bytes >= f.MaxBytes)
 }
 
 func (f *Fetcher) isStopped() bool {
@@ -120,25 +335,148 @@ func (f *Fetcher) isStopped() bool {
 }
 
 // Interruptible rate limit wait
-// Returns true if Stop() was called while waiting.
-func (f *Fetcher) waitForRateLimit(usedCapacity int64) bool {
-	d := f.rateLimit.Take(usedCapacity)
+// Returns early if Stop() is called or ctx is cancelled while waiting.
+func (f *Fetcher) waitForRateLimit(ctx context.Context, usedCapacity int64) {
+	d := f.limiter().Take(usedCapacity)
 	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
 		select {
-		case <-time.After(d):
-			return false
+		case <-t.C:
 		case <-f.stopNotify:
-			return true
+		case <-ctx.Done():
 		}
 	}
-	return false
+}
+
+// scan makes a single scan request, cancelling it if ctx is cancelled and
+// Dyn supports it.  If KeyConditionExpression is set then a query is made
+// instead using the same parameters.
+func (f *Fetcher) scan(ctx context.Context, params *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	if f.KeyConditionExpression != "" {
+		return f.query(ctx, params)
+	}
+	if cs, ok := f.Dyn.(DynContextScanner); ok {
+		return cs.ScanWithContext(ctx, params, f.requestOptions()...)
+	}
+	return f.Dyn.Scan(params)
+}
+
+// canCountThrottles returns true if the fetcher can count the throttled
+// retries of its requests itself.
+func (f *Fetcher) canCountThrottles() bool {
+	if f.KeyConditionExpression != "" {
+		_, ok := f.Dyn.(DynContextQuerier)
+		return ok
+	}
+	_, ok := f.Dyn.(DynContextScanner)
+	return ok
+}
+
+// requestOptions returns the options to make each request with, adding a
+// handler to count its throttled retries if AdaptiveCapacity is set
+// without Throttles.
+func (f *Fetcher) requestOptions() []request.Option {
+	if f.adaptive == nil || f.Throttles != nil {
+		return nil
+	}
+	return []request.Option{func(r *request.Request) {
+		r.Handlers.Retry.PushBack(func(r *request.Request) {
+			if r.IsErrorThrottle() {
+				atomic.AddInt64(&f.throttles, 1)
+			}
+		})
+	}}
+}
+
+// throttleCount returns the number of throttled requests seen so far.
+func (f *Fetcher) throttleCount() int64 {
+	if f.Throttles != nil {
+		return f.Throttles()
+	}
+	return atomic.LoadInt64(&f.throttles)
+}
+
+// query makes a single query request using the parameters of a scan,
+// returning the result as a scan's so that both are accounted for alike.
+func (f *Fetcher) query(ctx context.Context, params *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	input := &dynamodb.QueryInput{
+		TableName:                 params.TableName,
+		ConsistentRead:            params.ConsistentRead,
+		Limit:                     params.Limit,
+		ExclusiveStartKey:         params.ExclusiveStartKey,
+		ReturnConsumedCapacity:    params.ReturnConsumedCapacity,
+		Select:                    params.Select,
+		ProjectionExpression:      params.ProjectionExpression,
+		ExpressionAttributeNames:  params.ExpressionAttributeNames,
+		ExpressionAttributeValues: f.ExpressionAttributeValues,
+		FilterExpression:          params.FilterExpression,
+		KeyConditionExpression:    aws.String(f.KeyConditionExpression),
+	}
+	var resp *dynamodb.QueryOutput
+	var err error
+	if cq, ok := f.Dyn.(DynContextQuerier); ok {
+		resp, err = cq.QueryWithContext(ctx, input, f.requestOptions()...)
+	} else {
+		resp, err = f.Dyn.(DynQuerier).Query(input)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.ScanOutput{
+		ConsumedCapacity: resp.ConsumedCapacity,
+		Count:            resp.Count,
+		Items:            resp.Items,
+		LastEvaluatedKey: resp.LastEvaluatedKey,
+		ScannedCount:     resp.ScannedCount,
+	}, nil
+}
+
+// limiter returns the current rate limit, or nil if unlimited.
+func (f *Fetcher) limiter() *ratelimit.Bucket {
+	f.rateMu.Lock()
+	defer f.rateMu.Unlock()
+	return f.rateLimit
+}
+
+// setRateLimit replaces the rate limit with one allowing the given read
+// capacity.
+func (f *Fetcher) setRateLimit(capacity float64) {
+	n := int64(capacity)
+	if n < 1 {
+		n = 1
+	}
+	f.rateMu.Lock()
+	f.rateLimit = ratelimit.NewBucketWithQuantum(time.Second, n, n)
+	f.rateMu.Unlock()
+}
+
+// adjustCapacity updates the rate limit if AdaptiveCapacity is set and the
+// read capacity has changed.
+func (f *Fetcher) adjustCapacity() {
+	if f.adaptive == nil {
+		return
+	}
+	if capacity, changed := f.adaptive.update(time.Now(), f.throttleCount()); changed {
+		f.setRateLimit(capacity)
+	}
+}
+
+// readCapacity returns the read capacity currently targeted.
+func (f *Fetcher) readCapacity() float64 {
+	if f.adaptive != nil {
+		capacity, _ := f.adaptive.capacity()
+		return capacity
+	}
+	return f.ReadCapacity
 }
 
 // process a single segment.  executed in a separate goroutine by Run
 // for parallel scans.
-func (f *Fetcher) processSegment(segNum int64, doneChan chan<- error) {
-	limit := aws.Int64(int64(initialLimit)) // slow start
-	if f.rateLimit == nil {
+func (f *Fetcher) processSegment(ctx context.Context, segNum int64, doneChan chan<- error) {
+	seg := &f.segments[segNum]
+	limit := aws.Int64(int64(f.initialLimit())) // slow start
+	if f.limiter() == nil {
 		limit = aws.Int64(0) // unlimited
 	}
 
@@ -149,28 +487,68 @@ func (f *Fetcher) processSegment(segNum int64, doneChan chan<- error) {
 		Segment:                aws.Int64(segNum),
 		TotalSegments:          aws.Int64(int64(f.MaxParallel)),
 		ReturnConsumedCapacity: aws.String("TOTAL"),
+		Select:                 aws.String(f.selectMode()),
+	}
+	if f.ProjectionExpression != "" && !f.CountOnly {
+		params.ProjectionExpression = aws.String(f.ProjectionExpression)
+	}
+	if f.FilterExpression != "" {
+		params.FilterExpression = aws.String(f.FilterExpression)
+	}
+	if len(f.ExpressionAttributeNames) > 0 &&
+		(params.ProjectionExpression != nil || params.FilterExpression != nil || f.KeyConditionExpression != "") {
+		params.ExpressionAttributeNames = f.ExpressionAttributeNames
+	}
+	if len(f.ExpressionAttributeValues) > 0 && params.FilterExpression != nil {
+		params.ExpressionAttributeValues = f.ExpressionAttributeValues
+	}
+	if key, ok := f.StartKeys[segNum]; ok {
+		if key == nil {
+			// segment was completed by a previous read
+			atomic.StoreInt32(&seg.done, 1)
+			doneChan <- nil
+			return
+		}
+		params.ExclusiveStartKey = key
 	}
 
 	usedCapacity := int64(1)
 	for {
-		if f.rateLimit != nil {
-			if isStopped := f.waitForRateLimit(usedCapacity); isStopped {
-				break
-			}
+		if f.limiter() != nil {
+			f.waitForRateLimit(ctx, usedCapacity)
 		}
 
+		if err := ctx.Err(); err != nil {
+			doneChan <- err
+			return
+		}
 		if f.isStopped() {
 			break
 		}
 
 		// the dynamo service will automatically retry soft errors (including hitting capacity limits)
 		// with a backoff algorithm any other errors returned are hard errors
-		resp, err := f.Dyn.Scan(params)
+		resp, err := f.scan(ctx, params)
 		if err != nil {
+			if ctx.Err() != nil {
+				doneChan <- ctx.Err()
+				return
+			}
 			doneChan <- fmt.Errorf("read from DynamoDB failed: %s", err)
 			return
 		}
 
+		// some endpoints, such as DynamoDB Local, don't report the capacity
+		// consumed, or return ConsumedCapacity without CapacityUnits set;
+		// treat it as zero and size the limit from the items returned
+		// instead.
+		var capacityUnits float64
+		reported := resp.ConsumedCapacity != nil && resp.ConsumedCapacity.CapacityUnits != nil
+		if reported {
+			capacityUnits = *resp.ConsumedCapacity.CapacityUnits
+		}
+		estimateSize := f.isPartialRead() && reported
+
 		var respSize int64
 		for _, item := range resp.Items {
 			if err := f.Writer.WriteItem(item); err != nil {
@@ -179,24 +557,47 @@ func (f *Fetcher) processSegment(segNum int64, doneChan chan<- error) {
 			}
 			itemSize := calcItemSize(item)
 			respSize += int64(itemSize)
-			f.limitCalc.addSize(itemSize)
+			if !estimateSize {
+				f.limitCalc.addSize(itemSize)
+			}
+			if f.CollectItemSizes && f.ProjectionExpression == "" {
+				f.itemSizes.add(itemSize)
+			}
+		}
+		f.adjustCapacity()
+		if estimateSize {
+			// the returned items don't reflect the size of the items read
+			// from the table; estimate it from the capacity consumed instead.
+			scanned := aws.Int64Value(resp.ScannedCount)
+			itemSize := f.estimateItemSize(capacityUnits, scanned)
+			for i := int64(0); i < scanned && i < int64(f.limitCalcSize()); i++ {
+				f.limitCalc.addSize(itemSize)
+			}
 		}
 
-		atomic.AddInt64(&f.itemsRead, int64(len(resp.Items)))
-		atomic.AddInt64(&f.bytesRead, respSize)
-		atomic.AddInt64(&f.capacityUsed, int64(*resp.ConsumedCapacity.CapacityUnits*10))
-		if f.MaxItems > 0 && atomic.LoadInt64(&f.itemsRead) >= f.MaxItems {
+		itemCount := int64(len(resp.Items))
+		if f.CountOnly {
+			itemCount = aws.Int64Value(resp.Count)
+		}
+		atomic.AddInt64(&seg.itemsRead, itemCount)
+		atomic.AddInt64(&seg.bytesRead, respSize)
+		atomic.AddInt64(&seg.capacityUsed, int64(capacityUnits*10))
+		if f.CheckpointWriter != nil {
+			f.CheckpointWriter(segNum, resp.LastEvaluatedKey)
+		}
+		if f.limitReached() {
 			break
 		}
 
 		if resp.LastEvaluatedKey == nil {
 			// all data scanned
+			atomic.StoreInt32(&seg.done, 1)
 			break
 		}
 
-		usedCapacity = int64(math.Ceil(*resp.ConsumedCapacity.CapacityUnits))
+		usedCapacity = int64(math.Ceil(capacityUnits))
 		params.ExclusiveStartKey = resp.LastEvaluatedKey
-		if f.rateLimit != nil {
+		if f.limiter() != nil {
 			if newLimit := f.calcLimit(); newLimit > 0 {
 				params.Limit = aws.Int64(int64(newLimit))
 			}
@@ -205,10 +606,73 @@ func (f *Fetcher) processSegment(segNum int64, doneChan chan<- error) {
 	doneChan <- nil
 }
 
+func (f *Fetcher) limitCalcSize() int {
+	if f.LimitCalcSize > 0 {
+		return f.LimitCalcSize
+	}
+	return DefaultLimitCalcSize
+}
+
+func (f *Fetcher) initialLimit() int {
+	if f.InitialLimit > 0 {
+		return f.InitialLimit
+	}
+	return DefaultInitialLimit
+}
+
+func (f *Fetcher) adaptiveWindow() time.Duration {
+	if f.AdaptiveWindow > 0 {
+		return f.AdaptiveWindow
+	}
+	return DefaultAdaptiveWindow
+}
+
+func (f *Fetcher) maxReadCapacity() float64 {
+	if f.MaxReadCapacity > 0 {
+		return f.MaxReadCapacity
+	}
+	return f.ReadCapacity * DefaultMaxCapacityFactor
+}
+
+// selectMode returns the Select parameter to use for scan requests.
+func (f *Fetcher) selectMode() string {
+	switch {
+	case f.CountOnly:
+		return dynamodb.SelectCount
+	case f.ProjectionExpression != "":
+		return dynamodb.SelectSpecificAttributes
+	default:
+		return dynamodb.SelectAllAttributes
+	}
+}
+
+// isPartialRead returns true if the items returned by a scan do not hold
+// all of the data read from the table.
+func (f *Fetcher) isPartialRead() bool {
+	return f.CountOnly || f.ProjectionExpression != "" || f.FilterExpression != ""
+}
+
+// estimateItemSize estimates the average size of scanned items from the
+// read capacity consumed to scan them.
+func (f *Fetcher) estimateItemSize(capacityUsed float64, scanned int64) int {
+	if scanned < 1 {
+		return 0
+	}
+	bytesRead := capacityUsed * 4096
+	if !f.ConsistentRead {
+		bytesRead *= 2 // eventually consistent reads use half the capacity
+	}
+	size := int(bytesRead / float64(scanned))
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
 // adjust the fetch limit amount to approximate the desired read capacity and
 // make effective use of 4k blocks for small items
 func (f *Fetcher) calcLimit() (newLimit int) {
-	desiredCapacity := f.ReadCapacity / float64(f.MaxParallel)
+	desiredCapacity := f.readCapacity() / float64(f.MaxParallel)
 
 	// find the median item size based on recent history
 	medianSize := f.limitCalc.median()
@@ -5,15 +5,21 @@
 package dyndump
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"reflect"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/juju/ratelimit"
 )
 
 func setLimitMedian(lc *limitCalc, median int) {
@@ -104,7 +110,8 @@ func TestProcessSegment(t *testing.T) {
 	f := &Fetcher{
 		Dyn:            dyn,
 		ConsistentRead: true,
-		limitCalc:      newLimitCalc(limitCalcSize),
+		limitCalc:      newLimitCalc(DefaultLimitCalcSize),
+		segments:       make([]segmentCounters, 4),
 		TableName:      "table-name",
 		MaxParallel:    4,
 		ReadCapacity:   10,
@@ -112,7 +119,7 @@ func TestProcessSegment(t *testing.T) {
 	}
 
 	done := make(chan error)
-	go f.processSegment(2, done)
+	go f.processSegment(context.Background(), 2, done)
 
 	select {
 	case <-time.After(time.Second):
@@ -144,7 +151,7 @@ func TestRunOK(t *testing.T) {
 	iw := new(testItemWriter)
 	f := &Fetcher{
 		Dyn:          dyn,
-		limitCalc:    newLimitCalc(limitCalcSize),
+		limitCalc:    newLimitCalc(DefaultLimitCalcSize),
 		TableName:    "table-name",
 		MaxParallel:  4,
 		ReadCapacity: 10,
@@ -175,6 +182,375 @@ func TestRunOK(t *testing.T) {
 	}
 }
 
+// Check that each segment's statistics are counted separately and sum to
+// the aggregate statistics.
+func TestFetcherSegmentStats(t *testing.T) {
+	dyn := &fakeDynamo{
+		scan: func(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+			segnum := int(aws.Int64Value(input.Segment))
+			return &dynamodb.ScanOutput{
+				Items:            makeItems(segnum*10, segnum+1),
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(float64(segnum) + 0.5)},
+			}, nil
+		},
+	}
+	f := &Fetcher{
+		Dyn:         dyn,
+		TableName:   "table-name",
+		MaxParallel: 3,
+		Writer:      new(testItemWriter),
+	}
+	if err := f.Run(); err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+
+	var total FetcherStats
+	segments := f.SegmentStats()
+	if len(segments) != 3 {
+		t.Fatal("Incorrect segment count", len(segments))
+	}
+	for i, seg := range segments {
+		if seg.Segment != int64(i) || seg.ItemsRead != int64(i+1) || seg.CapacityUsed != float64(i)+0.5 || !seg.Done {
+			t.Errorf("Incorrect stats for segment %d: %#v", i, seg)
+		}
+		total.ItemsRead += seg.ItemsRead
+		total.BytesRead += seg.BytesRead
+		total.CapacityUsed += seg.CapacityUsed
+	}
+	stats := f.Stats()
+	if stats.ItemsRead != total.ItemsRead || stats.BytesRead != total.BytesRead || stats.CapacityUsed != total.CapacityUsed {
+		t.Errorf("Segment stats %#v don't sum to %#v", total, stats)
+	}
+}
+
+// Check that the read stops once MaxBytes or MaxItems is reached,
+// whichever comes first.
+func TestFetcherMaxBytes(t *testing.T) {
+	pageSize := int64(0)
+	for _, item := range makeItems(0, 10) {
+		pageSize += int64(calcItemSize(item))
+	}
+
+	tests := []struct {
+		maxItems      int64
+		maxBytes      int64
+		expectedPages int64
+	}{
+		{0, pageSize*2 + pageSize/2, 3},
+		{0, pageSize * 2, 2},
+		{15, pageSize * 3, 2},
+		{50, pageSize * 3, 3},
+	}
+
+	for _, test := range tests {
+		var pages int64
+		dyn := &fakeDynamo{
+			scan: func(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+				pages++
+				items := makeItems(0, 10)
+				return &dynamodb.ScanOutput{
+					Items:            items,
+					LastEvaluatedKey: items[9],
+					ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+				}, nil
+			},
+		}
+		f := &Fetcher{
+			Dyn:         dyn,
+			TableName:   "table-name",
+			MaxParallel: 1,
+			MaxItems:    test.maxItems,
+			MaxBytes:    test.maxBytes,
+			Writer:      new(testItemWriter),
+		}
+		if err := f.Run(); err != nil {
+			t.Fatal("Unexpected error from Run", err)
+		}
+		if pages != test.expectedPages {
+			t.Errorf("maxItems=%d maxBytes=%d expected %d pages, read %d",
+				test.maxItems, test.maxBytes, test.expectedPages, pages)
+		}
+		if stats := f.Stats(); stats.BytesRead != pages*pageSize {
+			t.Errorf("maxItems=%d maxBytes=%d incorrect bytes read %d",
+				test.maxItems, test.maxBytes, stats.BytesRead)
+		}
+	}
+}
+
+var selectTests = []struct {
+	name       string
+	projection string
+	countOnly  bool
+	expected   string
+}{
+	{"full-item", "", false, "ALL_ATTRIBUTES"},
+	{"projection", "a, b", false, "SPECIFIC_ATTRIBUTES"},
+	{"count", "", true, "COUNT"},
+	{"count-projection", "a, b", true, "COUNT"},
+}
+
+// Check the Select parameter matches the fetch mode
+func TestScanSelect(t *testing.T) {
+	for _, test := range selectTests {
+		var input *dynamodb.ScanInput
+		dyn := &fakeDynamo{
+			scan: func(in *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+				input = in
+				return &dynamodb.ScanOutput{
+					Items:            makeItems(0, 3),
+					Count:            aws.Int64(3),
+					ScannedCount:     aws.Int64(3),
+					ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+				}, nil
+			},
+		}
+
+		f := &Fetcher{
+			Dyn:                  dyn,
+			TableName:            "table-name",
+			MaxParallel:          1,
+			ReadCapacity:         10,
+			Writer:               new(testItemWriter),
+			ProjectionExpression: test.projection,
+			CountOnly:            test.countOnly,
+		}
+		if err := f.Run(); err != nil {
+			t.Fatalf("test=%q unexpected error from Run: %v", test.name, err)
+		}
+
+		if sel := aws.StringValue(input.Select); sel != test.expected {
+			t.Errorf("test=%q expected=%q actual=%q", test.name, test.expected, sel)
+		}
+		expectedProjection := test.projection
+		if test.countOnly {
+			expectedProjection = ""
+		}
+		if p := aws.StringValue(input.ProjectionExpression); p != expectedProjection {
+			t.Errorf("test=%q incorrect projection %q", test.name, p)
+		}
+		if n := f.Stats().ItemsRead; n != 3 {
+			t.Errorf("test=%q incorrect items read %d", test.name, n)
+		}
+	}
+}
+
+// Check that a filter expression is passed to the scan, and that only the
+// items returned are counted while all of the capacity consumed is.
+func TestScanFilter(t *testing.T) {
+	var input *dynamodb.ScanInput
+	dyn := &fakeDynamo{
+		scan: func(in *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+			input = in
+			return &dynamodb.ScanOutput{
+				Items:            makeItems(0, 2),
+				Count:            aws.Int64(2),
+				ScannedCount:     aws.Int64(10),
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(5)},
+			}, nil
+		},
+	}
+	values := map[string]*dynamodb.AttributeValue{":status": {S: aws.String("active")}}
+	w := new(testItemWriter)
+	f := &Fetcher{
+		Dyn:                       dyn,
+		TableName:                 "table-name",
+		MaxParallel:               1,
+		ReadCapacity:              10,
+		Writer:                    w,
+		FilterExpression:          "#status = :status",
+		ExpressionAttributeNames:  map[string]*string{"#status": aws.String("status")},
+		ExpressionAttributeValues: values,
+	}
+	if err := f.Run(); err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+
+	if aws.StringValue(input.FilterExpression) != "#status = :status" ||
+		aws.StringValue(input.ExpressionAttributeNames["#status"]) != "status" ||
+		!reflect.DeepEqual(input.ExpressionAttributeValues, values) {
+		t.Errorf("Incorrect scan input %#v", input)
+	}
+	stats := f.Stats()
+	if stats.ItemsRead != 2 || len(w.items) != 2 {
+		t.Errorf("Incorrect items read=%d written=%d", stats.ItemsRead, len(w.items))
+	}
+	if stats.CapacityUsed != 5 {
+		t.Error("Incorrect capacity used", stats.CapacityUsed)
+	}
+}
+
+// Check that a projected scan passes the projection and its attribute names,
+// that items holding only the projected attributes are encoded intact and
+// that the bytes read reflect only the attributes returned.
+func TestScanProjectionEncode(t *testing.T) {
+	items := []map[string]*dynamodb.AttributeValue{
+		{"id": {S: aws.String("a")}, "#name": {S: aws.String("first")}},
+		{"id": {S: aws.String("b")}}, // missing the projected name
+	}
+	var input *dynamodb.ScanInput
+	dyn := &fakeDynamo{
+		scan: func(in *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+			input = in
+			return &dynamodb.ScanOutput{
+				Items:            items,
+				Count:            aws.Int64(2),
+				ScannedCount:     aws.Int64(2),
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(2)},
+			}, nil
+		},
+	}
+	var buf bytes.Buffer
+	f := &Fetcher{
+		Dyn:                      dyn,
+		TableName:                "table-name",
+		MaxParallel:              1,
+		Writer:                   NewSimpleEncoder(&buf),
+		ProjectionExpression:     "id, #n",
+		ExpressionAttributeNames: map[string]*string{"#n": aws.String("#name")},
+	}
+	if err := f.Run(); err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+
+	if aws.StringValue(input.ProjectionExpression) != "id, #n" ||
+		aws.StringValue(input.ExpressionAttributeNames["#n"]) != "#name" {
+		t.Errorf("Incorrect scan input %#v", input)
+	}
+
+	dec := NewSimpleDecoder(&buf)
+	for i, expected := range items {
+		item, err := dec.ReadItem()
+		if err != nil {
+			t.Fatalf("Failed to decode item %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(item, expected) {
+			t.Errorf("Incorrect item %d: %v", i, item)
+		}
+	}
+
+	if n := f.Stats().BytesRead; n != int64(calcItemSize(items[0])+calcItemSize(items[1])) {
+		t.Error("Incorrect bytes read", n)
+	}
+}
+
+// Check that the limit for a projected scan is based on the capacity consumed
+// rather than the size of the returned items.
+func TestProjectionLimit(t *testing.T) {
+	dyn := &fakeDynamo{
+		scan: func(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+			// 100 projected items are tiny, but used 100 units of capacity.
+			return &dynamodb.ScanOutput{
+				Items:            makeItems(0, 100),
+				ScannedCount:     aws.Int64(100),
+				LastEvaluatedKey: makeIntItem("key", 1),
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(100)},
+			}, nil
+		},
+	}
+
+	f := &Fetcher{
+		Dyn:                  dyn,
+		ConsistentRead:       true,
+		limitCalc:            newLimitCalc(DefaultLimitCalcSize),
+		segments:             make([]segmentCounters, 1),
+		MaxParallel:          1,
+		ReadCapacity:         10,
+		Writer:               new(testItemWriter),
+		ProjectionExpression: "key",
+		stopNotify:           make(chan struct{}),
+	}
+	f.rateLimit = ratelimit.NewBucketWithQuantum(time.Second, 1000, 1000)
+	f.MaxItems = 100
+
+	done := make(chan error)
+	go f.processSegment(context.Background(), 0, done)
+	if err := <-done; err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	// each item is ~4k, so 10 units of capacity should fetch ~10 items
+	if limit := f.calcLimit(); limit != 10 {
+		t.Error("Incorrect limit", limit)
+	}
+}
+
+// Check that the initial request limit can be set per fetcher.
+func TestInitialLimit(t *testing.T) {
+	for _, test := range []struct{ initialLimit, expected int }{{0, DefaultInitialLimit}, {5, 5}} {
+		var limit int64
+		dyn := &fakeDynamo{
+			scan: func(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+				limit = aws.Int64Value(input.Limit)
+				return &dynamodb.ScanOutput{
+					Items:            makeItems(0, 1),
+					ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+				}, nil
+			},
+		}
+
+		f := &Fetcher{
+			Dyn:          dyn,
+			MaxParallel:  1,
+			ReadCapacity: 10,
+			InitialLimit: test.initialLimit,
+			Writer:       new(testItemWriter),
+		}
+		if err := f.Run(); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		if limit != int64(test.expected) {
+			t.Errorf("initialLimit=%d expected=%d actual=%d", test.initialLimit, test.expected, limit)
+		}
+	}
+}
+
+// Check that item sizes are counted in the histogram when enabled.
+func TestItemSizeHistogram(t *testing.T) {
+	sizes := []int{10, 1023, 1024, 5000, 20000, 100000, 300000}
+	dyn := &fakeDynamo{
+		scan: func(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+			var items []map[string]*dynamodb.AttributeValue
+			for _, size := range sizes {
+				// the attribute name "s" counts toward the item size
+				items = append(items, map[string]*dynamodb.AttributeValue{
+					"s": {S: aws.String(strings.Repeat("x", size-1))},
+				})
+			}
+			return &dynamodb.ScanOutput{
+				Items:            items,
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+			}, nil
+		},
+	}
+
+	for _, collect := range []bool{false, true} {
+		f := &Fetcher{
+			Dyn:              dyn,
+			MaxParallel:      1,
+			Writer:           new(testItemWriter),
+			CollectItemSizes: collect,
+		}
+		if err := f.Run(); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		expected := SizeHistogram{2, 1, 1, 1, 1, 1}
+		if !collect {
+			expected = SizeHistogram{}
+		}
+		if h := f.Stats().ItemSizes; h != expected {
+			t.Errorf("collect=%t expected=%v actual=%v", collect, expected, h)
+		}
+	}
+
+	var labels []string
+	for i := 0; i < NumSizeBuckets; i++ {
+		labels = append(labels, SizeBucketLabel(i))
+	}
+	if expected := []string{"<1K", "1K-4K", "4K-16K", "16K-64K", "64K-256K", "256K+"}; !reflect.DeepEqual(labels, expected) {
+		t.Errorf("expected=%v actual=%v", expected, labels)
+	}
+}
+
 // TODO: add unit tests for the rest of the thing.
 
 // Test stop on maxitems
@@ -205,6 +581,304 @@ func makeItems(offset, count int) (result []map[string]*dynamodb.AttributeValue)
 	return result
 }
 
+// Check that cancelling the context passed to RunContext stops the fetcher
+// while it's waiting on the rate limit, returning the context's error.
+func TestFetcherRunContext(t *testing.T) {
+	dyn := &fakeDynamo{
+		scan: func(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+			return &dynamodb.ScanOutput{
+				Items:            []map[string]*dynamodb.AttributeValue{makeIntItem("key", 1)},
+				LastEvaluatedKey: makeIntItem("key", 1),
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(100)},
+			}, nil
+		},
+	}
+	f := &Fetcher{
+		Dyn:          dyn,
+		TableName:    "table-name",
+		MaxParallel:  2,
+		ReadCapacity: 1,
+		Writer:       new(testItemWriter),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- f.RunContext(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Error("Incorrect error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for fetcher to stop")
+	}
+}
+
+// ctxDynamo implements DynContextScanner, blocking each scan until its
+// context is cancelled.
+type ctxDynamo struct {
+	fakeDynamo
+}
+
+func (cd *ctxDynamo) ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	<-ctx.Done()
+	return nil, errors.New("request canceled")
+}
+
+// Check that cancelling the context cancels a scan in progress if Dyn
+// implements DynContextScanner.
+func TestFetcherRunContextScan(t *testing.T) {
+	f := &Fetcher{
+		Dyn:         new(ctxDynamo),
+		TableName:   "table-name",
+		MaxParallel: 1,
+		Writer:      new(testItemWriter),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := f.RunContext(ctx); err != context.DeadlineExceeded {
+		t.Error("Incorrect error", err)
+	}
+}
+
+// fakeQuerier serves a query in two pages.
+type fakeQuerier struct {
+	fakeDynamo
+	m      sync.Mutex
+	inputs []*dynamodb.QueryInput
+}
+
+func (fq *fakeQuerier) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	fq.m.Lock()
+	defer fq.m.Unlock()
+	fq.inputs = append(fq.inputs, input)
+	resp := &dynamodb.QueryOutput{
+		Items:            []map[string]*dynamodb.AttributeValue{makeIntItem("key", len(fq.inputs))},
+		Count:            aws.Int64(1),
+		ScannedCount:     aws.Int64(1),
+		ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(0.5)},
+	}
+	if len(fq.inputs) == 1 {
+		resp.LastEvaluatedKey = makeIntItem("key", 1)
+	}
+	return resp, nil
+}
+
+// Check that setting KeyConditionExpression queries the table in place of
+// scanning it, with the same accounting.
+func TestFetcherQuery(t *testing.T) {
+	fq := &fakeQuerier{fakeDynamo: fakeDynamo{
+		scan: func(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+			return nil, errors.New("unexpected scan")
+		},
+	}}
+	w := new(testItemWriter)
+	values := map[string]*dynamodb.AttributeValue{":id": {S: aws.String("abc")}}
+	f := &Fetcher{
+		Dyn:                       fq,
+		TableName:                 "table-name",
+		MaxParallel:               1,
+		ReadCapacity:              10,
+		Writer:                    w,
+		KeyConditionExpression:    "#id = :id",
+		ExpressionAttributeNames:  map[string]*string{"#id": aws.String("id")},
+		ExpressionAttributeValues: values,
+	}
+	if err := f.Run(); err != nil {
+		t.Fatal("Run failed", err)
+	}
+
+	if len(fq.inputs) != 2 {
+		t.Fatal("Incorrect number of queries", len(fq.inputs))
+	}
+	for _, input := range fq.inputs {
+		if aws.StringValue(input.KeyConditionExpression) != "#id = :id" ||
+			aws.StringValue(input.ExpressionAttributeNames["#id"]) != "id" ||
+			!reflect.DeepEqual(input.ExpressionAttributeValues, values) {
+			t.Errorf("Incorrect query input %#v", input)
+		}
+	}
+	if fq.inputs[1].ExclusiveStartKey == nil {
+		t.Error("Second query didn't continue from the first")
+	}
+	if len(w.items) != 2 {
+		t.Error("Incorrect number of items written", len(w.items))
+	}
+	stats := f.Stats()
+	if stats.ItemsRead != 2 || stats.CapacityUsed != 1 {
+		t.Errorf("Incorrect stats items=%d capacity=%.1f", stats.ItemsRead, stats.CapacityUsed)
+	}
+}
+
+// Check that a query requires a DynQuerier and a MaxParallel of 1.
+func TestFetcherQueryInvalid(t *testing.T) {
+	tests := []struct {
+		dyn      DynScanner
+		parallel int
+	}{
+		{&fakeDynamo{}, 1},
+		{&fakeQuerier{}, 2},
+	}
+	for i, test := range tests {
+		f := &Fetcher{
+			Dyn:                    test.dyn,
+			TableName:              "table-name",
+			MaxParallel:            test.parallel,
+			KeyConditionExpression: "id = :id",
+		}
+		if err := f.Run(); err == nil {
+			t.Errorf("%d: No error returned from Run", i)
+		}
+	}
+}
+
+// Check that segments resume from their StartKeys, skipping those that are
+// complete, and that the key for each page is passed to CheckpointWriter.
+func TestFetcherStartKeys(t *testing.T) {
+	startKey := makeIntItem("key", 21)
+	var m sync.Mutex
+	firstInputs := make(map[int64]*dynamodb.ScanInput)
+	dyn := &fakeDynamo{
+		scan: func(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+			segnum := aws.Int64Value(input.Segment)
+			m.Lock()
+			defer m.Unlock()
+			resp := &dynamodb.ScanOutput{
+				Items:            makeItems(int(segnum)*10, 1),
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+			}
+			if _, ok := firstInputs[segnum]; !ok {
+				// copy the input as the fetcher updates it for the next page
+				in := *input
+				firstInputs[segnum] = &in
+				resp.LastEvaluatedKey = makeItems(int(segnum)*10, 1)[0]
+			}
+			return resp, nil
+		},
+	}
+
+	checkpoints := make(map[int64][]map[string]*dynamodb.AttributeValue)
+	f := &Fetcher{
+		Dyn:         dyn,
+		TableName:   "table-name",
+		MaxParallel: 4,
+		Writer:      new(testItemWriter),
+		StartKeys: map[int64]map[string]*dynamodb.AttributeValue{
+			1: nil, // complete
+			2: startKey,
+		},
+		CheckpointWriter: func(segment int64, key map[string]*dynamodb.AttributeValue) {
+			m.Lock()
+			checkpoints[segment] = append(checkpoints[segment], key)
+			m.Unlock()
+		},
+	}
+	if err := f.Run(); err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+
+	if _, ok := firstInputs[1]; ok {
+		t.Error("Complete segment 1 was scanned")
+	}
+	if key := firstInputs[2].ExclusiveStartKey; !reflect.DeepEqual(key, startKey) {
+		t.Errorf("Incorrect start key for segment 2: %v", key)
+	}
+	for _, seg := range []int64{0, 3} {
+		if key := firstInputs[seg].ExclusiveStartKey; key != nil {
+			t.Errorf("Unexpected start key for segment %d: %v", seg, key)
+		}
+	}
+
+	for _, seg := range []int64{0, 2, 3} {
+		expected := []map[string]*dynamodb.AttributeValue{makeItems(int(seg)*10, 1)[0], nil}
+		if !reflect.DeepEqual(checkpoints[seg], expected) {
+			t.Errorf("Incorrect checkpoints for segment %d: %v", seg, checkpoints[seg])
+		}
+	}
+	if len(checkpoints[1]) != 0 {
+		t.Error("Unexpected checkpoints for segment 1", checkpoints[1])
+	}
+}
+
+// Check that a response without ConsumedCapacity, as returned by DynamoDB
+// Local, doesn't cause a panic and that the limit is sized from the items.
+func TestFetcherNilConsumedCapacity(t *testing.T) {
+	for _, projection := range []string{"", "key"} {
+		var limits []int64
+		dyn := &fakeDynamo{
+			scan: func(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+				limits = append(limits, aws.Int64Value(input.Limit))
+				resp := &dynamodb.ScanOutput{
+					Items:        makeItems(len(limits)*10, 2),
+					ScannedCount: aws.Int64(2),
+				}
+				if len(limits) < 3 {
+					resp.LastEvaluatedKey = resp.Items[1]
+				}
+				return resp, nil
+			},
+		}
+		f := &Fetcher{
+			Dyn:                  dyn,
+			TableName:            "table-name",
+			MaxParallel:          1,
+			ReadCapacity:         1000,
+			LimitCalcSize:        2,
+			Writer:               new(testItemWriter),
+			ProjectionExpression: projection,
+		}
+		if err := f.Run(); err != nil {
+			t.Fatalf("projection=%q unexpected error from Run: %v", projection, err)
+		}
+		stats := f.Stats()
+		if stats.ItemsRead != 6 || stats.CapacityUsed != 0 {
+			t.Errorf("projection=%q incorrect stats %#v", projection, stats)
+		}
+		if len(limits) != 3 || limits[2] <= int64(f.initialLimit()) {
+			t.Errorf("projection=%q limit not sized from items: %v", projection, limits)
+		}
+	}
+}
+
+// Check that a response holding ConsumedCapacity without CapacityUnits set,
+// as returned by some DynamoDB compatible endpoints, is treated as if no
+// capacity was reported.
+func TestFetcherNilCapacityUnits(t *testing.T) {
+	var calls int
+	dyn := &fakeDynamo{
+		scan: func(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+			calls++
+			resp := &dynamodb.ScanOutput{
+				Items:            makeItems(calls*10, 2),
+				ScannedCount:     aws.Int64(2),
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{TableName: aws.String("table-name")},
+			}
+			if calls < 2 {
+				resp.LastEvaluatedKey = resp.Items[1]
+			}
+			return resp, nil
+		},
+	}
+	f := &Fetcher{
+		Dyn:                  dyn,
+		TableName:            "table-name",
+		MaxParallel:          1,
+		ReadCapacity:         1000,
+		Writer:               new(testItemWriter),
+		ProjectionExpression: "key",
+	}
+	if err := f.Run(); err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+	if stats := f.Stats(); stats.ItemsRead != 4 || stats.CapacityUsed != 0 {
+		t.Errorf("Incorrect stats %#v", stats)
+	}
+}
+
 type fakeDynamo struct {
 	scan func(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error)
 }
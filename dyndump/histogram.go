@@ -0,0 +1,53 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// NumSizeBuckets is the number of buckets held by a SizeHistogram.
+const NumSizeBuckets = 6
+
+// sizeBucketBounds holds the exclusive upper bound of each bucket but the
+// last, which holds all larger items.
+var sizeBucketBounds = [NumSizeBuckets - 1]int{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10}
+
+// SizeHistogram counts items by their size using fixed, log scale buckets
+// of <1K, 1K-4K, 4K-16K, 16K-64K, 64K-256K and 256K or more.
+type SizeHistogram [NumSizeBuckets]int64
+
+// add counts an item of the given size.  It is safe to call from
+// concurrent goroutines.
+func (h *SizeHistogram) add(size int) {
+	i := 0
+	for i < len(sizeBucketBounds) && size >= sizeBucketBounds[i] {
+		i++
+	}
+	atomic.AddInt64(&h[i], 1)
+}
+
+// load returns a copy of the histogram that is safe to call while items
+// are being added.
+func (h *SizeHistogram) load() (result SizeHistogram) {
+	for i := range h {
+		result[i] = atomic.LoadInt64(&h[i])
+	}
+	return result
+}
+
+// SizeBucketLabel returns a label describing the range of sizes counted by
+// the i'th bucket, eg. "1K-4K".
+func SizeBucketLabel(i int) string {
+	kib := func(n int) string { return fmt.Sprintf("%dK", n>>10) }
+	switch {
+	case i == 0:
+		return "<" + kib(sizeBucketBounds[0])
+	case i < len(sizeBucketBounds):
+		return kib(sizeBucketBounds[i-1]) + "-" + kib(sizeBucketBounds[i])
+	}
+	return kib(sizeBucketBounds[len(sizeBucketBounds)-1]) + "+"
+}
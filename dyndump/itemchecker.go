@@ -0,0 +1,197 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// DynGetter defines the portion of the DynamoDB service that ItemChecker
+// requires.
+type DynGetter interface {
+	GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+}
+
+// ItemMismatch describes an item that ItemChecker found to be missing from
+// the table, or that held different attributes to those expected.
+type ItemMismatch struct {
+	Key      map[string]*dynamodb.AttributeValue // The primary key of the item
+	Expected map[string]*dynamodb.AttributeValue // The item that should have been in the table
+	Actual   map[string]*dynamodb.AttributeValue // The item read from the table, or nil if it doesn't exist
+	Attrs    []string                            // The names of the attributes that differ, in order
+}
+
+func (m *ItemMismatch) Error() string {
+	var keys []string
+	for name := range m.Key {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	for i, name := range keys {
+		keys[i] = fmt.Sprintf("%s=%q", name, fmtKeyValue(m.Key[name]))
+	}
+	if m.Actual == nil {
+		return fmt.Sprintf("item %s is missing from the table", strings.Join(keys, " "))
+	}
+	return fmt.Sprintf("item %s differs from the table's in attributes %s",
+		strings.Join(keys, " "), strings.Join(m.Attrs, ", "))
+}
+
+// ItemChecker checks that items, such as a sample of those loaded by a
+// Loader, are held in a DynamoDB table, fetching each with GetItem by its
+// primary key and comparing their attributes.
+//
+// Attributes are compared by value rather than by their representation, so
+// numbers that differ only in their formatting, such as 1.50 and 1.5, and
+// sets holding the same members in a different order are equal.
+type ItemChecker struct {
+	Dyn            DynGetter
+	TableName      string
+	HashKey        string // The attribute name of the table's hash key
+	RangeKey       string // The attribute name of the table's range key, if it has one
+	ConsistentRead bool   // Set to true to read the items with strongly consistent reads
+}
+
+// Check fetches each of the items from the table, returning those that
+// are missing or differ.  An error is returned if an item lacks a key
+// attribute or a request fails.
+func (c *ItemChecker) Check(items []map[string]*dynamodb.AttributeValue) ([]*ItemMismatch, error) {
+	var mismatches []*ItemMismatch
+	for _, item := range items {
+		key := make(map[string]*dynamodb.AttributeValue)
+		for _, name := range []string{c.HashKey, c.RangeKey} {
+			if name == "" {
+				continue
+			}
+			av, ok := item[name]
+			if !ok {
+				return nil, fmt.Errorf("item has no value for key attribute %q", name)
+			}
+			key[name] = av
+		}
+
+		resp, err := c.Dyn.GetItem(&dynamodb.GetItemInput{
+			TableName:      aws.String(c.TableName),
+			Key:            key,
+			ConsistentRead: aws.Bool(c.ConsistentRead),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("read from DynamoDB failed: %s", err)
+		}
+
+		m := &ItemMismatch{Key: key, Expected: item, Actual: resp.Item}
+		if m.Actual != nil {
+			m.Attrs = diffItems(item, m.Actual)
+			if len(m.Attrs) == 0 {
+				continue
+			}
+		}
+		mismatches = append(mismatches, m)
+	}
+	return mismatches, nil
+}
+
+// diffItems returns the sorted names of the attributes that differ between
+// two items, including those only held by one of them.
+func diffItems(a, b map[string]*dynamodb.AttributeValue) (names []string) {
+	for name, av := range a {
+		if !attrEqual(av, b[name]) {
+			names = append(names, name)
+		}
+	}
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// attrEqual reports whether two attributes hold the same type and value.
+func attrEqual(a, b *dynamodb.AttributeValue) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	switch {
+	case a.S != nil:
+		return b.S != nil && *a.S == *b.S
+	case a.N != nil:
+		return b.N != nil && numEqual(*a.N, *b.N)
+	case a.B != nil:
+		return b.B != nil && bytes.Equal(a.B, b.B)
+	case a.BOOL != nil:
+		return b.BOOL != nil && *a.BOOL == *b.BOOL
+	case a.NULL != nil:
+		return b.NULL != nil && *a.NULL == *b.NULL
+	case a.SS != nil:
+		return b.SS != nil && setEqual(len(a.SS), len(b.SS), func(i, j int) bool {
+			return aws.StringValue(a.SS[i]) == aws.StringValue(b.SS[j])
+		})
+	case a.NS != nil:
+		return b.NS != nil && setEqual(len(a.NS), len(b.NS), func(i, j int) bool {
+			return numEqual(aws.StringValue(a.NS[i]), aws.StringValue(b.NS[j]))
+		})
+	case a.BS != nil:
+		return b.BS != nil && setEqual(len(a.BS), len(b.BS), func(i, j int) bool {
+			return bytes.Equal(a.BS[i], b.BS[j])
+		})
+	case a.L != nil:
+		if b.L == nil || len(a.L) != len(b.L) {
+			return false
+		}
+		for i := range a.L {
+			if !attrEqual(a.L[i], b.L[i]) {
+				return false
+			}
+		}
+		return true
+	case a.M != nil:
+		return b.M != nil && len(diffItems(a.M, b.M)) == 0
+	}
+	return false
+}
+
+// numEqual reports whether two DynamoDB numbers have the same value.
+// Numbers hold up to 38 significant digits, which a 256 bit mantissa
+// represents exactly.
+func numEqual(a, b string) bool {
+	x, _, errx := big.ParseFloat(a, 10, 256, big.ToNearestEven)
+	y, _, erry := big.ParseFloat(b, 10, 256, big.ToNearestEven)
+	if errx != nil || erry != nil {
+		return a == b
+	}
+	return x.Cmp(y) == 0
+}
+
+// setEqual reports whether two sets of sizes na and nb hold the same
+// members, where eq reports whether the i'th member of the first equals
+// the j'th member of the second.
+func setEqual(na, nb int, eq func(i, j int) bool) bool {
+	if na != nb {
+		return false
+	}
+	matched := make([]bool, nb)
+	for i := 0; i < na; i++ {
+		found := false
+		for j := 0; j < nb; j++ {
+			if !matched[j] && eq(i, j) {
+				matched[j], found = true, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+type fakeDynGetter struct {
+	get func(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+}
+
+func (d *fakeDynGetter) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return d.get(input)
+}
+
+// Check that missing and differing items are reported, while items that
+// differ only in number formatting or set order are not.
+func TestItemChecker(t *testing.T) {
+	table := map[string]map[string]*dynamodb.AttributeValue{
+		"same": {
+			"id":    {S: aws.String("same")},
+			"num":   {N: aws.String("1.5")},
+			"tags":  {SS: []*string{aws.String("b"), aws.String("a")}},
+			"score": {NS: []*string{aws.String("10"), aws.String("2")}},
+			"doc": {M: map[string]*dynamodb.AttributeValue{
+				"list": {L: []*dynamodb.AttributeValue{{BOOL: aws.Bool(true)}, {NULL: aws.Bool(true)}}},
+			}},
+		},
+		"changed": {
+			"id":    {S: aws.String("changed")},
+			"num":   {S: aws.String("1")},
+			"extra": {S: aws.String("x")},
+			"list":  {L: []*dynamodb.AttributeValue{{N: aws.String("2")}, {N: aws.String("1")}}},
+		},
+	}
+	dyn := &fakeDynGetter{
+		get: func(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+			if aws.StringValue(input.TableName) != "table-name" {
+				return nil, errors.New("incorrect table name")
+			}
+			if !aws.BoolValue(input.ConsistentRead) {
+				t.Error("ConsistentRead was false")
+			}
+			if len(input.Key) != 1 {
+				t.Errorf("Incorrect key %v", input.Key)
+			}
+			return &dynamodb.GetItemOutput{Item: table[aws.StringValue(input.Key["id"].S)]}, nil
+		},
+	}
+
+	items := []map[string]*dynamodb.AttributeValue{
+		{
+			"id":    {S: aws.String("same")},
+			"num":   {N: aws.String("1.50")},
+			"tags":  {SS: []*string{aws.String("a"), aws.String("b")}},
+			"score": {NS: []*string{aws.String("2.0"), aws.String("1e1")}},
+			"doc": {M: map[string]*dynamodb.AttributeValue{
+				"list": {L: []*dynamodb.AttributeValue{{BOOL: aws.Bool(true)}, {NULL: aws.Bool(true)}}},
+			}},
+		},
+		{
+			"id":   {S: aws.String("changed")},
+			"num":  {N: aws.String("1")},
+			"list": {L: []*dynamodb.AttributeValue{{N: aws.String("1")}, {N: aws.String("2")}}},
+		},
+		{
+			"id": {S: aws.String("missing")},
+		},
+	}
+
+	c := &ItemChecker{Dyn: dyn, TableName: "table-name", HashKey: "id", ConsistentRead: true}
+	mismatches, err := c.Check(items)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(mismatches) != 2 {
+		t.Fatalf("Incorrect mismatch count %d", len(mismatches))
+	}
+
+	if attrs := mismatches[0].Attrs; !reflect.DeepEqual(attrs, []string{"extra", "list", "num"}) {
+		t.Errorf("Incorrect attributes %v", attrs)
+	}
+	if msg := mismatches[0].Error(); !strings.Contains(msg, `id="changed"`) || !strings.Contains(msg, "extra, list, num") {
+		t.Errorf("Incorrect message %q", msg)
+	}
+	if mismatches[1].Actual != nil {
+		t.Error("Missing item has a value")
+	}
+	if msg := mismatches[1].Error(); !strings.Contains(msg, `id="missing"`) || !strings.Contains(msg, "missing") {
+		t.Errorf("Incorrect message %q", msg)
+	}
+}
+
+// Check that an item lacking a key attribute, and a failed request, return
+// an error.
+func TestItemCheckerErrors(t *testing.T) {
+	dyn := &fakeDynGetter{
+		get: func(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+			return nil, errors.New("request failed")
+		},
+	}
+	c := &ItemChecker{Dyn: dyn, TableName: "table-name", HashKey: "id", RangeKey: "sort"}
+
+	_, err := c.Check([]map[string]*dynamodb.AttributeValue{{"id": {S: aws.String("a")}}})
+	if err == nil || !strings.Contains(err.Error(), `"sort"`) {
+		t.Error("Incorrect error", err)
+	}
+
+	_, err = c.Check([]map[string]*dynamodb.AttributeValue{{
+		"id":   {S: aws.String("a")},
+		"sort": {N: aws.String("1")},
+	}})
+	if err == nil || !strings.Contains(err.Error(), "request failed") {
+		t.Error("Incorrect error", err)
+	}
+}
@@ -5,13 +5,26 @@
 package dyndump
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
 	"sync"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 )
 
+// SequenceKey is the attribute name used to annotate each item with its
+// sequence number when SimpleEncoder.Sequence is enabled.  Loader removes
+// it from items before writing them to DynamoDB.
+const SequenceKey = "__seq"
+
 // attributeValue is a copy of dynamodb.AttributeValue with some json
 // tags added to avoid encoding omitted entries when writing out the dump.
 type attributeValue struct {
@@ -48,7 +61,16 @@ type attributeValue struct {
 	SS []*string `json:",omitempty"`
 }
 
-func toAttribute(src *dynamodb.AttributeValue) (dst *attributeValue) {
+// toAttribute converts src to an attributeValue, returning an error naming
+// the attribute if it, or any value nested within it, has no type set.
+func toAttribute(name string, src *dynamodb.AttributeValue) (dst *attributeValue, err error) {
+	if src == nil {
+		return nil, fmt.Errorf("attribute %q has no value", name)
+	}
+	if src.B == nil && src.BOOL == nil && src.BS == nil && src.L == nil && src.M == nil &&
+		src.N == nil && src.NS == nil && src.NULL == nil && src.S == nil && src.SS == nil {
+		return nil, fmt.Errorf("attribute %q has no handled type", name)
+	}
 	dst = &attributeValue{
 		B:    src.B,
 		BOOL: src.BOOL,
@@ -62,59 +84,585 @@ func toAttribute(src *dynamodb.AttributeValue) (dst *attributeValue) {
 	if src.L != nil {
 		dst.L = make([]*attributeValue, len(src.L))
 		for i := range src.L {
-			dst.L[i] = toAttribute(src.L[i])
+			if dst.L[i], err = toAttribute(fmt.Sprintf("%s[%d]", name, i), src.L[i]); err != nil {
+				return nil, err
+			}
 		}
 	}
 	if src.M != nil {
 		dst.M = make(map[string]*attributeValue)
 		for k, v := range src.M {
-			dst.M[k] = toAttribute(v)
+			if dst.M[k], err = toAttribute(name+"."+k, v); err != nil {
+				return nil, err
+			}
 		}
 	}
-	return dst
+	return dst, nil
 }
 
 // SimpleEncoder implements the ItemWriter interface to convert DynamoDB
 // items to a JSON stream.
+//
+// By default each item is written as a compact JSON object on a line of
+// its own.  If Indent is set then each item is instead spread over several
+// lines with its attributes indented, which is easier to read and to diff.
+// If AsArray is set then the items are written as the elements of a single
+// JSON array, for tools that expect a JSON document rather than a stream;
+// each item is still written as it's received, and Close must be called
+// once all items have been written to end the array.  SimpleDecoder reads
+// all of these forms, but neither may be used to write to an S3Writer,
+// which requires an item per line.
+//
+// If Sequence is set then each item is written with an additional number
+// attribute named by SequenceKey holding its position in the stream,
+// starting at 1, which matches the item's line number in the output unless
+// Indent or AsArray is also set.
+//
+// NULL attributes are written explicitly as {"NULL":true} so that they're
+// restored by a load, unless OmitNulls is set, in which case they're left
+// out of the output and are missing from the restored items instead.
 type SimpleEncoder struct {
-	jw *json.Encoder
-	m  sync.Mutex
+	Sequence  bool // If true then annotate each item with its sequence number
+	OmitNulls bool // If true then omit NULL attributes, including those nested in maps
+	Indent    bool // If true then indent each item's attributes over several lines
+	AsArray   bool // If true then write the items as a JSON array, which Close ends
+
+	w      io.Writer
+	buf    bytes.Buffer
+	jw     *json.Encoder // encodes into buf
+	m      sync.Mutex
+	seq    int64
+	count  int64 // items written
+	closed bool
 }
 
 // NewSimpleEncoder creates an initializes a new SimpleEncoder.
 func NewSimpleEncoder(w io.Writer) *SimpleEncoder {
-	return &SimpleEncoder{
-		jw: json.NewEncoder(w),
-	}
+	e := &SimpleEncoder{w: w}
+	e.jw = json.NewEncoder(&e.buf)
+	return e
 }
 
 // WriteItem implemnts ItemWriter.
 func (e *SimpleEncoder) WriteItem(item map[string]*dynamodb.AttributeValue) error {
-	newItem := make(map[string]*attributeValue, len(item))
-	for k, v := range item {
-		newItem[k] = toAttribute(v)
+	newItem, err := toAttributeMap(item)
+	if err != nil {
+		return err
+	}
+	if e.OmitNulls {
+		omitNulls(newItem)
 	}
 	e.m.Lock()
-	err := e.jw.Encode(newItem)
-	e.m.Unlock()
+	defer e.m.Unlock()
+	if e.closed {
+		return errors.New("write to closed encoder")
+	}
+	if e.Sequence {
+		e.seq++
+		newItem[SequenceKey] = &attributeValue{N: aws.String(strconv.FormatInt(e.seq, 10))}
+	}
+
+	// each item is encoded, with any separator, then written in one call so
+	// that a failed write doesn't leave a partial item in the output
+	e.buf.Reset()
+	indent := ""
+	if e.AsArray {
+		if e.count == 0 {
+			e.buf.WriteString("[\n")
+		} else {
+			e.buf.WriteString(",\n")
+		}
+		if e.Indent {
+			indent = "  " // nest the items within the array
+			e.buf.WriteString(indent)
+		}
+	}
+	if e.Indent {
+		e.jw.SetIndent(indent, "  ")
+	}
+	if err := e.jw.Encode(newItem); err != nil {
+		return err
+	}
+	data := e.buf.Bytes()
+	if e.AsArray {
+		// the separator ends the line, so that the last item is followed
+		// by the closing bracket rather than a comma
+		data = data[:len(data)-1]
+	}
+	if _, err := e.w.Write(data); err != nil {
+		return err
+	}
+	e.count++
+	return nil
+}
+
+// Close ends the array if AsArray is set, writing an empty array if no items
+// were written.  It does nothing otherwise.  Close doesn't close the
+// underlying writer.
+func (e *SimpleEncoder) Close() error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if e.closed || !e.AsArray {
+		e.closed = true
+		return nil
+	}
+	e.closed = true
+	end := "\n]\n"
+	if e.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(e.w, end)
 	return err
 }
 
+// DefaultEncoderFlushSize is the number of bytes a BufferedEncoder buffer
+// holds before it's written out, if FlushSize isn't set.
+const DefaultEncoderFlushSize = 64 * 1024
+
+// BufferedEncoder implements the ItemWriter interface to convert DynamoDB
+// items to a JSON stream, as SimpleEncoder does, for writers called from
+// many goroutines at once such as a Fetcher with a high MaxParallel.
+//
+// SimpleEncoder holds its lock while each item is encoded and written, so
+// its callers take turns.  BufferedEncoder instead has a fixed number of
+// buffers; each call to WriteItem takes a free buffer and encodes the item
+// into it without holding a lock, and only a buffer that has reached
+// FlushSize is written to the underlying writer, which is serialized.
+//
+// Each buffer holds complete lines, so the output is a valid JSON stream,
+// however items written concurrently may be output in a different order to
+// that in which WriteItem returned, and output lags behind the items
+// written by up to FlushSize bytes per buffer.  Flush must be called once
+// all items have been written to write out the remaining buffered data.
+// Items can't be annotated with their sequence number, as their position
+// in the output isn't known when they're encoded.
+type BufferedEncoder struct {
+	OmitNulls bool // If true then omit NULL attributes, including those nested in maps
+	FlushSize int  // Bytes to buffer before writing out; defaults to DefaultEncoderFlushSize
+
+	w    io.Writer
+	m    sync.Mutex // serializes writes to w
+	err  error      // first write error, returned by all later writes
+	bufs chan *encodeBuffer
+}
+
+type encodeBuffer struct {
+	bytes.Buffer
+	jw *json.Encoder
+}
+
+// NewBufferedEncoder creates a BufferedEncoder with the given number of
+// buffers, which should usually match the number of goroutines that call
+// WriteItem.
+func NewBufferedEncoder(w io.Writer, buffers int) *BufferedEncoder {
+	if buffers < 1 {
+		buffers = 1
+	}
+	e := &BufferedEncoder{
+		w:    w,
+		bufs: make(chan *encodeBuffer, buffers),
+	}
+	for i := 0; i < buffers; i++ {
+		b := new(encodeBuffer)
+		b.jw = json.NewEncoder(&b.Buffer)
+		e.bufs <- b
+	}
+	return e
+}
+
+// WriteItem implements ItemWriter.
+func (e *BufferedEncoder) WriteItem(item map[string]*dynamodb.AttributeValue) error {
+	newItem, err := toAttributeMap(item)
+	if err != nil {
+		return err
+	}
+	if e.OmitNulls {
+		omitNulls(newItem)
+	}
+	b := <-e.bufs
+	defer func() { e.bufs <- b }()
+	if err := b.jw.Encode(newItem); err != nil {
+		return err
+	}
+	if b.Len() < e.flushSize() {
+		return nil
+	}
+	return e.write(b)
+}
+
+// Flush writes out any data held in the encoder's buffers.  It must not be
+// called concurrently with WriteItem.
+func (e *BufferedEncoder) Flush() error {
+	for i := 0; i < cap(e.bufs); i++ {
+		b := <-e.bufs
+		err := e.write(b)
+		e.bufs <- b
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write copies a buffer to the underlying writer and resets it.
+func (e *BufferedEncoder) write(b *encodeBuffer) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if e.err == nil && b.Len() > 0 {
+		_, e.err = e.w.Write(b.Bytes())
+	}
+	b.Reset()
+	return e.err
+}
+
+func (e *BufferedEncoder) flushSize() int {
+	if e.FlushSize > 0 {
+		return e.FlushSize
+	}
+	return DefaultEncoderFlushSize
+}
+
 // SimpleDecoder implements the ItemReader interface to convert JSON entries
 // to DynamoDB attributes items.
+//
+// It reads a stream of JSON objects, one per item, whether or not they're
+// indented, or a single JSON array of items as written by SimpleEncoder with
+// AsArray set.
+//
+// If the stream ends part way through an item, or before the end of an
+// array, ReadItem returns a TruncatedError recording the number of items
+// read.  If ExpectedItems is set, such as from the ItemCount recorded in a
+// backup's metadata, the error also records whether items were missing,
+// and a stream that ends cleanly before that many items have been read is
+// also reported as truncated.
 type SimpleDecoder struct {
-	jd *json.Decoder
+	ExpectedItems int64 // Number of items the stream should hold, if known
+
+	br      *bufio.Reader
+	jd      *json.Decoder
+	started bool
+	inArray bool  // set while reading the elements of an array
+	ended   bool  // set once the end of an array has been read
+	items   int64 // items read
+}
+
+// TruncatedError is returned by SimpleDecoder when its stream ends part way
+// through an item, such as when a backup file was only partly copied.
+type TruncatedError struct {
+	Items    int64 // The number of complete items read
+	Expected int64 // The number of items the stream should have held, or 0 if unknown
+}
+
+func (e *TruncatedError) Error() string {
+	switch {
+	case e.Expected == 0:
+		return fmt.Sprintf("source appears truncated after %d items", e.Items)
+	case e.Items < e.Expected:
+		return fmt.Sprintf("source appears truncated after %d of %d items", e.Items, e.Expected)
+	}
+	return fmt.Sprintf("source ended part way through an item after all %d items expected were read", e.Items)
 }
 
 // NewSimpleDecoder creates and initializes a new SimpleDeocder.
 func NewSimpleDecoder(r io.Reader) *SimpleDecoder {
+	br := bufio.NewReader(r)
 	return &SimpleDecoder{
-		jd: json.NewDecoder(r),
+		br: br,
+		jd: json.NewDecoder(br),
 	}
 }
 
 // ReadItem implements ItemReader.
 func (d *SimpleDecoder) ReadItem() (item map[string]*dynamodb.AttributeValue, err error) {
-	err = d.jd.Decode(&item)
+	if !d.started {
+		d.started = true
+		if err := d.start(); err != nil {
+			return nil, err
+		}
+	}
+	if d.ended {
+		return nil, d.endError()
+	}
+	if d.inArray {
+		// the decoder reports an array that ends between its elements as a
+		// syntax error, so check for the end of the stream first
+		if eof, err := d.atEOF(); err != nil {
+			return nil, err
+		} else if eof {
+			return nil, d.truncated()
+		}
+		if !d.jd.More() {
+			// read the closing bracket
+			if _, err := d.jd.Token(); err != nil {
+				return nil, err
+			}
+			d.ended = true
+			return nil, d.endError()
+		}
+	}
+	if err := d.jd.Decode(&item); err != nil {
+		switch {
+		case err == io.EOF && !d.inArray:
+			err = d.endError()
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			err = d.truncated()
+		}
+		return nil, err
+	}
+	d.items++
+	return item, nil
+}
+
+// truncated returns the error reporting that the stream ended part way
+// through.
+func (d *SimpleDecoder) truncated() error {
+	return &TruncatedError{Items: d.items, Expected: d.ExpectedItems}
+}
+
+// endError returns the error for the end of the items, which is io.EOF
+// unless fewer items were read than expected.
+func (d *SimpleDecoder) endError() error {
+	if d.items < d.ExpectedItems {
+		return d.truncated()
+	}
+	return io.EOF
+}
+
+// atEOF reports whether nothing but whitespace, and the comma that
+// separates array elements, remains to be read from the stream.
+func (d *SimpleDecoder) atEOF() (bool, error) {
+	rest, err := ioutil.ReadAll(d.jd.Buffered())
+	if err != nil {
+		return false, err
+	}
+	rest = bytes.TrimLeft(rest, jsonSpace)
+	rest = bytes.TrimLeft(bytes.TrimPrefix(rest, []byte(",")), jsonSpace)
+	if len(rest) > 0 {
+		return false, nil
+	}
+	for {
+		c, err := d.br.ReadByte()
+		if err == io.EOF {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		if strings.IndexByte(jsonSpace, c) < 0 {
+			d.br.UnreadByte()
+			return false, nil
+		}
+	}
+}
+
+// jsonSpace holds the whitespace characters allowed between JSON values.
+const jsonSpace = " \t\r\n"
+
+// start checks whether the stream holds an array of items, reading its
+// opening bracket if so.
+func (d *SimpleDecoder) start() error {
+	for {
+		c, err := d.br.ReadByte()
+		if err == io.EOF {
+			return nil // leave Decode to report the end of the stream
+		} else if err != nil {
+			return err
+		}
+		if strings.IndexByte(jsonSpace, c) >= 0 {
+			continue
+		}
+		d.br.UnreadByte()
+		if c != '[' {
+			return nil
+		}
+		d.inArray = true
+		_, err = d.jd.Token()
+		return err
+	}
+}
+
+// ItemCondition holds a condition expression to be applied by Loader when
+// writing an item, such as a check on a version attribute.
+type ItemCondition struct {
+	Expression string                              `json:"expression"` // The condition expression
+	Names      map[string]*string                  `json:"names"`      // Substitution tokens for attribute names used in Expression
+	Values     map[string]*dynamodb.AttributeValue `json:"values"`     // Substitution tokens for attribute values used in Expression
+}
+
+// conditionEnvelope is the JSON representation of an item and its condition.
+type conditionEnvelope struct {
+	Item      map[string]*attributeValue `json:"item"`
+	Condition *conditionJSON             `json:"condition,omitempty"`
+	Error     string                     `json:"error,omitempty"` // set by DeadLetterEncoder
+}
+
+type conditionJSON struct {
+	Expression string                     `json:"expression"`
+	Names      map[string]*string         `json:"names,omitempty"`
+	Values     map[string]*attributeValue `json:"values,omitempty"`
+}
+
+// EnvelopeEncoder implements the ItemWriter interface to convert DynamoDB
+// items to a JSON stream where each item is wrapped in an envelope that may
+// also carry a condition to be applied when the item is loaded.  Eg
+//
+//	{"item": {...}, "condition": {"expression": "...", "names": {...}, "values": {...}}}
+//
+// The condition for each item is returned by the Condition function; if
+// it's nil, or returns nil, then the envelope holds the item alone.
+type EnvelopeEncoder struct {
+	Condition func(item map[string]*dynamodb.AttributeValue) *ItemCondition
+
+	jw *json.Encoder
+	m  sync.Mutex
+}
+
+// NewEnvelopeEncoder creates and initializes a new EnvelopeEncoder.
+func NewEnvelopeEncoder(w io.Writer) *EnvelopeEncoder {
+	jw := json.NewEncoder(w)
+	jw.SetEscapeHTML(false) // keep condition expressions readable
+	return &EnvelopeEncoder{
+		jw: jw,
+	}
+}
+
+// WriteItem implements ItemWriter.
+func (e *EnvelopeEncoder) WriteItem(item map[string]*dynamodb.AttributeValue) error {
+	newItem, err := toAttributeMap(item)
+	if err != nil {
+		return err
+	}
+	env := conditionEnvelope{Item: newItem}
+	if e.Condition != nil {
+		if env.Condition, err = toConditionJSON(e.Condition(item)); err != nil {
+			return err
+		}
+	}
+	e.m.Lock()
+	defer e.m.Unlock()
+	return e.jw.Encode(env)
+}
+
+// DeadLetterEncoder implements the FailedItemWriter interface to record the
+// items a Loader failed to write as a JSON stream of envelopes, each holding
+// an item, its condition, if any, and the error that caused it to fail.  Eg
+//
+//	{"item": {...}, "error": "..."}
+//
+// Once the cause of the failures has been fixed, the stream may be loaded
+// again using an EnvelopeDecoder, which ignores the error.
+type DeadLetterEncoder struct {
+	jw *json.Encoder
+	m  sync.Mutex
+}
+
+// NewDeadLetterEncoder creates and initializes a new DeadLetterEncoder.
+func NewDeadLetterEncoder(w io.Writer) *DeadLetterEncoder {
+	jw := json.NewEncoder(w)
+	jw.SetEscapeHTML(false)
+	return &DeadLetterEncoder{
+		jw: jw,
+	}
+}
+
+// WriteFailedItem implements FailedItemWriter.
+func (e *DeadLetterEncoder) WriteFailedItem(item map[string]*dynamodb.AttributeValue, cond *ItemCondition, err error) error {
+	newItem, merr := toAttributeMap(item)
+	if merr != nil {
+		return merr
+	}
+	env := conditionEnvelope{Item: newItem, Error: err.Error()}
+	if env.Condition, merr = toConditionJSON(cond); merr != nil {
+		return merr
+	}
+	e.m.Lock()
+	defer e.m.Unlock()
+	return e.jw.Encode(env)
+}
+
+// EnvelopeDecoder implements the ConditionalItemReader interface to read
+// items and their conditions from the JSON stream written by EnvelopeEncoder.
+type EnvelopeDecoder struct {
+	jd *json.Decoder
+}
+
+// NewEnvelopeDecoder creates and initializes a new EnvelopeDecoder.
+func NewEnvelopeDecoder(r io.Reader) *EnvelopeDecoder {
+	return &EnvelopeDecoder{
+		jd: json.NewDecoder(r),
+	}
+}
+
+// ReadItem implements ItemReader, discarding the item's condition.
+func (d *EnvelopeDecoder) ReadItem() (item map[string]*dynamodb.AttributeValue, err error) {
+	item, _, err = d.ReadConditionalItem()
 	return item, err
 }
+
+// ReadConditionalItem implements ConditionalItemReader.
+func (d *EnvelopeDecoder) ReadConditionalItem() (item map[string]*dynamodb.AttributeValue, cond *ItemCondition, err error) {
+	var env struct {
+		Item      map[string]*dynamodb.AttributeValue `json:"item"`
+		Condition *ItemCondition                      `json:"condition"`
+	}
+	if err := d.jd.Decode(&env); err != nil {
+		return nil, nil, err
+	}
+	if env.Item == nil {
+		return nil, nil, errors.New("envelope has no item")
+	}
+	if env.Condition != nil && env.Condition.Expression == "" {
+		return nil, nil, errors.New("envelope condition has no expression")
+	}
+	return env.Item, env.Condition, nil
+}
+
+// toConditionJSON converts cond to its JSON representation, returning nil
+// if cond is nil.
+func toConditionJSON(cond *ItemCondition) (*conditionJSON, error) {
+	if cond == nil {
+		return nil, nil
+	}
+	values, err := toAttributeMap(cond.Values)
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition: %v", err)
+	}
+	return &conditionJSON{
+		Expression: cond.Expression,
+		Names:      cond.Names,
+		Values:     values,
+	}, nil
+}
+
+// omitNulls removes NULL attributes from item, including those nested
+// within maps.  NULL list elements are kept so the remaining elements keep
+// their positions.
+func omitNulls(item map[string]*attributeValue) {
+	for k, v := range item {
+		if v.NULL != nil {
+			delete(item, k)
+			continue
+		}
+		omitNestedNulls(v)
+	}
+}
+
+func omitNestedNulls(v *attributeValue) {
+	if v.M != nil {
+		omitNulls(v.M)
+	}
+	for _, el := range v.L {
+		omitNestedNulls(el)
+	}
+}
+
+func toAttributeMap(item map[string]*dynamodb.AttributeValue) (map[string]*attributeValue, error) {
+	newItem := make(map[string]*attributeValue, len(item))
+	for k, v := range item {
+		av, err := toAttribute(k, v)
+		if err != nil {
+			return nil, err
+		}
+		newItem[k] = av
+	}
+	return newItem, nil
+}
@@ -6,8 +6,16 @@ package dyndump
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -51,6 +59,21 @@ func TestSimpleEncoder(t *testing.T) {
 	}
 }
 
+func TestSimpleEncoderSequence(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewSimpleEncoder(&buf)
+	enc.Sequence = true
+	for i := 0; i < 2; i++ {
+		if err := enc.WriteItem(makeIntItem("k", i)); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+	}
+	expected := `{"__seq":{"N":"1"},"k":{"N":"0"}}` + "\n" + `{"__seq":{"N":"2"},"k":{"N":"1"}}` + "\n"
+	if val := buf.String(); val != expected {
+		t.Errorf("expected=%s actual=%s", expected, val)
+	}
+}
+
 func TestSimpleDecoder(t *testing.T) {
 	buf := strings.NewReader(`{"k":{"S":"foo"}}`)
 	dec := NewSimpleDecoder(buf)
@@ -66,3 +89,499 @@ func TestSimpleDecoder(t *testing.T) {
 		t.Errorf("expected=%#v actual=%#v", expected, item)
 	}
 }
+
+// Check the output of each combination of the Indent and AsArray options.
+func TestSimpleEncoderFormats(t *testing.T) {
+	tests := []struct {
+		name            string
+		indent, asArray bool
+		items           int
+		expected        string
+	}{
+		{"plain", false, false, 2, `{"k":{"N":"0"}}` + "\n" + `{"k":{"N":"1"}}` + "\n"},
+		{"indent", true, false, 1, "{\n  \"k\": {\n    \"N\": \"0\"\n  }\n}\n"},
+		{"array", false, true, 2, "[\n" + `{"k":{"N":"0"}},` + "\n" + `{"k":{"N":"1"}}` + "\n]\n"},
+		{"array-empty", false, true, 0, "[]\n"},
+		{"array-indent", true, true, 2, "[\n  {\n    \"k\": {\n      \"N\": \"0\"\n    }\n  },\n" +
+			"  {\n    \"k\": {\n      \"N\": \"1\"\n    }\n  }\n]\n"},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		enc := NewSimpleEncoder(&buf)
+		enc.Indent, enc.AsArray = test.indent, test.asArray
+		for i := 0; i < test.items; i++ {
+			if err := enc.WriteItem(makeIntItem("k", i)); err != nil {
+				t.Fatalf("test=%q unexpected error %v", test.name, err)
+			}
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatalf("test=%q unexpected error from Close %v", test.name, err)
+		}
+		if val := buf.String(); val != test.expected {
+			t.Errorf("test=%q expected=%q actual=%q", test.name, test.expected, val)
+		}
+		if err := enc.WriteItem(makeIntItem("k", 0)); err == nil {
+			t.Errorf("test=%q no error writing to a closed encoder", test.name)
+		}
+	}
+}
+
+// Check that an array is written as each item is received, rather than
+// once it has been closed.
+func TestSimpleEncoderArrayStreams(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewSimpleEncoder(&buf)
+	enc.AsArray = true
+	if err := enc.WriteItem(makeIntItem("k", 0)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if expected := "[\n" + `{"k":{"N":"0"}}`; buf.String() != expected {
+		t.Errorf("expected=%q actual=%q", expected, buf.String())
+	}
+}
+
+// Check that SimpleDecoder reads the items written in each of SimpleEncoder's
+// formats.
+func TestSimpleEncoderDecoderRoundTrip(t *testing.T) {
+	items := makeItems(0, 5)
+	items[2]["nested"] = &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{
+		{S: aws.String("str")},
+		{M: map[string]*dynamodb.AttributeValue{"a": {BOOL: aws.Bool(true)}}},
+	}}
+
+	for _, indent := range []bool{false, true} {
+		for _, asArray := range []bool{false, true} {
+			for _, count := range []int{0, len(items)} {
+				var buf bytes.Buffer
+				enc := NewSimpleEncoder(&buf)
+				enc.Indent, enc.AsArray = indent, asArray
+				for _, item := range items[:count] {
+					if err := enc.WriteItem(item); err != nil {
+						t.Fatal("Unexpected error", err)
+					}
+				}
+				enc.Close()
+
+				var read []map[string]*dynamodb.AttributeValue
+				dec := NewSimpleDecoder(&buf)
+				for {
+					item, err := dec.ReadItem()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatalf("indent=%t array=%t count=%d unexpected error %v", indent, asArray, count, err)
+					}
+					read = append(read, item)
+				}
+				if !reflect.DeepEqual(read, items[:count]) && !(count == 0 && len(read) == 0) {
+					t.Errorf("indent=%t array=%t count=%d items read don't match those written", indent, asArray, count)
+				}
+			}
+		}
+	}
+}
+
+// Check that a stream ending part way through an item, or an array missing
+// its closing bracket, is reported as truncated after the items read.
+func TestSimpleDecoderTruncated(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected int64
+		msg      string
+	}{
+		{"item", `{"k":{"N":"0"}}` + "\n" + `{"k":{"N":"1"}}` + "\n" + `{"k":{"N"`, 0,
+			"source appears truncated after 2 items"},
+		{"item-expected", `{"k":{"N":"0"}}` + "\n" + `{"k":`, 5,
+			"source appears truncated after 1 of 5 items"},
+		{"item-extra", `{"k":{"N":"0"}}` + "\n" + `{"k":`, 1,
+			"source ended part way through an item after all 1 items expected were read"},
+		{"array-item", "[\n" + `{"k":{"N":"0"}},` + "\n" + `{"k":{`, 0,
+			"source appears truncated after 1 items"},
+		{"array-end", "[\n" + `{"k":{"N":"0"}},` + "\n" + `{"k":{"N":"1"}}`, 3,
+			"source appears truncated after 2 of 3 items"},
+		{"array-comma", "[\n" + `{"k":{"N":"0"}},`, 0,
+			"source appears truncated after 1 items"},
+		{"array-open", "[\n", 0,
+			"source appears truncated after 0 items"},
+		{"clean-end", `{"k":{"N":"0"}}` + "\n" + `{"k":{"N":"1"}}` + "\n", 3,
+			"source appears truncated after 2 of 3 items"},
+		{"clean-empty", "", 1,
+			"source appears truncated after 0 of 1 items"},
+	}
+
+	for _, test := range tests {
+		dec := NewSimpleDecoder(strings.NewReader(test.data))
+		dec.ExpectedItems = test.expected
+		var err error
+		for err == nil {
+			_, err = dec.ReadItem()
+		}
+		if _, ok := err.(*TruncatedError); !ok {
+			t.Errorf("test=%q incorrect error %#v", test.name, err)
+		} else if err.Error() != test.msg {
+			t.Errorf("test=%q expected=%q actual=%q", test.name, test.msg, err.Error())
+		}
+	}
+}
+
+// Check that a complete stream ends with io.EOF and that invalid JSON is
+// not reported as truncation.
+func TestSimpleDecoderNotTruncated(t *testing.T) {
+	for _, data := range []string{"", "\n", `{"k":{"N":"0"}}` + "\n", "[]", "[\n" + `{"k":{"N":"0"}}` + "\n]\n"} {
+		dec := NewSimpleDecoder(strings.NewReader(data))
+		var err error
+		for err == nil {
+			_, err = dec.ReadItem()
+		}
+		if err != io.EOF {
+			t.Errorf("data=%q incorrect error %v", data, err)
+		}
+	}
+
+	dec := NewSimpleDecoder(strings.NewReader(`{"k":{"N":"0"}}` + "\n" + `{"k":{"N":"1"}}` + "\n"))
+	dec.ExpectedItems = 2
+	var err error
+	for err == nil {
+		_, err = dec.ReadItem()
+	}
+	if err != io.EOF {
+		t.Error("incorrect error for the expected number of items", err)
+	}
+
+	for _, data := range []string{`{"k":{"N":"0"}}` + "\n" + `{"k":x}` + "\n", "[\n" + `{"k":{"N":"0"}} x`} {
+		dec := NewSimpleDecoder(strings.NewReader(data))
+		dec.ReadItem()
+		if _, err := dec.ReadItem(); err == nil || err == io.EOF {
+			t.Errorf("data=%q no error for invalid JSON", data)
+		} else if _, ok := err.(*TruncatedError); ok {
+			t.Errorf("data=%q invalid JSON reported as truncated: %v", data, err)
+		}
+	}
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEnvelopeEncoder(&buf)
+	enc.Condition = func(item map[string]*dynamodb.AttributeValue) *ItemCondition {
+		if aws.StringValue(item["k"].N) == "0" {
+			return nil
+		}
+		return &ItemCondition{
+			Expression: "#V < :v",
+			Names:      map[string]*string{"#V": aws.String("version")},
+			Values:     map[string]*dynamodb.AttributeValue{":v": item["k"]},
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := enc.WriteItem(makeIntItem("k", i)); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+	}
+
+	expected := `{"item":{"k":{"N":"0"}}}` + "\n" +
+		`{"item":{"k":{"N":"1"}},"condition":{"expression":"#V < :v","names":{"#V":"version"},"values":{":v":{"N":"1"}}}}` + "\n"
+	if val := buf.String(); val != expected {
+		t.Errorf("expected=%s actual=%s", expected, val)
+	}
+
+	dec := NewEnvelopeDecoder(&buf)
+	item, cond, err := dec.ReadConditionalItem()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !reflect.DeepEqual(item, makeIntItem("k", 0)) || cond != nil {
+		t.Errorf("incorrect first item=%#v cond=%#v", item, cond)
+	}
+
+	item, cond, err = dec.ReadConditionalItem()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	expectedCond := &ItemCondition{
+		Expression: "#V < :v",
+		Names:      map[string]*string{"#V": aws.String("version")},
+		Values:     map[string]*dynamodb.AttributeValue{":v": {N: aws.String("1")}},
+	}
+	if !reflect.DeepEqual(item, makeIntItem("k", 1)) || !reflect.DeepEqual(cond, expectedCond) {
+		t.Errorf("incorrect second item=%#v cond=%#v", item, cond)
+	}
+}
+
+func TestEnvelopeDecoderInvalid(t *testing.T) {
+	for _, data := range []string{`{"k":{"S":"foo"}}`, `{"item":{"k":{"S":"foo"}},"condition":{}}`} {
+		if _, _, err := NewEnvelopeDecoder(strings.NewReader(data)).ReadConditionalItem(); err == nil {
+			t.Errorf("No error returned for %s", data)
+		}
+	}
+}
+
+// nullItem holds NULL attributes at the top level and nested in a map and
+// a list.
+var nullItem = map[string]*dynamodb.AttributeValue{
+	"k":    {S: aws.String("foo")},
+	"null": {NULL: aws.Bool(true)},
+	"map": {M: map[string]*dynamodb.AttributeValue{
+		"null": {NULL: aws.Bool(true)},
+		"s":    {S: aws.String("bar")},
+	}},
+	"list": {L: []*dynamodb.AttributeValue{{NULL: aws.Bool(true)}, {S: aws.String("baz")}}},
+}
+
+// Check that NULL attributes survive a round trip through the encoder and
+// decoder unchanged by default, so a load restores them.
+func TestSimpleEncoderNulls(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewSimpleEncoder(&buf).WriteItem(nullItem); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	item, err := NewSimpleDecoder(&buf).ReadItem()
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !reflect.DeepEqual(item, nullItem) {
+		t.Errorf("expected=%v actual=%v", nullItem, item)
+	}
+}
+
+func TestSimpleEncoderOmitNulls(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewSimpleEncoder(&buf)
+	enc.OmitNulls = true
+	if err := enc.WriteItem(nullItem); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	expected := `{"k":{"S":"foo"},"list":{"L":[{"NULL":true},{"S":"baz"}]},"map":{"M":{"s":{"S":"bar"}}}}` + "\n"
+	if val := buf.String(); val != expected {
+		t.Errorf("expected=%s actual=%s", expected, val)
+	}
+	if len(nullItem["map"].M) != 2 {
+		t.Error("Source item was modified")
+	}
+}
+
+// Check that an attribute with no type set returns an error naming the
+// attribute, rather than writing a value that can't be loaded.
+func TestSimpleEncoderNoType(t *testing.T) {
+	tests := []struct {
+		name string
+		item map[string]*dynamodb.AttributeValue
+		attr string
+	}{
+		{"empty", map[string]*dynamodb.AttributeValue{"k": {}}, `"k"`},
+		{"nil", map[string]*dynamodb.AttributeValue{"k": nil}, `"k"`},
+		{"list", map[string]*dynamodb.AttributeValue{"k": {L: []*dynamodb.AttributeValue{{S: aws.String("str")}, {}}}}, `"k[1]"`},
+		{"map", map[string]*dynamodb.AttributeValue{"k": {M: map[string]*dynamodb.AttributeValue{"key1": {}}}}, `"k.key1"`},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := NewSimpleEncoder(&buf).WriteItem(test.item)
+		if err == nil || !strings.Contains(err.Error(), test.attr) {
+			t.Errorf("test=%q incorrect error %v", test.name, err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("test=%q data written %q", test.name, buf.String())
+		}
+	}
+}
+
+// Check that items written from several goroutines are each output once,
+// as a complete line, once the encoder is flushed.
+func TestBufferedEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewBufferedEncoder(&buf, 4)
+	enc.FlushSize = 500
+	enc.OmitNulls = true
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 250; i++ {
+				item := map[string]*dynamodb.AttributeValue{
+					"k":    {N: aws.String(strconv.Itoa(g*1000 + i))},
+					"null": {NULL: aws.Bool(true)},
+				}
+				if err := enc.WriteItem(item); err != nil {
+					t.Error("Unexpected error", err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if buf.Len() == 0 {
+		t.Error("No data written before flush")
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal("Flush failed", err)
+	}
+
+	var expected, actual []string
+	for g := 0; g < 8; g++ {
+		for i := 0; i < 250; i++ {
+			expected = append(expected, strconv.Itoa(g*1000+i))
+		}
+	}
+	dec := NewSimpleDecoder(&buf)
+	for {
+		item, err := dec.ReadItem()
+		if err != nil {
+			break
+		}
+		if _, ok := item["null"]; ok {
+			t.Fatal("NULL attribute not omitted")
+		}
+		actual = append(actual, aws.StringValue(item["k"].N))
+	}
+	sort.Strings(expected)
+	sort.Strings(actual)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Incorrect items written; expected %d items, got %d", len(expected), len(actual))
+	}
+}
+
+type failWriter struct{ n int }
+
+func (w *failWriter) Write(p []byte) (int, error) {
+	if w.n++; w.n > 1 {
+		return 0, errors.New("write failed")
+	}
+	return len(p), nil
+}
+
+// Check that a write error is returned by all later writes.
+func TestBufferedEncoderWriteError(t *testing.T) {
+	enc := NewBufferedEncoder(&failWriter{}, 1)
+	enc.FlushSize = 1
+	item := map[string]*dynamodb.AttributeValue{"k": {S: aws.String("foo")}}
+	if err := enc.WriteItem(item); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := enc.WriteItem(item); err == nil || err.Error() != "write failed" {
+			t.Error("Incorrect error", err)
+		}
+	}
+	if err := enc.Flush(); err == nil {
+		t.Error("Flush didn't fail")
+	}
+}
+
+// binaryItem returns an item holding a binary attribute of size bytes.
+func binaryItem(size int) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"key":  {S: aws.String("item-key")},
+		"data": {B: bytes.Repeat([]byte{0xa5}, size)},
+	}
+}
+
+// Encode binary heavy items from several goroutines, as a dump with a
+// high MaxParallel does.  encoding/json streams large []byte values through
+// a base64 encoder into a pooled buffer, so this should report a handful of
+// small allocations per item regardless of the size of the binary value;
+// pooling buffers in the encoders themselves would only add a second copy
+// of each encoded item.
+func BenchmarkSimpleEncoderBinary(b *testing.B) {
+	item := binaryItem(300 * 1024)
+	enc := NewSimpleEncoder(ioutil.Discard)
+	b.ReportAllocs()
+	b.SetBytes(300 * 1024)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := enc.WriteItem(item); err != nil {
+				b.Fatal("WriteItem failed", err)
+			}
+		}
+	})
+}
+
+// typicalItem is a small item of the kind most tables hold.
+var typicalItem = map[string]*dynamodb.AttributeValue{
+	"id":      {S: aws.String("5f0c8a64-8f3b-4b8e-9d1e-3a5c2b7e9f10")},
+	"created": {N: aws.String("1461972123")},
+	"name":    {S: aws.String("A typical item name")},
+	"tags":    {SS: []*string{aws.String("red"), aws.String("green"), aws.String("blue")}},
+	"address": {M: map[string]*dynamodb.AttributeValue{
+		"street": {S: aws.String("123 Some Street")},
+		"city":   {S: aws.String("Somewhere")},
+		"zip":    {S: aws.String("12345")},
+	}},
+	"active": {BOOL: aws.Bool(true)},
+}
+
+// Compare SimpleEncoder and BufferedEncoder writing small items to a file
+// from as many goroutines as a multi-segment dump.  Run with -cpu to vary
+// the number of cores; SimpleEncoder encodes one item at a time and makes a
+// write call for each item, while BufferedEncoder encodes on all cores and
+// writes in FlushSize chunks.
+func BenchmarkSimpleEncoderParallel(b *testing.B) {
+	f := benchmarkFile(b)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	benchmarkEncoderParallel(b, NewSimpleEncoder(f))
+}
+
+func BenchmarkBufferedEncoderParallel(b *testing.B) {
+	f := benchmarkFile(b)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	enc := NewBufferedEncoder(f, 4*runtime.GOMAXPROCS(0))
+	benchmarkEncoderParallel(b, enc)
+	if err := enc.Flush(); err != nil {
+		b.Fatal("Flush failed", err)
+	}
+}
+
+// benchmarkFile creates a temporary file for a benchmark to write to.
+func benchmarkFile(b *testing.B) *os.File {
+	f, err := ioutil.TempFile("", "dyndump-bench")
+	if err != nil {
+		b.Fatal("Failed to create file", err)
+	}
+	return f
+}
+
+func benchmarkEncoderParallel(b *testing.B, enc ItemWriter) {
+	b.ReportAllocs()
+	b.SetBytes(int64(calcItemSize(typicalItem)))
+	b.SetParallelism(4)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := enc.WriteItem(typicalItem); err != nil {
+				b.Fatal("WriteItem failed", err)
+			}
+		}
+	})
+}
+
+// Decoding necessarily allocates each binary value, along with the item
+// holding it; this reports the allocations to compare against the item size.
+func BenchmarkSimpleDecoderBinary(b *testing.B) {
+	var buf bytes.Buffer
+	if err := NewSimpleEncoder(&buf).WriteItem(binaryItem(300 * 1024)); err != nil {
+		b.Fatal("WriteItem failed", err)
+	}
+	dec := NewSimpleDecoder(&repeatReader{data: buf.Bytes()})
+	b.ReportAllocs()
+	b.SetBytes(300 * 1024)
+	for i := 0; i < b.N; i++ {
+		if _, err := dec.ReadItem(); err != nil {
+			b.Fatal("ReadItem failed", err)
+		}
+	}
+}
+
+// repeatReader returns data over and over.
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (n int, err error) {
+	n = copy(p, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// KeyNamer determines the S3 keys a backup's metadata and parts are stored
+// at, allowing a different layout to be used in place of DefaultKeyNamer.
+// The same KeyNamer must be used by the S3Writer that writes a backup and
+// the S3Reader, S3Deleter and S3Refresher that later access it.
+//
+// The md passed to PartKey and PartListPrefix is the backup's metadata.
+// Only the fields set before any part is written, such as TableName,
+// StartTime, PartPath and PartKeyWidth, may be read, as the others are
+// updated while the backup runs.
+type KeyNamer interface {
+	// MetaKey returns the key of the metadata of the backup stored at
+	// prefix.  It must end with ".json"; while a backup written with
+	// DeferMetadata is running its metadata is stored with the suffix
+	// ".inprogress.json" instead.
+	MetaKey(prefix string) string
+
+	// PartKey returns the key of the part numbered partNum, counting from
+	// 1, whose file extension for its compression is ext, eg. ".json.gz".
+	// Keys must sort in part number order.
+	PartKey(prefix string, md *Metadata, partNum int32, ext string) string
+
+	// PartListPrefix returns the prefix that's listed to find the keys of
+	// the backup's parts.  It should be shared by no other objects, unless
+	// the KeyNamer also implements PartKeyMatcher.
+	PartListPrefix(prefix string, md *Metadata) string
+}
+
+// PartKeyMatcher may optionally be implemented by a KeyNamer whose
+// PartListPrefix is shared by objects other than the backup's parts, such
+// as the parts of other backups.  S3Reader, S3Deleter and S3Refresher then
+// ignore the listed keys it doesn't match.  Otherwise every key listed is treated as
+// a part, other than the backup's metadata.
+type PartKeyMatcher interface {
+	PartKeyPattern(prefix string, md *Metadata) (*regexp.Regexp, error)
+}
+
+// DefaultKeyNamer names keys as described for S3Writer.
+type DefaultKeyNamer struct{}
+
+// MetaKey implements KeyNamer.
+func (DefaultKeyNamer) MetaKey(prefix string) string {
+	return s3MetaKey(prefix)
+}
+
+// PartKey implements KeyNamer.
+func (DefaultKeyNamer) PartKey(prefix string, md *Metadata, partNum int32, ext string) string {
+	return fmt.Sprintf("%s%0*d%s", s3PartPathPrefix(prefix, md.PartPath), md.partKeyWidth(), partNum, ext)
+}
+
+// PartListPrefix implements KeyNamer.
+func (DefaultKeyNamer) PartListPrefix(prefix string, md *Metadata) string {
+	return s3PartPathPrefix(prefix, md.PartPath)
+}
+
+// PartKeyPattern implements PartKeyMatcher, excluding the keys of other
+// backups whose prefix begins with this backup's.
+func (DefaultKeyNamer) PartKeyPattern(prefix string, md *Metadata) (*regexp.Regexp, error) {
+	return s3PartKeyRegexp(s3PartPathPrefix(prefix, md.PartPath), md.partKeyWidth())
+}
+
+// NormalizedKeyNamer names keys by appending a "-" separator to the prefix
+// only if it doesn't already end with "/" or "-", ignoring any leading
+// slashes.  A prefix of "backups/" stores its metadata at
+// "backups/meta.json" rather than the "backups/-meta.json" used by
+// DefaultKeyNamer.
+//
+// Backups written with it may only be read, refreshed or deleted by
+// passing it as their KeyNamer, and can't be read by versions of dyndump
+// without it.
+type NormalizedKeyNamer struct{}
+
+// MetaKey implements KeyNamer.
+func (NormalizedKeyNamer) MetaKey(prefix string) string {
+	return s3KeyBase(prefix) + "meta.json"
+}
+
+// PartKey implements KeyNamer.
+func (n NormalizedKeyNamer) PartKey(prefix string, md *Metadata, partNum int32, ext string) string {
+	return fmt.Sprintf("%s%0*d%s", n.PartListPrefix(prefix, md), md.partKeyWidth(), partNum, ext)
+}
+
+// PartListPrefix implements KeyNamer.
+func (NormalizedKeyNamer) PartListPrefix(prefix string, md *Metadata) string {
+	return s3KeyBase(prefix) + md.PartPath + "part-"
+}
+
+// PartKeyPattern implements PartKeyMatcher.
+func (n NormalizedKeyNamer) PartKeyPattern(prefix string, md *Metadata) (*regexp.Regexp, error) {
+	return s3PartKeyRegexp(n.PartListPrefix(prefix, md), md.partKeyWidth())
+}
+
+func keyNamerOrDefault(n KeyNamer) KeyNamer {
+	if n == nil {
+		return DefaultKeyNamer{}
+	}
+	return n
+}
+
+// inProgressMetaKey returns the key metadata is written to while the backup
+// is running if DeferMetadata is set.
+func inProgressMetaKey(n KeyNamer, prefix string) string {
+	return strings.TrimSuffix(n.MetaKey(prefix), ".json") + ".inprogress.json"
+}
+
+// partKeyFilter returns a function reporting whether a key listed beneath
+// the backup's PartListPrefix is one of its parts.
+func partKeyFilter(n KeyNamer, prefix string, md *Metadata) (func(key string) bool, error) {
+	if m, ok := n.(PartKeyMatcher); ok {
+		re, err := m.PartKeyPattern(prefix, md)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+	metaKey, inProgressKey := n.MetaKey(prefix), inProgressMetaKey(n, prefix)
+	return func(key string) bool {
+		return key != metaKey && key != inProgressKey
+	}, nil
+}
@@ -5,38 +5,207 @@
 package dyndump
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"math"
+	"reflect"
 	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/juju/ratelimit"
 )
 
+// DefaultItemBufferFactor is the default number of items per worker that
+// Loader queues between the source and the workers.
+const DefaultItemBufferFactor = 4
+
+// MaxBatchWriteItems is the maximum number of items DynamoDB accepts in a
+// single BatchWriteItem request.
+const MaxBatchWriteItems = 25
+
 // ItemReader is the interface expected by a Loader to retrieve items from
 // a source for loading into a DynamoDB table.
 type ItemReader interface {
 	ReadItem() (item map[string]*dynamodb.AttributeValue, err error)
 }
 
+// ConditionalItemReader is implemented by an ItemReader that can also supply
+// a condition to be applied when writing each item, such as EnvelopeDecoder.
+type ConditionalItemReader interface {
+	ItemReader
+	ReadConditionalItem() (item map[string]*dynamodb.AttributeValue, cond *ItemCondition, err error)
+}
+
+// FailedItemWriter receives the items a Loader failed to write when
+// ContinueOnError is set, along with any condition read with the item and
+// the error that caused it to fail.
+type FailedItemWriter interface {
+	WriteFailedItem(item map[string]*dynamodb.AttributeValue, cond *ItemCondition, err error) error
+}
+
+// UTF8Mode selects how a Loader handles items holding strings that aren't
+// valid UTF-8, which DynamoDB rejects.
+type UTF8Mode int
+
+const (
+	// UTF8NoCheck leaves strings unchecked, so items holding invalid
+	// UTF-8 fail when DynamoDB rejects their put.
+	UTF8NoCheck UTF8Mode = iota
+
+	// UTF8Fail checks strings before each put, failing the item with a
+	// LoadError naming the attribute if one is invalid.  The failure is
+	// handled like a failed put, so is recorded rather than stopping the
+	// load if ContinueOnError is set.
+	UTF8Fail
+
+	// UTF8Skip checks strings before each put and skips items holding an
+	// invalid one.  Skipped items are counted in the ItemsInvalid stat and
+	// passed to FailedItems, if set, with a LoadError naming the attribute.
+	UTF8Skip
+)
+
+// CompareOp selects how Loader compares the value of ConditionalAttr held by
+// a loaded item with that of the existing item it would overwrite.
+type CompareOp int
+
+const (
+	// CompareGreater overwrites items whose value is less than the
+	// loaded item's, such as those last updated before the backup.
+	CompareGreater CompareOp = iota
+
+	// CompareGreaterEqual overwrites items whose value is less than or
+	// equal to the loaded item's.
+	CompareGreaterEqual
+
+	// CompareLess overwrites items whose value is greater than the
+	// loaded item's.
+	CompareLess
+
+	// CompareLessEqual overwrites items whose value is greater than or
+	// equal to the loaded item's.
+	CompareLessEqual
+)
+
+// existingOps holds the operator applied to the existing item's value for
+// each CompareOp; the comparison is made from the loaded item's side.
+var existingOps = [...]string{
+	CompareGreater:      "<",
+	CompareGreaterEqual: "<=",
+	CompareLess:         ">",
+	CompareLessEqual:    ">=",
+}
+
 // DynPuter defines the portion of the DynamoDB service the Loader requires.
 type DynPuter interface {
 	PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
 }
 
+// DynContextPuter may optionally be implemented by the DynPuter passed to
+// a Loader, allowing RunContext to cancel put requests in progress.  It's
+// implemented by the dynamodb service.
+type DynContextPuter interface {
+	PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error)
+}
+
+// DynBatchWriter defines the portion of the DynamoDB service the Loader
+// requires if BatchSize is greater than 1.
+type DynBatchWriter interface {
+	DynPuter
+	BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error)
+}
+
 // LoaderStats are returned by Loader.Stats
 type LoaderStats struct {
-	ItemsWritten int64
-	ItemsSkipped int64
-	BytesWritten int64
-	CapacityUsed float64
+	ItemsWritten  int64
+	ItemsSkipped  int64
+	ItemsFailed   int64
+	ItemsInvalid  int64 // Items skipped as they hold invalid UTF-8
+	ItemsStale    int64 // Items skipped as they failed the ConditionalAttr comparison
+	ItemsFiltered int64 // Items skipped by Transform
+	BytesWritten  int64
+	CapacityUsed  float64
+
+	// ItemsCompleted is the number of items read from Source, counting from
+	// the first, that have all been written, skipped or failed.  As items
+	// are written concurrently it may lag the total of the other counts.
+	ItemsCompleted int64
+}
+
+// LoadError is returned by Loader.Run when an item could not be written to
+// DynamoDB.  It identifies the item that failed by its hash key value.
+type LoadError struct {
+	HashKey   string // The attribute name of the hash key
+	HashValue string // The hash key value of the failed item, if known
+	Worker    int    // The loader worker that attempted the put
+	Attempt   int    // Number of requests made to write the item, including any retried by the SDK; 0 if Stage is set
+	Seq       string // The sequence number of the failed item, if the dump was annotated
+	Stage     string // The check that failed before the item was written, such as StageValidateUTF8, or empty if the write failed
+	Err       error  // The underlying error returned by DynamoDB or the check
+}
+
+// Stages reported by a LoadError for an item that failed before it was
+// written.
+const (
+	StageTransform    = "transform"
+	StageValidateUTF8 = "UTF-8 validation"
+)
+
+func (e *LoadError) Error() string {
+	key := e.HashKey
+	if key == "" {
+		key = "<unknown key>"
+	}
+	var seq string
+	if e.Seq != "" {
+		seq = "seq=" + e.Seq + " "
+	}
+	if e.Stage != "" {
+		return fmt.Sprintf("%s failed for item %s=%q (%sworker=%d): %v",
+			e.Stage, key, e.HashValue, seq, e.Worker, e.Err)
+	}
+	return fmt.Sprintf("put failed for item %s=%q (%sworker=%d attempt=%d): %v",
+		key, e.HashValue, seq, e.Worker, e.Attempt, e.Err)
 }
 
 // Loader reads records from an ItemReader and loads them into a DynamoDB
 // table.
+//
+// If Source implements ConditionalItemReader then any condition read with an
+// item is applied when it's written in place of the check made when
+// AllowOverwrite is false.  Items that fail their condition are skipped.
+//
+// If ConditionalAttr is set then, for items without a condition of their
+// own, AllowOverwrite is ignored and an existing item is instead only
+// overwritten if its value of ConditionalAttr compares with the loaded
+// item's as ConditionalOp requires, so that items are only restored if,
+// for example, their backup is newer than the live item.  Existing items
+// without the attribute are always overwritten, while loaded items without
+// it are only written if no item exists.  Items that fail the comparison
+// are counted in the ItemsStale stat rather than ItemsSkipped.
+//
+// If BatchSize is greater than 1 then each worker collects items into
+// batches of that size which are written with BatchWriteItem, which uses
+// fewer requests than writing each item with PutItem.  Items DynamoDB
+// returns as unprocessed are retried with a backoff.  BatchWriteItem can't
+// make conditional puts, so batching requires AllowOverwrite and can't be
+// combined with ConditionalAttr; items read with a condition of their own
+// are still written individually with PutItem.  If a batch fails then each
+// of its items that hadn't been written is failed with the batch's error.
+//
+// By default Run returns a LoadError for the first item that can't be
+// written.  If ContinueOnError is set then the failed item is instead
+// counted in the ItemsFailed stat and passed to FailedItems, if set, and
+// the load continues, unless more than MaxFailures items have failed.
+// Items whose puts were still throttled once the SDK's retries ran out
+// always stop the load, as the table's capacity is exhausted and the items
+// following them would most likely fail too.
 type Loader struct {
 	Dyn            DynPuter
 	TableName      string     // Table name to restore to
@@ -47,21 +216,110 @@ type Loader struct {
 	AllowOverwrite bool       // If true then any existing records will be ovewritten
 	HashKey        string     // The attribute name of the hash key for the table
 
-	rateLimit    *rateLimitWaiter
-	itemsWritten int64
-	itemsSkipped int64
-	bytesWritten int64
-	capacityUsed int64 // multiplied by 10
-	stopRequest  chan struct{}
-	stopNotify   chan struct{}
+	ContinueOnError bool             // If true then items that fail to load are recorded rather than stopping the load
+	FailedItems     FailedItemWriter // Optional destination for items that fail to load when ContinueOnError is set, or are skipped by UTF8Skip
+	MaxFailures     int              // If greater than 0, stop the load once more than this many items have failed when ContinueOnError is set
+
+	// ItemBufferSize sets the number of items read from Source that may be
+	// queued waiting for a worker, so that a source with uneven latency,
+	// such as one fetching parts from S3, doesn't leave workers idle.
+	// Defaults to DefaultItemBufferFactor times MaxParallel.  Set to -1 to
+	// hand each item directly to a worker.
+	//
+	// In the BenchmarkLoadItemBuffer benchmarks, which load from a source
+	// that stalls for 2ms every 20 items into a table taking 1ms per put,
+	// 8 workers took 55ms to load 400 items with the default buffer and
+	// 89ms with none.  A larger buffer made no further difference, as the
+	// workers are then limited by the put latency rather than the source.
+	ItemBufferSize int
+
+	// ValidateUTF8 selects whether the string attributes of each item,
+	// including those nested in lists and maps, are checked for valid
+	// UTF-8 before the item is written.
+	ValidateUTF8 UTF8Mode
+
+	// ConditionalAttr names an attribute, such as a last updated
+	// timestamp, compared with that of the existing item before each
+	// put using ConditionalOp.  Requires HashKey.
+	ConditionalAttr string
+	ConditionalOp   CompareOp
+
+	// BatchSize is the number of items written by each BatchWriteItem
+	// request, up to MaxBatchWriteItems.  Items are written with PutItem
+	// if it's 0 or 1.  Dyn must implement DynBatchWriter.
+	BatchSize int
+
+	// Transform, if set, is applied to each item after it's read from
+	// Source and before it's written, allowing attributes to be renamed,
+	// removed or rewritten.  It may modify and return the item it's passed,
+	// or return a new one.  Returning a nil item skips the item, counting it
+	// in the ItemsFiltered stat, while returning an error stops the load,
+	// even if ContinueOnError is set.  It's called concurrently by the
+	// workers, and receives items without their sequence number annotation.
+	Transform func(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error)
+
+	rateLimit     *rateLimitWaiter
+	itemsWritten  int64
+	itemsSkipped  int64
+	itemsFailed   int64
+	itemsInvalid  int64
+	itemsStale    int64
+	itemsFiltered int64
+	bytesWritten  int64
+	capacityUsed  int64 // multiplied by 10
+	stopRequest   chan struct{}
+	stopNotify    chan struct{}
+	completed     completionTracker
+}
+
+// pendingItem is an item read from the source waiting to be written.
+type pendingItem struct {
+	item  map[string]*dynamodb.AttributeValue
+	cond  *ItemCondition
+	index int64 // position of the item in Source, from 0
+}
+
+// batchItem is an item waiting to be written with BatchWriteItem.
+type batchItem struct {
+	pendingItem
+	seq string // the item's sequence number, if annotated
 }
 
 // Run executes the loader, starting goroutines to execute parallel puts
 // as required.  Returns when the load has finished, failed or been stopped.
 func (ld *Loader) Run() error {
+	return ld.RunContext(context.Background())
+}
+
+// RunContext executes the loader as Run does, additionally stopping the
+// reader and all workers if ctx is cancelled, in which case it returns
+// ctx.Err().  If Dyn implements DynContextPuter then put requests in
+// progress are cancelled too, otherwise they're allowed to complete.
+// Items whose puts are cancelled aren't counted as failed.
+func (ld *Loader) RunContext(ctx context.Context) error {
+	if ld.ConditionalAttr != "" {
+		if ld.HashKey == "" {
+			return errors.New("ConditionalAttr requires HashKey")
+		}
+		if ld.ConditionalOp < 0 || int(ld.ConditionalOp) >= len(existingOps) {
+			return fmt.Errorf("invalid ConditionalOp %d", ld.ConditionalOp)
+		}
+	}
+	if ld.BatchSize > 1 {
+		if ld.BatchSize > MaxBatchWriteItems {
+			return fmt.Errorf("BatchSize may not exceed %d", MaxBatchWriteItems)
+		}
+		if !ld.AllowOverwrite || ld.ConditionalAttr != "" {
+			return errors.New("BatchSize requires AllowOverwrite without ConditionalAttr, as BatchWriteItem can't make conditional puts")
+		}
+		if _, ok := ld.Dyn.(DynBatchWriter); !ok {
+			return errors.New("BatchSize requires a DynamoDB service that supports BatchWriteItem")
+		}
+	}
+
 	errChan := make(chan error, ld.MaxParallel)
-	itemsChan := make(chan map[string]*dynamodb.AttributeValue)
-	readDone := make(chan error)
+	itemsChan := make(chan pendingItem, ld.itemBufferSize())
+	readDone := make(chan error, 1)
 
 	ld.stopRequest = make(chan struct{}, 2)
 	ld.stopNotify = make(chan struct{})
@@ -70,6 +328,7 @@ func (ld *Loader) Run() error {
 		ld.rateLimit = &rateLimitWaiter{
 			Bucket:     ratelimit.NewBucketWithQuantum(time.Second, int64(ld.WriteCapacity), int64(ld.WriteCapacity)),
 			stopNotify: ld.stopNotify,
+			ctxDone:    ctx.Done(),
 		}
 	}
 
@@ -80,14 +339,28 @@ func (ld *Loader) Run() error {
 
 	go func() {
 		var rc int64
+		condSource, _ := ld.Source.(ConditionalItemReader)
+		// closing the channel once all items are read lets the workers
+		// finish any items still queued before exiting
+		defer close(itemsChan)
 		for {
 			select {
 			case <-ld.stopNotify:
 				readDone <- nil
 				return
 
+			case <-ctx.Done():
+				readDone <- ctx.Err()
+				return
+
 			default:
-				item, err := ld.Source.ReadItem()
+				item := pendingItem{index: rc}
+				var err error
+				if condSource != nil {
+					item.item, item.cond, err = condSource.ReadConditionalItem()
+				} else {
+					item.item, err = ld.Source.ReadItem()
+				}
 				if err == io.EOF {
 					readDone <- nil
 					return
@@ -95,7 +368,15 @@ func (ld *Loader) Run() error {
 					readDone <- err
 					return
 				}
-				itemsChan <- item
+				select {
+				case itemsChan <- item:
+				case <-ld.stopNotify:
+					readDone <- nil
+					return
+				case <-ctx.Done():
+					readDone <- ctx.Err()
+					return
+				}
 				rc++
 				if rc == ld.MaxItems {
 					readDone <- nil
@@ -105,8 +386,8 @@ func (ld *Loader) Run() error {
 		}
 	}()
 
-	for i := int64(0); i < int64(ld.MaxParallel); i++ {
-		go ld.load(itemsChan, errChan)
+	for i := 0; i < ld.MaxParallel; i++ {
+		go ld.load(ctx, i, itemsChan, errChan)
 	}
 
 	// wait for either the reader or a writer to finish or fail
@@ -114,8 +395,10 @@ func (ld *Loader) Run() error {
 	var err error
 	select {
 	case err = <-readDone:
-		// reader exited
-		ld.Stop()
+		// reader exited; on success the workers drain the queued items
+		if err != nil {
+			ld.Stop()
+		}
 
 	case err = <-errChan:
 		rem--
@@ -131,6 +414,10 @@ func (ld *Loader) Run() error {
 			}
 		}
 	}
+	select {
+	case ld.stopRequest <- struct{}{}: // release the fanout goroutine
+	default:
+	}
 	return err
 }
 
@@ -143,15 +430,22 @@ func (ld *Loader) Stop() {
 // Stats return the current loader statistics.
 func (ld *Loader) Stats() LoaderStats {
 	return LoaderStats{
-		ItemsWritten: atomic.LoadInt64(&ld.itemsWritten),
-		ItemsSkipped: atomic.LoadInt64(&ld.itemsSkipped),
-		BytesWritten: atomic.LoadInt64(&ld.bytesWritten),
-		CapacityUsed: float64(atomic.LoadInt64(&ld.capacityUsed)) / 10,
+		ItemsWritten:  atomic.LoadInt64(&ld.itemsWritten),
+		ItemsSkipped:  atomic.LoadInt64(&ld.itemsSkipped),
+		ItemsFailed:   atomic.LoadInt64(&ld.itemsFailed),
+		ItemsInvalid:  atomic.LoadInt64(&ld.itemsInvalid),
+		ItemsStale:    atomic.LoadInt64(&ld.itemsStale),
+		ItemsFiltered: atomic.LoadInt64(&ld.itemsFiltered),
+		BytesWritten:  atomic.LoadInt64(&ld.bytesWritten),
+		CapacityUsed:  float64(atomic.LoadInt64(&ld.capacityUsed)) / 10,
+
+		ItemsCompleted: ld.completed.count(),
 	}
 }
 
-func (ld *Loader) load(items chan map[string]*dynamodb.AttributeValue, doneChan chan<- error) {
+func (ld *Loader) load(ctx context.Context, worker int, items chan pendingItem, doneChan chan<- error) {
 	usedCapacity := int64(1)
+	var batch []batchItem
 
 	for {
 		select {
@@ -159,42 +453,372 @@ func (ld *Loader) load(items chan map[string]*dynamodb.AttributeValue, doneChan
 			doneChan <- nil
 			return
 
-		case item := <-items:
-			if ld.rateLimit != nil {
-				ld.rateLimit.waitForRateLimit(usedCapacity)
-			}
-			req := &dynamodb.PutItemInput{
-				TableName: aws.String(ld.TableName),
-				Item:      item,
-				ReturnConsumedCapacity: aws.String("TOTAL"),
+		case <-ctx.Done():
+			doneChan <- ctx.Err()
+			return
+
+		case pending, ok := <-items:
+			if !ok {
+				// all items loaded, once any still batched are written
+				doneChan <- ld.writeBatch(ctx, worker, batch, &usedCapacity)
+				return
 			}
-			if !ld.AllowOverwrite {
-				req.ConditionExpression = aws.String("attribute_not_exists(#K)")
-				req.ExpressionAttributeNames = map[string]*string{
-					"#K": aws.String(ld.HashKey),
+			if ld.BatchSize > 1 && pending.cond == nil {
+				seq, ok, err := ld.prepareItem(worker, &pending)
+				if err != nil {
+					doneChan <- err
+					return
 				}
-			}
-
-			resp, err := ld.Dyn.PutItem(req)
-			if err != nil {
-				if aerr, ok := err.(awserr.Error); ok {
-					if aerr.Code() == "ConditionalCheckFailedException" {
-						atomic.AddInt64(&ld.itemsSkipped, 1)
-						// without a response available, we can't know for sure the
-						// capacity that was consumed; make a rough calculation
-						itemSize := float64(calcItemSize(item))
-						usedCapacity = int64(math.Ceil(itemSize / 1000))
-						continue
-					}
+				if !ok {
+					ld.completed.done(pending.index)
+					continue
 				}
+				if batch = append(batch, batchItem{pending, seq}); len(batch) < ld.BatchSize {
+					continue
+				}
+				err = ld.writeBatch(ctx, worker, batch, &usedCapacity)
+				batch = nil
+				if err != nil {
+					doneChan <- err
+					return
+				}
+				continue
+			}
+			if err := ld.loadItem(ctx, worker, pending, &usedCapacity); err != nil {
 				doneChan <- err
 				return
 			}
+			ld.completed.done(pending.index)
+		}
+	}
+}
+
+// loadItem writes a single item, returning an error if the load should
+// stop.  Items that are skipped, or recorded as failed, return nil.
+// usedCapacity holds the capacity consumed by the worker's previous put
+// and is updated with that consumed by this one.
+func (ld *Loader) loadItem(ctx context.Context, worker int, pending pendingItem, usedCapacity *int64) error {
+	seq, ok, err := ld.prepareItem(worker, &pending)
+	if !ok {
+		return err
+	}
+	item := pending.item
+	if ld.rateLimit != nil {
+		ld.rateLimit.waitForRateLimit(*usedCapacity)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	req := &dynamodb.PutItemInput{
+		TableName:              aws.String(ld.TableName),
+		Item:                   item,
+		ReturnConsumedCapacity: aws.String("TOTAL"),
+	}
+	cond, compared := pending.cond, false
+	if cond == nil && ld.ConditionalAttr != "" {
+		cond, compared = ld.compareCondition(item), true
+	}
+	if cond != nil {
+		req.ConditionExpression = aws.String(cond.Expression)
+		if len(cond.Names) > 0 {
+			req.ExpressionAttributeNames = cond.Names
+		}
+		if len(cond.Values) > 0 {
+			req.ExpressionAttributeValues = cond.Values
+		}
+	} else if !ld.AllowOverwrite {
+		req.ConditionExpression = aws.String("attribute_not_exists(#K)")
+		req.ExpressionAttributeNames = map[string]*string{
+			"#K": aws.String(ld.HashKey),
+		}
+	}
+
+	resp, attempts, err := ld.putItem(ctx, req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if aerr, ok := err.(awserr.Error); ok {
+			if aerr.Code() == "ConditionalCheckFailedException" {
+				if compared {
+					atomic.AddInt64(&ld.itemsStale, 1)
+				} else {
+					atomic.AddInt64(&ld.itemsSkipped, 1)
+				}
+				// without a response available, we can't know for sure the
+				// capacity that was consumed; make a rough calculation
+				itemSize := float64(calcItemSize(item))
+				*usedCapacity = int64(math.Ceil(itemSize / 1000))
+				return nil
+			}
+		}
+		lerr := ld.newLoadError(worker, attempts, item, err)
+		lerr.Seq = seq
+		return ld.failItem(item, pending.cond, lerr)
+	}
+
+	itemSize := calcItemSize(item)
+	if resp.ConsumedCapacity != nil && resp.ConsumedCapacity.CapacityUnits != nil {
+		*usedCapacity = int64(math.Ceil(*resp.ConsumedCapacity.CapacityUnits))
+		atomic.AddInt64(&ld.capacityUsed, int64(*resp.ConsumedCapacity.CapacityUnits*10))
+	} else {
+		// some endpoints, such as DynamoDB Local, don't report the capacity
+		// consumed; estimate it from the item's size to rate limit by.
+		*usedCapacity = int64(math.Ceil(float64(itemSize) / 1000))
+	}
+	atomic.AddInt64(&ld.itemsWritten, 1)
+	atomic.AddInt64(&ld.bytesWritten, int64(itemSize))
+	return nil
+}
+
+// putItem makes a single put request, cancelling it if ctx is cancelled
+// and Dyn supports it.  It returns the number of attempts made, including
+// those retried by the SDK, which can only be counted if Dyn implements
+// DynContextPuter.
+func (ld *Loader) putItem(ctx context.Context, req *dynamodb.PutItemInput) (resp *dynamodb.PutItemOutput, attempts int, err error) {
+	attempts = 1
+	if cp, ok := ld.Dyn.(DynContextPuter); ok {
+		resp, err = cp.PutItemWithContext(ctx, req, func(r *request.Request) {
+			r.Handlers.Complete.PushBack(func(r *request.Request) {
+				attempts = r.RetryCount + 1
+			})
+		})
+		return resp, attempts, err
+	}
+	resp, err = ld.Dyn.PutItem(req)
+	return resp, attempts, err
+}
+
+// prepareItem removes the sequence number annotation from an item, returning
+// it, applies Transform and checks the item's strings if ValidateUTF8 is
+// set.  It returns false if the item was skipped or recorded as failed
+// instead, along with any error that should stop the load.
+func (ld *Loader) prepareItem(worker int, pending *pendingItem) (seq string, ok bool, err error) {
+	item := pending.item
+	if av, ok := item[SequenceKey]; ok {
+		seq = aws.StringValue(av.N)
+		delete(item, SequenceKey)
+	}
+	if ld.Transform != nil {
+		transformed, err := ld.Transform(item)
+		if err != nil {
+			lerr := ld.newLoadError(worker, 0, item, err)
+			lerr.Seq, lerr.Stage = seq, StageTransform
+			return seq, false, lerr
+		}
+		if transformed == nil {
+			atomic.AddInt64(&ld.itemsFiltered, 1)
+			return seq, false, nil
+		}
+		item, pending.item = transformed, transformed
+	}
+	if ld.ValidateUTF8 != UTF8NoCheck {
+		if err := checkItemUTF8(item); err != nil {
+			lerr := ld.newLoadError(worker, 0, item, err)
+			lerr.Seq, lerr.Stage = seq, StageValidateUTF8
+			if ld.ValidateUTF8 == UTF8Skip {
+				atomic.AddInt64(&ld.itemsInvalid, 1)
+				return seq, false, ld.recordFailedItem(item, pending.cond, lerr)
+			}
+			return seq, false, ld.failItem(item, pending.cond, lerr)
+		}
+	}
+	return seq, true, nil
+}
+
+// writeBatch writes a batch of items with BatchWriteItem, retrying any that
+// DynamoDB leaves unprocessed with a backoff.  usedCapacity is updated as
+// for loadItem.
+func (ld *Loader) writeBatch(ctx context.Context, worker int, batch []batchItem, usedCapacity *int64) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	requests := make([]*dynamodb.WriteRequest, len(batch))
+	var size int64
+	for i, bi := range batch {
+		requests[i] = &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: bi.item}}
+		size += int64(calcItemSize(bi.item))
+	}
+
+	svc := ld.Dyn.(DynBatchWriter)
+	remaining := batch
+	backoff := minUnprocessedBackoff
+	for attempt := 1; len(requests) > 0; attempt++ {
+		if ld.rateLimit != nil {
+			ld.rateLimit.waitForRateLimit(*usedCapacity)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		resp, err := svc.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+			RequestItems:           map[string][]*dynamodb.WriteRequest{ld.TableName: requests},
+			ReturnConsumedCapacity: aws.String("TOTAL"),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err := ld.failBatch(worker, attempt, remaining, err); err != nil {
+				return err
+			}
+			break
+		}
+
+		var capacity float64
+		for _, cc := range resp.ConsumedCapacity {
+			if cc != nil {
+				capacity += aws.Float64Value(cc.CapacityUnits)
+			}
+		}
+		*usedCapacity = int64(math.Ceil(capacity))
+		atomic.AddInt64(&ld.capacityUsed, int64(capacity*10))
+
+		unprocessed := resp.UnprocessedItems[ld.TableName]
+		var unprocessedSize int64
+		for _, req := range unprocessed {
+			if req.PutRequest != nil {
+				unprocessedSize += int64(calcItemSize(req.PutRequest.Item))
+			}
+		}
+		atomic.AddInt64(&ld.itemsWritten, int64(len(requests)-len(unprocessed)))
+		atomic.AddInt64(&ld.bytesWritten, size-unprocessedSize)
+		if len(unprocessed) == 0 {
+			break
+		}
+		if len(unprocessed) < len(requests) {
+			backoff = minUnprocessedBackoff // made progress
+		}
+		requests, size = unprocessed, unprocessedSize
+		remaining = unprocessedItems(remaining, unprocessed)
 
-			usedCapacity = int64(math.Ceil(*resp.ConsumedCapacity.CapacityUnits))
-			atomic.AddInt64(&ld.itemsWritten, 1)
-			atomic.AddInt64(&ld.bytesWritten, int64(calcItemSize(item)))
-			atomic.AddInt64(&ld.capacityUsed, int64(*resp.ConsumedCapacity.CapacityUnits*10))
+		select {
+		case <-time.After(backoff):
+		case <-ld.stopNotify:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+		if backoff *= 2; backoff > maxUnprocessedBackoff {
+			backoff = maxUnprocessedBackoff
+		}
+	}
+	for _, bi := range batch {
+		ld.completed.done(bi.index)
+	}
+	return nil
+}
+
+// failBatch fails each of the items of a batch that hadn't been written
+// when its BatchWriteItem request failed, returning the first LoadError
+// unless ContinueOnError is set.
+func (ld *Loader) failBatch(worker, attempt int, items []batchItem, err error) error {
+	for _, bi := range items {
+		lerr := ld.newLoadError(worker, attempt, bi.item, err)
+		lerr.Seq = bi.seq
+		if ferr := ld.failItem(bi.item, nil, lerr); ferr != nil {
+			return ferr
+		}
+	}
+	return nil
+}
+
+// unprocessedItems returns the items of a batch that DynamoDB returned as
+// unprocessed, so that they can be identified if the batch later fails.
+func unprocessedItems(batch []batchItem, unprocessed []*dynamodb.WriteRequest) (result []batchItem) {
+	matched := make([]bool, len(batch))
+	for _, req := range unprocessed {
+		if req.PutRequest == nil {
+			continue
+		}
+		for i, bi := range batch {
+			if !matched[i] && reflect.DeepEqual(bi.item, req.PutRequest.Item) {
+				matched[i] = true
+				result = append(result, bi)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// compareCondition returns the condition applied to an item when
+// ConditionalAttr is set.
+func (ld *Loader) compareCondition(item map[string]*dynamodb.AttributeValue) *ItemCondition {
+	names := map[string]*string{"#K": aws.String(ld.HashKey)}
+	value, ok := item[ld.ConditionalAttr]
+	if !ok {
+		return &ItemCondition{Expression: "attribute_not_exists(#K)", Names: names}
+	}
+	names["#C"] = aws.String(ld.ConditionalAttr)
+	return &ItemCondition{
+		Expression: "attribute_not_exists(#K) OR attribute_not_exists(#C) OR #C " + existingOps[ld.ConditionalOp] + " :c",
+		Names:      names,
+		Values:     map[string]*dynamodb.AttributeValue{":c": value},
+	}
+}
+
+// failItem returns lerr, unless ContinueOnError is set in which case the
+// item is counted and recorded as failed.  It returns an error if the
+// item's puts were throttled, or once MaxFailures is exceeded.
+func (ld *Loader) failItem(item map[string]*dynamodb.AttributeValue, cond *ItemCondition, lerr *LoadError) error {
+	if !ld.ContinueOnError || request.IsErrorThrottle(lerr.Err) {
+		return lerr
+	}
+	failed := atomic.AddInt64(&ld.itemsFailed, 1)
+	if err := ld.recordFailedItem(item, cond, lerr); err != nil {
+		return err
+	}
+	if ld.MaxFailures > 0 && failed > int64(ld.MaxFailures) {
+		return fmt.Errorf("more than %d items failed to load; last failure: %v", ld.MaxFailures, lerr)
+	}
+	return nil
+}
+
+// recordFailedItem passes an item that wasn't loaded to FailedItems, if set.
+func (ld *Loader) recordFailedItem(item map[string]*dynamodb.AttributeValue, cond *ItemCondition, lerr *LoadError) error {
+	if ld.FailedItems == nil {
+		return nil
+	}
+	if err := ld.FailedItems.WriteFailedItem(item, cond, lerr); err != nil {
+		return fmt.Errorf("failed to record failed item: %v", err)
+	}
+	return nil
+}
+
+func (ld *Loader) itemBufferSize() int {
+	switch {
+	case ld.ItemBufferSize < 0:
+		return 0
+	case ld.ItemBufferSize > 0:
+		return ld.ItemBufferSize
+	}
+	return DefaultItemBufferFactor * ld.MaxParallel
+}
+
+// newLoadError wraps a put error with the details of the item that failed.
+func (ld *Loader) newLoadError(worker, attempt int, item map[string]*dynamodb.AttributeValue, err error) *LoadError {
+	e := &LoadError{
+		HashKey: ld.HashKey,
+		Worker:  worker,
+		Attempt: attempt,
+		Err:     err,
+	}
+	if av, ok := item[ld.HashKey]; ok && ld.HashKey != "" {
+		e.HashValue = fmtKeyValue(av)
+	}
+	return e
+}
+
+// fmtKeyValue returns a printable representation of a key attribute.
+// Key attributes may only be strings, numbers or binary values.
+func fmtKeyValue(av *dynamodb.AttributeValue) string {
+	switch {
+	case av.S != nil:
+		return *av.S
+	case av.N != nil:
+		return *av.N
+	case av.B != nil:
+		return base64.StdEncoding.EncodeToString(av.B)
 	}
+	return ""
 }
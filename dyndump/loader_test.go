@@ -5,15 +5,22 @@
 package dyndump
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"io"
 	"reflect"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 )
 
@@ -54,6 +61,64 @@ func TestLoadOK(t *testing.T) {
 	}
 }
 
+// Check that a response holding ConsumedCapacity without CapacityUnits set,
+// as returned by some DynamoDB compatible endpoints, doesn't cause a panic.
+func TestLoadNilCapacityUnits(t *testing.T) {
+	items := newLoadItems(makeIntItem("v", 1), makeIntItem("v", 2))
+	dyn := &fakeDynPuter{
+		put: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			return &dynamodb.PutItemOutput{
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{TableName: aws.String("test-table")},
+			}, nil
+		},
+	}
+	ld := &Loader{
+		Dyn:           dyn,
+		TableName:     "test-table",
+		MaxParallel:   1,
+		WriteCapacity: 10,
+		Source:        items,
+	}
+	if err := ld.Run(); err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+	if stats := ld.Stats(); stats.ItemsWritten != 2 || stats.CapacityUsed != 0 {
+		t.Errorf("Incorrect stats %#v", stats)
+	}
+}
+
+// Check that items that are written, skipped or failed are all counted as
+// completed.
+func TestLoadItemsCompleted(t *testing.T) {
+	items := newLoadItems(makeIntItem("v", 1), makeIntItem("v", 2), makeIntItem("v", 3), makeIntItem("v", 4))
+	dyn := &fakeDynPuter{
+		put: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			switch aws.StringValue(input.Item["v"].N) {
+			case "2":
+				return nil, awserr.New("ConditionalCheckFailedException", "exists", nil)
+			case "3":
+				return nil, errors.New("put failed")
+			}
+			return &dynamodb.PutItemOutput{
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+			}, nil
+		},
+	}
+	ld := &Loader{
+		Dyn:             dyn,
+		TableName:       "test-table",
+		MaxParallel:     2,
+		Source:          items,
+		ContinueOnError: true,
+	}
+	if err := ld.Run(); err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+	if stats := ld.Stats(); stats.ItemsCompleted != 4 {
+		t.Errorf("Incorrect stats %#v", stats)
+	}
+}
+
 // Test that a failure from readitem causes Run to exit with error
 func TestLoadReadErr(t *testing.T) {
 	testErr := errors.New("test error")
@@ -113,17 +178,941 @@ func TestLoadPutErr(t *testing.T) {
 	case <-time.After(time.Second):
 		t.Fatal("Timed out waiting for Run to complete")
 	case err := <-done:
-		if err != testErr {
+		if lerr, ok := err.(*LoadError); !ok || lerr.Err != testErr {
 			t.Error("Incorrect error from Run", err)
 		}
 	}
 }
 
+// Test that a put failure identifies the item that failed
+func TestLoadPutErrKey(t *testing.T) {
+	testErr := errors.New("test error")
+	items := newLoadItems(makeIntItem("v", 1), makeIntItem("v", 2), makeIntItem("v", 3))
+
+	dyn := &fakeDynPuter{
+		put: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			if aws.StringValue(input.Item["v"].N) == "2" {
+				return nil, testErr
+			}
+			return &dynamodb.PutItemOutput{
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+			}, nil
+		},
+	}
+
+	ld := &Loader{
+		Dyn:         dyn,
+		TableName:   "test-table",
+		MaxParallel: 1,
+		Source:      items,
+		HashKey:     "v",
+	}
+
+	done := make(chan error)
+	go func() { done <- ld.Run() }()
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for Run to complete")
+	case err := <-done:
+		lerr, ok := err.(*LoadError)
+		if !ok {
+			t.Fatal("Incorrect error type from Run", err)
+		}
+		if lerr.HashValue != "2" || lerr.Attempt != 1 {
+			t.Errorf("Incorrect error details %#v", lerr)
+		}
+		if msg := err.Error(); !strings.Contains(msg, `v="2"`) {
+			t.Error("Key not found in error message", msg)
+		}
+	}
+}
+
+// Test that sequence numbers are stripped from items and reported on failure
+func TestLoadPutErrSeq(t *testing.T) {
+	testErr := errors.New("test error")
+	var items []map[string]*dynamodb.AttributeValue
+	for i := 1; i <= 3; i++ {
+		item := makeIntItem("v", i)
+		item[SequenceKey] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(i + 10))}
+		items = append(items, item)
+	}
+
+	dyn := &fakeDynPuter{
+		put: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			if _, ok := input.Item[SequenceKey]; ok {
+				t.Error("Sequence number was not stripped from item")
+			}
+			if aws.StringValue(input.Item["v"].N) == "2" {
+				return nil, testErr
+			}
+			return &dynamodb.PutItemOutput{
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+			}, nil
+		},
+	}
+
+	ld := &Loader{
+		Dyn:         dyn,
+		TableName:   "test-table",
+		MaxParallel: 1,
+		Source:      newLoadItems(items...),
+		HashKey:     "v",
+	}
+
+	err := ld.Run()
+	lerr, ok := err.(*LoadError)
+	if !ok {
+		t.Fatal("Incorrect error type from Run", err)
+	}
+	if lerr.Seq != "12" {
+		t.Errorf("Incorrect sequence number %q", lerr.Seq)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "seq=12") {
+		t.Error("Sequence number not found in error message", msg)
+	}
+}
+
+// Test that conditions read with items are applied to their puts
+func TestLoadCondition(t *testing.T) {
+	data := `{"item":{"v":{"N":"1"}}}
+{"item":{"v":{"N":"2"}},"condition":{"expression":"#V < :v","names":{"#V":"version"},"values":{":v":{"N":"5"}}}}
+`
+	var m sync.Mutex
+	conds := make(map[string]string)
+	dyn := &fakeDynPuter{
+		put: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			m.Lock()
+			conds[aws.StringValue(input.Item["v"].N)] = aws.StringValue(input.ConditionExpression)
+			m.Unlock()
+			if v := input.ExpressionAttributeValues[":v"]; v != nil && aws.StringValue(v.N) != "5" {
+				t.Error("Incorrect condition value", aws.StringValue(v.N))
+			}
+			return &dynamodb.PutItemOutput{
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+			}, nil
+		},
+	}
+
+	ld := &Loader{
+		Dyn:         dyn,
+		TableName:   "test-table",
+		MaxParallel: 2,
+		Source:      NewEnvelopeDecoder(strings.NewReader(data)),
+		HashKey:     "v",
+	}
+	if err := ld.Run(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	expected := map[string]string{
+		"1": "attribute_not_exists(#K)",
+		"2": "#V < :v",
+	}
+	if !reflect.DeepEqual(conds, expected) {
+		t.Errorf("expected=%v actual=%v", expected, conds)
+	}
+}
+
+// compareTable fakes a table holding an "updated" number attribute for
+// some items, evaluating the conditions generated for ConditionalAttr.
+func compareTable(live map[string]int) *fakeDynPuter {
+	return &fakeDynPuter{
+		put: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			id := aws.StringValue(input.Item["id"].S)
+			existing, exists := live[id]
+			expr := aws.StringValue(input.ConditionExpression)
+			ok := !exists
+			if exists && expr != "attribute_not_exists(#K)" {
+				loaded, _ := strconv.Atoi(aws.StringValue(input.ExpressionAttributeValues[":c"].N))
+				switch op := expr[strings.LastIndex(expr, "#C ")+3 : strings.LastIndex(expr, " :c")]; {
+				case existing < 0: // live item without the attribute
+					ok = true
+				case op == "<":
+					ok = existing < loaded
+				case op == "<=":
+					ok = existing <= loaded
+				case op == ">":
+					ok = existing > loaded
+				case op == ">=":
+					ok = existing >= loaded
+				}
+			}
+			if !ok {
+				return nil, awserr.New("ConditionalCheckFailedException", "stale", nil)
+			}
+			return &dynamodb.PutItemOutput{
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+			}, nil
+		},
+	}
+}
+
+// Test that ConditionalAttr only overwrites items that compare as required
+// and counts the others as stale.
+func TestLoadConditionalAttr(t *testing.T) {
+	data := `{"item":{"id":{"S":"a"},"updated":{"N":"5"}}}
+{"item":{"id":{"S":"b"},"updated":{"N":"1"}}}
+{"item":{"id":{"S":"c"}}}
+{"item":{"id":{"S":"d"},"updated":{"N":"2"}}}
+{"item":{"id":{"S":"e"},"updated":{"N":"3"}}}
+{"item":{"id":{"S":"f"},"updated":{"N":"4"}},"condition":{"expression":"attribute_not_exists(#K)","names":{"#K":"id"}}}
+`
+	// e exists without the attribute, while d doesn't exist at all
+	live := map[string]int{"a": 3, "b": 4, "c": 1, "e": -1, "f": 0}
+	tests := []struct {
+		op                      CompareOp
+		written, stale, skipped int64
+	}{
+		{CompareGreater, 3, 2, 1},      // a, d, e written
+		{CompareLess, 3, 2, 1},         // b, d, e written
+		{CompareGreaterEqual, 3, 2, 1}, // a, d, e written
+	}
+	for _, test := range tests {
+		ld := &Loader{
+			Dyn:             compareTable(live),
+			TableName:       "test-table",
+			MaxParallel:     2,
+			Source:          NewEnvelopeDecoder(strings.NewReader(data)),
+			HashKey:         "id",
+			AllowOverwrite:  true,
+			ConditionalAttr: "updated",
+			ConditionalOp:   test.op,
+		}
+		if err := ld.Run(); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		stats := ld.Stats()
+		if stats.ItemsWritten != test.written || stats.ItemsStale != test.stale || stats.ItemsSkipped != test.skipped {
+			t.Errorf("op=%d incorrect stats written=%d stale=%d skipped=%d",
+				test.op, stats.ItemsWritten, stats.ItemsStale, stats.ItemsSkipped)
+		}
+	}
+
+	ld := &Loader{ConditionalAttr: "updated", MaxParallel: 1}
+	if err := ld.Run(); err == nil {
+		t.Error("Expected error for ConditionalAttr without HashKey")
+	}
+	ld = &Loader{ConditionalAttr: "updated", ConditionalOp: 10, HashKey: "id", MaxParallel: 1}
+	if err := ld.Run(); err == nil {
+		t.Error("Expected error for an invalid ConditionalOp")
+	}
+}
+
+// Test that failed items are recorded and the load continues when
+// ContinueOnError is set, and that the recorded items can be loaded again
+func TestLoadContinueOnError(t *testing.T) {
+	testErr := errors.New("test error")
+	var written stringVals
+	failing := true
+	dyn := &fakeDynPuter{
+		put: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			v := aws.StringValue(input.Item["v"].N)
+			if failing && (v == "2" || v == "4") {
+				return nil, testErr
+			}
+			written.Add(v)
+			return &dynamodb.PutItemOutput{
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+			}, nil
+		},
+	}
+
+	var buf bytes.Buffer
+	ld := &Loader{
+		Dyn:             dyn,
+		TableName:       "test-table",
+		MaxParallel:     2,
+		Source:          newLoadItems(makeIntItem("v", 1), makeIntItem("v", 2), makeIntItem("v", 3), makeIntItem("v", 4), makeIntItem("v", 5)),
+		HashKey:         "v",
+		ContinueOnError: true,
+		FailedItems:     NewDeadLetterEncoder(&buf),
+	}
+	if err := ld.Run(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if stats := ld.Stats(); stats.ItemsWritten != 3 || stats.ItemsFailed != 2 {
+		t.Errorf("Incorrect stats %#v", stats)
+	}
+	if !strings.Contains(buf.String(), `"error":"put failed for item v=`) {
+		t.Error("Error not recorded", buf.String())
+	}
+
+	// reload the failures
+	failing = false
+	ld = &Loader{
+		Dyn:         dyn,
+		TableName:   "test-table",
+		MaxParallel: 1,
+		Source:      NewEnvelopeDecoder(&buf),
+		HashKey:     "v",
+	}
+	if err := ld.Run(); err != nil {
+		t.Fatal("Unexpected error reloading failures", err)
+	}
+	if expected := []string{"1", "2", "3", "4", "5"}; !reflect.DeepEqual(written.Sorted(), expected) {
+		t.Errorf("expected=%v actual=%v", expected, written.Sorted())
+	}
+}
+
+// everyThirdFails returns a puter that fails every third item it's passed
+// with err.
+func everyThirdFails(err error) *fakeDynPuter {
+	return &fakeDynPuter{
+		put: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			v, _ := strconv.Atoi(aws.StringValue(input.Item["v"].N))
+			if v%3 == 0 {
+				return nil, err
+			}
+			return &dynamodb.PutItemOutput{
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+			}, nil
+		},
+	}
+}
+
+func intItems(n int) *loadItems {
+	items := newLoadItems()
+	for i := 1; i <= n; i++ {
+		items.items = append(items.items, loadItem{item: makeIntItem("v", i)})
+	}
+	return items
+}
+
+func TestLoadFailedItems(t *testing.T) {
+	validationErr := awserr.New("ValidationException", "empty string in key", nil)
+	var failed deadLetters
+	ld := &Loader{
+		Dyn:             everyThirdFails(validationErr),
+		TableName:       "test-table",
+		MaxParallel:     3,
+		Source:          intItems(30),
+		HashKey:         "v",
+		ContinueOnError: true,
+		FailedItems:     &failed,
+		MaxFailures:     10,
+	}
+	if err := ld.Run(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if stats := ld.Stats(); stats.ItemsWritten != 20 || stats.ItemsFailed != 10 {
+		t.Errorf("Incorrect stats %#v", stats)
+	}
+	if expected := []string{"12", "15", "18", "21", "24", "27", "3", "30", "6", "9"}; !reflect.DeepEqual(failed.values.Sorted(), expected) {
+		t.Errorf("expected=%v actual=%v", expected, failed.values.Sorted())
+	}
+}
+
+func TestLoadMaxFailures(t *testing.T) {
+	validationErr := awserr.New("ValidationException", "empty string in key", nil)
+	ld := &Loader{
+		Dyn:             everyThirdFails(validationErr),
+		TableName:       "test-table",
+		MaxParallel:     1,
+		Source:          intItems(30),
+		HashKey:         "v",
+		ContinueOnError: true,
+		MaxFailures:     4,
+	}
+	err := ld.Run()
+	if err == nil || !strings.Contains(err.Error(), "more than 4 items failed to load") {
+		t.Fatal("Unexpected error", err)
+	}
+	if stats := ld.Stats(); stats.ItemsFailed != 5 {
+		t.Errorf("Incorrect stats %#v", stats)
+	}
+}
+
+func TestLoadThrottledFailure(t *testing.T) {
+	// items that are still throttled after the SDK's retries stop the load
+	throttleErr := awserr.New("ProvisionedThroughputExceededException", "throttled", nil)
+	var failed deadLetters
+	ld := &Loader{
+		Dyn:             everyThirdFails(throttleErr),
+		TableName:       "test-table",
+		MaxParallel:     1,
+		Source:          intItems(30),
+		HashKey:         "v",
+		ContinueOnError: true,
+		FailedItems:     &failed,
+	}
+	err := ld.Run()
+	lerr, ok := err.(*LoadError)
+	if !ok || lerr.Err != throttleErr {
+		t.Fatal("Unexpected error", err)
+	}
+	if stats := ld.Stats(); stats.ItemsFailed != 0 || stats.ItemsWritten != 2 {
+		t.Errorf("Incorrect stats %#v", stats)
+	}
+	if len(failed.values.values) != 0 {
+		t.Error("Throttled item recorded as failed", failed.values.values)
+	}
+}
+
+// deadLetters implements FailedItemWriter, recording the hash key value of
+// each failed item.
+type deadLetters struct {
+	values stringVals
+}
+
+func (d *deadLetters) WriteFailedItem(item map[string]*dynamodb.AttributeValue, cond *ItemCondition, err error) error {
+	d.values.Add(aws.StringValue(item["v"].N))
+	return nil
+}
+
+// fakeBatchWriter implements DynBatchWriter, returning the first
+// unprocessed items of each batch as unprocessed on its first attempt.
+type fakeBatchWriter struct {
+	fakeDynPuter
+	m           sync.Mutex
+	unprocessed int
+	batchErr    error
+	attempts    map[string]int
+	written     stringVals
+	batchSizes  []int
+}
+
+func (d *fakeBatchWriter) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	requests := input.RequestItems["test-table"]
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.batchSizes = append(d.batchSizes, len(requests))
+	if d.batchErr != nil {
+		return nil, d.batchErr
+	}
+	resp := &dynamodb.BatchWriteItemOutput{
+		ConsumedCapacity: []*dynamodb.ConsumedCapacity{{CapacityUnits: aws.Float64(float64(len(requests)))}},
+	}
+	for i, req := range requests {
+		v := aws.StringValue(req.PutRequest.Item["v"].N)
+		d.attempts[v]++
+		if d.attempts[v] == 1 && i < d.unprocessed {
+			// return a copy, as DynamoDB does
+			item := map[string]*dynamodb.AttributeValue{"v": {N: aws.String(v)}}
+			resp.UnprocessedItems = map[string][]*dynamodb.WriteRequest{
+				"test-table": append(resp.UnprocessedItems["test-table"], &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}}),
+			}
+			continue
+		}
+		d.written.Add(v)
+	}
+	resp.ConsumedCapacity[0].CapacityUnits = aws.Float64(float64(len(requests) - len(resp.UnprocessedItems["test-table"])))
+	return resp, nil
+}
+
+// Check that items are written in batches and that unprocessed items are
+// retried.
+func TestLoadBatch(t *testing.T) {
+	var items []map[string]*dynamodb.AttributeValue
+	var expected []string
+	for i := 0; i < 60; i++ {
+		items = append(items, makeIntItem("v", i))
+		expected = append(expected, strconv.Itoa(i))
+	}
+	sort.Strings(expected)
+	dyn := &fakeBatchWriter{unprocessed: 3, attempts: make(map[string]int)}
+	ld := &Loader{
+		Dyn:            dyn,
+		TableName:      "test-table",
+		MaxParallel:    2,
+		Source:         newLoadItems(items...),
+		HashKey:        "v",
+		AllowOverwrite: true,
+		BatchSize:      7,
+	}
+	if err := ld.Run(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if vals := dyn.written.Sorted(); !reflect.DeepEqual(vals, expected) {
+		t.Error("Incorrect values written", vals)
+	}
+	stats := ld.Stats()
+	if stats.ItemsWritten != 60 || stats.ItemsCompleted != 60 || stats.CapacityUsed != 60 {
+		t.Errorf("Incorrect stats %#v", stats)
+	}
+	var total int
+	for _, size := range dyn.batchSizes {
+		if size > 7 {
+			t.Errorf("Batch of %d items exceeds BatchSize", size)
+		}
+		total += size
+	}
+	// each batch retries up to 3 unprocessed items
+	if total <= 60 || len(dyn.batchSizes) < 2*60/7 {
+		t.Errorf("Incorrect batches %v", dyn.batchSizes)
+	}
+}
+
+// Check that the items of a failed batch are recorded when ContinueOnError
+// is set, and that items with a condition are written with PutItem.
+func TestLoadBatchFailed(t *testing.T) {
+	var puts stringVals
+	dyn := &fakeBatchWriter{
+		fakeDynPuter: fakeDynPuter{put: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			puts.Add(aws.StringValue(input.Item["v"].N))
+			return &dynamodb.PutItemOutput{
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+			}, nil
+		}},
+		batchErr: errors.New("batch failed"),
+		attempts: make(map[string]int),
+	}
+	data := `{"item":{"v":{"N":"1"}}}
+{"item":{"v":{"N":"2"}},"condition":{"expression":"attribute_not_exists(#K)","names":{"#K":"v"}}}
+{"item":{"v":{"N":"3"}}}
+`
+	var buf bytes.Buffer
+	ld := &Loader{
+		Dyn:             dyn,
+		TableName:       "test-table",
+		MaxParallel:     1,
+		Source:          NewEnvelopeDecoder(strings.NewReader(data)),
+		HashKey:         "v",
+		AllowOverwrite:  true,
+		BatchSize:       5,
+		ContinueOnError: true,
+		FailedItems:     NewDeadLetterEncoder(&buf),
+	}
+	if err := ld.Run(); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if stats := ld.Stats(); stats.ItemsWritten != 1 || stats.ItemsFailed != 2 || stats.ItemsCompleted != 3 {
+		t.Errorf("Incorrect stats %#v", stats)
+	}
+	if vals := puts.Sorted(); !reflect.DeepEqual(vals, []string{"2"}) {
+		t.Error("Incorrect items written with PutItem", vals)
+	}
+	if n := strings.Count(buf.String(), "batch failed"); n != 2 {
+		t.Errorf("Incorrect number of failures recorded %d: %s", n, buf.String())
+	}
+
+	ld = &Loader{
+		Dyn:            dyn,
+		TableName:      "test-table",
+		MaxParallel:    1,
+		Source:         NewEnvelopeDecoder(strings.NewReader(data)),
+		HashKey:        "v",
+		AllowOverwrite: true,
+		BatchSize:      5,
+	}
+	if err := ld.Run(); err == nil || !strings.Contains(err.Error(), "batch failed") {
+		t.Error("Incorrect error", err)
+	}
+}
+
+func TestLoadBatchInvalid(t *testing.T) {
+	tests := []struct {
+		name           string
+		dyn            DynPuter
+		allowOverwrite bool
+		batchSize      int
+	}{
+		{"too large", &fakeBatchWriter{}, true, MaxBatchWriteItems + 1},
+		{"conditional", &fakeBatchWriter{}, false, 10},
+		{"unsupported", &fakeDynPuter{}, true, 10},
+	}
+	for _, test := range tests {
+		ld := &Loader{
+			Dyn:            test.dyn,
+			TableName:      "test-table",
+			MaxParallel:    1,
+			Source:         newLoadItems(),
+			AllowOverwrite: test.allowOverwrite,
+			BatchSize:      test.batchSize,
+		}
+		if err := ld.Run(); err == nil {
+			t.Errorf("test=%q expected error", test.name)
+		}
+	}
+}
+
+// Check that Transform can rename or drop attributes, or skip items.
+func TestLoadTransform(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform func(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error)
+		expected  []string
+		filtered  int64
+	}{
+		{"rename", func(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+			item["renamed"] = item["old"]
+			delete(item, "old")
+			return item, nil
+		}, []string{`1:renamed=x`, `2:renamed=x`, `3:renamed=x`}, 0},
+		{"drop", func(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+			delete(item, "old")
+			return item, nil
+		}, []string{`1:`, `2:`, `3:`}, 0},
+		{"skip", func(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+			if aws.StringValue(item["v"].N) == "2" {
+				return nil, nil
+			}
+			return map[string]*dynamodb.AttributeValue{"v": item["v"]}, nil
+		}, []string{`1:`, `3:`}, 1},
+	}
+
+	for _, test := range tests {
+		var items []map[string]*dynamodb.AttributeValue
+		for i := 1; i <= 3; i++ {
+			item := makeIntItem("v", i)
+			item["old"] = &dynamodb.AttributeValue{S: aws.String("x")}
+			item[SequenceKey] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(i))}
+			items = append(items, item)
+		}
+		var values stringVals
+		dyn := &fakeDynPuter{
+			put: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+				v := aws.StringValue(input.Item["v"].N) + ":"
+				for k, av := range input.Item {
+					if k != "v" {
+						v += k + "=" + aws.StringValue(av.S)
+					}
+				}
+				values.Add(v)
+				return &dynamodb.PutItemOutput{
+					ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+				}, nil
+			},
+		}
+		ld := &Loader{
+			Dyn:         dyn,
+			TableName:   "test-table",
+			MaxParallel: 2,
+			Source:      newLoadItems(items...),
+			Transform:   test.transform,
+		}
+		if err := ld.Run(); err != nil {
+			t.Fatalf("test=%q unexpected error %v", test.name, err)
+		}
+		if vals := values.Sorted(); !reflect.DeepEqual(vals, test.expected) {
+			t.Errorf("test=%q incorrect items written %q", test.name, vals)
+		}
+		stats := ld.Stats()
+		if stats.ItemsFiltered != test.filtered || stats.ItemsCompleted != 3 {
+			t.Errorf("test=%q incorrect stats %#v", test.name, stats)
+		}
+	}
+}
+
+// Check that a Transform error stops the load, even with ContinueOnError.
+func TestLoadTransformErr(t *testing.T) {
+	var puts int64
+	ld := &Loader{
+		Dyn: &fakeDynPuter{
+			put: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+				atomic.AddInt64(&puts, 1)
+				return &dynamodb.PutItemOutput{
+					ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+				}, nil
+			},
+		},
+		TableName:       "test-table",
+		MaxParallel:     1,
+		Source:          newLoadItems(makeIntItem("v", 1), makeIntItem("v", 2)),
+		HashKey:         "v",
+		ContinueOnError: true,
+		Transform: func(item map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+			return nil, errors.New("bad item")
+		},
+	}
+	err := ld.Run()
+	lerr, ok := err.(*LoadError)
+	if !ok || lerr.HashValue != "1" || lerr.Stage != StageTransform {
+		t.Fatalf("Incorrect error %#v", err)
+	}
+	if expected := `transform failed for item v="1" (worker=0): bad item`; lerr.Error() != expected {
+		t.Errorf("Incorrect message %q", lerr.Error())
+	}
+	if puts != 0 {
+		t.Errorf("%d items written", puts)
+	}
+}
+
+// Check that cancelling the context passed to RunContext stops the loader
+// while it's waiting on the rate limit, returning the context's error.
+func TestLoadRunContext(t *testing.T) {
+	dyn := &fakeDynPuter{
+		put: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			return &dynamodb.PutItemOutput{
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(100)},
+			}, nil
+		},
+	}
+	ld := &Loader{
+		Dyn:           dyn,
+		TableName:     "test-table",
+		MaxParallel:   2,
+		WriteCapacity: 1,
+		Source:        &stallingItems{count: 1000, stallEvery: 1000},
+		HashKey:       "key",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- ld.RunContext(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Error("Incorrect error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for loader to stop")
+	}
+}
+
+// ctxDynPuter implements DynContextPuter, blocking each put until its
+// context is cancelled.
+type ctxDynPuter struct {
+	fakeDynPuter
+}
+
+func (d *ctxDynPuter) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	<-ctx.Done()
+	return nil, errors.New("request canceled")
+}
+
+// Check that cancelling the context cancels a put in progress if Dyn
+// implements DynContextPuter, and that the cancelled put isn't counted
+// as a failed item.
+func TestLoadRunContextPut(t *testing.T) {
+	var buf bytes.Buffer
+	ld := &Loader{
+		Dyn:             new(ctxDynPuter),
+		TableName:       "test-table",
+		MaxParallel:     1,
+		Source:          newLoadItems(makeIntItem("v", 1), makeIntItem("v", 2)),
+		HashKey:         "v",
+		ContinueOnError: true,
+		FailedItems:     NewDeadLetterEncoder(&buf),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ld.RunContext(ctx); err != context.DeadlineExceeded {
+		t.Error("Incorrect error", err)
+	}
+	if stats := ld.Stats(); stats.ItemsFailed != 0 || stats.ItemsCompleted != 0 {
+		t.Errorf("Incorrect stats %#v", stats)
+	}
+	if buf.Len() != 0 {
+		t.Error("Cancelled item recorded as failed", buf.String())
+	}
+}
+
+// retryDynPuter fails every put as if the SDK had retried it retries times.
+type retryDynPuter struct {
+	fakeDynPuter
+	retries int
+}
+
+func (d *retryDynPuter) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	r := &request.Request{RetryCount: d.retries}
+	r.ApplyOptions(opts...)
+	r.Handlers.Complete.Run(r)
+	return nil, errors.New("internal server error")
+}
+
+// Check that a failed put reports the attempts made by the SDK.
+func TestLoadErrorAttempts(t *testing.T) {
+	ld := &Loader{
+		Dyn:         &retryDynPuter{retries: 3},
+		TableName:   "test-table",
+		MaxParallel: 1,
+		Source:      newLoadItems(makeIntItem("v", 1)),
+		HashKey:     "v",
+	}
+	err := ld.Run()
+	lerr, ok := err.(*LoadError)
+	if !ok {
+		t.Fatal("Incorrect error from Run", err)
+	}
+	if lerr.Attempt != 4 {
+		t.Errorf("Incorrect attempts %d", lerr.Attempt)
+	}
+}
+
+// Check that items holding invalid UTF-8 are skipped or fail, as set by
+// ValidateUTF8, and that the error names the attribute.
+func TestLoadValidateUTF8(t *testing.T) {
+	badItem := makeIntItem("v", 2)
+	badItem["m"] = &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{
+		"l": {L: []*dynamodb.AttributeValue{{S: aws.String("ok")}, {S: aws.String("bad\xff")}}},
+	}}
+
+	tests := []struct {
+		mode        UTF8Mode
+		errMessage  string
+		written     []string
+		invalid     int64
+		deadLetters bool
+	}{
+		{UTF8NoCheck, "", []string{"1", "2", "3"}, 0, false},
+		{UTF8Fail, `UTF-8 validation failed for item v="2" (worker=0): attribute "m.l[1]" holds a string that is not valid UTF-8`, []string{"1"}, 0, false},
+		{UTF8Skip, "", []string{"1", "3"}, 1, true},
+	}
+
+	for _, test := range tests {
+		var written stringVals
+		var buf bytes.Buffer
+		ld := &Loader{
+			Dyn: &fakeDynPuter{
+				put: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+					written.Add(aws.StringValue(input.Item["v"].N))
+					return &dynamodb.PutItemOutput{
+						ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+					}, nil
+				},
+			},
+			TableName:    "test-table",
+			MaxParallel:  1,
+			Source:       newLoadItems(makeIntItem("v", 1), badItem, makeIntItem("v", 3)),
+			HashKey:      "v",
+			ValidateUTF8: test.mode,
+			FailedItems:  NewDeadLetterEncoder(&buf),
+		}
+		err := ld.Run()
+		switch {
+		case test.errMessage == "" && err != nil:
+			t.Errorf("mode=%d unexpected error %v", test.mode, err)
+		case test.errMessage != "" && (err == nil || err.Error() != test.errMessage):
+			t.Errorf("mode=%d incorrect error %v", test.mode, err)
+		}
+		if actual := written.Sorted(); !reflect.DeepEqual(actual, test.written) {
+			t.Errorf("mode=%d expected=%v actual=%v", test.mode, test.written, actual)
+		}
+		if n := ld.Stats().ItemsInvalid; n != test.invalid {
+			t.Errorf("mode=%d incorrect invalid count %d", test.mode, n)
+		}
+		if recorded := strings.Contains(buf.String(), `m.l[1]`); recorded != test.deadLetters {
+			t.Errorf("mode=%d incorrect dead letters %q", test.mode, buf.String())
+		}
+	}
+}
+
+// Check that a NULL attribute survives a dump and load unchanged.
+func TestLoadNullRoundTrip(t *testing.T) {
+	item := map[string]*dynamodb.AttributeValue{
+		"v":    {N: aws.String("1")},
+		"null": {NULL: aws.Bool(true)},
+	}
+	var buf bytes.Buffer
+	if err := NewSimpleEncoder(&buf).WriteItem(item); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	var loaded map[string]*dynamodb.AttributeValue
+	dyn := &fakeDynPuter{
+		put: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			loaded = input.Item
+			return &dynamodb.PutItemOutput{
+				ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+			}, nil
+		},
+	}
+	ld := &Loader{
+		Dyn:         dyn,
+		TableName:   "test-table",
+		MaxParallel: 1,
+		Source:      NewSimpleDecoder(&buf),
+	}
+	if err := ld.Run(); err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+	if !reflect.DeepEqual(loaded, item) {
+		t.Errorf("expected=%v actual=%v", item, loaded)
+	}
+}
+
 type loadItem struct {
 	item map[string]*dynamodb.AttributeValue
 	err  error
 }
 
+// Check that items queued in the buffer when the source ends are all
+// written, including when MaxItems ends the read.
+func TestLoadItemBuffer(t *testing.T) {
+	for _, maxItems := range []int64{0, 15} {
+		var written stringVals
+		ld := &Loader{
+			Dyn: &fakeDynPuter{
+				put: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+					time.Sleep(time.Millisecond) // let the buffer fill
+					written.Add(aws.StringValue(input.Item["key"].N))
+					return &dynamodb.PutItemOutput{
+						ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+					}, nil
+				},
+			},
+			TableName:      "test-table",
+			MaxParallel:    2,
+			MaxItems:       maxItems,
+			ItemBufferSize: 10,
+			Source:         newLoadItems(makeItems(0, 20)...),
+			HashKey:        "key",
+		}
+		if err := ld.Run(); err != nil {
+			t.Fatalf("maxItems=%d unexpected error: %v", maxItems, err)
+		}
+		expected := int64(20)
+		if maxItems > 0 {
+			expected = maxItems
+		}
+		if n := len(written.Sorted()); int64(n) != expected || ld.Stats().ItemsWritten != expected {
+			t.Errorf("maxItems=%d incorrect items written=%d stats=%d", maxItems, n, ld.Stats().ItemsWritten)
+		}
+	}
+}
+
+// stallingItems returns items from a source that stalls every stallEvery
+// items, as a reader does when fetching the next part of a backup.
+type stallingItems struct {
+	count      int
+	n          int
+	stallEvery int
+	stall      time.Duration
+}
+
+func (s *stallingItems) ReadItem() (map[string]*dynamodb.AttributeValue, error) {
+	if s.n >= s.count {
+		return nil, io.EOF
+	}
+	s.n++
+	if s.n%s.stallEvery == 0 {
+		time.Sleep(s.stall)
+	}
+	return makeIntItem("key", s.n), nil
+}
+
+func benchmarkLoadItemBuffer(b *testing.B, bufferSize int) {
+	for i := 0; i < b.N; i++ {
+		ld := &Loader{
+			Dyn: &fakeDynPuter{
+				put: func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+					time.Sleep(time.Millisecond)
+					return &dynamodb.PutItemOutput{
+						ConsumedCapacity: &dynamodb.ConsumedCapacity{CapacityUnits: aws.Float64(1)},
+					}, nil
+				},
+			},
+			TableName:      "test-table",
+			MaxParallel:    8,
+			ItemBufferSize: bufferSize,
+			Source:         &stallingItems{count: 400, stallEvery: 20, stall: 2 * time.Millisecond},
+			HashKey:        "key",
+		}
+		if err := ld.Run(); err != nil {
+			b.Fatal("Unexpected error", err)
+		}
+	}
+}
+
+func BenchmarkLoadItemBufferNone(b *testing.B)    { benchmarkLoadItemBuffer(b, -1) }
+func BenchmarkLoadItemBufferDefault(b *testing.B) { benchmarkLoadItemBuffer(b, 0) }
+func BenchmarkLoadItemBufferLarge(b *testing.B)   { benchmarkLoadItemBuffer(b, 256) }
+
 func newLoadItems(items ...map[string]*dynamodb.AttributeValue) *loadItems {
 	r := new(loadItems)
 	for _, i := range items {
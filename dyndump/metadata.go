@@ -4,7 +4,13 @@
 
 package dyndump
 
-import "time"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
 
 // MetadataStatus represents the state of the backup.
 type MetadataStatus string
@@ -31,6 +37,26 @@ const (
 	BackupQuery MetadataBackupType = "query"
 )
 
+// PartCompression represents how the parts of a backup are compressed.
+type PartCompression string
+
+const (
+	// CompressionGzip compresses parts with gzip, which S3 clients
+	// decompress transparently.
+	CompressionGzip PartCompression = "gzip"
+
+	// CompressionZlib compresses parts with zlib, using the backup's
+	// compression dictionary as a preset if it has one.
+	CompressionZlib PartCompression = "zlib"
+
+	// CompressionZstd compresses parts with zstd, which compresses better
+	// and faster than gzip, but which S3 clients don't decompress.
+	CompressionZstd PartCompression = "zstd"
+
+	// CompressionNone stores parts uncompressed.
+	CompressionNone PartCompression = "none"
+)
+
 // Metadata is stored alongside backups pushed to S3.
 type Metadata struct {
 	TableName         string             `json:"table_name"`
@@ -43,4 +69,102 @@ type Metadata struct {
 	CompressedBytes   int64              `json:"compressed_bytes"`   // Size of the gzipped JSON takes, in bytes.
 	ItemCount         int64              `json:"item_count"`         // Number of items in the backup.
 	PartCount         int64              `json:"part_count"`         // Number of S3 objects comprising the backup
+	MasterHash        string             `json:"master_hash"`        // Hex SHA256 of the part hashes, in part order
+	CreatedBy         string             `json:"created_by"`         // User and/or host that created the backup.
+	ToolVersion       string             `json:"tool_version"`       // Version of the tool that created the backup.
+	PartPath          string             `json:"part_path"`          // Path inserted before part names, eg. "dt=2016-04-01/"
+	CompressionDict   []byte             `json:"compression_dict"`   // Preset dictionary used to compress parts, if any.
+	HashKey           string             `json:"hash_key"`           // Hash key attribute name of the source table, if known.
+	RangeKey          string             `json:"range_key"`          // Range key attribute name of the source table, if it has one.
+	ItemSizes         *SizeHistogram     `json:"item_sizes"`         // Count of items by size, if collected.
+	TTLAttribute      string             `json:"ttl_attribute"`      // Time to live attribute of the source table, if TTL is enabled.
+	PartKeyWidth      int                `json:"part_key_width"`     // Digits in each part key's number; 0 for DefaultPartKeyWidth.
+	Compression       PartCompression    `json:"compression"`        // How parts are compressed; empty for backups that predate it.
+
+	// The source table's schema, if known, as recorded by SetTableSchema
+	// to allow the table to be created before it's restored.  Only the
+	// definitions of the table's and its indexes' key attributes are
+	// included.
+	KeySchema              []*dynamodb.KeySchemaElement     `json:"key_schema"`
+	AttributeDefinitions   []*dynamodb.AttributeDefinition  `json:"attribute_definitions"`
+	GlobalSecondaryIndexes []*dynamodb.GlobalSecondaryIndex `json:"global_secondary_indexes"`
+	LocalSecondaryIndexes  []*dynamodb.LocalSecondaryIndex  `json:"local_secondary_indexes"`
+	BillingMode            string                           `json:"billing_mode"` // "PROVISIONED" or "PAY_PER_REQUEST"
+	ProvisionedThroughput  *dynamodb.ProvisionedThroughput  `json:"provisioned_throughput"`
+	StreamSpecification    *dynamodb.StreamSpecification    `json:"stream_specification"` // Set if streams are enabled.
+}
+
+// partCompression returns how the backup's parts are compressed.  Backups
+// written before the compression was recorded are gzip compressed, unless
+// they hold a compression dictionary.
+func (md Metadata) partCompression() PartCompression {
+	switch {
+	case md.Compression != "":
+		return md.Compression
+	case md.CompressionDict != nil:
+		return CompressionZlib
+	}
+	return CompressionGzip
+}
+
+// partKeyWidth returns the number of digits in the part numbers of the
+// backup's keys.  Backups written before the width was recorded use
+// DefaultPartKeyWidth.
+func (md *Metadata) partKeyWidth() int {
+	if md.PartKeyWidth > 0 {
+		return md.PartKeyWidth
+	}
+	return DefaultPartKeyWidth
+}
+
+// combineMetadata returns the metadata of several backups read as one.
+// Counts and sizes are summed and the times span all of the backups.  The
+// master hash is a hash of the backups' master hashes, and is empty if any
+// of them has none; fields describing how parts are stored are cleared as
+// they may differ between backups.
+func combineMetadata(mds []Metadata) Metadata {
+	if len(mds) == 1 {
+		return mds[0]
+	}
+	md := mds[0]
+	md.PartPath = ""
+	md.CompressionDict = nil
+	md.Compression = ""
+	md.PartKeyWidth = 0
+	md.UncompressedBytes, md.CompressedBytes, md.ItemCount, md.PartCount = 0, 0, 0, 0
+	var sizes SizeHistogram
+	master := sha256.New()
+	for _, pmd := range mds {
+		md.UncompressedBytes += pmd.UncompressedBytes
+		md.CompressedBytes += pmd.CompressedBytes
+		md.ItemCount += pmd.ItemCount
+		md.PartCount += pmd.PartCount
+		if pmd.Status != StatusCompleted {
+			md.Status = pmd.Status
+		}
+		if pmd.StartTime.Before(md.StartTime) {
+			md.StartTime = pmd.StartTime
+		}
+		if pmd.EndTime == nil || (md.EndTime != nil && pmd.EndTime.After(*md.EndTime)) {
+			md.EndTime = pmd.EndTime
+		}
+		if pmd.MasterHash == "" {
+			md.MasterHash = ""
+		}
+		master.Write([]byte(pmd.MasterHash))
+		if pmd.ItemSizes == nil {
+			md.ItemSizes = nil
+		} else {
+			for i, n := range pmd.ItemSizes {
+				sizes[i] += n
+			}
+		}
+	}
+	if md.MasterHash != "" {
+		md.MasterHash = hex.EncodeToString(master.Sum(nil))
+	}
+	if md.ItemSizes != nil {
+		md.ItemSizes = &sizes
+	}
+	return md
 }
@@ -0,0 +1,90 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"sync"
+)
+
+// reorderBuffer folds part hashes into a master hash in part order.
+//
+// Parts may complete in any order, so the hashes of parts that complete
+// before those preceding them are held until they can be folded in.  If
+// maxDepth is greater than zero then add blocks while maxDepth hashes are
+// held, until the missing parts complete or the buffer is cancelled.  Adding
+// the next part in order never blocks, so a ceiling can't deadlock the
+// writers holding the missing parts.
+type reorderBuffer struct {
+	m         sync.Mutex
+	cond      *sync.Cond
+	master    hash.Hash
+	next      int32 // next part number to fold into the master hash
+	pending   map[int32][]byte
+	maxDepth  int
+	cancelled bool
+}
+
+func newReorderBuffer(maxDepth int) *reorderBuffer {
+	b := &reorderBuffer{
+		master:   sha256.New(),
+		next:     1,
+		pending:  make(map[int32][]byte),
+		maxDepth: maxDepth,
+	}
+	b.cond = sync.NewCond(&b.m)
+	return b
+}
+
+// add adds the hash of a completed part, returning false if the buffer was
+// cancelled while waiting for room.
+func (b *reorderBuffer) add(partNum int32, sum []byte) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	for b.maxDepth > 0 && partNum != b.next && len(b.pending) >= b.maxDepth && !b.cancelled {
+		b.cond.Wait()
+	}
+	if b.cancelled {
+		return false
+	}
+
+	b.pending[partNum] = sum
+	for {
+		h, ok := b.pending[b.next]
+		if !ok {
+			break
+		}
+		b.master.Write(h)
+		delete(b.pending, b.next)
+		b.next++
+	}
+	b.cond.Broadcast()
+	return true
+}
+
+// cancel releases any callers blocked in add.
+func (b *reorderBuffer) cancel() {
+	b.m.Lock()
+	b.cancelled = true
+	b.m.Unlock()
+	b.cond.Broadcast()
+}
+
+// depth returns the number of hashes waiting for earlier parts to complete.
+func (b *reorderBuffer) depth() int {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return len(b.pending)
+}
+
+// sum returns the hex encoded master hash of the parts folded in so far.
+func (b *reorderBuffer) sum() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return hex.EncodeToString(b.master.Sum(nil))
+}
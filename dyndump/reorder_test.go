@@ -0,0 +1,161 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func partSum(i int) []byte {
+	sum := sha256.Sum256(randbytes(i, 10))
+	return sum[:]
+}
+
+// Check that hashes added out of order are folded in part order, and that
+// add blocks once the buffer is full until the missing part arrives.
+func TestReorderBuffer(t *testing.T) {
+	expected := sha256.New()
+	for i := 1; i <= 4; i++ {
+		expected.Write(partSum(i))
+	}
+
+	b := newReorderBuffer(1)
+	b.add(3, partSum(3))
+	if d := b.depth(); d != 1 {
+		t.Fatal("Incorrect depth", d)
+	}
+
+	added := make(chan bool)
+	go func() { added <- b.add(4, partSum(4)) }()
+	select {
+	case <-added:
+		t.Fatal("add did not block on a full buffer")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.add(1, partSum(1)) // in order; must not block
+	b.add(2, partSum(2))
+	select {
+	case ok := <-added:
+		if !ok {
+			t.Fatal("add failed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for blocked add")
+	}
+
+	if d := b.depth(); d != 0 {
+		t.Error("Incorrect final depth", d)
+	}
+	if sum := b.sum(); sum != hex.EncodeToString(expected.Sum(nil)) {
+		t.Error("Incorrect master hash", sum)
+	}
+}
+
+// Check that cancelling the buffer releases a blocked add.
+func TestReorderBufferCancel(t *testing.T) {
+	b := newReorderBuffer(1)
+	b.add(2, partSum(2))
+
+	added := make(chan bool)
+	go func() { added <- b.add(3, partSum(3)) }()
+	time.Sleep(10 * time.Millisecond)
+	b.cancel()
+
+	select {
+	case ok := <-added:
+		if ok {
+			t.Error("add succeeded after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for cancelled add")
+	}
+}
+
+// Force parts to complete out of order by holding the upload of the first
+// part until the others have been uploaded, and check that the master hash
+// is still calculated in part order with a bounded buffer.
+func TestS3WriterReorder(t *testing.T) {
+	const parts = 5
+	fs3 := newFakeS3()
+	release := make(chan struct{})
+	var m sync.Mutex
+	var uploaded int
+	var maxDepth int
+	var w *S3Writer
+
+	put := fakePutObject(func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		key := aws.StringValue(input.Key)
+		if key == "test-prefix-part-000000001.json.gz" {
+			select {
+			case <-release:
+			case <-time.After(time.Second):
+				return nil, errors.New("timeout waiting for other parts")
+			}
+		}
+		resp, err := fs3.PutObject(input)
+		if key != s3MetaKey("test-prefix") {
+			m.Lock()
+			uploaded++
+			if d := w.ReorderDepth(); d > maxDepth {
+				maxDepth = d
+			}
+			if uploaded == parts-2 {
+				// part 1 and one other are outstanding
+				close(release)
+			}
+			m.Unlock()
+		}
+		return resp, err
+	})
+
+	w = NewS3Writer(put, "test-bucket", "test-prefix", Metadata{})
+	w.PartSize = MinPartSize
+	w.MaxParallel = parts
+	w.MaxReorderDepth = 2
+
+	done := make(chan error)
+	go func() { done <- w.Run() }()
+	for i := 0; i < parts; i++ {
+		if _, err := w.Write(randbytes(i, MinPartSize)); err != nil {
+			t.Fatal("Write failed", err)
+		}
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+
+	if maxDepth > w.MaxReorderDepth {
+		t.Errorf("Reorder depth %d exceeded limit %d", maxDepth, w.MaxReorderDepth)
+	}
+	var md Metadata
+	if err := json.Unmarshal(fs3.metadata, &md); err != nil {
+		t.Fatal("Failed to decode metadata", err)
+	}
+	var keys []string
+	for k := range fs3.parts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	expected := sha256.New()
+	for _, k := range keys {
+		sum, _ := hex.DecodeString(aws.StringValue(fs3.parts[k].md[partHashKey]))
+		expected.Write(sum)
+	}
+	if md.MasterHash != hex.EncodeToString(expected.Sum(nil)) {
+		t.Error("Incorrect master hash", md.MasterHash)
+	}
+}
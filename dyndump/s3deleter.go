@@ -5,9 +5,9 @@
 package dyndump
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"regexp"
 	"sync/atomic"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -24,11 +24,23 @@ type S3DeleteGetLister interface {
 //
 // Given a bucket and path prefix, it will check that the backup has a valid
 // metadata file and then remove all of the parts that are associated with it,
-// before finally removing the metadata file itself.
+// before finally removing the metadata file itself.  A backup written with
+// DeferMetadata that failed or was interrupted may have only its in-progress
+// metadata, which is used in its place; the in-progress metadata is always
+// removed along with the metadata file.
 type S3Deleter struct {
+	// OnProgress, if set, is called after each batch of parts is deleted
+	// with the total number of parts deleted so far.
+	OnProgress func(deleted int64)
+
+	// MaxKeys is the maximum number of parts to list, and so delete, per
+	// request; defaults to DefaultMaxKeys.
+	MaxKeys int64
+
 	s3         S3DeleteGetLister
 	bucket     string // bucket is the name of the S3 Bucket to read from
 	pathPrefix string // pathPrefix is the prefix used to store the backup
+	keyNamer   KeyNamer
 	md         Metadata
 	delcount   int64
 	abort      int64
@@ -38,12 +50,28 @@ type S3Deleter struct {
 // fetch the metadata object from S3 before returning to confirm that a
 // valid backup actually exists at the given pathPrefix.
 func NewS3Deleter(s3 S3DeleteGetLister, bucket, pathPrefix string) (*S3Deleter, error) {
+	return NewS3DeleterWithKeyNamer(s3, bucket, pathPrefix, nil)
+}
+
+// NewS3DeleterWithKeyNamer is the same as NewS3Deleter, but locates the
+// backup's metadata and parts with keyNamer, which defaults to
+// DefaultKeyNamer if nil.
+func NewS3DeleterWithKeyNamer(s3 S3DeleteGetLister, bucket, pathPrefix string, keyNamer KeyNamer) (*S3Deleter, error) {
+	if err := ValidatePathPrefix(pathPrefix); err != nil {
+		return nil, err
+	}
 	r := &S3Reader{
 		S3:         s3,
 		Bucket:     bucket,
 		PathPrefix: pathPrefix,
+		KeyNamer:   keyNamer,
 	}
 	md, err := r.Metadata()
+	if isNoSuchKey(err) {
+		if imd, ierr := r.readInProgressMetadata(pathPrefix); ierr == nil {
+			md, err = imd, nil
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -51,6 +79,7 @@ func NewS3Deleter(s3 S3DeleteGetLister, bucket, pathPrefix string) (*S3Deleter,
 		s3:         s3,
 		bucket:     bucket,
 		pathPrefix: pathPrefix,
+		keyNamer:   r.keyNamer(),
 		md:         md,
 	}, nil
 }
@@ -73,24 +102,36 @@ func (d *S3Deleter) Abort() {
 
 // Delete starts deleting the configured backup.  It will block until the
 // delete operations complete.
-func (d *S3Deleter) Delete() (err error) {
+func (d *S3Deleter) Delete() error {
+	return d.DeleteContext(context.Background())
+}
+
+// DeleteContext is the same as Delete, but stops deleting parts once the
+// supplied context is cancelled, returning the context's error.  The
+// metadata files are left in place if the delete does not complete.
+func (d *S3Deleter) DeleteContext(ctx context.Context) (err error) {
 	bucket := aws.String(d.bucket)
-	prefix := aws.String(s3PartPrefix(d.pathPrefix))
-	isPart, err := regexp.Compile(fmt.Sprintf(`^%s\d{9}.json.gz$`, s3PartPrefix(d.pathPrefix)))
+	keyNamer := keyNamerOrDefault(d.keyNamer)
+	prefix := aws.String(keyNamer.PartListPrefix(d.pathPrefix, &d.md))
+	isPart, err := partKeyFilter(keyNamer, d.pathPrefix, &d.md)
 	if err != nil {
 		return errors.New("Illegal path prefix")
 	}
 
-	req := &s3.ListObjectsInput{
-		Bucket: bucket,
-		Prefix: prefix,
+	req := &s3.ListObjectsV2Input{
+		Bucket:  bucket,
+		Prefix:  prefix,
+		MaxKeys: aws.Int64(maxKeysOrDefault(d.MaxKeys)),
+	}
+	mdkeys := []*s3.ObjectIdentifier{
+		{Key: aws.String(inProgressMetaKey(keyNamer, d.pathPrefix))},
+		{Key: aws.String(keyNamer.MetaKey(d.pathPrefix))},
 	}
-	mdkey := s3MetaKey(d.pathPrefix)
 
 	isCompleted := false
 
-	s3err := d.s3.ListObjectsPages(req, func(page *s3.ListObjectsOutput, lastPage bool) bool {
-		if d.isAborted() {
+	s3err := d.s3.ListObjectsV2Pages(req, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		if d.isAborted() || ctx.Err() != nil {
 			return false
 		}
 
@@ -100,7 +141,7 @@ func (d *S3Deleter) Delete() (err error) {
 		}
 
 		for _, value := range page.Contents {
-			if !isPart.Match([]byte(aws.StringValue(value.Key))) {
+			if !isPart(aws.StringValue(value.Key)) {
 				continue // ignore anything that isn't a part, including metadata
 			}
 			del.Delete.Objects = append(del.Delete.Objects, &s3.ObjectIdentifier{Key: value.Key})
@@ -117,25 +158,32 @@ func (d *S3Deleter) Delete() (err error) {
 					aws.StringValue(errs[0].Message))
 				return false
 			}
-			atomic.AddInt64(&d.delcount, int64(len(del.Delete.Objects)))
+			deleted := atomic.AddInt64(&d.delcount, int64(len(del.Delete.Objects)))
+			if d.OnProgress != nil {
+				d.OnProgress(deleted)
+			}
 		}
 		if lastPage {
 			isCompleted = true
 		}
-		return !d.isAborted()
+		return !d.isAborted() && ctx.Err() == nil
 	})
 
 	if s3err != nil {
 		return s3err
 	}
 
+	if err == nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
 	if err == nil && isCompleted {
-		// Delete the metadata file
+		// Delete the metadata files; S3 ignores whichever doesn't exist
 		del := &s3.DeleteObjectsInput{
 			Bucket: bucket,
 			Delete: &s3.Delete{
 				Quiet:   aws.Bool(true),
-				Objects: []*s3.ObjectIdentifier{{Key: aws.String(mdkey)}},
+				Objects: mdkeys,
 			},
 		}
 		resp, rerr := d.s3.DeleteObjects(del)
@@ -5,6 +5,7 @@
 package dyndump
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -41,7 +42,7 @@ func TestDeleteOK(t *testing.T) {
 
 	f := &fakeS3Deleter{
 		fakeS3GetLister: &fakeS3GetLister{
-			list: func(input *s3.ListObjectsInput, fn func(p *s3.ListObjectsOutput, lastPage bool) (shouldContinue bool)) error {
+			list: func(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
 				if bucketName := aws.StringValue(input.Bucket); bucketName != "test-bucket" {
 					return fmt.Errorf("incorrect bucket for list %q", bucketName)
 				}
@@ -51,11 +52,11 @@ func TestDeleteOK(t *testing.T) {
 
 				// generate a couple of pages
 				for i := 0; i < 2; i++ {
-					page := &s3.ListObjectsOutput{
+					page := &s3.ListObjectsV2Output{
 						Contents: []*s3.Object{
 							{Key: aws.String(fmt.Sprintf("test-prefix-part-%09d.json.gz", 0+(2*i)))},
 							{Key: aws.String("test-prefix-ignore-this.json.gz")},
-							{Key: aws.String(fmt.Sprintf("test-prefix-part-%09d.json.gz", 1+(2*i)))},
+							{Key: aws.String(fmt.Sprintf("test-prefix-part-%09d.json.zlib", 1+(2*i)))},
 						},
 					}
 					cont := fn(page, i == 1)
@@ -86,22 +87,132 @@ func TestDeleteOK(t *testing.T) {
 	}
 
 	var expected []string
-	for i := 0; i < 4; i++ {
-		expected = append(expected, fmt.Sprintf("test-prefix-part-%09d.json.gz", i))
+	for i := 0; i < 4; i += 2 {
+		expected = append(expected,
+			fmt.Sprintf("test-prefix-part-%09d.json.gz", i),
+			fmt.Sprintf("test-prefix-part-%09d.json.zlib", i+1))
 	}
-	expected = append(expected, "test-prefix-meta.json")
+	expected = append(expected, "test-prefix-meta.inprogress.json", "test-prefix-meta.json")
 	if !reflect.DeepEqual(deleted, expected) {
 		t.Error("Incorrect delete keys", deleted)
 	}
 }
 
+// Check that cancelling the context stops the delete after the current batch
+// and leaves the metadata file in place.
+func TestDeleteContextCancel(t *testing.T) {
+	var deleted []string
+	var progress []int64
+
+	f := &fakeS3Deleter{
+		fakeS3GetLister: &fakeS3GetLister{
+			list: func(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
+				for i := 0; i < 3; i++ {
+					page := &s3.ListObjectsV2Output{
+						Contents: []*s3.Object{
+							{Key: aws.String(fmt.Sprintf("test-prefix-part-%09d.json.gz", 0+(2*i)))},
+							{Key: aws.String(fmt.Sprintf("test-prefix-part-%09d.json.gz", 1+(2*i)))},
+						},
+					}
+					if !fn(page, i == 2) {
+						return nil
+					}
+				}
+				return nil
+			},
+		},
+		del: func(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+			for _, obj := range input.Delete.Objects {
+				deleted = append(deleted, aws.StringValue(obj.Key))
+			}
+			return new(s3.DeleteObjectsOutput), nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &S3Deleter{
+		s3:         f,
+		bucket:     "test-bucket",
+		pathPrefix: "test-prefix",
+		OnProgress: func(n int64) {
+			progress = append(progress, n)
+			if n >= 4 {
+				cancel()
+			}
+		},
+	}
+
+	if err := d.DeleteContext(ctx); err != context.Canceled {
+		t.Fatal("Incorrect error response received", err)
+	}
+
+	if !reflect.DeepEqual(progress, []int64{2, 4}) {
+		t.Error("Incorrect progress updates", progress)
+	}
+
+	if len(deleted) != 4 {
+		t.Error("Incorrect delete keys", deleted)
+	}
+
+	if d.Completed() != 4 {
+		t.Error("Incorrect completed count", d.Completed())
+	}
+}
+
+// Check that a backup written with DeferMetadata that was aborted, leaving
+// only its in-progress metadata, can be deleted.
+func TestDeleteDeferredAborted(t *testing.T) {
+	fs3 := newFakeS3()
+	w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+	w.PartSize = MinPartSize
+	w.MaxParallel = 1
+	w.DeferMetadata = true
+
+	done := make(chan error)
+	go func() { done <- w.Run() }()
+	for i := 0; i < 3; i++ {
+		if _, err := w.Write(randbytes(i, MinPartSize)); err != nil {
+			t.Fatal("Write failed", err)
+		}
+	}
+	w.Abort()
+	if err := <-done; err == nil {
+		t.Fatal("No error returned from Run")
+	}
+	if fs3.metaKey != "" {
+		t.Fatal("Metadata written for an aborted backup")
+	}
+	if _, ok := fs3.parts["test-prefix-meta.inprogress.json"]; !ok {
+		t.Fatal("In-progress metadata not written")
+	}
+
+	d, err := NewS3Deleter(&fakeS3Deleter{
+		fakeS3GetLister: fs3.getLister(),
+		del:             fs3.DeleteObjects,
+	}, "test-bucket", "test-prefix")
+	if err != nil {
+		t.Fatal("Failed to create deleter", err)
+	}
+	if md := d.Metadata(); md.TableName != "a_table" || md.Status != StatusFailed {
+		t.Errorf("Incorrect metadata table=%q status=%q", md.TableName, md.Status)
+	}
+	if err := d.Delete(); err != nil {
+		t.Fatal("Delete failed", err)
+	}
+	if len(fs3.parts) != 0 {
+		t.Errorf("Objects left after delete: %v", fs3.parts)
+	}
+}
+
 func TestDeleteFailedList(t *testing.T) {
 	var called bool
 	e := errors.New("Test failure")
 
 	f := &fakeS3Deleter{
 		fakeS3GetLister: &fakeS3GetLister{
-			list: func(input *s3.ListObjectsInput, fn func(p *s3.ListObjectsOutput, lastPage bool) (shouldContinue bool)) error {
+			list: func(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
 				return e
 			},
 		},
@@ -132,8 +243,8 @@ func TestDeleteFailedCall(t *testing.T) {
 
 	f := &fakeS3Deleter{
 		fakeS3GetLister: &fakeS3GetLister{
-			list: func(input *s3.ListObjectsInput, fn func(p *s3.ListObjectsOutput, lastPage bool) (shouldContinue bool)) error {
-				page := &s3.ListObjectsOutput{
+			list: func(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
+				page := &s3.ListObjectsV2Output{
 					Contents: []*s3.Object{
 						{Key: aws.String(fmt.Sprintf("test-prefix-part-%09d.json.gz", 0))},
 						{Key: aws.String(fmt.Sprintf("test-prefix-part-%09d.json.gz", 1))},
@@ -163,8 +274,8 @@ func TestDeleteFailedCall(t *testing.T) {
 func TestDeleteFailedPart(t *testing.T) {
 	f := &fakeS3Deleter{
 		fakeS3GetLister: &fakeS3GetLister{
-			list: func(input *s3.ListObjectsInput, fn func(p *s3.ListObjectsOutput, lastPage bool) (shouldContinue bool)) error {
-				page := &s3.ListObjectsOutput{
+			list: func(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
+				page := &s3.ListObjectsV2Output{
 					Contents: []*s3.Object{
 						{Key: aws.String(fmt.Sprintf("test-prefix-part-%09d.json.gz", 0))},
 						{Key: aws.String(fmt.Sprintf("test-prefix-part-%09d.json.gz", 1))},
@@ -0,0 +1,189 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"bytes"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3MultipartPuter defines the portion of the S3 service required by
+// S3Writer when UseMultipartUpload is set.
+type S3MultipartPuter interface {
+	S3Puter
+	CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error)
+	CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error)
+}
+
+// s3ContextPartUploader is implemented by the SDK's S3 client, allowing
+// the hashes of rate limited chunks to be supplied as for s3ContextPuter.
+type s3ContextPartUploader interface {
+	UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error)
+}
+
+// multipartChunkSize is the size of each chunk of a part sent with a
+// multipart upload; S3 requires all but the last chunk to be at least 5MiB.
+var multipartChunkSize = 5 * 1024 * 1024
+
+// multipartPart receives the compressed data of a part, uploading it to S3
+// in chunks as it's written rather than buffering the entire part.
+//
+// The multipart upload is only started once a full chunk has been written,
+// so parts smaller than a chunk are left in the buffer to be uploaded with
+// PutObject as usual.  The part's key is allocated when the upload starts.
+type multipartPart struct {
+	w        *S3Writer
+	encoding string
+	pn       int32
+	key      string
+	uploadID *string
+	chunks   []*s3.CompletedPart
+	buf      bytes.Buffer
+	size     int64 // compressed bytes written to the part
+}
+
+func (mp *multipartPart) Write(p []byte) (n int, err error) {
+	n, _ = mp.buf.Write(p)
+	mp.size += int64(n)
+	for mp.buf.Len() >= multipartChunkSize {
+		if err := mp.uploadChunk(mp.buf.Next(multipartChunkSize)); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// started returns true if the multipart upload has begun.
+func (mp *multipartPart) started() bool {
+	return mp.uploadID != nil
+}
+
+// uploadChunk sends the next chunk of the part, starting the multipart
+// upload first if necessary.
+func (mp *multipartPart) uploadChunk(data []byte) error {
+	svc := mp.w.S3.(S3MultipartPuter)
+	if !mp.started() {
+		mp.pn, mp.key = mp.w.newKey()
+		put := mp.w.partRequest(mp.key, mp.encoding)
+		resp, err := svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket:               put.Bucket,
+			Key:                  put.Key,
+			ContentEncoding:      put.ContentEncoding,
+			ContentType:          put.ContentType,
+			ACL:                  put.ACL,
+			ServerSideEncryption: put.ServerSideEncryption,
+			SSEKMSKeyId:          put.SSEKMSKeyId,
+			StorageClass:         put.StorageClass,
+		})
+		if err != nil {
+			return err
+		}
+		mp.uploadID = resp.UploadId
+	}
+
+	num := aws.Int64(int64(len(mp.chunks) + 1))
+	input := &s3.UploadPartInput{
+		Bucket:     aws.String(mp.w.Bucket),
+		Key:        aws.String(mp.key),
+		UploadId:   mp.uploadID,
+		PartNumber: num,
+		Body:       bytes.NewReader(data),
+	}
+	resp, err := mp.uploadPart(input)
+	if err != nil {
+		return err
+	}
+	mp.chunks = append(mp.chunks, &s3.CompletedPart{ETag: resp.ETag, PartNumber: num})
+	return nil
+}
+
+// uploadPart uploads a chunk, limiting its rate if an upload limit is set.
+func (mp *multipartPart) uploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	svc := mp.w.S3.(S3MultipartPuter)
+	if mp.w.uploadLimit == nil {
+		return svc.UploadPart(input)
+	}
+	body := &rateLimitedReadSeeker{ReadSeeker: input.Body, bucket: mp.w.uploadLimit, stop: mp.w.uploadStop}
+	input.Body = body
+	csvc, ok := svc.(s3ContextPartUploader)
+	if !ok {
+		return svc.UploadPart(input)
+	}
+	contentMD5, sha, err := body.payloadHashes()
+	if err != nil {
+		return nil, err
+	}
+	input.ContentMD5 = aws.String(contentMD5)
+	return csvc.UploadPartWithContext(aws.BackgroundContext(), input, payloadSHA256Option(sha))
+}
+
+// complete uploads the remainder of the part and completes the upload.
+// The object is then copied over itself to apply the metadata set on req,
+// as the part's hash isn't known when the upload is started.
+func (mp *multipartPart) complete(req *s3.PutObjectInput) error {
+	svc := mp.w.S3.(S3MultipartPuter)
+	if mp.buf.Len() > 0 {
+		if err := mp.uploadChunk(mp.buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	_, err := svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          req.Bucket,
+		Key:             req.Key,
+		UploadId:        mp.uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: mp.chunks},
+	})
+	if err != nil {
+		return err
+	}
+	mp.uploadID = nil // nothing left to abort
+
+	_, err = svc.CopyObject(&s3.CopyObjectInput{
+		Bucket:               req.Bucket,
+		Key:                  req.Key,
+		CopySource:           aws.String(url.PathEscape(aws.StringValue(req.Bucket) + "/" + aws.StringValue(req.Key))),
+		MetadataDirective:    aws.String(s3.MetadataDirectiveReplace),
+		Metadata:             req.Metadata,
+		ContentEncoding:      req.ContentEncoding,
+		ContentType:          req.ContentType,
+		ACL:                  req.ACL,
+		ServerSideEncryption: req.ServerSideEncryption,
+		SSEKMSKeyId:          req.SSEKMSKeyId,
+		StorageClass:         req.StorageClass,
+	})
+	return err
+}
+
+// abort cancels the multipart upload, if one was started, so that S3
+// discards the chunks uploaded so far.
+func (mp *multipartPart) abort() error {
+	if !mp.started() {
+		return nil
+	}
+	_, err := mp.w.S3.(S3MultipartPuter).AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(mp.w.Bucket),
+		Key:      aws.String(mp.key),
+		UploadId: mp.uploadID,
+	})
+	mp.uploadID = nil
+	return err
+}
+
+// reset clears the part ready for the next to be written.
+func (mp *multipartPart) reset() {
+	mp.pn = 0
+	mp.key = ""
+	mp.uploadID = nil
+	mp.chunks = nil
+	mp.buf.Reset()
+	mp.size = 0
+}
@@ -0,0 +1,253 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type fakeUpload struct {
+	input  *s3.CreateMultipartUploadInput
+	chunks map[int64][]byte
+}
+
+// multipartS3 implements S3MultipartPuter on top of fakeS3, storing each
+// upload as a part once it's completed.
+type multipartS3 struct {
+	*fakeS3
+	uploads    map[string]*fakeUpload // keyed by upload id
+	nextID     int
+	chunkSizes map[string][]int // size of each chunk uploaded, by key
+	copied     []string
+	kmsKeys    []string // KMS key of each upload created or copied
+	classes    []string // storage class of each upload created or copied
+	aborted    int
+	uploadErr  error
+}
+
+func newMultipartS3() *multipartS3 {
+	return &multipartS3{
+		fakeS3:     newFakeS3(),
+		uploads:    make(map[string]*fakeUpload),
+		chunkSizes: make(map[string][]int),
+	}
+}
+
+func (ms3 *multipartS3) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	ms3.m.Lock()
+	defer ms3.m.Unlock()
+	ms3.nextID++
+	ms3.kmsKeys = append(ms3.kmsKeys, aws.StringValue(input.SSEKMSKeyId))
+	ms3.classes = append(ms3.classes, aws.StringValue(input.StorageClass))
+	id := fmt.Sprintf("upload-%d", ms3.nextID)
+	ms3.uploads[id] = &fakeUpload{input: input, chunks: make(map[int64][]byte)}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (ms3 *multipartS3) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	if ms3.uploadErr != nil {
+		return nil, ms3.uploadErr
+	}
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	ms3.m.Lock()
+	defer ms3.m.Unlock()
+	up := ms3.uploads[aws.StringValue(input.UploadId)]
+	if up == nil {
+		return nil, errors.New("no such upload")
+	}
+	num := aws.Int64Value(input.PartNumber)
+	up.chunks[num] = data
+	key := aws.StringValue(input.Key)
+	ms3.chunkSizes[key] = append(ms3.chunkSizes[key], len(data))
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("etag-%d", num))}, nil
+}
+
+func (ms3 *multipartS3) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	ms3.m.Lock()
+	up := ms3.uploads[aws.StringValue(input.UploadId)]
+	delete(ms3.uploads, aws.StringValue(input.UploadId))
+	ms3.m.Unlock()
+	if up == nil {
+		return nil, errors.New("no such upload")
+	}
+	var data []byte
+	for i, chunk := range input.MultipartUpload.Parts {
+		num := aws.Int64Value(chunk.PartNumber)
+		if num != int64(i+1) || aws.StringValue(chunk.ETag) != fmt.Sprintf("etag-%d", num) {
+			return nil, fmt.Errorf("incorrect chunk %d", i)
+		}
+		data = append(data, up.chunks[num]...)
+	}
+	_, err := ms3.fakeS3.PutObject(&s3.PutObjectInput{
+		Bucket:          up.input.Bucket,
+		Key:             up.input.Key,
+		Body:            bytes.NewReader(data),
+		ContentEncoding: up.input.ContentEncoding,
+		ContentType:     up.input.ContentType,
+		Metadata:        up.input.Metadata,
+	})
+	return new(s3.CompleteMultipartUploadOutput), err
+}
+
+func (ms3 *multipartS3) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	ms3.m.Lock()
+	defer ms3.m.Unlock()
+	delete(ms3.uploads, aws.StringValue(input.UploadId))
+	ms3.aborted++
+	return new(s3.AbortMultipartUploadOutput), nil
+}
+
+func (ms3 *multipartS3) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	key := aws.StringValue(input.Key)
+	if src := url.PathEscape("test-bucket/" + key); aws.StringValue(input.CopySource) != src {
+		return nil, fmt.Errorf("incorrect copy source %q", aws.StringValue(input.CopySource))
+	}
+	if aws.StringValue(input.MetadataDirective) != s3.MetadataDirectiveReplace {
+		return nil, errors.New("metadata not replaced")
+	}
+	ms3.m.Lock()
+	defer ms3.m.Unlock()
+	part, ok := ms3.parts[key]
+	if !ok {
+		return nil, fmt.Errorf("no such key %q", key)
+	}
+	part.md = input.Metadata
+	ms3.parts[key] = part
+	ms3.copied = append(ms3.copied, key)
+	ms3.kmsKeys = append(ms3.kmsKeys, aws.StringValue(input.SSEKMSKeyId))
+	ms3.classes = append(ms3.classes, aws.StringValue(input.StorageClass))
+	return new(s3.CopyObjectOutput), nil
+}
+
+// Check that parts larger than a chunk are streamed with a multipart upload
+// and still carry their hash, item count, encryption and storage class.
+func TestS3MultipartUpload(t *testing.T) {
+	defer func(size int) { multipartChunkSize = size }(multipartChunkSize)
+	multipartChunkSize = 4000
+
+	ms3 := newMultipartS3()
+	w := NewS3Writer(ms3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+	w.PartSize = 20000
+	w.MaxParallel = 1
+	w.UseMultipartUpload = true
+	w.ServerSideEncryption = s3.ServerSideEncryptionAwsKms
+	w.SSEKMSKeyID = "test-key"
+	w.StorageClass = s3.StorageClassStandardIa
+
+	done := make(chan error)
+	go func() { done <- w.Run() }()
+	var expected []byte
+	for i := 0; i < 42; i++ {
+		data := randbytes(i, 1000)
+		expected = append(expected, data...)
+		if _, err := w.Write(data); err != nil {
+			t.Fatal("Write failed", err)
+		}
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+
+	// the final part is smaller than a chunk, so is sent with PutObject
+	if len(ms3.parts) != 3 || len(ms3.copied) != 2 {
+		t.Fatalf("Incorrect parts written=%d copied=%d", len(ms3.parts), len(ms3.copied))
+	}
+	for key, sizes := range ms3.chunkSizes {
+		for i, size := range sizes[:len(sizes)-1] {
+			if size != multipartChunkSize {
+				t.Errorf("key %q chunk %d has incorrect size %d", key, i, size)
+			}
+		}
+	}
+	for key, part := range ms3.parts {
+		if aws.StringValue(part.md[partHashKey]) == "" || aws.StringValue(part.md[partItemCountKey]) == "" {
+			t.Errorf("Part %q is missing metadata: %v", key, part.md)
+		}
+		if part.enc != "gzip" || part.ctype != "application/json" {
+			t.Errorf("Part %q has incorrect encoding=%q type=%q", key, part.enc, part.ctype)
+		}
+	}
+	if len(ms3.kmsKeys) != 4 {
+		t.Errorf("Incorrect number of uploads created and copied: %d", len(ms3.kmsKeys))
+	}
+	for i, key := range ms3.kmsKeys {
+		if key != "test-key" || ms3.classes[i] != s3.StorageClassStandardIa {
+			t.Errorf("Incorrect KMS key %q or storage class %q", key, ms3.classes[i])
+		}
+	}
+	if len(ms3.uploads) != 0 || ms3.aborted != 0 {
+		t.Errorf("Incorrect uploads open=%d aborted=%d", len(ms3.uploads), ms3.aborted)
+	}
+
+	r := &S3Reader{S3: ms3.getLister(), Bucket: "test-bucket", PathPrefix: "test-prefix"}
+	if err := r.Verify(); err != nil {
+		t.Fatal("Verify failed", err)
+	}
+	r = &S3Reader{S3: ms3.getLister(), Bucket: "test-bucket", PathPrefix: "test-prefix"}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("Read failed", err)
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Error("Read data does not match written data")
+	}
+}
+
+// Check that an upload is aborted if a chunk fails to upload.
+func TestS3MultipartUploadFailed(t *testing.T) {
+	defer func(size int) { multipartChunkSize = size }(multipartChunkSize)
+	multipartChunkSize = 4000
+
+	ms3 := newMultipartS3()
+	ms3.uploadErr = errors.New("upload failed")
+	w := NewS3Writer(ms3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+	w.PartSize = 20000
+	w.MaxParallel = 1
+	w.UseMultipartUpload = true
+
+	done := make(chan error)
+	go func() { done <- w.Run() }()
+	for i := 0; i < 50; i++ {
+		if _, err := w.Write(randbytes(i, 1000)); err != nil {
+			break
+		}
+	}
+	w.Close()
+	if err := <-done; err != ms3.uploadErr {
+		t.Fatal("Incorrect error from Run", err)
+	}
+	if len(ms3.parts) != 0 || len(ms3.uploads) != 0 || ms3.aborted != 1 {
+		t.Errorf("Incorrect uploads parts=%d open=%d aborted=%d", len(ms3.parts), len(ms3.uploads), ms3.aborted)
+	}
+}
+
+// Check that the multipart requirements are validated before starting.
+func TestS3MultipartUploadInvalid(t *testing.T) {
+	w := NewS3Writer(newFakeS3(), "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+	w.UseMultipartUpload = true
+	if err := w.Run(); err == nil {
+		t.Error("Expected error for an S3 service without multipart uploads")
+	}
+
+	w = NewS3Writer(newMultipartS3(), "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+	w.UseMultipartUpload = true
+	w.WriteOnce = true
+	if err := w.Run(); err == nil {
+		t.Error("Expected error for WriteOnce")
+	}
+}
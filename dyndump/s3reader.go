@@ -5,102 +5,650 @@
 package dyndump
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/klauspost/compress/zstd"
 )
 
-var (
-	maxKeys = 1000
+// DefaultMaxKeys is the default number of part keys requested from S3 in
+// each list request.
+const DefaultMaxKeys = 1000
+
+// VerifyMode selects which integrity checks S3Reader performs.
+type VerifyMode int
+
+const (
+	// VerifyAll checks both the hash of each part and the master hash
+	// of the entire backup.
+	VerifyAll VerifyMode = iota
+
+	// VerifyParts checks only the hash of each part.
+	VerifyParts
+
+	// VerifyMaster checks only the master hash and part count of the
+	// entire backup.
+	VerifyMaster
+
+	// VerifyNone disables integrity checks.
+	VerifyNone
 )
 
 // S3GetLister defines the portion of the S3 service required by S3Reader.
 type S3GetLister interface {
 	GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
-	ListObjectsPages(input *s3.ListObjectsInput, fn func(p *s3.ListObjectsOutput, lastPage bool) (shouldContinue bool)) error
+	ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error
 }
 
 // S3Reader reads raw decompressed data from S3 and exposes it as a single
 // byte stream by implementing the io.Reader interface.
+//
+// By default the data read from each part is checked against the hash
+// recorded by S3Writer and the master hash of the backup is checked once
+// all parts have been read.  As a part's data is passed to Read before its
+// hash can be checked, a mismatch is reported as an error from the Read call
+// following the end of the part.  Backups written without hashes are not
+// checked.  The number of bytes each part decompresses to is also checked
+// against the raw size recorded by S3Writer, catching a truncated part
+// whose compressed data still decodes cleanly.
+//
+// Parts are listed MaxKeys at a time and each page of keys is held while its
+// parts are read.  Lowering MaxKeys reduces memory use for backups with a
+// very large number of parts at the cost of more list requests; S3 returns
+// no more than 1000 keys per request regardless of the value set.
+//
+// The parts are fetched by a goroutine started by the first call to Read.
+// If the backup isn't read to the end then Close must be called to stop it.
+//
+// If MaxParallel is greater than 1 then up to that many parts are
+// downloaded concurrently.  Each part is held in memory until the parts
+// before it have been read, so that data is still returned by Read, and
+// hashed, in part order.
+//
+// An interrupted load may be resumed by setting SkipParts to the value
+// PartsCompleted returned for the items that were loaded.  The master hash
+// can't be checked when parts are skipped, so only part hashes are checked.
+//
+// If PathPrefixes is set then the backups stored at each of those prefixes
+// are read in turn as one concatenated stream, in place of PathPrefix.  The
+// backups must all be of the same table, and each backup's part count and
+// master hash are checked separately.  SkipParts and PartsCompleted count
+// parts across the whole stream.
 type S3Reader struct {
-	S3            S3GetLister
-	Bucket        string // Bucket is the name of the S3 Bucket to read from
-	PathPrefix    string // PathPrefix is the prefix used to store the backup
-	currentReader io.ReadCloser
-	r             *io.PipeReader
-	w             *io.PipeWriter
-	err           error
+	S3                 S3GetLister
+	Bucket             string     // Bucket is the name of the S3 Bucket to read from
+	PathPrefix         string     // PathPrefix is the prefix used to store the backup
+	PathPrefixes       []string   // PathPrefixes, if set, lists several backups to read in order instead of PathPrefix
+	VerifyMode         VerifyMode // VerifyMode selects the integrity checks to perform
+	SkipIntegrityCheck bool       // If true then no integrity checks are performed; shorthand for VerifyNone
+	DeepVerify         bool       // If true then every item in each part is decoded to check it's valid
+	MaxKeys            int64      // Maximum number of keys to list per request; defaults to DefaultMaxKeys
+	SkipParts          int64      // Number of parts to skip from the start of the backup
+	MaxParallel        int        // Maximum number of parts to download concurrently; parts are read one at a time if 0 or 1
+	KeyNamer           KeyNamer   // Determines the keys of the backup's metadata and parts; defaults to DefaultKeyNamer
+	currentReader      io.ReadCloser
+	mds                []Metadata // metadata of each backup, read by Metadata
+	verifyAll          bool       // set by Verify to force every integrity check
+	m                  sync.Mutex // guards r, closed and partItems
+	partItems          []int64    // cumulative item count of each part read
+	toSkip             int64      // parts still to be skipped by the reader goroutine
+	r                  *io.PipeReader
+	w                  *io.PipeWriter
+	closed             bool
+	err                error
 }
 
-// Metadata returns the backup's metadata information.
+// Metadata returns the backup's metadata information.  If PathPrefixes is
+// set then the metadata of each backup is read and combined; counts and
+// sizes are summed and the backup is only reported as completed if all of
+// its backups are.
 func (r *S3Reader) Metadata() (md Metadata, err error) {
-	mdkey := s3MetaKey(r.PathPrefix)
-	req := &s3.GetObjectInput{
-		Bucket: aws.String(r.Bucket),
-		Key:    aws.String(mdkey),
+	if err := r.validatePrefixes(); err != nil {
+		return md, err
+	}
+	var mds []Metadata
+	for _, prefix := range r.prefixes() {
+		pmd, err := r.readMetadata(prefix)
+		if err != nil {
+			return md, err
+		}
+		if len(mds) > 0 && pmd.TableName != mds[0].TableName {
+			return md, fmt.Errorf("backup at prefix %q is of table %q, not %q", prefix, pmd.TableName, mds[0].TableName)
+		}
+		mds = append(mds, pmd)
+	}
+	r.mds = mds
+	return combineMetadata(mds), nil
+}
+
+// prefixes returns the path prefixes of the backups to read.
+func (r *S3Reader) prefixes() []string {
+	if len(r.PathPrefixes) > 0 {
+		return r.PathPrefixes
+	}
+	return []string{r.PathPrefix}
+}
+
+// validatePrefixes checks each of the path prefixes to be read.
+func (r *S3Reader) validatePrefixes() error {
+	for _, prefix := range r.prefixes() {
+		if err := ValidatePathPrefix(prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *S3Reader) keyNamer() KeyNamer {
+	return keyNamerOrDefault(r.KeyNamer)
+}
+
+// readMetadata reads the metadata of the backup stored at prefix.
+func (r *S3Reader) readMetadata(prefix string) (md Metadata, err error) {
+	resp, err := r.getObject(r.keyNamer().MetaKey(prefix))
+	if err != nil {
+		return md, err
 	}
-	resp, err := r.S3.GetObject(req)
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&md)
+	return md, err
+}
+
+// readInProgressMetadata reads the metadata that a backup written with
+// DeferMetadata stores at prefix until it completes.
+func (r *S3Reader) readInProgressMetadata(prefix string) (md Metadata, err error) {
+	resp, err := r.getObject(inProgressMetaKey(r.keyNamer(), prefix))
 	if err != nil {
 		return md, err
 	}
+	defer resp.Body.Close()
 	err = json.NewDecoder(resp.Body).Decode(&md)
 	return md, err
 }
 
+func (r *S3Reader) getObject(key string) (*s3.GetObjectOutput, error) {
+	return r.S3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(r.Bucket),
+		Key:    aws.String(key),
+	})
+}
+
+// isNoSuchKey reports whether err is S3's response to getting a key that
+// doesn't exist.
+func isNoSuchKey(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == s3.ErrCodeNoSuchKey
+}
+
 // Read reads a block of data from the backup
 // It is not safe to call this concurrently from different goroutines.
 func (r *S3Reader) Read(p []byte) (n int, err error) {
 	if r.err != nil {
+		return 0, r.err
+	}
+	pr, err := r.pipe()
+	if err != nil {
+		r.err = err
 		return 0, err
 	}
+	n, err = pr.Read(p)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// pipe returns the read half of the pipe fed by the reader goroutine,
+// starting it if necessary.
+func (r *S3Reader) pipe() (*io.PipeReader, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.closed {
+		return nil, io.ErrClosedPipe
+	}
 	if r.r == nil {
+		if err := r.validatePrefixes(); err != nil {
+			return nil, err
+		}
 		r.r, r.w = io.Pipe()
 		go r.reader()
 	}
-	n, err = r.r.Read(p)
+	return r.r, nil
+}
+
+// Close stops the goroutine fetching parts from S3, causing any further
+// calls to Read to fail.  It may be called concurrently with Read, such as
+// to abort a load.
+func (r *S3Reader) Close() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.closed = true
+	if r.r != nil {
+		// the reader goroutine exits once its next write to the pipe fails
+		return r.r.Close()
+	}
+	return nil
+}
+
+// PartsCompleted returns the number of parts, including any skipped, whose
+// items are all among the first items returned by Read.  Items are counted
+// as lines of data, as written by SimpleEncoder.
+func (r *S3Reader) PartsCompleted(items int64) int64 {
+	r.m.Lock()
+	defer r.m.Unlock()
+	n := sort.Search(len(r.partItems), func(i int) bool { return r.partItems[i] > items })
+	return r.SkipParts + int64(n)
+}
+
+// addPart records the number of items held by a part that has been read.
+func (r *S3Reader) addPart(items int64) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if n := len(r.partItems); n > 0 {
+		items += r.partItems[n-1]
+	}
+	r.partItems = append(r.partItems, items)
+}
+
+// Verify reads every part of the backup, discarding its data, and checks
+// the hash of each part, the master hash and the part count regardless of
+// VerifyMode and SkipIntegrityCheck.  It returns an error describing the
+// first mismatch found, or nil if the backup is intact.  Items are decoded
+// too if DeepVerify is set.
+//
+// Backups without integrity hashes can't be verified, and Verify can't be
+// combined with SkipParts or with calls to Read.
+func (r *S3Reader) Verify() error {
+	if r.SkipParts > 0 {
+		return errors.New("cannot verify a backup when skipping parts")
+	}
+	md, err := r.Metadata()
 	if err != nil {
-		r.err = err
+		return err
 	}
-	return n, err
+	if md.MasterHash == "" {
+		return errors.New("backup has no integrity hashes to verify")
+	}
+	r.verifyAll = true
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
+
+func (r *S3Reader) verifyMode() (parts, master bool) {
+	if r.verifyAll {
+		return true, true
+	}
+	if r.SkipIntegrityCheck {
+		return false, false
+	}
+	switch r.VerifyMode {
+	case VerifyAll:
+		return true, true
+	case VerifyParts:
+		return true, false
+	case VerifyMaster:
+		return false, true
+	}
+	return false, false
 }
 
 // reader is a goroutine started by Read that pulls all of the individual
 // backup objects from S3 and sends their data into one half of a pipe
 // for aggregate reads by Read.
 func (r *S3Reader) reader() {
-	var closed bool
+	if err := r.readBackups(); err != nil {
+		r.w.CloseWithError(err)
+	} else {
+		r.w.Close()
+	}
+}
 
-	req := &s3.ListObjectsInput{
-		Bucket: aws.String(r.Bucket),
-		Prefix: aws.String(s3PartPrefix(r.PathPrefix)),
+// readBackups copies the parts of each backup to the pipe in turn.
+func (r *S3Reader) readBackups() error {
+	if r.mds == nil {
+		// the metadata holds the master hash and the path to the parts
+		if _, err := r.Metadata(); err != nil {
+			return err
+		}
 	}
-	err := r.S3.ListObjectsPages(req, func(page *s3.ListObjectsOutput, lastPage bool) bool {
-		for _, value := range page.Contents {
-			req := &s3.GetObjectInput{
+	r.toSkip = r.SkipParts
+	prefixes := r.prefixes()
+	for i, prefix := range prefixes {
+		err := r.readBackup(prefix, &r.mds[i])
+		if err != nil && len(prefixes) > 1 {
+			return fmt.Errorf("backup at prefix %q: %v", prefix, err)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBackup copies the parts of the backup stored at prefix to the pipe,
+// checking its part count and master hash once they've all been read.
+func (r *S3Reader) readBackup(prefix string, md *Metadata) error {
+	st := &partState{md: md, master: sha256.New()}
+	var verifyMaster bool
+	st.verifyParts, verifyMaster = r.verifyMode()
+	if r.SkipParts > 0 {
+		verifyMaster = false // the skipped parts' hashes aren't known
+	}
+
+	keyNamer := r.keyNamer()
+	isPart, err := partKeyFilter(keyNamer, prefix, md)
+	if err != nil {
+		return err
+	}
+	st.isPart = isPart
+	req := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(r.Bucket),
+		Prefix:  aws.String(keyNamer.PartListPrefix(prefix, md)),
+		MaxKeys: aws.Int64(maxKeysOrDefault(r.MaxKeys)),
+	}
+	if r.MaxParallel > 1 {
+		err = r.readParallel(req, st)
+	} else {
+		err = r.listParts(req, st, func(key *string) error {
+			resp, err := r.S3.GetObject(&s3.GetObjectInput{
 				Bucket: aws.String(r.Bucket),
-				Key:    value.Key,
-			}
-			getResp, err := r.S3.GetObject(req)
+				Key:    key,
+			})
 			if err != nil {
-				r.w.CloseWithError(err)
-				closed = true
-				return false
+				return err
+			}
+			return r.copyPart(st, aws.StringValue(key), resp)
+		})
+	}
+	if err == nil && verifyMaster && md.MasterHash != "" {
+		if st.partCount != md.PartCount {
+			err = fmt.Errorf("integrity check failed: expected %d parts, found %d", md.PartCount, st.partCount)
+		} else if hex.EncodeToString(st.master.Sum(nil)) != md.MasterHash {
+			err = fmt.Errorf("integrity check failed: master hash mismatch")
+		}
+	}
+	return err
+}
+
+// partState holds the hashes of the parts of a backup copied so far.
+type partState struct {
+	md          *Metadata
+	isPart      func(key string) bool // reports whether a listed key is one of the backup's parts
+	verifyParts bool
+	master      hash.Hash
+	partCount   int64
+}
+
+// listParts lists the keys of the backup's parts in order, calling fn for
+// each that isn't skipped.  Listed keys that aren't parts of the backup,
+// such as those of another backup whose prefix begins with this one's, are
+// ignored.  Listing stops if fn returns an error, which is returned.
+func (r *S3Reader) listParts(req *s3.ListObjectsV2Input, st *partState, fn func(key *string) error) error {
+	var ferr error
+	err := r.S3.ListObjectsV2Pages(req, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, value := range page.Contents {
+			if !st.isPart(aws.StringValue(value.Key)) {
+				continue
+			}
+			if r.toSkip > 0 {
+				r.toSkip--
+				continue
 			}
-			if _, err := io.Copy(r.w, getResp.Body); err != nil {
-				r.w.CloseWithError(err)
-				closed = true
+			if ferr = fn(value.Key); ferr != nil {
 				return false
 			}
 		}
 		return true
 	})
-	if !closed {
+	if ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// copyPart copies a part's data to the pipe, checking its hash and adding
+// it to the master hash.
+func (r *S3Reader) copyPart(st *partState, key string, resp *s3.GetObjectOutput) error {
+	defer resp.Body.Close()
+	body, err := partBody(st.md, resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to decompress part %q: %v", key, err)
+	}
+	hash := sha256.New()
+	out := &lineCountWriter{w: r.w}
+	if r.DeepVerify {
+		err = r.copyDecoded(key, resp, out, io.TeeReader(body, hash))
+	} else {
+		_, err = io.Copy(out, io.TeeReader(body, hash))
+	}
+	switch err {
+	case nil:
+	case gzip.ErrChecksum, gzip.ErrHeader, io.ErrUnexpectedEOF:
+		return fmt.Errorf("integrity check failed for part %q: %v", key, err)
+	default:
+		return err
+	}
+	if expected := partMetadata(resp.Metadata, partRawSizeKey); st.verifyParts && expected != "" && expected != strconv.FormatInt(out.bytes, 10) {
+		return fmt.Errorf("integrity check failed for part %q: decompressed to %d bytes; expected %s", key, out.bytes, expected)
+	}
+	sum := hash.Sum(nil)
+	if expected := partMetadata(resp.Metadata, partHashKey); st.verifyParts && expected != "" && expected != hex.EncodeToString(sum) {
+		return fmt.Errorf("integrity check failed for part %q", key)
+	}
+	st.master.Write(sum)
+	st.partCount++
+	r.addPart(out.lines)
+	return nil
+}
+
+// partFetch is a part being downloaded ahead of being copied to the pipe.
+type partFetch struct {
+	key  *string
+	resp *s3.GetObjectOutput
+	err  error
+	done chan struct{} // closed once the part has been downloaded
+}
+
+// fetch downloads the part's data into memory.
+func (pf *partFetch) fetch(r *S3Reader) {
+	defer close(pf.done)
+	resp, err := r.S3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(r.Bucket),
+		Key:    pf.key,
+	})
+	if err != nil {
+		pf.err = err
+		return
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		pf.err = err
+		return
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	pf.resp = resp
+}
+
+// readParallel downloads up to MaxParallel parts concurrently, copying
+// each to the pipe in order once it and all of the parts before it have
+// been downloaded.
+func (r *S3Reader) readParallel(req *s3.ListObjectsV2Input, st *partState) error {
+	fetches := make(chan *partFetch)
+	pending := make(chan *partFetch, r.MaxParallel) // parts waiting to be copied, in order
+	stop := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < r.MaxParallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pf := range fetches {
+				pf.fetch(r)
+			}
+		}()
+	}
+
+	copyDone := make(chan error, 1)
+	go func() {
+		var err error
+		for pf := range pending {
+			<-pf.done
+			if err != nil {
+				continue // discard the remaining parts
+			}
+			if err = pf.err; err == nil {
+				err = r.copyPart(st, aws.StringValue(pf.key), pf.resp)
+			}
+			if err != nil {
+				close(stop)
+			}
+		}
+		copyDone <- err
+	}()
+
+	listErr := r.listParts(req, st, func(key *string) error {
+		pf := &partFetch{key: key, done: make(chan struct{})}
+		select {
+		case pending <- pf:
+		case <-stop:
+			return errors.New("stopped")
+		}
+		fetches <- pf
+		return nil
+	})
+	close(fetches)
+	close(pending)
+	wg.Wait()
+	if err := <-copyDone; err != nil {
+		return err
+	}
+	return listErr
+}
+
+// partBody returns a reader for a part's uncompressed data, using the
+// compression recorded in the backup's metadata.  Gzipped parts are
+// decompressed by S3, while zlib and zstd compressed parts must be
+// decompressed here.
+func partBody(md *Metadata, body io.Reader) (io.Reader, error) {
+	switch c := md.partCompression(); c {
+	case CompressionGzip, CompressionNone:
+		return body, nil
+	case CompressionZlib:
+		if md.CompressionDict == nil {
+			return zlib.NewReader(body)
+		}
+		return zlib.NewReaderDict(body, md.CompressionDict)
+	case CompressionZstd:
+		d, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
 		if err != nil {
-			r.w.CloseWithError(err)
-		} else {
-			r.w.Close()
+			return nil, err
 		}
+		return &zstdReader{d: d}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", c)
+	}
+}
+
+// zstdReader releases its decoder once the part has been read.
+type zstdReader struct {
+	d   *zstd.Decoder
+	err error
+}
+
+func (zr *zstdReader) Read(p []byte) (n int, err error) {
+	if zr.err != nil {
+		return 0, zr.err
+	}
+	n, zr.err = zr.d.Read(p)
+	if zr.err != nil {
+		zr.d.Close()
 	}
+	return n, zr.err
+}
+
+// copyDecoded copies a part's data to w while decoding each item it holds,
+// returning an error if the data isn't valid or if the number of items
+// doesn't match the count recorded in the part's metadata.
+func (r *S3Reader) copyDecoded(key string, resp *s3.GetObjectOutput, w io.Writer, body io.Reader) error {
+	pr, pw := io.Pipe()
+	decoded := make(chan error, 1)
+	go func() {
+		var count int64
+		dec := NewSimpleDecoder(pr)
+		for {
+			_, err := dec.ReadItem()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				err = fmt.Errorf("part %q contains invalid data: %v", key, err)
+				pr.CloseWithError(err)
+				decoded <- err
+				return
+			}
+			count++
+		}
+		if expected := partMetadata(resp.Metadata, partItemCountKey); expected != "" && expected != strconv.FormatInt(count, 10) {
+			decoded <- fmt.Errorf("part %q holds %d items; expected %s", key, count, expected)
+			return
+		}
+		decoded <- nil
+	}()
+
+	_, err := io.Copy(io.MultiWriter(w, pw), body)
+	pw.CloseWithError(err)
+	derr := <-decoded
+	if err != nil {
+		return err
+	}
+	return derr
+}
+
+// maxKeysOrDefault returns maxKeys, or DefaultMaxKeys if it's not set.
+func maxKeysOrDefault(maxKeys int64) int64 {
+	if maxKeys <= 0 {
+		return DefaultMaxKeys
+	}
+	return maxKeys
+}
+
+// partMetadata returns the value of a part's S3 object metadata key.
+// S3 may return the key with a different case to the one it was stored with.
+func partMetadata(md map[string]*string, key string) string {
+	for k, v := range md {
+		if strings.EqualFold(k, key) {
+			return aws.StringValue(v)
+		}
+	}
+	return ""
+}
+
+// lineCountWriter counts the lines and bytes written through it.
+type lineCountWriter struct {
+	w     io.Writer
+	lines int64
+	bytes int64
+}
+
+func (lw *lineCountWriter) Write(p []byte) (n int, err error) {
+	n, err = lw.w.Write(p)
+	lw.lines += int64(bytes.Count(p[:n], []byte{'\n'}))
+	lw.bytes += int64(n)
+	return n, err
 }
@@ -10,7 +10,9 @@ import (
 	"io"
 	"io/ioutil"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -18,7 +20,7 @@ import (
 
 func TestS3ReadOK(t *testing.T) {
 	f := &fakeS3GetLister{
-		list: func(input *s3.ListObjectsInput, fn func(p *s3.ListObjectsOutput, lastPage bool) (shouldContinue bool)) error {
+		list: func(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
 			//once.Do(func() {
 			if bucketName := aws.StringValue(input.Bucket); bucketName != "test-bucket" {
 				return fmt.Errorf("incorrect bucket for list %q", bucketName)
@@ -29,10 +31,10 @@ func TestS3ReadOK(t *testing.T) {
 
 			// generate a couple of pages
 			for i := 0; i < 2; i++ {
-				page := &s3.ListObjectsOutput{
+				page := &s3.ListObjectsV2Output{
 					Contents: []*s3.Object{
-						{Key: aws.String(fmt.Sprintf("key%d", 0+(2*i)))},
-						{Key: aws.String(fmt.Sprintf("key%d", 1+(2*i)))},
+						{Key: aws.String(testPartKey(1 + (2 * i)))},
+						{Key: aws.String(testPartKey(2 + (2 * i)))},
 					},
 				}
 				cont := fn(page, i == 1)
@@ -43,7 +45,7 @@ func TestS3ReadOK(t *testing.T) {
 			return nil
 		},
 
-		get: func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		get: withMetadata(func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
 			if bucketName := aws.StringValue(input.Bucket); bucketName != "test-bucket" {
 				return nil, fmt.Errorf("incorrect bucket for get %q", bucketName)
 			}
@@ -51,7 +53,7 @@ func TestS3ReadOK(t *testing.T) {
 				Body: ioutil.NopCloser(strings.NewReader(fmt.Sprintf("get %s\n", aws.StringValue(input.Key)))),
 			}
 			return resp, nil
-		},
+		}),
 	}
 
 	r := &S3Reader{
@@ -64,20 +66,99 @@ func TestS3ReadOK(t *testing.T) {
 	if err != nil {
 		t.Fatal("Unexpected error", err)
 	}
-	expected := "get key0\nget key1\nget key2\nget key3\n"
+	expected := fmt.Sprintf("get %s\nget %s\nget %s\nget %s\n", testPartKey(1), testPartKey(2), testPartKey(3), testPartKey(4))
 	if s := string(data); s != expected {
 		t.Errorf("expected=%q actual=%q", expected, s)
 	}
 }
 
+// testPartKey returns the key of a part of the backup at "test-prefix".
+func testPartKey(partNum int) string {
+	return fmt.Sprintf("test-prefix-part-%09d.json.gz", partNum)
+}
+
+// partLines returns a fakeS3GetLister serving parts holding the given
+// number of lines each.
+func partLines(lines ...int) *fakeS3GetLister {
+	return &fakeS3GetLister{
+		list: func(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
+			page := new(s3.ListObjectsV2Output)
+			for i := range lines {
+				page.Contents = append(page.Contents, &s3.Object{Key: aws.String(testPartKey(i + 1))})
+			}
+			fn(page, true)
+			return nil
+		},
+		get: withMetadata(func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+			var i int
+			fmt.Sscanf(aws.StringValue(input.Key), "test-prefix-part-%d.json.gz", &i)
+			data := strings.Repeat(fmt.Sprintf("part %d\n", i-1), lines[i-1])
+			return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(data))}, nil
+		}),
+	}
+}
+
+// Check that the parts whose items have all been read are counted, and
+// that skipped parts are neither read nor counted again.
+func TestS3ReadPartsCompleted(t *testing.T) {
+	r := &S3Reader{S3: partLines(2, 1, 3), Bucket: "test-bucket", PathPrefix: "test-prefix"}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	for items, expected := range []int64{0, 0, 1, 2, 2, 2, 3, 3} {
+		if n := r.PartsCompleted(int64(items)); n != expected {
+			t.Errorf("items=%d expected=%d actual=%d", items, expected, n)
+		}
+	}
+
+	r = &S3Reader{S3: partLines(2, 1, 3), Bucket: "test-bucket", PathPrefix: "test-prefix", SkipParts: 2}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if expected := "part 2\npart 2\npart 2\n"; string(data) != expected {
+		t.Errorf("expected=%q actual=%q", expected, data)
+	}
+	if n := r.PartsCompleted(0); n != 2 {
+		t.Error("Incorrect parts completed before reading", n)
+	}
+	if n := r.PartsCompleted(3); n != 3 {
+		t.Error("Incorrect parts completed", n)
+	}
+}
+
+// Check that keys listed beneath the part prefix that aren't parts of the
+// backup, such as those of a backup at "test-prefix-part-b", aren't read.
+func TestS3ReadIgnoresOtherKeys(t *testing.T) {
+	f := partLines(1, 2)
+	list := f.list
+	f.list = func(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
+		return list(input, func(p *s3.ListObjectsV2Output, lastPage bool) bool {
+			p.Contents = append(p.Contents,
+				&s3.Object{Key: aws.String("test-prefix-part-b-meta.json")},
+				&s3.Object{Key: aws.String("test-prefix-part-b-part-000000001.json.gz")})
+			return fn(p, lastPage)
+		})
+	}
+	r := &S3Reader{S3: f, Bucket: "test-bucket", PathPrefix: "test-prefix", SkipIntegrityCheck: true}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if expected := "part 0\npart 1\npart 1\n"; string(data) != expected {
+		t.Errorf("expected=%q actual=%q", expected, data)
+	}
+}
+
 // Check that an error response from list objects translates into a read error
 func TestS3ReadListFailed(t *testing.T) {
 	var testError = errors.New("test error")
 
 	f := &fakeS3GetLister{
-		list: func(input *s3.ListObjectsInput, fn func(p *s3.ListObjectsOutput, lastPage bool) (shouldContinue bool)) error {
+		list: func(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
 			return testError
 		},
+		get: withMetadata(nil),
 	}
 
 	r := &S3Reader{
@@ -97,10 +178,10 @@ func TestS3GetFailed(t *testing.T) {
 	var testError = errors.New("test error")
 
 	f := &fakeS3GetLister{
-		list: func(input *s3.ListObjectsInput, fn func(p *s3.ListObjectsOutput, lastPage bool) (shouldContinue bool)) error {
-			page := &s3.ListObjectsOutput{
+		list: func(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
+			page := &s3.ListObjectsV2Output{
 				Contents: []*s3.Object{
-					{Key: aws.String("key00")},
+					{Key: aws.String(testPartKey(1))},
 				},
 			}
 			fn(page, false)
@@ -129,22 +210,22 @@ func TestS3ReadFailed(t *testing.T) {
 	var testError = errors.New("test error")
 
 	f := &fakeS3GetLister{
-		list: func(input *s3.ListObjectsInput, fn func(p *s3.ListObjectsOutput, lastPage bool) (shouldContinue bool)) error {
-			page := &s3.ListObjectsOutput{
+		list: func(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
+			page := &s3.ListObjectsV2Output{
 				Contents: []*s3.Object{
-					{Key: aws.String("key00")},
+					{Key: aws.String(testPartKey(1))},
 				},
 			}
 			fn(page, false)
 			return nil
 		},
 
-		get: func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		get: withMetadata(func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
 			resp := &s3.GetObjectOutput{
 				Body: ioutil.NopCloser(&errReader{content: strings.NewReader("test"), err: testError}),
 			}
 			return resp, nil
-		},
+		}),
 	}
 
 	r := &S3Reader{
@@ -159,6 +240,50 @@ func TestS3ReadFailed(t *testing.T) {
 	}
 }
 
+// Check that once a read has failed, further reads report the same error
+// rather than a clean EOF.
+func TestS3ReadErrorRepeated(t *testing.T) {
+	var testError = errors.New("test error")
+
+	f := &fakeS3GetLister{
+		list: func(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
+			page := &s3.ListObjectsV2Output{
+				Contents: []*s3.Object{
+					{Key: aws.String(testPartKey(1))},
+					{Key: aws.String(testPartKey(2))},
+				},
+			}
+			fn(page, false)
+			return nil
+		},
+
+		get: withMetadata(func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+			if aws.StringValue(input.Key) == testPartKey(2) {
+				return nil, testError
+			}
+			return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader("test"))}, nil
+		}),
+	}
+
+	r := &S3Reader{
+		S3:         f,
+		Bucket:     "test-bucket",
+		PathPrefix: "test-prefix",
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != testError {
+		t.Fatal("Incorrect error response", err)
+	}
+	if string(data) != "test" {
+		t.Errorf("Incorrect data read before failure %q", data)
+	}
+	n, err := r.Read(make([]byte, 10))
+	if n != 0 || err != testError {
+		t.Errorf("Incorrect second read n=%d err=%v", n, err)
+	}
+}
+
 func TestS3ReadMetadata(t *testing.T) {
 	f := &fakeS3GetLister{
 		get: func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
@@ -191,8 +316,49 @@ func TestS3ReadMetadata(t *testing.T) {
 	}
 }
 
+// Check that the configured number of keys is requested per list page.
+func TestS3ReadMaxKeys(t *testing.T) {
+	for _, test := range []struct{ maxKeys, expected int64 }{{0, DefaultMaxKeys}, {10, 10}} {
+		var requested int64
+		f := &fakeS3GetLister{
+			list: func(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
+				requested = aws.Int64Value(input.MaxKeys)
+				fn(new(s3.ListObjectsV2Output), true)
+				return nil
+			},
+			get: withMetadata(nil),
+		}
+
+		r := &S3Reader{
+			S3:         f,
+			Bucket:     "test-bucket",
+			PathPrefix: "test-prefix",
+			MaxKeys:    test.maxKeys,
+		}
+		if _, err := ioutil.ReadAll(r); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		if requested != test.expected {
+			t.Errorf("maxKeys=%d expected=%d actual=%d", test.maxKeys, test.expected, requested)
+		}
+	}
+}
+
+// withMetadata wraps a fake GetObject function to return a metadata object
+// without a master hash for the metadata key.
+func withMetadata(get func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)) func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		if strings.HasSuffix(aws.StringValue(input.Key), "meta.json") {
+			return &s3.GetObjectOutput{
+				Body: ioutil.NopCloser(strings.NewReader(`{"table_name":"a_table"}`)),
+			}, nil
+		}
+		return get(input)
+	}
+}
+
 type fakeS3GetLister struct {
-	list func(input *s3.ListObjectsInput, fn func(p *s3.ListObjectsOutput, lastPage bool) (shouldContinue bool)) error
+	list func(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error
 	get  func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
 }
 
@@ -200,7 +366,7 @@ func (s3 *fakeS3GetLister) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOut
 	return s3.get(input)
 }
 
-func (s3 *fakeS3GetLister) ListObjectsPages(input *s3.ListObjectsInput, fn func(p *s3.ListObjectsOutput, lastPage bool) (shouldContinue bool)) error {
+func (s3 *fakeS3GetLister) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
 	return s3.list(input, fn)
 }
 
@@ -216,3 +382,162 @@ func (r *errReader) Read(p []byte) (n int, err error) {
 	}
 	return n, err
 }
+
+// Check that closing a reader part way through a backup stops it fetching
+// the remaining parts.
+func TestS3ReadClose(t *testing.T) {
+	fs3 := writeTestBackup(t, 5, false)
+	fl := fs3.getLister()
+	list := fl.list
+	listDone := make(chan struct{})
+	fl.list = func(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
+		defer close(listDone)
+		return list(input, fn)
+	}
+	get := fl.get
+	var gets int64
+	fl.get = func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		atomic.AddInt64(&gets, 1)
+		return get(input)
+	}
+
+	r := &S3Reader{
+		S3:         fl,
+		Bucket:     "test-bucket",
+		PathPrefix: "test-prefix",
+	}
+	if _, err := r.Read(make([]byte, 10)); err != nil {
+		t.Fatal("Read failed", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal("Close failed", err)
+	}
+
+	select {
+	case <-listDone:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for reader to stop")
+	}
+	// the metadata and the first part
+	if n := atomic.LoadInt64(&gets); n != 2 {
+		t.Error("Incorrect number of objects fetched", n)
+	}
+	if _, err := r.Read(make([]byte, 10)); err == nil {
+		t.Error("No error from Read after Close")
+	}
+}
+
+// writePrefixBackup writes a backup of the given number of parts to a new
+// fakeS3, returning the data written.
+func writePrefixBackup(t *testing.T, prefix, table string, seed, parts int) (*fakeS3, []byte) {
+	fs3 := newFakeS3()
+	w := NewS3Writer(fs3, "test-bucket", prefix, Metadata{TableName: table})
+	w.PartSize = MinPartSize
+	w.MaxParallel = 1
+
+	done := make(chan error)
+	go func() { done <- w.Run() }()
+	var data []byte
+	for i := 0; i < parts; i++ {
+		item := []byte(fmt.Sprintf("%d %x\n", i, randbytes(seed+i, MinPartSize)))
+		data = append(data, item...)
+		if _, err := w.Write(item); err != nil {
+			t.Fatal("Write failed", err)
+		}
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+	return fs3, data
+}
+
+// prefixLister routes requests to the backup whose prefix matches the key.
+func prefixLister(backups map[string]*fakeS3) *fakeS3GetLister {
+	find := func(key string) *fakeS3GetLister {
+		for prefix, fs3 := range backups {
+			if strings.HasPrefix(key, prefix+"-") {
+				return fs3.getLister()
+			}
+		}
+		return nil
+	}
+	return &fakeS3GetLister{
+		list: func(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
+			return find(aws.StringValue(input.Prefix)).list(input, fn)
+		},
+		get: func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+			return find(aws.StringValue(input.Key)).get(input)
+		},
+	}
+}
+
+// Check that several backups are read as one stream with combined metadata.
+func TestS3ReadPathPrefixes(t *testing.T) {
+	fs3a, dataA := writePrefixBackup(t, "backup-a", "a_table", 0, 3)
+	fs3b, dataB := writePrefixBackup(t, "backup-b", "a_table", 100, 2)
+	lister := prefixLister(map[string]*fakeS3{"backup-a": fs3a, "backup-b": fs3b})
+
+	for _, parallel := range []int{1, 3} {
+		r := &S3Reader{
+			S3:           lister,
+			Bucket:       "test-bucket",
+			PathPrefixes: []string{"backup-a", "backup-b"},
+			MaxParallel:  parallel,
+		}
+		md, err := r.Metadata()
+		if err != nil {
+			t.Fatal("Unexpected metadata error", err)
+		}
+		if md.TableName != "a_table" || md.PartCount != 5 || md.ItemCount != 5 || md.Status != StatusCompleted || md.MasterHash == "" {
+			t.Errorf("parallel=%d incorrect combined metadata %#v", parallel, md)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("parallel=%d read failed: %v", parallel, err)
+		}
+		if string(data) != string(dataA)+string(dataB) {
+			t.Errorf("parallel=%d read data does not match written data", parallel)
+		}
+		if n := r.PartsCompleted(5); n != 5 {
+			t.Errorf("parallel=%d incorrect parts completed %d", parallel, n)
+		}
+	}
+
+	// skipped parts are counted across both backups
+	r := &S3Reader{
+		S3:           lister,
+		Bucket:       "test-bucket",
+		PathPrefixes: []string{"backup-a", "backup-b"},
+		SkipParts:    4,
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("Read failed", err)
+	}
+	if string(data) != string(dataB[len(dataB)/2:]) {
+		t.Error("Incorrect data read after skipping parts")
+	}
+
+	// a corrupt part is reported against its backup
+	part := fs3b.parts["backup-b-part-000000001.json.gz"]
+	part.data[10]++
+	r = &S3Reader{S3: lister, Bucket: "test-bucket", PathPrefixes: []string{"backup-a", "backup-b"}}
+	if _, err := ioutil.ReadAll(r); err == nil || !strings.Contains(err.Error(), `backup at prefix "backup-b"`) {
+		t.Error("Incorrect error for corrupt part", err)
+	}
+}
+
+// Check that backups of different tables can't be read together.
+func TestS3ReadPathPrefixesMismatch(t *testing.T) {
+	fs3a, _ := writePrefixBackup(t, "backup-a", "a_table", 0, 1)
+	fs3b, _ := writePrefixBackup(t, "backup-b", "b_table", 0, 1)
+	r := &S3Reader{
+		S3:           prefixLister(map[string]*fakeS3{"backup-a": fs3a, "backup-b": fs3b}),
+		Bucket:       "test-bucket",
+		PathPrefixes: []string{"backup-a", "backup-b"},
+	}
+	if _, err := ioutil.ReadAll(r); err == nil || !strings.Contains(err.Error(), `is of table "b_table"`) {
+		t.Error("Incorrect error for mismatched tables", err)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3RefreshService defines the portion of the S3 service required by
+// S3Refresher.
+type S3RefreshService interface {
+	S3GetLister
+	S3PutHeader
+}
+
+// S3Refresher recalculates the part and item counts recorded in a backup's
+// metadata from the parts present in S3, such as after parts have been
+// added or removed by hand.
+//
+// Each part is listed and its item count is read from the object metadata
+// set by S3Writer, so the data itself is not read and part hashes are not
+// checked.  The compressed size of the backup is recalculated from the
+// listed part sizes, but the master hash and uncompressed size are left
+// unchanged, so a backup whose parts have changed will fail a master hash
+// check when it's read.
+//
+// Only the metadata of a completed backup is refreshed unless Force is set.
+// A backup written with DeferMetadata that hasn't completed can't be
+// refreshed, as it has no metadata at its usual key.
+type S3Refresher struct {
+	// MaxKeys is the maximum number of parts to list per request; defaults
+	// to DefaultMaxKeys.
+	MaxKeys int64
+
+	// Force allows the metadata of a backup that's still running, or that
+	// failed, to be refreshed.  Its status is left unchanged.
+	Force bool
+
+	s3         S3RefreshService
+	bucket     string
+	pathPrefix string
+	keyNamer   KeyNamer
+	md         Metadata
+	checked    int64
+	abort      int64
+}
+
+// NewS3Refresher creates and initializes an S3Refresher.  It fetches the
+// backup's metadata from S3 before returning to confirm that a valid backup
+// exists at the given pathPrefix.
+func NewS3Refresher(s3 S3RefreshService, bucket, pathPrefix string) (*S3Refresher, error) {
+	return NewS3RefresherWithKeyNamer(s3, bucket, pathPrefix, nil)
+}
+
+// NewS3RefresherWithKeyNamer is the same as NewS3Refresher, but locates the
+// backup's metadata and parts with keyNamer, which defaults to
+// DefaultKeyNamer if nil.
+func NewS3RefresherWithKeyNamer(s3 S3RefreshService, bucket, pathPrefix string, keyNamer KeyNamer) (*S3Refresher, error) {
+	if err := ValidatePathPrefix(pathPrefix); err != nil {
+		return nil, err
+	}
+	r := &S3Reader{
+		S3:         s3,
+		Bucket:     bucket,
+		PathPrefix: pathPrefix,
+		KeyNamer:   keyNamer,
+	}
+	md, err := r.Metadata()
+	if isNoSuchKey(err) {
+		if _, ierr := r.readInProgressMetadata(pathPrefix); ierr == nil {
+			return nil, fmt.Errorf("backup at prefix %q hasn't completed; only its in-progress metadata exists", pathPrefix)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &S3Refresher{
+		s3:         s3,
+		bucket:     bucket,
+		pathPrefix: pathPrefix,
+		keyNamer:   r.keyNamer(),
+		md:         md,
+	}, nil
+}
+
+// Metadata returns the metadata read by NewS3Refresher.
+func (r *S3Refresher) Metadata() Metadata {
+	return r.md
+}
+
+// Completed returns the number of parts that have been checked so far.
+// It may be called while a refresh is in progress.
+func (r *S3Refresher) Completed() int64 {
+	return atomic.LoadInt64(&r.checked)
+}
+
+// Abort requests the refresher stops checking parts.  The metadata is not
+// updated.
+func (r *S3Refresher) Abort() {
+	atomic.StoreInt64(&r.abort, 1)
+}
+
+// Refresh checks each of the backup's parts and rewrites its metadata with
+// the recalculated totals, returning the updated metadata.  It returns an
+// error without updating the metadata if a part has no recorded item count,
+// or if the backup isn't complete and Force isn't set.
+func (r *S3Refresher) Refresh() (md Metadata, err error) {
+	md = r.md
+	if md.Status != StatusCompleted && !r.Force {
+		return md, fmt.Errorf("backup status is %q, not %q", md.Status, StatusCompleted)
+	}
+	keyNamer := keyNamerOrDefault(r.keyNamer)
+	partPrefix := keyNamer.PartListPrefix(r.pathPrefix, &md)
+	isPart, err := partKeyFilter(keyNamer, r.pathPrefix, &md)
+	if err != nil {
+		return md, errors.New("Illegal path prefix")
+	}
+
+	var partCount, itemCount, compressedBytes int64
+	req := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(r.bucket),
+		Prefix:  aws.String(partPrefix),
+		MaxKeys: aws.Int64(maxKeysOrDefault(r.MaxKeys)),
+	}
+	s3err := r.s3.ListObjectsV2Pages(req, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, value := range page.Contents {
+			if r.isAborted() {
+				err = errors.New("aborted")
+				return false
+			}
+			key := aws.StringValue(value.Key)
+			if !isPart(key) {
+				continue
+			}
+			resp, herr := r.s3.HeadObject(&s3.HeadObjectInput{
+				Bucket: aws.String(r.bucket),
+				Key:    value.Key,
+			})
+			if herr != nil {
+				err = fmt.Errorf("failed to read part %q: %v", key, herr)
+				return false
+			}
+			count, perr := strconv.ParseInt(partMetadata(resp.Metadata, partItemCountKey), 10, 64)
+			if perr != nil {
+				err = fmt.Errorf("part %q has no valid item count", key)
+				return false
+			}
+			partCount++
+			itemCount += count
+			compressedBytes += aws.Int64Value(value.Size)
+			atomic.AddInt64(&r.checked, 1)
+		}
+		return true
+	})
+	if s3err != nil {
+		return md, s3err
+	}
+	if err != nil {
+		return md, err
+	}
+
+	md.PartCount = partCount
+	md.ItemCount = itemCount
+	md.CompressedBytes = compressedBytes
+	if err := putMetadata(r.s3, &s3.PutObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(keyNamer.MetaKey(r.pathPrefix)),
+	}, md); err != nil {
+		return r.md, err
+	}
+	r.md = md
+	return md, nil
+}
+
+func (r *S3Refresher) isAborted() bool {
+	return atomic.LoadInt64(&r.abort) != 0
+}
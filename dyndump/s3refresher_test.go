@@ -0,0 +1,137 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type fakeS3Refresher struct {
+	*fakeS3GetLister
+	*fakeS3
+}
+
+// Check that removing a part from a backup is reflected in its metadata
+// once refreshed.
+func TestRefreshOK(t *testing.T) {
+	fs3 := writeTestBackup(t, 4, false)
+	delete(fs3.parts, "test-prefix-part-000000002.json.gz")
+	fs3.parts["test-prefix-part-ignore-this.json.gz"] = putdata{}
+
+	r, err := NewS3Refresher(&fakeS3Refresher{fs3.getLister(), fs3}, "test-bucket", "test-prefix")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if md := r.Metadata(); md.PartCount != 4 || md.ItemCount != 4 {
+		t.Fatalf("Incorrect initial metadata parts=%d items=%d", md.PartCount, md.ItemCount)
+	}
+	md, err := r.Refresh()
+	if err != nil {
+		t.Fatal("Refresh failed", err)
+	}
+
+	var stored Metadata
+	if err := json.Unmarshal(fs3.metadata, &stored); err != nil {
+		t.Fatal("Failed to decode metadata", err)
+	}
+	for _, md := range []Metadata{md, stored} {
+		if md.PartCount != 3 || md.ItemCount != 3 || md.CompressedBytes != 3*MinPartSize {
+			t.Errorf("Incorrect metadata parts=%d items=%d compressed=%d", md.PartCount, md.ItemCount, md.CompressedBytes)
+		}
+		if md.TableName != "a_table" || md.Status != StatusCompleted {
+			t.Errorf("Metadata not preserved table=%q status=%q", md.TableName, md.Status)
+		}
+	}
+	if n := r.Completed(); n != 3 {
+		t.Error("Incorrect completed count", n)
+	}
+}
+
+// Check that the metadata of a backup that isn't complete is only
+// refreshed if Force is set, and that its status is preserved.
+func TestRefreshNotCompleted(t *testing.T) {
+	fs3 := writeTestBackup(t, 2, false)
+	var md Metadata
+	if err := json.Unmarshal(fs3.metadata, &md); err != nil {
+		t.Fatal("Failed to decode metadata", err)
+	}
+	md.Status = StatusFailed
+	data, err := json.Marshal(md)
+	if err != nil {
+		t.Fatal("Failed to encode metadata", err)
+	}
+	fs3.metadata = data
+
+	r, err := NewS3Refresher(&fakeS3Refresher{fs3.getLister(), fs3}, "test-bucket", "test-prefix")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if _, err := r.Refresh(); err == nil || !strings.Contains(err.Error(), "backup status is") {
+		t.Error("Incorrect error", err)
+	}
+	if string(fs3.metadata) != string(data) {
+		t.Error("Metadata was changed")
+	}
+
+	r.Force = true
+	md, err = r.Refresh()
+	if err != nil {
+		t.Fatal("Forced refresh failed", err)
+	}
+	if md.PartCount != 2 || md.Status != StatusFailed {
+		t.Errorf("Incorrect metadata parts=%d status=%q", md.PartCount, md.Status)
+	}
+}
+
+// Check that a backup written with DeferMetadata that never completed
+// can't be refreshed.
+func TestRefreshDeferredAborted(t *testing.T) {
+	fs3 := newFakeS3()
+	w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+	w.PartSize = MinPartSize
+	w.MaxParallel = 1
+	w.DeferMetadata = true
+
+	done := make(chan error)
+	go func() { done <- w.Run() }()
+	if _, err := w.Write(randbytes(1, MinPartSize)); err != nil {
+		t.Fatal("Write failed", err)
+	}
+	w.Abort()
+	if err := <-done; err == nil {
+		t.Fatal("No error returned from Run")
+	}
+
+	_, err := NewS3Refresher(&fakeS3Refresher{fs3.getLister(), fs3}, "test-bucket", "test-prefix")
+	if err == nil || !strings.Contains(err.Error(), "only its in-progress metadata exists") {
+		t.Error("Incorrect error", err)
+	}
+	if fs3.metaKey != "" {
+		t.Error("Metadata was written")
+	}
+}
+
+// Check that a part without an item count fails the refresh without
+// changing the metadata.
+func TestRefreshNoItemCount(t *testing.T) {
+	fs3 := writeTestBackup(t, 2, false)
+	part := fs3.parts["test-prefix-part-000000001.json.gz"]
+	part.md = nil
+	fs3.parts["test-prefix-part-000000001.json.gz"] = part
+	before := string(fs3.metadata)
+
+	r, err := NewS3Refresher(&fakeS3Refresher{fs3.getLister(), fs3}, "test-bucket", "test-prefix")
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if _, err := r.Refresh(); err == nil || !strings.Contains(err.Error(), "has no valid item count") {
+		t.Error("Incorrect error", err)
+	}
+	if string(fs3.metadata) != before {
+		t.Error("Metadata was changed")
+	}
+}
@@ -7,17 +7,30 @@ package dyndump
 import (
 	"bytes"
 	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/juju/ratelimit"
+	"github.com/klauspost/compress/zstd"
 )
 
 const (
@@ -30,6 +43,35 @@ const (
 
 	// MinPartSize defines the minimum value that can be used for PartSize.
 	MinPartSize = 1000
+
+	// DefaultMetadataRetries sets the default number of times the final
+	// metadata write is retried after all parts have been uploaded.
+	DefaultMetadataRetries = 3
+
+	// DefaultPartKeyWidth is the default number of digits in the part
+	// number of each part key, zero padded so that parts are listed in
+	// order.
+	DefaultPartKeyWidth = 9
+
+	// maxDeleteKeys is the maximum number of keys S3 accepts in a single
+	// DeleteObjects request.
+	maxDeleteKeys = 1000
+
+	// MaxPathPrefixLen defines the maximum length of a path prefix, leaving
+	// room for the object names appended to it within S3's key length limit.
+	MaxPathPrefixLen = 1000
+
+	// MaxCompressionDictSize is the maximum number of bytes of a compression
+	// dictionary that are used; any bytes before the final
+	// MaxCompressionDictSize are ignored by the compressor.
+	MaxCompressionDictSize = 32 * 1024
+
+	// s3 object metadata keys set on each part
+	partHashKey      = "dyndump-sha256"
+	partItemCountKey = "dyndump-itemcount"
+	partRawSizeKey   = "dyndump-rawsize"
+
+	datePartitionFormat = "dt=2006-01-02/"
 )
 
 // S3Puter defines the portion of the S3 service required by S3Writer.
@@ -37,22 +79,272 @@ type S3Puter interface {
 	PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
 }
 
+// s3ContextPuter is implemented by the SDK's S3 client.  S3Writer uses it
+// to supply the hashes of rate limited parts, which the SDK would otherwise
+// read the part through the limit to compute before sending it.
+type s3ContextPuter interface {
+	PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error)
+}
+
+// S3PutHeader defines the portion of the S3 service required by S3Writer
+// when CheckpointFile or WriteOnce is set.
+type S3PutHeader interface {
+	S3Puter
+	HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+}
+
+// S3PutDeleter defines the portion of the S3 service required by S3Writer
+// when CleanupOnAbort is set.
+type S3PutDeleter interface {
+	S3Puter
+	DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error)
+}
+
+// metadataRetryDelay is the delay before the first retry of the final
+// metadata write, doubling with each further attempt.
+var metadataRetryDelay = time.Second
+
+// partRetryDelay is the delay before the first retry of a part upload,
+// doubling with each further attempt.
+var partRetryDelay = time.Second
+
+// MetadataError is returned by S3Writer.Run when every part of a backup was
+// uploaded but the final metadata could not be written.  The backup may be
+// completed by writing Metadata to Key.
+type MetadataError struct {
+	Key      string   // The key the metadata should be written to
+	Metadata Metadata // The metadata of the completed backup
+	Attempts int      // Number of writes attempted
+	Err      error    // The error returned by the final attempt
+}
+
+func (e *MetadataError) Error() string {
+	return fmt.Sprintf("all %d parts uploaded but writing metadata to %q failed after %d attempts: %v",
+		e.Metadata.PartCount, e.Key, e.Attempts, e.Err)
+}
+
+// S3WriterStats is returned by S3Writer.Stats to report the data uploaded.
+type S3WriterStats struct {
+	PartCount         int64
+	UncompressedBytes int64
+	CompressedBytes   int64
+}
+
 // S3Writer takes a stream of JSON data and uploads it
 // in parallel to S3.
 //
+// The data should hold an item per line, as written by SimpleEncoder or
+// BufferedEncoder; the item count of each part and of the backup are the
+// number of lines written, however many items each Write holds.  The
+// output of a SimpleEncoder with Indent or AsArray set must not be written,
+// as its item counts would be wrong and its parts couldn't be read or
+// verified individually by S3Reader.
+//
 // It divides the stream into multiple pieces which store a maximum of
 // approximately PartSize bytes each.
 //
 // Each part is given a key name beginning with PathPrefix and also uploads
 // a metadata file on completion which summarizes the table.
+//
+// Unless KeyNamer is set, keys are named by appending a "-" separator and
+// the object name to PathPrefix.  For example a PathPrefix of
+// "backups/mytable" stores its metadata as "backups/mytable-meta.json" and
+// its parts as "backups/mytable-part-000000001.json.gz".  The separator is
+// added even if PathPrefix ends with "/" or "-"; set KeyNamer to
+// NormalizedKeyNamer to omit it.
+//
+// If DatePartition is set then parts are stored beneath a date path
+// derived from the backup's start time, to allow S3 lifecycle rules to
+// expire them by prefix.  For example a PathPrefix of "backups/mytable"
+// started on 2016-04-01 stores its parts as
+// "backups/mytable-dt=2016-04-01/part-000000001.json.gz".  The path is recorded in
+// the metadata so S3Reader and S3Deleter can locate the parts.
+//
+// The SHA256 hash of each part's uncompressed data is stored in the part's
+// object metadata, and a master hash of all the part hashes is stored in the
+// backup's metadata on completion, allowing S3Reader to verify the backup
+// when it's read.
+//
+// If CheckpointFile is set then the key and hash of each uploaded part is
+// recorded in a local file.  If the writer is restarted with the same
+// bucket, prefix and checkpoint file then any part whose data matches a
+// recorded part, and which is confirmed to still exist in S3, is not
+// uploaded again.  The file is removed once the backup completes.
+//
+// Parts are gzip compressed unless Compression is set.  Zlib compressed
+// parts are named with a ".json.zlib" suffix in place of ".json.gz" and
+// stored with a "deflate" content encoding, zstd compressed parts are named
+// with a ".json.zst" suffix and stored with a "zstd" content encoding, while
+// uncompressed parts are named with a ".json" suffix and stored without a
+// content encoding.  The
+// compression is recorded in the metadata for S3Reader.  If CompressionDict
+// is set then parts are zlib compressed using the dictionary as a preset,
+// which is stored in the metadata for S3Reader to decompress them with.
+//
+// The metadata is normally written when the writer starts and updated as
+// each part completes, so a reader may find a backup that's still running
+// or that failed.  If DeferMetadata is set then the metadata is instead
+// written to an in-progress key, such as
+// "backups/mytable-meta.inprogress.json", until the backup completes, and
+// is only then written to the usual key.
+// Readers that look for the usual key therefore only find completed
+// backups.  The in-progress key is deleted on completion if S3 implements
+// S3PutDeleter, and is left holding the failed status if the backup fails.
+//
+// Each part's key is allocated from a sequential part number before it's
+// first uploaded.  If PartRetries is set then a failed PutObject of a part
+// is retried with the same key, so an upload that succeeded but was
+// reported as failed, such as one that timed out after S3 stored the
+// object, is overwritten by the retry rather than leaving a second copy of
+// the part under a new key to be counted twice by readers.
+//
+// If WriteOnce is set then no object is ever written more than once, for
+// buckets that use S3 Object Lock or a policy that rejects overwrites.  The
+// metadata is written only once the backup completes or fails, and the
+// writer fails rather than overwrite a part or metadata key that already
+// exists.
 type S3Writer struct {
 	S3          S3Puter
 	Bucket      string // S3 bucket name to upload to
 	PathPrefix  string // Prefix to apply to each part of the backup
 	PartSize    int    // number of bytes to store each part
 	MaxParallel int    // Maximum number of parallel uploads to perform to S3
+	SkipHashing bool   // If true then part and master hashes are not calculated
+
+	// CleanupOnAbort causes the parts uploaded and the metadata to be
+	// deleted if the writer is aborted or fails, rather than leaving them
+	// in place with the metadata marked as failed.  They're kept if only
+	// the final metadata can't be written, so the backup can be completed
+	// by hand.  S3 must implement S3PutDeleter.
+	CleanupOnAbort bool
+
+	// UploadBandwidth limits the aggregate number of bytes per second
+	// uploaded to S3 by all workers.  Set to 0 for unlimited.  An upload
+	// waiting on the limit is stopped by Abort.
+	UploadBandwidth int64
+
+	// DatePartition stores parts beneath a "dt=YYYY-MM-DD/" path, using the
+	// UTC date the backup started.
+	DatePartition bool
+
+	// CheckpointFile is the path of a local file used to record completed
+	// parts so that an interrupted upload may be resumed.  Parts are only
+	// skipped if hashing is enabled.  S3 must implement S3PutHeader.
+	CheckpointFile string
+
+	// Compression selects how parts are compressed; defaults to
+	// CompressionGzip, or CompressionZlib if CompressionDict is set.
+	Compression PartCompression
+
+	// CompressionDict holds a sample of representative item data used to
+	// prime the compressor of each part, improving the compression of
+	// small parts holding items with a similar structure.  Only the final
+	// MaxCompressionDictSize bytes are used.
+	//
+	// The gain is largest for small parts, as the compressor otherwise
+	// learns the structure of the items from the part itself.  For items
+	// sharing a schema, a dictionary of 200 sample items reduced 4KiB parts
+	// by around 15%, but parts of 64KiB or more by under 2%.
+	CompressionDict []byte
+
+	// CompressionLevel sets the gzip or zlib compression level of each
+	// part, from gzip.HuffmanOnly to gzip.BestCompression; 0 uses the
+	// default level.  gzip.BestSpeed trades ratio for speed on CPU bound
+	// dumps, while gzip.BestCompression suits archival backups.  Use
+	// CompressionNone to store parts uncompressed.  zstd parts map levels 1
+	// to 9 to the nearest zstd encoder level, and don't support
+	// gzip.HuffmanOnly.
+	CompressionLevel int
+
+	// GzipFlushInterval is the number of uncompressed bytes written to a
+	// part's compressor between flushes; defaults to PartSize/10.  Flushing
+	// allows the compressed size of the part to be measured, so that it's
+	// completed once it reaches PartSize, but ends the current compressed
+	// block early, reducing the compression ratio.  A larger interval
+	// compresses better, at the cost of parts overshooting PartSize by up
+	// to the compressed size of an interval's data.  Set to a negative
+	// value to never flush, leaving parts to be measured by the blocks the
+	// compressor emits by itself, which may overshoot by tens of KiB.
+	GzipFlushInterval int
+
+	// MaxReorderDepth limits the number of part hashes held while waiting
+	// for earlier parts to complete, so that they can be folded into the
+	// master hash in order.  Once reached, workers that complete a part out
+	// of order wait for the earlier parts before continuing.  Set to 0 for
+	// unlimited.
+	MaxReorderDepth int
+
+	// DeferMetadata writes the metadata to an in-progress key until the
+	// backup completes successfully.
+	DeferMetadata bool
+
+	// WriteOnce ensures that each object is written at most once.  S3 must
+	// implement S3PutHeader.
+	WriteOnce bool
+
+	// MetadataRetries is the number of times the final metadata write is
+	// retried once all parts have been uploaded.
+	MetadataRetries int
+
+	// PartRetries is the number of times a failed PutObject of a part is
+	// retried, in addition to the retries made by the S3 service itself.
+	// If WriteOnce is set then the part is checked before each retry and
+	// the upload is treated as complete if it already holds the part's
+	// hash.  Parts uploaded with UseMultipartUpload are not retried.
+	PartRetries int
+
+	// KeyNamer determines the keys the metadata and parts are stored at;
+	// defaults to DefaultKeyNamer.
+	KeyNamer KeyNamer
+
+	// PartKeyWidth sets the number of digits the part number of each part
+	// key is zero padded to; defaults to DefaultPartKeyWidth.  Parts are
+	// only listed in order while their numbers fit within the width.  The
+	// width is recorded in the metadata for S3Deleter and S3Refresher.
+	PartKeyWidth int
+
+	// ACL is the canned ACL applied to each part and the metadata, such as
+	// s3.ObjectCannedACLBucketOwnerFullControl to give the owner of a
+	// bucket in another account access to the backup.  If empty the
+	// bucket's default is used.
+	ACL string
+
+	// ServerSideEncryption is the server side encryption applied to each
+	// part and the metadata, either s3.ServerSideEncryptionAes256 or
+	// s3.ServerSideEncryptionAwsKms.  If empty the bucket's default is used.
+	ServerSideEncryption string
+
+	// SSEKMSKeyID is the ID of the KMS key used to encrypt each object when
+	// ServerSideEncryption is s3.ServerSideEncryptionAwsKms.  If empty the
+	// account's default key for S3 is used.
+	SSEKMSKeyID string
+
+	// StorageClass is the S3 storage class each part is stored with, such
+	// as s3.StorageClassStandardIa for backups that are rarely read.  The
+	// metadata is always stored with the standard class so that it remains
+	// cheap to read.  Parts stored as GLACIER or DEEP_ARCHIVE must be
+	// restored before the backup can be read.  If empty the standard class
+	// is used.
+	StorageClass string
+
+	// UseMultipartUpload streams each part to S3 in chunks of 5MiB using a
+	// multipart upload as its data is compressed, rather than buffering the
+	// whole part in a temporary file before uploading it.  Each worker holds
+	// up to a chunk in memory instead.  Parts smaller than a chunk are
+	// uploaded with PutObject.  As S3 only accepts object metadata at the
+	// start of an upload, each completed part is copied over itself to set
+	// its hash and item count, so this can't be combined with WriteOnce.
+	// S3 must implement S3MultipartPuter.
+	UseMultipartUpload bool
 
 	md              Metadata
+	uploadLimit     *ratelimit.Bucket
+	uploadStop      chan struct{} // closed by Abort to stop rate limited uploads
+	hashes          *reorderBuffer
+	keys            []string // keys of the parts uploaded
+	checkpoint      *uploadCheckpoint
+	skippedParts    int64
+	aborted         bool
 	partnum         int32
 	rawBytes        int64
 	compressedBytes int64
@@ -64,10 +356,14 @@ type S3Writer struct {
 	mm              sync.Mutex // metadata mutex
 }
 
-// NewS3Writer creates and initializes a new S3Writer
+// NewS3Writer creates and initializes a new S3Writer.  The metadata's Type
+// defaults to BackupFull; set it to BackupQuery if the backup holds only
+// the items matched by a query.
 func NewS3Writer(s3 S3Puter, bucket, pathPrefix string, metadata Metadata) *S3Writer {
 	metadata.Status = StatusRunning
-	metadata.Type = BackupFull
+	if metadata.Type == "" {
+		metadata.Type = BackupFull
+	}
 	metadata.StartTime = time.Now()
 	metadata.EndTime = nil
 	metadata.PartCount = 0
@@ -76,13 +372,15 @@ func NewS3Writer(s3 S3Puter, bucket, pathPrefix string, metadata Metadata) *S3Wr
 	metadata.ItemCount = 0
 
 	return &S3Writer{
-		S3:          s3,
-		Bucket:      bucket,
-		PathPrefix:  pathPrefix,
-		PartSize:    DefaultPartSize,
-		MaxParallel: DefaultS3MaxParallel,
-		md:          metadata,
-		data:        make(chan []byte),
+		S3:              s3,
+		Bucket:          bucket,
+		PathPrefix:      pathPrefix,
+		PartSize:        DefaultPartSize,
+		MaxParallel:     DefaultS3MaxParallel,
+		MetadataRetries: DefaultMetadataRetries,
+		md:              metadata,
+		data:            make(chan []byte),
+		uploadStop:      make(chan struct{}),
 	}
 }
 
@@ -97,6 +395,87 @@ func (w *S3Writer) Run() error {
 	if w.MaxParallel < 1 {
 		return errors.New("MaxParallel must be 1 or greater")
 	}
+	if err := ValidatePathPrefix(w.PathPrefix); err != nil {
+		return err
+	}
+	if w.SSEKMSKeyID != "" && w.ServerSideEncryption != s3.ServerSideEncryptionAwsKms {
+		return errors.New("SSEKMSKeyID requires ServerSideEncryption to be aws:kms")
+	}
+	switch w.compression() {
+	case CompressionGzip, CompressionZlib, CompressionZstd, CompressionNone:
+	default:
+		return fmt.Errorf("unsupported compression %q", w.Compression)
+	}
+	if w.CompressionDict != nil && w.compression() != CompressionZlib {
+		return errors.New("CompressionDict requires zlib compression")
+	}
+	if w.CompressionLevel < gzip.HuffmanOnly || w.CompressionLevel > gzip.BestCompression {
+		return fmt.Errorf("invalid CompressionLevel %d", w.CompressionLevel)
+	}
+	if w.CompressionLevel == gzip.HuffmanOnly && w.compression() == CompressionZstd {
+		return errors.New("HuffmanOnly CompressionLevel isn't supported by zstd")
+	}
+	if w.PartRetries < 0 {
+		return errors.New("PartRetries may not be negative")
+	}
+	if w.CleanupOnAbort {
+		if _, ok := w.S3.(S3PutDeleter); !ok {
+			return errors.New("CleanupOnAbort requires an S3 service that supports DeleteObjects")
+		}
+	}
+	if w.WriteOnce {
+		if _, ok := w.S3.(S3PutHeader); !ok {
+			return errors.New("WriteOnce requires an S3 service that supports HeadObject")
+		}
+		// check now, rather than failing to write the metadata at the end
+		key := w.keyNamer().MetaKey(w.PathPrefix)
+		if exists, err := w.objectExists(key); err != nil {
+			return err
+		} else if exists {
+			return fmt.Errorf("Metadata key %q already exists", key)
+		}
+	}
+	if w.UseMultipartUpload {
+		if _, ok := w.S3.(S3MultipartPuter); !ok {
+			return errors.New("UseMultipartUpload requires an S3 service that supports multipart uploads and CopyObject")
+		}
+		if w.WriteOnce {
+			return errors.New("UseMultipartUpload cannot be used with WriteOnce")
+		}
+	}
+	if w.CheckpointFile != "" {
+		if _, ok := w.S3.(S3PutHeader); !ok {
+			return errors.New("CheckpointFile requires an S3 service that supports HeadObject")
+		}
+		cp, err := w.loadCheckpoint()
+		if err != nil {
+			return err
+		}
+		w.checkpoint = cp
+	}
+	if !w.SkipHashing {
+		w.fm.Lock()
+		w.hashes = newReorderBuffer(w.MaxReorderDepth)
+		w.fm.Unlock()
+	}
+	if w.UploadBandwidth > 0 {
+		w.uploadLimit = ratelimit.NewBucketWithQuantum(time.Second, w.UploadBandwidth, w.UploadBandwidth)
+	}
+	if w.checkpoint != nil && w.checkpoint.PartPath != "" {
+		// keep resumed parts beneath the path they were originally written to
+		w.md.PartPath = w.checkpoint.PartPath
+	} else if w.DatePartition {
+		w.md.PartPath = w.md.StartTime.UTC().Format(datePartitionFormat)
+	}
+	if len(w.CompressionDict) > MaxCompressionDictSize {
+		w.CompressionDict = w.CompressionDict[len(w.CompressionDict)-MaxCompressionDictSize:]
+	}
+	w.md.CompressionDict = w.CompressionDict
+	w.md.Compression = w.compression()
+	w.md.PartKeyWidth = w.partKeyWidth()
+	if w.checkpoint != nil {
+		w.checkpoint.PartPath = w.md.PartPath
+	}
 	if err := w.flushMetadata(); err != nil {
 		return err
 	}
@@ -108,13 +487,57 @@ func (w *S3Writer) Run() error {
 	now := time.Now()
 	w.md.EndTime = &now
 	if err := w.failError(); err != nil {
+		if w.CleanupOnAbort {
+			if cerr := w.cleanup(); cerr != nil {
+				return fmt.Errorf("%v; cleanup failed: %v", err, cerr)
+			}
+			w.removeCheckpoint()
+			return err
+		}
 		w.md.Status = StatusFailed
 		w.flushMetadata()
 		return err
 	}
 
+	if !w.SkipHashing {
+		w.md.MasterHash = w.hashes.sum()
+	}
 	w.md.Status = StatusCompleted
-	return w.flushMetadata()
+	if err := w.flushFinalMetadata(); err != nil {
+		return err
+	}
+	if err := w.removeInProgressMetadata(); err != nil {
+		return err
+	}
+	return w.removeCheckpoint()
+}
+
+// SetItemSizes records a histogram of the size of the items in the backup
+// in its metadata.  It should be called before the writer is closed.
+func (w *S3Writer) SetItemSizes(h SizeHistogram) {
+	w.mm.Lock()
+	defer w.mm.Unlock()
+	w.md.ItemSizes = &h
+}
+
+// Stats returns the number of parts completed so far and the size of the
+// data they hold before and after compression.  It is safe to call from
+// concurrent goroutines.
+func (w *S3Writer) Stats() S3WriterStats {
+	w.mm.Lock()
+	defer w.mm.Unlock()
+	return S3WriterStats{
+		PartCount:         w.md.PartCount,
+		UncompressedBytes: w.md.UncompressedBytes,
+		CompressedBytes:   w.md.CompressedBytes,
+	}
+}
+
+// SkippedParts returns the number of parts that were not uploaded because
+// they had already been uploaded by a previous run recorded in
+// CheckpointFile.
+func (w *S3Writer) SkippedParts() int64 {
+	return atomic.LoadInt64(&w.skippedParts)
 }
 
 // Write takes a single block of JSON text and sends it to S3.
@@ -136,42 +559,455 @@ func (w *S3Writer) Close() error {
 	return w.failed
 }
 
-// Abort closes the writer and marks the metadata state as failed
+// Abort closes the writer and marks the metadata state as failed, or
+// deletes the backup if CleanupOnAbort is set.
 func (w *S3Writer) Abort() error {
+	w.fm.Lock()
+	if !w.aborted && w.uploadStop != nil {
+		close(w.uploadStop)
+	}
+	w.aborted = true
+	w.fm.Unlock()
 	w.fail(errors.New("aborted"))
 	return w.Close()
 }
 
-func (w *S3Writer) completePart(deltaRaw, deltaCompressed, deltaItems int64) error {
+// cleanup deletes the parts uploaded by the writer, followed by the
+// metadata.
+func (w *S3Writer) cleanup() error {
+	svc := w.S3.(S3PutDeleter)
+	keys := append(w.keys, w.metaKey())
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxDeleteKeys {
+			n = maxDeleteKeys
+		}
+		del := &s3.DeleteObjectsInput{
+			Bucket: aws.String(w.Bucket),
+			Delete: &s3.Delete{Quiet: aws.Bool(true)},
+		}
+		for _, key := range keys[:n] {
+			del.Delete.Objects = append(del.Delete.Objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		resp, err := svc.DeleteObjects(del)
+		if err != nil {
+			return err
+		}
+		if errs := resp.Errors; len(errs) > 0 {
+			return fmt.Errorf("Failed to delete key %q: %v",
+				aws.StringValue(errs[0].Key),
+				aws.StringValue(errs[0].Message))
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+func (w *S3Writer) completePart(partNum int32, key string, hash []byte, deltaRaw, deltaCompressed, deltaItems int64) error {
+	if err := w.recordPart(key, hash, deltaRaw, deltaCompressed, deltaItems); err != nil {
+		return err
+	}
+	// may block until earlier parts complete, so must be called without mm
+	if hash != nil && !w.hashes.add(partNum, hash) {
+		return w.failError()
+	}
+	return nil
+}
+
+func (w *S3Writer) recordPart(key string, hash []byte, deltaRaw, deltaCompressed, deltaItems int64) error {
 	w.mm.Lock()
 	defer w.mm.Unlock()
 
+	w.keys = append(w.keys, key)
 	w.md.UncompressedBytes += deltaRaw
 	w.md.CompressedBytes += deltaCompressed
 	w.md.ItemCount += deltaItems
 	w.md.PartCount++
+	if w.checkpoint != nil && hash != nil {
+		w.checkpoint.Parts[key] = hex.EncodeToString(hash)
+		if err := w.saveCheckpoint(); err != nil {
+			return err
+		}
+	}
 	return w.flushMetadata()
 }
 
-func (w *S3Writer) flushMetadata() error {
-	data, err := json.MarshalIndent(w.md, "", "  ")
+// uploadCheckpoint is stored in CheckpointFile to record the parts of a
+// backup that have been uploaded.
+type uploadCheckpoint struct {
+	Bucket     string            `json:"bucket"`
+	PathPrefix string            `json:"path_prefix"`
+	PartPath   string            `json:"part_path"`
+	Parts      map[string]string `json:"parts"` // part key to hex encoded hash
+}
+
+// loadCheckpoint reads CheckpointFile, returning an empty checkpoint if
+// the file doesn't exist yet.
+func (w *S3Writer) loadCheckpoint() (*uploadCheckpoint, error) {
+	cp := &uploadCheckpoint{
+		Bucket:     w.Bucket,
+		PathPrefix: w.PathPrefix,
+		Parts:      make(map[string]string),
+	}
+	data, err := ioutil.ReadFile(w.CheckpointFile)
+	if os.IsNotExist(err) {
+		return cp, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint file: %v", err)
+	}
+	if cp.Bucket != w.Bucket || cp.PathPrefix != w.PathPrefix {
+		return nil, fmt.Errorf("checkpoint file is for bucket=%q prefix=%q", cp.Bucket, cp.PathPrefix)
+	}
+	if cp.Parts == nil {
+		cp.Parts = make(map[string]string)
+	}
+	return cp, nil
+}
+
+// saveCheckpoint writes the checkpoint to a temporary file and renames it
+// over CheckpointFile so that an interruption never leaves a partial file.
+// The caller must hold mm.
+func (w *S3Writer) saveCheckpoint() error {
+	data, err := json.MarshalIndent(w.checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpName := w.CheckpointFile + ".tmp"
+	if err := ioutil.WriteFile(tmpName, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, w.CheckpointFile)
+}
+
+func (w *S3Writer) removeCheckpoint() error {
+	if w.checkpoint == nil {
+		return nil
+	}
+	if err := os.Remove(w.CheckpointFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// isUploaded returns true if the checkpoint records key as having been
+// uploaded with the given hash, and the object still exists in S3 with
+// that hash.
+func (w *S3Writer) isUploaded(key string, hash []byte) (bool, error) {
+	if w.checkpoint == nil || hash == nil {
+		return false, nil
+	}
+	hexHash := hex.EncodeToString(hash)
+	w.mm.Lock()
+	recorded := w.checkpoint.Parts[key]
+	w.mm.Unlock()
+	if recorded != hexHash {
+		return false, nil
+	}
+
+	resp, err := w.headObject(key)
+	if resp == nil || err != nil {
+		return false, err
+	}
+	return partMetadata(resp.Metadata, partHashKey) == hexHash, nil
+}
+
+// objectExists returns true if key already exists in S3.
+func (w *S3Writer) objectExists(key string) (bool, error) {
+	resp, err := w.headObject(key)
+	return resp != nil, err
+}
+
+// headObject returns the head of key, or nil if it doesn't exist.
+func (w *S3Writer) headObject(key string) (*s3.HeadObjectOutput, error) {
+	resp, err := w.S3.(S3PutHeader).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(w.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// metaKey returns the key the metadata is currently written to.
+func (w *S3Writer) metaKey() string {
+	if w.DeferMetadata && w.md.Status != StatusCompleted {
+		return inProgressMetaKey(w.keyNamer(), w.PathPrefix)
+	}
+	return w.keyNamer().MetaKey(w.PathPrefix)
+}
+
+func (w *S3Writer) keyNamer() KeyNamer {
+	return keyNamerOrDefault(w.KeyNamer)
+}
+
+// removeInProgressMetadata deletes the in-progress metadata written before
+// the backup completed, if S3 supports it.
+func (w *S3Writer) removeInProgressMetadata() error {
+	svc, ok := w.S3.(S3PutDeleter)
+	if !w.DeferMetadata || w.WriteOnce || !ok {
+		return nil
+	}
+	key := inProgressMetaKey(w.keyNamer(), w.PathPrefix)
+	resp, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(w.Bucket),
+		Delete: &s3.Delete{
+			Quiet:   aws.Bool(true),
+			Objects: []*s3.ObjectIdentifier{{Key: aws.String(key)}},
+		},
+	})
 	if err != nil {
 		return err
 	}
+	if errs := resp.Errors; len(errs) > 0 {
+		return fmt.Errorf("Failed to delete key %q: %v", key, aws.StringValue(errs[0].Message))
+	}
+	return nil
+}
+
+func (w *S3Writer) flushMetadata() error {
+	if w.WriteOnce && w.md.Status == StatusRunning {
+		return nil
+	}
+	return putMetadata(w.S3, w.putRequest(w.metaKey()), w.md)
+}
+
+// putRequest returns a request to upload an object to key with the ACL and
+// server side encryption settings applied.
+func (w *S3Writer) putRequest(key string) *s3.PutObjectInput {
 	req := &s3.PutObjectInput{
-		Bucket:      aws.String(w.Bucket),
-		Key:         aws.String(s3MetaKey(w.PathPrefix)),
-		Body:        bytes.NewReader(data),
-		ContentType: aws.String("application/json"),
+		Bucket: aws.String(w.Bucket),
+		Key:    aws.String(key),
+	}
+	if w.ACL != "" {
+		req.ACL = aws.String(w.ACL)
+	}
+	if w.ServerSideEncryption != "" {
+		req.ServerSideEncryption = aws.String(w.ServerSideEncryption)
+	}
+	if w.SSEKMSKeyID != "" {
+		req.SSEKMSKeyId = aws.String(w.SSEKMSKeyID)
+	}
+	return req
+}
+
+// partRequest returns a request to upload a part to key.  Unlike the
+// metadata, parts are stored with StorageClass.
+func (w *S3Writer) partRequest(key, encoding string) *s3.PutObjectInput {
+	req := w.putRequest(key)
+	if encoding != "" {
+		req.ContentEncoding = aws.String(encoding)
+	}
+	req.ContentType = aws.String("application/json")
+	if w.StorageClass != "" {
+		req.StorageClass = aws.String(w.StorageClass)
+	}
+	return req
+}
+
+// putPart uploads a part with PutObject, retrying up to PartRetries times
+// with the same key and body.
+func (w *S3Writer) putPart(req *s3.PutObjectInput, hash []byte) error {
+	key := aws.StringValue(req.Key)
+	var err error
+	delay := partRetryDelay
+	for attempt := 0; attempt <= w.PartRetries; attempt++ {
+		if attempt > 0 {
+			if ferr := w.failError(); ferr != nil {
+				return err // another worker failed; don't delay it
+			}
+			time.Sleep(delay)
+			delay *= 2
+			if _, serr := req.Body.Seek(0, io.SeekStart); serr != nil {
+				return serr
+			}
+			if w.WriteOnce {
+				// the failed attempt may have stored the part
+				resp, herr := w.headObject(key)
+				if herr != nil {
+					return herr
+				}
+				if resp != nil {
+					if hash != nil && partMetadata(resp.Metadata, partHashKey) == hex.EncodeToString(hash) {
+						return nil
+					}
+					return fmt.Errorf("Part %q already exists", key)
+				}
+			}
+		}
+		if err = w.putObject(req); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// putObject uploads req, supplying the hashes of a rate limited body if S3
+// allows it so that it's only read through the limit as it's sent.
+func (w *S3Writer) putObject(req *s3.PutObjectInput) error {
+	body, limited := req.Body.(*rateLimitedReadSeeker)
+	svc, ok := w.S3.(s3ContextPuter)
+	if !limited || !ok {
+		_, err := w.S3.PutObject(req)
+		return err
+	}
+	contentMD5, sha, err := body.payloadHashes()
+	if err != nil {
+		return err
+	}
+	req.ContentMD5 = aws.String(contentMD5)
+	_, err = svc.PutObjectWithContext(aws.BackgroundContext(), req, payloadSHA256Option(sha))
+	return err
+}
+
+// payloadSHA256Option sets the SHA-256 of a request's payload, so that the
+// SDK's signer doesn't read the payload to compute it.
+func payloadSHA256Option(sha string) request.Option {
+	return func(r *request.Request) {
+		r.HTTPRequest.Header.Set("X-Amz-Content-Sha256", sha)
+	}
+}
+
+// flushFinalMetadata writes the metadata of a completed backup, retrying
+// up to MetadataRetries times.
+func (w *S3Writer) flushFinalMetadata() error {
+	var err error
+	delay := metadataRetryDelay
+	for attempt := 0; attempt <= w.MetadataRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err = w.flushMetadata(); err == nil {
+			return nil
+		}
+	}
+	return &MetadataError{
+		Key:      w.metaKey(),
+		Metadata: w.md,
+		Attempts: w.MetadataRetries + 1,
+		Err:      err,
+	}
+}
+
+// putMetadata writes a backup's metadata using req, which sets the bucket
+// and key along with any other options to upload it with.
+func putMetadata(svc S3Puter, req *s3.PutObjectInput, md Metadata) error {
+	data, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
 	}
-	_, err = w.S3.PutObject(req)
+	req.Body = bytes.NewReader(data)
+	req.ContentType = aws.String("application/json")
+	_, err = svc.PutObject(req)
 	return err
 }
 
-// newKey generates the next S3 object key.
-func (w *S3Writer) newKey() string {
+// ReorderDepth returns the number of part hashes currently held while
+// waiting for earlier parts to complete.
+func (w *S3Writer) ReorderDepth() int {
+	w.fm.Lock()
+	hashes := w.hashes
+	w.fm.Unlock()
+	if hashes == nil {
+		return 0
+	}
+	return hashes.depth()
+}
+
+// newKey generates the next S3 object key and its part number.
+func (w *S3Writer) newKey() (partNum int32, key string) {
 	pn := atomic.AddInt32(&w.partnum, 1)
-	return fmt.Sprintf("%s%09d.json.gz", s3PartPrefix(w.PathPrefix), pn)
+	ext := ".json.gz"
+	switch w.compression() {
+	case CompressionZlib:
+		ext = ".json.zlib"
+	case CompressionZstd:
+		ext = ".json.zst"
+	case CompressionNone:
+		ext = ".json"
+	}
+	return pn, w.keyNamer().PartKey(w.PathPrefix, &w.md, pn, ext)
+}
+
+// gzipFlushInterval returns the number of bytes written to a part's
+// compressor between flushes, or 0 if it's never flushed.
+func (w *S3Writer) gzipFlushInterval() int {
+	switch {
+	case w.GzipFlushInterval > 0:
+		return w.GzipFlushInterval
+	case w.GzipFlushInterval < 0:
+		return 0
+	}
+	return w.PartSize / 10
+}
+
+// compression returns how parts are compressed.
+func (w *S3Writer) compression() PartCompression {
+	switch {
+	case w.Compression != "":
+		return w.Compression
+	case w.CompressionDict != nil:
+		return CompressionZlib
+	}
+	return CompressionGzip
+}
+
+func (w *S3Writer) partKeyWidth() int {
+	if w.PartKeyWidth > 0 {
+		return w.PartKeyWidth
+	}
+	return DefaultPartKeyWidth
+}
+
+// partCompressor is implemented by gzip.Writer, zlib.Writer, zstd.Encoder
+// and nopCompressor.
+type partCompressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// nopCompressor writes uncompressed parts.
+type nopCompressor struct {
+	io.Writer
+}
+
+func (c *nopCompressor) Flush() error      { return nil }
+func (c *nopCompressor) Close() error      { return nil }
+func (c *nopCompressor) Reset(w io.Writer) { c.Writer = w }
+
+// newCompressor returns the compressor used for each part and the content
+// encoding to store the part with, if any.
+func (w *S3Writer) newCompressor(dst io.Writer) (c partCompressor, encoding string, err error) {
+	level := w.CompressionLevel
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	switch w.compression() {
+	case CompressionZlib:
+		c, err = zlib.NewWriterLevelDict(dst, level, w.CompressionDict)
+		return c, "deflate", err
+	case CompressionZstd:
+		// parts are already compressed in parallel by separate workers
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if w.CompressionLevel > 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(w.CompressionLevel)))
+		}
+		c, err = zstd.NewWriter(dst, opts...)
+		return c, "zstd", err
+	case CompressionNone:
+		return &nopCompressor{Writer: dst}, "", nil
+	}
+	// the level is kept when the compressor is reset for the next part
+	c, err = gzip.NewWriterLevel(dst, level)
+	return c, "gzip", err
 }
 
 // fail sets the failure error, if not already set
@@ -181,6 +1017,9 @@ func (w *S3Writer) fail(err error) {
 	if w.failed == nil {
 		w.failed = err
 	}
+	if w.hashes != nil {
+		w.hashes.cancel() // release workers waiting on earlier parts
+	}
 	w.fm.Unlock()
 }
 
@@ -198,62 +1037,155 @@ func (w *S3Writer) worker() {
 
 	defer w.wg.Done()
 
-	tmpfile, err := ioutil.TempFile("", "dyndump")
+	// the compressed data is either held in tmpfile until the part is
+	// complete, or streamed to S3 by mp
+	var out io.Writer
+	var tmpfile *os.File
+	var mp *multipartPart
+	if w.UseMultipartUpload {
+		mp = &multipartPart{w: w}
+		defer mp.abort() // discard an upload left incomplete by a failure
+		out = mp
+	} else {
+		var err error
+		if tmpfile, err = ioutil.TempFile("", "dyndump"); err != nil {
+			w.fail(err)
+			return
+		}
+		defer os.Remove(tmpfile.Name())
+		out = tmpfile
+	}
+	partSize := func() int64 {
+		if mp != nil {
+			return mp.size
+		}
+		fsize, _ := tmpfile.Seek(0, 1)
+		return fsize
+	}
+
+	gz, encoding, err := w.newCompressor(out)
 	if err != nil {
 		w.fail(err)
 		return
 	}
-	defer os.Remove(tmpfile.Name())
-
-	gz := gzip.NewWriter(tmpfile)
+	if mp != nil {
+		mp.encoding = encoding
+	}
+	hash := sha256.New()
 
 	flush := func() error {
 		if err := w.failError(); err != nil {
 			failed = true // complete final flush
 		}
-		gz.Close()
-		fsize, _ := tmpfile.Seek(0, 1)
-		tmpfile.Seek(0, 0)
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		fsize := partSize()
 
-		req := &s3.PutObjectInput{
-			Bucket:          aws.String(w.Bucket),
-			Key:             aws.String(w.newKey()),
-			Body:            tmpfile,
-			ContentEncoding: aws.String("gzip"),
-			ContentType:     aws.String("application/json"),
+		var pn int32
+		var key string
+		var body io.ReadSeeker
+		switch {
+		case mp == nil:
+			tmpfile.Seek(0, 0)
+			body = tmpfile
+		case !mp.started():
+			body = bytes.NewReader(mp.buf.Bytes())
+		default:
+			pn, key = mp.pn, mp.key // allocated when the upload started
 		}
-		_, err := w.S3.PutObject(req)
+		if key == "" {
+			pn, key = w.newKey()
+		}
+		if body != nil && w.uploadLimit != nil {
+			body = &rateLimitedReadSeeker{ReadSeeker: body, bucket: w.uploadLimit, stop: w.uploadStop}
+		}
+
+		req := w.partRequest(key, encoding)
+		req.Body = body
+		req.Metadata = map[string]*string{
+			partItemCountKey: aws.String(strconv.FormatInt(writeCount, 10)),
+			partRawSizeKey:   aws.String(strconv.FormatInt(rawPendingLen, 10)),
+		}
+		var sum []byte
+		if !w.SkipHashing {
+			sum = hash.Sum(nil)
+			req.Metadata[partHashKey] = aws.String(hex.EncodeToString(sum))
+		}
+		uploaded, err := w.isUploaded(key, sum)
 		if err != nil {
 			return err
 		}
+		if uploaded {
+			atomic.AddInt64(&w.skippedParts, 1)
+			if mp != nil {
+				if err := mp.abort(); err != nil {
+					return err
+				}
+			}
+		} else {
+			if w.WriteOnce {
+				if exists, err := w.objectExists(key); err != nil {
+					return err
+				} else if exists {
+					return fmt.Errorf("Part %q already exists", key)
+				}
+			}
+			if mp != nil && mp.started() {
+				err = mp.complete(req)
+			} else {
+				err = w.putPart(req, sum)
+			}
+			if err != nil {
+				return err
+			}
+		}
 
-		if err := w.completePart(rawPendingLen, fsize, writeCount); err != nil {
+		if err := w.completePart(pn, key, sum, rawPendingLen, fsize, writeCount); err != nil {
 			return err
 		}
 
 		rawPendingLen = 0
 		writeCount = 0
-		tmpfile.Truncate(0)
-		tmpfile.Seek(0, 0)
-		gz.Reset(tmpfile)
+		if mp != nil {
+			mp.reset()
+		} else {
+			tmpfile.Truncate(0)
+			tmpfile.Seek(0, 0)
+		}
+		gz.Reset(out)
+		hash.Reset()
 		return nil
 	}
 
 	var intervalBytes int
-	gzipFlushInterval := w.PartSize / 10
+	gzipFlushInterval := w.gzipFlushInterval()
 	for data := range w.data {
 		if failed {
 			continue
 		}
-		gz.Write(data)
+		if _, err := gz.Write(data); err != nil {
+			// eg. a multipart upload failed to send a chunk
+			w.fail(err)
+			failed = true
+			continue
+		}
+		if !w.SkipHashing {
+			hash.Write(data)
+		}
 		rawPendingLen += int64(len(data))
-		writeCount++
+		writeCount += int64(bytes.Count(data, []byte{'\n'}))
 		intervalBytes += len(data)
-		if intervalBytes >= gzipFlushInterval {
-			gz.Flush() // Flush to get a sense of how much data is buffered
+		if gzipFlushInterval > 0 && intervalBytes >= gzipFlushInterval {
+			// Flush to get a sense of how much data is buffered
+			if err := gz.Flush(); err != nil {
+				w.fail(err)
+				failed = true
+				continue
+			}
 			intervalBytes = 0
 		}
-		if fsize, _ := tmpfile.Seek(0, 1); fsize >= int64(w.PartSize) {
+		if partSize() >= int64(w.PartSize) {
 			if err := flush(); err != nil {
 				w.fail(err)
 				failed = true
@@ -268,9 +1200,49 @@ func (w *S3Writer) worker() {
 	}
 }
 
+// ValidatePathPrefix checks that prefix may be used as the path prefix of
+// a backup stored in S3.
+func ValidatePathPrefix(prefix string) error {
+	if prefix == "" {
+		return errors.New("path prefix must be set")
+	}
+	if len(prefix) > MaxPathPrefixLen {
+		return fmt.Errorf("path prefix must be %d bytes or less", MaxPathPrefixLen)
+	}
+	if !utf8.ValidString(prefix) {
+		return errors.New("path prefix must be valid UTF-8")
+	}
+	for _, r := range prefix {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("path prefix contains illegal character %q", r)
+		}
+	}
+	return nil
+}
+
+// s3KeyBase normalizes a path prefix into the string that NormalizedKeyNamer
+// appends object names to.  Leading slashes are removed and a "-" separator
+// is added unless the prefix already ends with a "/" or "-".
+func s3KeyBase(prefix string) string {
+	prefix = strings.TrimLeft(prefix, "/")
+	if prefix == "" || strings.HasSuffix(prefix, "/") || strings.HasSuffix(prefix, "-") {
+		return prefix
+	}
+	return prefix + "-"
+}
+
 func s3MetaKey(prefix string) string {
 	return prefix + "-meta.json"
 }
-func s3PartPrefix(prefix string) string {
-	return prefix + "-part-"
+
+// s3PartKeyRegexp returns a regexp matching the keys of the parts stored
+// beneath partPrefix with part numbers of the given width, excluding any
+// other objects sharing the prefix.
+func s3PartKeyRegexp(partPrefix string, width int) (*regexp.Regexp, error) {
+	return regexp.Compile(fmt.Sprintf(`^%s\d{%d}\.json(\.gz|\.zlib|\.zst)?$`, regexp.QuoteMeta(partPrefix), width))
+}
+
+// s3PartPathPrefix returns the prefix of part keys stored beneath partPath.
+func s3PartPathPrefix(prefix, partPath string) string {
+	return prefix + "-" + partPath + "part-"
 }
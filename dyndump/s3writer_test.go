@@ -5,19 +5,32 @@
 package dyndump
 
 import (
+	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/juju/ratelimit"
 )
 
 func TestS3NewKey(t *testing.T) {
@@ -25,14 +38,1888 @@ func TestS3NewKey(t *testing.T) {
 		PathPrefix: "aprefix",
 	}
 
-	k := w.newKey()
-	if expected := "aprefix-part-000000001.json.gz"; k != expected {
-		t.Errorf("expected=%q actual=%q", expected, k)
+	pn, k := w.newKey()
+	if expected := "aprefix-part-000000001.json.gz"; k != expected || pn != 1 {
+		t.Errorf("expected=%q actual=%q (%d)", expected, k, pn)
 	}
 
-	k = w.newKey()
-	if expected := "aprefix-part-000000002.json.gz"; k != expected {
-		t.Errorf("expected=%q actual=%q", expected, k)
+	pn, k = w.newKey()
+	if expected := "aprefix-part-000000002.json.gz"; k != expected || pn != 2 {
+		t.Errorf("expected=%q actual=%q (%d)", expected, k, pn)
+	}
+}
+
+// Check that parts written with a non-default key width are read, refreshed
+// and deleted using the width recorded in the metadata.
+func TestS3PartKeyWidth(t *testing.T) {
+	fs3 := newFakeS3()
+	w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+	w.PartSize = MinPartSize
+	w.MaxParallel = 1
+	w.PartKeyWidth = 4
+
+	done := make(chan error)
+	go func() { done <- w.Run() }()
+	var expected []byte
+	for i := 0; i < 3; i++ {
+		data := randbytes(i, MinPartSize)
+		expected = append(expected, data...)
+		if _, err := w.Write(data); err != nil {
+			t.Fatal("Write failed", err)
+		}
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+	for i := 1; i <= 3; i++ {
+		if k := fmt.Sprintf("test-prefix-part-%04d.json.gz", i); fs3.parts[k].data == nil {
+			t.Errorf("Part %q not written; have %v", k, fs3.parts)
+		}
+	}
+
+	r := &S3Reader{S3: fs3.getLister(), Bucket: "test-bucket", PathPrefix: "test-prefix"}
+	md, err := r.Metadata()
+	if err != nil {
+		t.Fatal("Failed to read metadata", err)
+	}
+	if md.PartKeyWidth != 4 {
+		t.Error("Incorrect part key width", md.PartKeyWidth)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("Read failed", err)
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Error("Read data does not match written data")
+	}
+
+	rf, err := NewS3Refresher(&fakeS3Refresher{fs3.getLister(), fs3}, "test-bucket", "test-prefix")
+	if err != nil {
+		t.Fatal("Failed to create refresher", err)
+	}
+	if md, err := rf.Refresh(); err != nil || md.PartCount != 3 {
+		t.Errorf("Incorrect refresh parts=%d err=%v", md.PartCount, err)
+	}
+
+	var deleted []string
+	d, err := NewS3Deleter(&fakeS3Deleter{
+		fakeS3GetLister: fs3.getLister(),
+		del: func(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+			for _, obj := range input.Delete.Objects {
+				deleted = append(deleted, aws.StringValue(obj.Key))
+			}
+			return new(s3.DeleteObjectsOutput), nil
+		},
+	}, "test-bucket", "test-prefix")
+	if err != nil {
+		t.Fatal("Failed to create deleter", err)
+	}
+	if err := d.Delete(); err != nil {
+		t.Fatal("Delete failed", err)
+	}
+	if len(deleted) != 5 {
+		t.Error("Incorrect keys deleted", deleted)
+	}
+}
+
+// dirKeyNamer stores a backup's metadata and parts in separate directories
+// beneath the prefix, numbering the parts with six digits.
+type dirKeyNamer struct{}
+
+func (dirKeyNamer) MetaKey(prefix string) string {
+	return prefix + "/backup-meta.json"
+}
+
+func (dirKeyNamer) PartKey(prefix string, md *Metadata, partNum int32, ext string) string {
+	return fmt.Sprintf("%s/parts/%s/%06d%s", prefix, md.TableName, partNum, ext)
+}
+
+func (dirKeyNamer) PartListPrefix(prefix string, md *Metadata) string {
+	return prefix + "/parts/" + md.TableName + "/"
+}
+
+// Check that a backup written with a KeyNamer is read, refreshed and
+// deleted using the same keys.
+func TestS3KeyNamer(t *testing.T) {
+	fs3 := newFakeS3()
+	w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+	w.PartSize = MinPartSize
+	w.MaxParallel = 1
+	w.KeyNamer = dirKeyNamer{}
+
+	done := make(chan error)
+	go func() { done <- w.Run() }()
+	var expected []byte
+	for i := 0; i < 3; i++ {
+		data := randbytes(i, MinPartSize)
+		expected = append(expected, data...)
+		if _, err := w.Write(data); err != nil {
+			t.Fatal("Write failed", err)
+		}
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+	if fs3.metaKey != "test-prefix/backup-meta.json" {
+		t.Errorf("Incorrect metadata key %q", fs3.metaKey)
+	}
+	for i := 1; i <= 3; i++ {
+		if k := fmt.Sprintf("test-prefix/parts/a_table/%06d.json.gz", i); fs3.parts[k].data == nil {
+			t.Errorf("Part %q not written; have %v", k, fs3.parts)
+		}
+	}
+
+	// the default names find nothing
+	r := &S3Reader{S3: fs3.getLister(), Bucket: "test-bucket", PathPrefix: "test-prefix"}
+	if _, err := r.Metadata(); err == nil {
+		t.Error("Metadata read with the default key namer")
+	}
+
+	r = &S3Reader{S3: fs3.getLister(), Bucket: "test-bucket", PathPrefix: "test-prefix", KeyNamer: dirKeyNamer{}}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("Read failed", err)
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Error("Read data does not match written data")
+	}
+
+	rf, err := NewS3RefresherWithKeyNamer(&fakeS3Refresher{fs3.getLister(), fs3}, "test-bucket", "test-prefix", dirKeyNamer{})
+	if err != nil {
+		t.Fatal("Failed to create refresher", err)
+	}
+	if md, err := rf.Refresh(); err != nil || md.PartCount != 3 {
+		t.Errorf("Incorrect refresh parts=%d err=%v", md.PartCount, err)
+	}
+
+	var deleted []string
+	d, err := NewS3DeleterWithKeyNamer(&fakeS3Deleter{
+		fakeS3GetLister: fs3.getLister(),
+		del: func(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+			for _, obj := range input.Delete.Objects {
+				deleted = append(deleted, aws.StringValue(obj.Key))
+			}
+			return new(s3.DeleteObjectsOutput), nil
+		},
+	}, "test-bucket", "test-prefix", dirKeyNamer{})
+	if err != nil {
+		t.Fatal("Failed to create deleter", err)
+	}
+	if err := d.Delete(); err != nil {
+		t.Fatal("Delete failed", err)
+	}
+	sort.Strings(deleted)
+	if expected := []string{
+		"test-prefix/backup-meta.inprogress.json",
+		"test-prefix/backup-meta.json",
+		"test-prefix/parts/a_table/000001.json.gz",
+		"test-prefix/parts/a_table/000002.json.gz",
+		"test-prefix/parts/a_table/000003.json.gz",
+	}; !reflect.DeepEqual(deleted, expected) {
+		t.Error("Incorrect keys deleted", deleted)
+	}
+}
+
+// Check that the prefix isn't normalized by default, so that a backup whose
+// prefix ends with a separator is stored at the same keys as by earlier
+// versions and is found by the reader, refresher and deleter.
+func TestS3SeparatorPrefixKeys(t *testing.T) {
+	for _, prefix := range []string{"backups/", "/test-prefix", "test-prefix-"} {
+		fs3 := newFakeS3()
+		w := NewS3Writer(fs3, "test-bucket", prefix, Metadata{TableName: "a_table"})
+		w.PartSize = MinPartSize
+		w.MaxParallel = 1
+
+		done := make(chan error)
+		go func() { done <- w.Run() }()
+		var expected []byte
+		for i := 0; i < 2; i++ {
+			data := randbytes(i, MinPartSize)
+			expected = append(expected, data...)
+			if _, err := w.Write(data); err != nil {
+				t.Fatal("Write failed", err)
+			}
+		}
+		w.Close()
+		if err := <-done; err != nil {
+			t.Fatal("Unexpected error from Run", err)
+		}
+		if mdkey := prefix + "-meta.json"; fs3.metaKey != mdkey {
+			t.Fatalf("prefix=%q incorrect metadata key %q", prefix, fs3.metaKey)
+		}
+
+		r := &S3Reader{S3: fs3.getLister(), Bucket: "test-bucket", PathPrefix: prefix}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("prefix=%q read failed: %v", prefix, err)
+		}
+		if !reflect.DeepEqual(data, expected) {
+			t.Errorf("prefix=%q read data does not match written data", prefix)
+		}
+
+		rf, err := NewS3Refresher(&fakeS3Refresher{fs3.getLister(), fs3}, "test-bucket", prefix)
+		if err != nil {
+			t.Fatalf("prefix=%q failed to create refresher: %v", prefix, err)
+		}
+		if md, err := rf.Refresh(); err != nil || md.PartCount != 2 {
+			t.Errorf("prefix=%q incorrect refresh parts=%d err=%v", prefix, md.PartCount, err)
+		}
+
+		var deleted []string
+		d, err := NewS3Deleter(&fakeS3Deleter{
+			fakeS3GetLister: fs3.getLister(),
+			del: func(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+				for _, obj := range input.Delete.Objects {
+					deleted = append(deleted, aws.StringValue(obj.Key))
+				}
+				return new(s3.DeleteObjectsOutput), nil
+			},
+		}, "test-bucket", prefix)
+		if err != nil {
+			t.Fatalf("prefix=%q failed to create deleter: %v", prefix, err)
+		}
+		if err := d.Delete(); err != nil {
+			t.Fatalf("prefix=%q delete failed: %v", prefix, err)
+		}
+		sort.Strings(deleted)
+		if expected := []string{
+			prefix + "-meta.inprogress.json",
+			prefix + "-meta.json",
+			prefix + "-part-000000001.json.gz",
+			prefix + "-part-000000002.json.gz",
+		}; !reflect.DeepEqual(deleted, expected) {
+			t.Errorf("prefix=%q incorrect keys deleted %v", prefix, deleted)
+		}
+	}
+}
+
+func TestS3PartKeyRegexpWidth(t *testing.T) {
+	re, err := s3PartKeyRegexp("p-part-", 4)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	for k, expected := range map[string]bool{
+		"p-part-0001.json.gz":      true,
+		"p-part-0001.json.zlib":    true,
+		"p-part-000000001.json.gz": false,
+		"p-part-001.json.gz":       false,
+	} {
+		if re.MatchString(k) != expected {
+			t.Errorf("key=%q expected match=%t", k, expected)
+		}
+	}
+}
+
+type prefixTest struct {
+	prefix     string
+	metaKey    string
+	partPrefix string
+}
+
+var prefixTests = []prefixTest{
+	{"aprefix", "aprefix-meta.json", "aprefix-part-"},
+	{"aprefix-", "aprefix--meta.json", "aprefix--part-"},
+	{"backups/aprefix", "backups/aprefix-meta.json", "backups/aprefix-part-"},
+	{"backups/", "backups/-meta.json", "backups/-part-"},
+	{"/backups/", "/backups/-meta.json", "/backups/-part-"},
+	{"/", "/-meta.json", "/-part-"},
+}
+
+var normalizedPrefixTests = []prefixTest{
+	{"aprefix", "aprefix-meta.json", "aprefix-part-"},
+	{"aprefix-", "aprefix-meta.json", "aprefix-part-"},
+	{"backups/aprefix", "backups/aprefix-meta.json", "backups/aprefix-part-"},
+	{"backups/", "backups/meta.json", "backups/part-"},
+	{"/backups/", "backups/meta.json", "backups/part-"},
+	{"/", "meta.json", "part-"},
+}
+
+func TestS3PrefixKeys(t *testing.T) {
+	for _, keyNamer := range []KeyNamer{DefaultKeyNamer{}, NormalizedKeyNamer{}} {
+		tests := prefixTests
+		if keyNamer == (NormalizedKeyNamer{}) {
+			tests = normalizedPrefixTests
+		}
+		for _, test := range tests {
+			if k := keyNamer.MetaKey(test.prefix); k != test.metaKey {
+				t.Errorf("keyNamer=%T prefix=%q expected meta key=%q actual=%q", keyNamer, test.prefix, test.metaKey, k)
+			}
+			if k := keyNamer.PartListPrefix(test.prefix, &Metadata{}); k != test.partPrefix {
+				t.Errorf("keyNamer=%T prefix=%q expected part prefix=%q actual=%q", keyNamer, test.prefix, test.partPrefix, k)
+			}
+		}
+	}
+}
+
+func TestValidatePathPrefix(t *testing.T) {
+	for _, prefix := range []string{"aprefix", "backups/", "/", "backups/2016-04-01-12:25-"} {
+		if err := ValidatePathPrefix(prefix); err != nil {
+			t.Errorf("prefix=%q unexpected error %v", prefix, err)
+		}
+	}
+	for _, prefix := range []string{"", "bad\nprefix", "bad\xffprefix", strings.Repeat("a", MaxPathPrefixLen+1)} {
+		if err := ValidatePathPrefix(prefix); err == nil {
+			t.Errorf("prefix=%q no error returned", prefix)
+		}
+	}
+}
+
+// Check that the writer, reader and deleter all agree on the keys used
+// for a backup, regardless of how the prefix is terminated, whether it's
+// normalized or whether the parts are date partitioned.
+func TestS3PrefixRoundTrip(t *testing.T) {
+	for _, datePartition := range []bool{false, true} {
+		for _, test := range prefixTests {
+			testS3PrefixRoundTrip(t, DefaultKeyNamer{}, test.prefix, test.metaKey, datePartition)
+		}
+		for _, test := range normalizedPrefixTests {
+			testS3PrefixRoundTrip(t, NormalizedKeyNamer{}, test.prefix, test.metaKey, datePartition)
+		}
+	}
+}
+
+func testS3PrefixRoundTrip(t *testing.T, keyNamer KeyNamer, prefix, metaKey string, datePartition bool) {
+	fs3 := newFakeS3()
+	w := NewS3Writer(fs3, "test-bucket", prefix, Metadata{TableName: "a_table"})
+	w.PartSize = MinPartSize
+	w.MaxParallel = 1 // keep parts in write order
+	w.DatePartition = datePartition
+	w.KeyNamer = keyNamer
+
+	done := make(chan error)
+	go func() { done <- w.Run() }()
+
+	var expected []byte
+	for i := 0; i < 10; i++ {
+		data := []byte(fmt.Sprintf(`{"k":{"N":"%d"}}`+"\n", i))
+		data = append(data, randbytes(i, MinPartSize)...)
+		expected = append(expected, data...)
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("prefix=%q write failed: %v", prefix, err)
+		}
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("prefix=%q unexpected error from Run: %v", prefix, err)
+	}
+
+	var partPath string
+	if datePartition {
+		partPath = time.Now().UTC().Format("dt=2006-01-02/")
+	}
+	partPrefix := keyNamer.PartListPrefix(prefix, &Metadata{PartPath: partPath})
+	for k := range fs3.parts {
+		if !strings.HasPrefix(k, partPrefix) {
+			t.Errorf("prefix=%q datePartition=%t incorrect part key %q", prefix, datePartition, k)
+		}
+	}
+
+	f := fs3.getLister()
+	r := &S3Reader{S3: f, Bucket: "test-bucket", PathPrefix: prefix, KeyNamer: keyNamer}
+	md, err := r.Metadata()
+	if err != nil {
+		t.Fatalf("prefix=%q failed to read metadata: %v", prefix, err)
+	}
+	if md.TableName != "a_table" || md.PartCount != int64(len(fs3.parts)) {
+		t.Errorf("prefix=%q incorrect metadata %#v", prefix, md)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("prefix=%q read failed: %v", prefix, err)
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("prefix=%q read data does not match written data", prefix)
+	}
+
+	var deleted []string
+	d, err := NewS3DeleterWithKeyNamer(&fakeS3Deleter{
+		fakeS3GetLister: f,
+		del: func(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+			for _, obj := range input.Delete.Objects {
+				deleted = append(deleted, aws.StringValue(obj.Key))
+			}
+			return new(s3.DeleteObjectsOutput), nil
+		},
+	}, "test-bucket", prefix, keyNamer)
+	if err != nil {
+		t.Fatalf("prefix=%q failed to create deleter: %v", prefix, err)
+	}
+	if err := d.Delete(); err != nil {
+		t.Fatalf("prefix=%q delete failed: %v", prefix, err)
+	}
+	if len(deleted) != len(fs3.parts)+2 || deleted[len(deleted)-1] != metaKey {
+		t.Errorf("prefix=%q incorrect keys deleted %v", prefix, deleted)
+	}
+}
+
+// Check that parts downloaded in parallel are returned in order and that the
+// master hash is still verified.
+func TestS3ReadParallel(t *testing.T) {
+	fs3 := newFakeS3()
+	w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+	w.PartSize = MinPartSize
+	w.MaxParallel = 1 // keep parts in write order
+
+	done := make(chan error)
+	go func() { done <- w.Run() }()
+	var expected []byte
+	for i := 0; i < 8; i++ {
+		data := randbytes(i, MinPartSize)
+		expected = append(expected, data...)
+		if _, err := w.Write(data); err != nil {
+			t.Fatal("Write failed", err)
+		}
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+
+	f := fs3.getLister()
+	get := f.get
+	var m sync.Mutex
+	var inFlight, maxInFlight int
+	f.get = func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		if !strings.HasSuffix(aws.StringValue(input.Key), "meta.json") {
+			m.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			m.Unlock()
+			// complete later parts first
+			var pn int
+			fmt.Sscanf(aws.StringValue(input.Key), "test-prefix-part-%d", &pn)
+			time.Sleep(time.Duration(8-pn) * time.Millisecond)
+			m.Lock()
+			inFlight--
+			m.Unlock()
+		}
+		return get(input)
+	}
+
+	r := &S3Reader{S3: f, Bucket: "test-bucket", PathPrefix: "test-prefix", MaxParallel: 4}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Error("Read data does not match written data")
+	}
+	if maxInFlight < 2 || maxInFlight > 4 {
+		t.Error("Incorrect number of parallel downloads", maxInFlight)
+	}
+
+	// the master hash check fails if a part is missing
+	delete(fs3.parts, "test-prefix-part-000000005.json.gz")
+	r = &S3Reader{S3: f, Bucket: "test-bucket", PathPrefix: "test-prefix", MaxParallel: 4}
+	if _, err := ioutil.ReadAll(r); err == nil || !strings.Contains(err.Error(), "expected 8 parts, found 7") {
+		t.Error("Incorrect error for missing part", err)
+	}
+}
+
+// Check that a failed download stops a parallel read with its error.
+func TestS3ReadParallelGetFailed(t *testing.T) {
+	fs3 := writeTestBackup(t, 8, false)
+	f := fs3.getLister()
+	get := f.get
+	testError := errors.New("test error")
+	f.get = func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		if aws.StringValue(input.Key) == "test-prefix-part-000000003.json.gz" {
+			return nil, testError
+		}
+		return get(input)
+	}
+	r := &S3Reader{S3: f, Bucket: "test-bucket", PathPrefix: "test-prefix", MaxParallel: 4}
+	if _, err := ioutil.ReadAll(r); err != testError {
+		t.Error("Incorrect error", err)
+	}
+}
+
+// writeTestBackup writes a backup of the given number of parts to a fakeS3.
+func writeTestBackup(t *testing.T, parts int, skipHashing bool) *fakeS3 {
+	fs3 := newFakeS3()
+	w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+	w.PartSize = MinPartSize
+	w.MaxParallel = 2
+	w.SkipHashing = skipHashing
+
+	done := make(chan error)
+	go func() { done <- w.Run() }()
+
+	for i := 0; i < parts; i++ {
+		if _, err := w.Write(randbytes(i, MinPartSize)); err != nil {
+			t.Fatal("Write failed", err)
+		}
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+	if len(fs3.parts) != parts {
+		t.Fatal("Incorrect part count", len(fs3.parts))
+	}
+	return fs3
+}
+
+func TestS3WriteHashes(t *testing.T) {
+	fs3 := writeTestBackup(t, 4, false)
+	var md Metadata
+	if err := json.Unmarshal(fs3.metadata, &md); err != nil {
+		t.Fatal("Failed to decode metadata", err)
+	}
+	if md.MasterHash == "" {
+		t.Error("Master hash not set")
+	}
+	for k, part := range fs3.parts {
+		sum := sha256.Sum256(part.data)
+		if h := aws.StringValue(part.md[partHashKey]); h != hex.EncodeToString(sum[:]) {
+			t.Errorf("Incorrect hash for part %q: %q", k, h)
+		}
+		if c := aws.StringValue(part.md[partItemCountKey]); c != "1" {
+			t.Errorf("Incorrect item count for part %q: %q", k, c)
+		}
+		if n := aws.StringValue(part.md[partRawSizeKey]); n != strconv.Itoa(len(part.data)) {
+			t.Errorf("Incorrect raw size for part %q: %q", k, n)
+		}
+	}
+
+	fs3 = writeTestBackup(t, 4, true)
+	if err := json.Unmarshal(fs3.metadata, &md); err != nil {
+		t.Fatal("Failed to decode metadata", err)
+	}
+	if md.MasterHash != "" {
+		t.Error("Master hash set with SkipHashing", md.MasterHash)
+	}
+	for k, part := range fs3.parts {
+		if _, ok := part.md[partHashKey]; ok {
+			t.Errorf("Hash set for part %q with SkipHashing", k)
+		}
+	}
+}
+
+// Check that a Write holding several items, as BufferedEncoder makes, is
+// counted as that many items.
+func TestS3WriteItemCount(t *testing.T) {
+	fs3 := newFakeS3()
+	w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{})
+	done := make(chan error)
+	go func() { done <- w.Run() }()
+
+	var buf bytes.Buffer
+	enc := NewBufferedEncoder(&buf, 1)
+	for _, item := range makeItems(0, 5) {
+		enc.WriteItem(item)
+	}
+	enc.Flush()
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		t.Fatal("Write failed", err)
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+
+	var md Metadata
+	if err := json.Unmarshal(fs3.metadata, &md); err != nil {
+		t.Fatal("Failed to decode metadata", err)
+	}
+	if md.ItemCount != 5 {
+		t.Errorf("Incorrect metadata item count %d", md.ItemCount)
+	}
+	for k, part := range fs3.parts {
+		if c := aws.StringValue(part.md[partItemCountKey]); c != "5" {
+			t.Errorf("Incorrect item count for part %q: %q", k, c)
+		}
+	}
+}
+
+var verifyTests = []struct {
+	name       string
+	mode       VerifyMode
+	skip       bool
+	corrupt    bool // corrupt the data in a part
+	missing    bool // remove a part
+	errMessage string
+}{
+	{"ok", VerifyAll, false, false, false, ""},
+	{"corrupt-all", VerifyAll, false, true, false, "integrity check failed for part"},
+	{"corrupt-parts", VerifyParts, false, true, false, "integrity check failed for part"},
+	{"corrupt-master", VerifyMaster, false, true, false, "master hash mismatch"},
+	{"corrupt-none", VerifyNone, false, true, false, ""},
+	{"corrupt-skip", VerifyAll, true, true, false, ""},
+	{"missing-all", VerifyAll, false, false, true, "expected 4 parts, found 3"},
+	{"missing-parts", VerifyParts, false, false, true, ""},
+}
+
+func TestS3ReadVerify(t *testing.T) {
+	for _, test := range verifyTests {
+		fs3 := writeTestBackup(t, 4, false)
+		if test.corrupt {
+			part := fs3.parts["test-prefix-part-000000002.json.gz"]
+			part.data[10]++
+		}
+		if test.missing {
+			delete(fs3.parts, "test-prefix-part-000000003.json.gz")
+		}
+
+		r := &S3Reader{
+			S3:                 fs3.getLister(),
+			Bucket:             "test-bucket",
+			PathPrefix:         "test-prefix",
+			VerifyMode:         test.mode,
+			SkipIntegrityCheck: test.skip,
+		}
+		_, err := ioutil.ReadAll(r)
+		switch {
+		case test.errMessage == "" && err != nil:
+			t.Errorf("test=%q unexpected error %v", test.name, err)
+		case test.errMessage != "" && (err == nil || !strings.Contains(err.Error(), test.errMessage)):
+			t.Errorf("test=%q incorrect error %v", test.name, err)
+		}
+	}
+}
+
+var verifyOpTests = []struct {
+	name       string
+	skipHash   bool
+	corrupt    bool
+	missing    bool
+	errMessage string
+}{
+	{"ok", false, false, false, ""},
+	{"corrupt", false, true, false, "integrity check failed for part"},
+	{"missing", false, false, true, "expected 4 parts, found 3"},
+	{"no-hashes", true, false, false, "no integrity hashes"},
+}
+
+// Verify should check everything regardless of the reader's VerifyMode.
+func TestS3Verify(t *testing.T) {
+	for _, test := range verifyOpTests {
+		fs3 := writeTestBackup(t, 4, test.skipHash)
+		if test.corrupt {
+			part := fs3.parts["test-prefix-part-000000002.json.gz"]
+			part.data[10]++
+		}
+		if test.missing {
+			delete(fs3.parts, "test-prefix-part-000000003.json.gz")
+		}
+
+		r := &S3Reader{
+			S3:                 fs3.getLister(),
+			Bucket:             "test-bucket",
+			PathPrefix:         "test-prefix",
+			VerifyMode:         VerifyNone,
+			SkipIntegrityCheck: true,
+		}
+		err := r.Verify()
+		switch {
+		case test.errMessage == "" && err != nil:
+			t.Errorf("test=%q unexpected error %v", test.name, err)
+		case test.errMessage != "" && (err == nil || !strings.Contains(err.Error(), test.errMessage)):
+			t.Errorf("test=%q incorrect error %v", test.name, err)
+		}
+		if test.errMessage == "" {
+			if n := r.PartsCompleted(math.MaxInt64); n != 4 {
+				t.Errorf("test=%q expected 4 parts verified, got %d", test.name, n)
+			}
+		}
+	}
+}
+
+// Check that a part that decompresses to fewer bytes than were written is
+// reported as truncated, before its hash is checked.
+func TestS3ReadTruncatedPart(t *testing.T) {
+	fs3 := writeTestBackup(t, 4, false)
+	key := "test-prefix-part-000000002.json.gz"
+	part := fs3.parts[key]
+	part.data = part.data[:len(part.data)/2]
+	fs3.parts[key] = part
+
+	r := &S3Reader{
+		S3:         fs3.getLister(),
+		Bucket:     "test-bucket",
+		PathPrefix: "test-prefix",
+	}
+	_, err := ioutil.ReadAll(r)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("decompressed to %d bytes; expected %d", MinPartSize/2, MinPartSize)) {
+		t.Error("Incorrect error", err)
+	}
+}
+
+// Check that a deep verify decodes the items in each part.
+func TestS3ReadDeepVerify(t *testing.T) {
+	tests := []struct {
+		name       string
+		modify     func(part putdata)
+		errMessage string
+	}{
+		{"ok", func(part putdata) {}, ""},
+		{"invalid", func(part putdata) { part.data[0] = 'x' }, "contains invalid data"},
+		{"count", func(part putdata) { part.md[partItemCountKey] = aws.String("5") }, "holds 1 items; expected 5"},
+	}
+
+	for _, test := range tests {
+		fs3 := newFakeS3()
+		w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+		w.PartSize = MinPartSize
+		w.MaxParallel = 1
+
+		done := make(chan error)
+		go func() { done <- w.Run() }()
+		for i := 0; i < 4; i++ {
+			item := fmt.Sprintf(`{"k":{"S":"%d%x"}}`+"\n", i, randbytes(i, MinPartSize))
+			if _, err := w.Write([]byte(item)); err != nil {
+				t.Fatal("Write failed", err)
+			}
+		}
+		w.Close()
+		if err := <-done; err != nil {
+			t.Fatal("Unexpected error from Run", err)
+		}
+
+		test.modify(fs3.parts["test-prefix-part-000000002.json.gz"])
+
+		r := &S3Reader{
+			S3:         fs3.getLister(),
+			Bucket:     "test-bucket",
+			PathPrefix: "test-prefix",
+			VerifyMode: VerifyNone,
+			DeepVerify: true,
+		}
+		_, err := ioutil.ReadAll(r)
+		switch {
+		case test.errMessage == "" && err != nil:
+			t.Errorf("test=%q unexpected error %v", test.name, err)
+		case test.errMessage != "" && (err == nil || !strings.Contains(err.Error(), test.errMessage)):
+			t.Errorf("test=%q incorrect error %v", test.name, err)
+		}
+	}
+}
+
+// Check that part uploads are throttled and can still be rewound for retries.
+func TestRateLimitedReadSeeker(t *testing.T) {
+	data := randbytes(1, 3000)
+	r := &rateLimitedReadSeeker{
+		ReadSeeker: bytes.NewReader(data),
+		bucket:     ratelimit.NewBucketWithQuantum(100*time.Millisecond, 1000, 1000), // 10KB/sec
+	}
+
+	start := time.Now()
+	result, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	// the first 1000 bytes are covered by the bucket's capacity; the
+	// remaining 2000 should take 200ms at 10KB/sec
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond || elapsed > time.Second {
+		t.Error("Read was not throttled to the expected rate", elapsed)
+	}
+	if !bytes.Equal(result, data) {
+		t.Error("Incorrect data read")
+	}
+
+	// computing the payload hashes shouldn't be charged to the bucket
+	available := r.bucket.Available()
+	contentMD5, sha, err := r.payloadHashes()
+	if err != nil {
+		t.Fatal("payloadHashes failed", err)
+	}
+	if avail := r.bucket.Available(); avail < available {
+		t.Errorf("payloadHashes charged the bucket: available %d -> %d", available, avail)
+	}
+	expectedSHA := sha256.Sum256(data)
+	if sha != hex.EncodeToString(expectedSHA[:]) {
+		t.Error("Incorrect SHA-256", sha)
+	}
+	if contentMD5 == "" {
+		t.Error("No MD5 returned")
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		t.Fatal("Seek failed", err)
+	}
+	if result, _ := ioutil.ReadAll(r); !bytes.Equal(result, data) {
+		t.Error("Incorrect data read after seek")
+	}
+}
+
+// Check that closing the stop channel interrupts a rate limited read.
+func TestRateLimitedReadSeekerStop(t *testing.T) {
+	r := &rateLimitedReadSeeker{
+		ReadSeeker: bytes.NewReader(randbytes(1, 3000)),
+		bucket:     ratelimit.NewBucketWithQuantum(time.Second, 1, 1), // 1 byte/sec
+		stop:       make(chan struct{}),
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(r)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(r.stop)
+
+	select {
+	case err := <-done:
+		if err != errUploadStopped {
+			t.Error("Unexpected error", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read was not interrupted")
+	}
+}
+
+// Check that Abort stops an upload waiting on UploadBandwidth.
+func TestS3AbortRateLimited(t *testing.T) {
+	fs3 := newFakeS3()
+	w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+	w.PartSize = MinPartSize
+	w.UploadBandwidth = 1
+
+	done := make(chan error)
+	go func() { done <- w.Run() }()
+	if _, err := w.Write(randbytes(1, MinPartSize)); err != nil {
+		t.Fatal("Write failed", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	w.Abort()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Run didn't return an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Abort didn't stop the rate limited upload")
+	}
+}
+
+// Check that an aborted writer deletes everything it uploaded if requested.
+func TestS3AbortCleanup(t *testing.T) {
+	for _, cleanup := range []bool{false, true} {
+		fs3 := newFakeS3()
+		w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+		w.PartSize = MinPartSize
+		w.MaxParallel = 1
+		w.CleanupOnAbort = cleanup
+
+		done := make(chan error)
+		go func() { done <- w.Run() }()
+		for i := 0; i < 3; i++ {
+			if _, err := w.Write(randbytes(i, MinPartSize)); err != nil {
+				t.Fatal("Write failed", err)
+			}
+		}
+		w.Abort()
+		if err := <-done; err == nil {
+			t.Fatal("No error returned from Run")
+		}
+
+		fs3.m.Lock()
+		partCount, metaKey := len(fs3.parts), fs3.metaKey
+		fs3.m.Unlock()
+		switch {
+		case cleanup && (partCount != 0 || metaKey != ""):
+			t.Errorf("Objects remain after cleanup parts=%d metaKey=%q", partCount, metaKey)
+		case !cleanup && (partCount == 0 || metaKey == ""):
+			t.Errorf("Objects removed without cleanup parts=%d metaKey=%q", partCount, metaKey)
+		}
+	}
+}
+
+// failPartS3 fails every upload of a part with the given key.
+type failPartS3 struct {
+	*fakeS3
+	key string
+}
+
+func (f *failPartS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	if aws.StringValue(input.Key) == f.key {
+		return nil, errors.New("upload failed")
+	}
+	return f.fakeS3.PutObject(input)
+}
+
+// Check that a writer that fails to upload a part also deletes everything
+// it uploaded if CleanupOnAbort is set.
+func TestS3FailCleanup(t *testing.T) {
+	for _, cleanup := range []bool{false, true} {
+		fs3 := &failPartS3{fakeS3: newFakeS3(), key: "test-prefix-part-000000003.json.gz"}
+		w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+		w.PartSize = MinPartSize
+		w.MaxParallel = 1
+		w.CleanupOnAbort = cleanup
+
+		done := make(chan error)
+		go func() { done <- w.Run() }()
+		for i := 0; i < 3; i++ {
+			if _, err := w.Write(randbytes(i, MinPartSize)); err != nil {
+				break // the failed part may be reported by a later write
+			}
+		}
+		w.Close()
+		if err := <-done; err == nil {
+			t.Fatal("No error returned from Run")
+		}
+
+		fs3.m.Lock()
+		partCount, metaKey := len(fs3.parts), fs3.metaKey
+		fs3.m.Unlock()
+		switch {
+		case cleanup && (partCount != 0 || metaKey != ""):
+			t.Errorf("Objects remain after cleanup parts=%d metaKey=%q", partCount, metaKey)
+		case !cleanup && (partCount == 0 || metaKey == ""):
+			t.Errorf("Objects removed without cleanup parts=%d metaKey=%q", partCount, metaKey)
+		}
+	}
+}
+
+// Check that CleanupOnAbort is rejected if the S3 service can't delete.
+func TestS3CleanupNoDeleter(t *testing.T) {
+	w := NewS3Writer(struct{ S3Puter }{newFakeS3()}, "test-bucket", "test-prefix", Metadata{})
+	w.CleanupOnAbort = true
+	if err := w.Run(); err == nil {
+		t.Error("No error returned from Run")
+	}
+}
+
+// Check that a writer restarted with a checkpoint file skips the parts
+// already uploaded by an aborted run.
+func TestS3ResumeCheckpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		remove   string // part to remove from S3 before resuming
+		expected int64
+	}{
+		{"all-present", "", 3},
+		{"part-missing", "test-prefix-part-000000002.json.gz", 2},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "dyndump")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		cpFile := filepath.Join(dir, "checkpoint.json")
+		fs3 := newFakeS3()
+
+		run := func(parts int, abort bool) *S3Writer {
+			w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+			w.PartSize = MinPartSize
+			w.MaxParallel = 1
+			w.CheckpointFile = cpFile
+
+			done := make(chan error)
+			go func() { done <- w.Run() }()
+			for i := 0; i < parts; i++ {
+				if _, err := w.Write(randbytes(i, MinPartSize)); err != nil {
+					t.Fatalf("test=%q write failed: %v", test.name, err)
+				}
+			}
+			if abort {
+				w.Abort()
+				if err := <-done; err == nil {
+					t.Fatalf("test=%q no error returned from aborted Run", test.name)
+				}
+			} else {
+				w.Close()
+				if err := <-done; err != nil {
+					t.Fatalf("test=%q unexpected error from Run: %v", test.name, err)
+				}
+			}
+			return w
+		}
+
+		run(3, true)
+		if _, err := os.Stat(cpFile); err != nil {
+			t.Fatalf("test=%q checkpoint file not written: %v", test.name, err)
+		}
+		if test.remove != "" {
+			fs3.m.Lock()
+			delete(fs3.parts, test.remove)
+			fs3.m.Unlock()
+		}
+
+		w := run(5, false)
+		if n := w.SkippedParts(); n != test.expected {
+			t.Errorf("test=%q expected=%d skipped actual=%d", test.name, test.expected, n)
+		}
+		if len(fs3.parts) != 5 {
+			t.Errorf("test=%q incorrect part count %d", test.name, len(fs3.parts))
+		}
+		var md Metadata
+		if err := json.Unmarshal(fs3.metadata, &md); err != nil {
+			t.Fatalf("test=%q failed to decode metadata: %v", test.name, err)
+		}
+		if md.Status != StatusCompleted || md.PartCount != 5 {
+			t.Errorf("test=%q incorrect metadata status=%q parts=%d", test.name, md.Status, md.PartCount)
+		}
+		if _, err := os.Stat(cpFile); !os.IsNotExist(err) {
+			t.Errorf("test=%q checkpoint file not removed: %v", test.name, err)
+		}
+	}
+}
+
+// Check that a checkpoint file for a different backup is rejected.
+func TestS3CheckpointMismatch(t *testing.T) {
+	f, err := ioutil.TempFile("", "dyndump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"bucket": "test-bucket", "path_prefix": "other-prefix", "parts": {}}`)
+	f.Close()
+
+	w := NewS3Writer(newFakeS3(), "test-bucket", "test-prefix", Metadata{})
+	w.CheckpointFile = f.Name()
+	if err := w.Run(); err == nil || !strings.Contains(err.Error(), "other-prefix") {
+		t.Error("Incorrect error", err)
+	}
+}
+
+// Check that parts compressed with a dictionary are read back intact and
+// are smaller than those compressed without one.
+func TestS3CompressionDict(t *testing.T) {
+	item := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":{"N":"%d"},"name":{"S":"user-%d"},"email":{"S":"user%d@example.com"},"active":{"BOOL":true}}`+"\n", i, i, i))
+	}
+	var dict, expected []byte
+	for i := 0; i < 10; i++ {
+		dict = append(dict, item(-i)...)
+	}
+
+	compressed := make(map[bool]int64)
+	for _, useDict := range []bool{false, true} {
+		fs3 := newFakeS3()
+		w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+		w.PartSize = MinPartSize
+		w.MaxParallel = 1
+		if useDict {
+			w.CompressionDict = dict
+		}
+
+		done := make(chan error)
+		go func() { done <- w.Run() }()
+		expected = nil
+		for i := 0; i < 100; i++ {
+			data := item(i)
+			expected = append(expected, data...)
+			if _, err := w.Write(data); err != nil {
+				t.Fatal("Write failed", err)
+			}
+		}
+		w.Close()
+		if err := <-done; err != nil {
+			t.Fatal("Unexpected error from Run", err)
+		}
+
+		var md Metadata
+		if err := json.Unmarshal(fs3.metadata, &md); err != nil {
+			t.Fatal("Failed to decode metadata", err)
+		}
+		compressed[useDict] = md.CompressedBytes
+		if useDict && !bytes.Equal(md.CompressionDict, dict) {
+			t.Error("Dictionary not stored in metadata")
+		}
+		for k, part := range fs3.parts {
+			if useDict && (!strings.HasSuffix(k, ".json.zlib") || part.enc != "deflate") {
+				t.Errorf("Incorrect key or encoding for part %q: %q", k, part.enc)
+			}
+		}
+
+		r := &S3Reader{S3: fs3.getLister(), Bucket: "test-bucket", PathPrefix: "test-prefix"}
+		result, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("dict=%t read failed: %v", useDict, err)
+		}
+		if !bytes.Equal(result, expected) {
+			t.Errorf("dict=%t incorrect data read", useDict)
+		}
+	}
+	if compressed[true] >= compressed[false] {
+		t.Errorf("Dictionary did not improve compression dict=%d nodict=%d", compressed[true], compressed[false])
+	}
+}
+
+var compressionTests = []struct {
+	compression PartCompression
+	recorded    PartCompression
+	ext         string
+	enc         string
+}{
+	{"", CompressionGzip, ".json.gz", "gzip"},
+	{CompressionGzip, CompressionGzip, ".json.gz", "gzip"},
+	{CompressionZlib, CompressionZlib, ".json.zlib", "deflate"},
+	{CompressionZstd, CompressionZstd, ".json.zst", "zstd"},
+	{CompressionNone, CompressionNone, ".json", ""},
+}
+
+// Check that parts are written with the selected compression, which is
+// recorded in the metadata and used by S3Reader to read them back.
+func TestS3Compression(t *testing.T) {
+	for _, test := range compressionTests {
+		fs3 := newFakeS3()
+		w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+		w.PartSize = MinPartSize
+		w.MaxParallel = 1
+		w.Compression = test.compression
+
+		done := make(chan error)
+		go func() { done <- w.Run() }()
+		var expected []byte
+		for i := 0; i < 3; i++ {
+			data := randbytes(i, MinPartSize)
+			expected = append(expected, data...)
+			if _, err := w.Write(data); err != nil {
+				t.Fatal("Write failed", err)
+			}
+		}
+		w.Close()
+		if err := <-done; err != nil {
+			t.Fatalf("compression=%q unexpected error from Run: %v", test.compression, err)
+		}
+
+		var md Metadata
+		if err := json.Unmarshal(fs3.metadata, &md); err != nil {
+			t.Fatal("Failed to decode metadata", err)
+		}
+		if md.Compression != test.recorded {
+			t.Errorf("compression=%q incorrect compression recorded %q", test.compression, md.Compression)
+		}
+		if len(fs3.parts) != 3 {
+			t.Errorf("compression=%q incorrect part count %d", test.compression, len(fs3.parts))
+		}
+		for k, part := range fs3.parts {
+			if k[strings.Index(k, ".json"):] != test.ext || part.enc != test.enc {
+				t.Errorf("compression=%q incorrect key or encoding for part %q: %q", test.compression, k, part.enc)
+			}
+		}
+		if test.compression == CompressionNone && md.CompressedBytes != md.UncompressedBytes {
+			t.Errorf("Incorrect compressed size %d for uncompressed parts of %d bytes", md.CompressedBytes, md.UncompressedBytes)
+		}
+
+		r := &S3Reader{S3: fs3.getLister(), Bucket: "test-bucket", PathPrefix: "test-prefix"}
+		result, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("compression=%q read failed: %v", test.compression, err)
+		}
+		if !bytes.Equal(result, expected) {
+			t.Errorf("compression=%q incorrect data read", test.compression)
+		}
+	}
+}
+
+// Check that items written with zstd at each compression level are read
+// back intact and verified, and that a corrupted zstd part is detected.
+func TestS3Zstd(t *testing.T) {
+	for _, level := range []int{0, gzip.BestSpeed, gzip.BestCompression} {
+		fs3 := newFakeS3()
+		w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+		w.PartSize = MinPartSize
+		w.MaxParallel = 2
+		w.Compression = CompressionZstd
+		w.CompressionLevel = level
+
+		done := make(chan error)
+		go func() { done <- w.Run() }()
+		var expected []byte
+		for i := 0; i < 4; i++ {
+			// large enough that each item fills a part once compressed
+			item := fmt.Sprintf(`{"id":{"N":"%d"},"data":{"S":"%x"}}`+"\n", i, randbytes(i, 2*MinPartSize))
+			expected = append(expected, item...)
+			if _, err := w.Write([]byte(item)); err != nil {
+				t.Fatal("Write failed", err)
+			}
+		}
+		w.Close()
+		if err := <-done; err != nil {
+			t.Fatalf("level=%d unexpected error from Run: %v", level, err)
+		}
+		if stats := w.Stats(); stats.CompressedBytes >= stats.UncompressedBytes {
+			t.Errorf("level=%d parts not compressed: %d bytes from %d", level, stats.CompressedBytes, stats.UncompressedBytes)
+		}
+
+		r := &S3Reader{
+			S3:         fs3.getLister(),
+			Bucket:     "test-bucket",
+			PathPrefix: "test-prefix",
+			VerifyMode: VerifyAll,
+			DeepVerify: true,
+		}
+		result, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("level=%d read failed: %v", level, err)
+		}
+		if !bytes.Equal(result, expected) {
+			t.Errorf("level=%d incorrect data read", level)
+		}
+		if n := r.PartsCompleted(math.MaxInt64); n != 4 {
+			t.Errorf("level=%d expected 4 parts read, got %d", level, n)
+		}
+
+		part := fs3.parts["test-prefix-part-000000002.json.zst"]
+		part.data[len(part.data)/2]++
+		r = &S3Reader{S3: fs3.getLister(), Bucket: "test-bucket", PathPrefix: "test-prefix"}
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Errorf("level=%d no error reading a corrupted part", level)
+		}
+	}
+}
+
+// Check that unsupported compressions are rejected by both the writer and
+// the reader.
+func TestS3CompressionInvalid(t *testing.T) {
+	w := NewS3Writer(newFakeS3(), "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+	w.Compression = "lz4"
+	if err := w.Run(); err == nil || !strings.Contains(err.Error(), `unsupported compression "lz4"`) {
+		t.Error("Incorrect error for unsupported compression", err)
+	}
+
+	w = NewS3Writer(newFakeS3(), "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+	w.Compression = CompressionNone
+	w.CompressionDict = []byte("dict")
+	if err := w.Run(); err == nil {
+		t.Error("Expected error for a dictionary without zlib compression")
+	}
+
+	w = NewS3Writer(newFakeS3(), "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+	w.Compression = CompressionZstd
+	w.CompressionLevel = gzip.HuffmanOnly
+	if err := w.Run(); err == nil {
+		t.Error("Expected error for HuffmanOnly with zstd compression")
+	}
+
+	fs3 := writeTestBackup(t, 2, false)
+	fs3.metadata = bytes.Replace(fs3.metadata, []byte(`"compression": "gzip"`), []byte(`"compression": "lz4"`), 1)
+	r := &S3Reader{S3: fs3.getLister(), Bucket: "test-bucket", PathPrefix: "test-prefix"}
+	if _, err := ioutil.ReadAll(r); err == nil || !strings.Contains(err.Error(), `unsupported compression "lz4"`) {
+		t.Error("Incorrect error reading unsupported compression", err)
+	}
+}
+
+// deferS3 records the status of each metadata object written to a fakeS3,
+// and stores in-progress metadata separately.
+type deferS3 struct {
+	*fakeS3
+	m          sync.Mutex
+	writes     []string // "key status" for each metadata write
+	inProgress bool     // true if the in-progress metadata exists
+}
+
+func (d *deferS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	k := aws.StringValue(input.Key)
+	if !strings.HasSuffix(k, ".json") {
+		return d.fakeS3.PutObject(input)
+	}
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	var md Metadata
+	if err := json.Unmarshal(data, &md); err != nil {
+		return nil, err
+	}
+	d.m.Lock()
+	d.writes = append(d.writes, fmt.Sprintf("%s %s", k, md.Status))
+	d.m.Unlock()
+	if k == inProgressMetaKey(DefaultKeyNamer{}, "test-prefix") {
+		d.m.Lock()
+		d.inProgress = true
+		d.m.Unlock()
+		return new(s3.PutObjectOutput), nil
+	}
+	input.Body = bytes.NewReader(data)
+	return d.fakeS3.PutObject(input)
+}
+
+func (d *deferS3) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	for _, obj := range input.Delete.Objects {
+		if aws.StringValue(obj.Key) == inProgressMetaKey(DefaultKeyNamer{}, "test-prefix") {
+			d.m.Lock()
+			d.inProgress = false
+			d.m.Unlock()
+		}
+	}
+	return d.fakeS3.DeleteObjects(input)
+}
+
+// Check that DeferMetadata only writes the metadata to its usual key once
+// the backup completes, and never if it's aborted.
+func TestS3DeferMetadata(t *testing.T) {
+	for _, abort := range []bool{false, true} {
+		ds3 := &deferS3{fakeS3: newFakeS3()}
+		w := NewS3Writer(ds3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+		w.PartSize = MinPartSize
+		w.MaxParallel = 1
+		w.DeferMetadata = true
+
+		done := make(chan error)
+		go func() { done <- w.Run() }()
+		for i := 0; i < 3; i++ {
+			if _, err := w.Write(randbytes(i, MinPartSize)); err != nil {
+				t.Fatal("Write failed", err)
+			}
+		}
+		if abort {
+			w.Abort()
+			if err := <-done; err == nil {
+				t.Fatal("No error returned from Run")
+			}
+		} else {
+			w.Close()
+			if err := <-done; err != nil {
+				t.Fatal("Unexpected error from Run", err)
+			}
+		}
+
+		inProgressKey := inProgressMetaKey(DefaultKeyNamer{}, "test-prefix")
+		expectedLast := s3MetaKey("test-prefix") + " " + string(StatusCompleted)
+		if abort {
+			expectedLast = inProgressKey + " " + string(StatusFailed)
+		}
+		for i, write := range ds3.writes {
+			if i == len(ds3.writes)-1 {
+				if write != expectedLast {
+					t.Errorf("abort=%t incorrect final metadata write %q", abort, write)
+				}
+			} else if write != inProgressKey+" "+string(StatusRunning) {
+				t.Errorf("abort=%t incorrect metadata write %d: %q", abort, i, write)
+			}
+		}
+		if ds3.inProgress == !abort {
+			t.Errorf("abort=%t incorrect in-progress state %t", abort, ds3.inProgress)
+		}
+		if hasMeta := ds3.fakeS3.metaKey != ""; hasMeta == abort {
+			t.Errorf("abort=%t incorrect metadata state %t", abort, hasMeta)
+		}
+	}
+}
+
+// countS3 counts the number of times each key is written.
+type countS3 struct {
+	*fakeS3
+	puts map[string]int
+}
+
+func (c *countS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	c.m.Lock()
+	c.puts[aws.StringValue(input.Key)]++
+	c.m.Unlock()
+	return c.fakeS3.PutObject(input)
+}
+
+// Check that WriteOnce writes each part and the metadata exactly once.
+func TestS3WriteOnce(t *testing.T) {
+	cs3 := &countS3{fakeS3: newFakeS3(), puts: make(map[string]int)}
+	w := NewS3Writer(cs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+	w.PartSize = MinPartSize
+	w.MaxParallel = 2
+	w.WriteOnce = true
+
+	done := make(chan error)
+	go func() { done <- w.Run() }()
+	for i := 0; i < 5; i++ {
+		if _, err := w.Write(randbytes(i, MinPartSize)); err != nil {
+			t.Fatal("Write failed", err)
+		}
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+
+	if len(cs3.puts) != 6 {
+		t.Errorf("Incorrect number of keys written: %d", len(cs3.puts))
+	}
+	for key, count := range cs3.puts {
+		if count != 1 {
+			t.Errorf("Key %q written %d times", key, count)
+		}
+	}
+	var md Metadata
+	if err := json.Unmarshal(cs3.metadata, &md); err != nil {
+		t.Fatal("Failed to decode metadata", err)
+	}
+	if md.Status != StatusCompleted || md.PartCount != 5 {
+		t.Errorf("Incorrect metadata status=%s parts=%d", md.Status, md.PartCount)
+	}
+}
+
+// Check that WriteOnce fails rather than overwrite an existing part.
+func TestS3WriteOnceExists(t *testing.T) {
+	fs3 := newFakeS3()
+	_, key := (&S3Writer{PathPrefix: "test-prefix"}).newKey()
+	fs3.parts[key] = putdata{data: []byte("existing")}
+
+	w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+	w.PartSize = MinPartSize
+	w.MaxParallel = 1
+	w.WriteOnce = true
+
+	done := make(chan error)
+	go func() { done <- w.Run() }()
+	w.Write(randbytes(0, MinPartSize))
+	w.Close()
+	if err := <-done; err == nil {
+		t.Fatal("No error returned from Run")
+	}
+	if string(fs3.parts[key].data) != "existing" {
+		t.Error("Existing part was overwritten")
+	}
+	var md Metadata
+	if err := json.Unmarshal(fs3.metadata, &md); err != nil {
+		t.Fatal("Failed to decode metadata", err)
+	}
+	if md.Status != StatusFailed {
+		t.Error("Incorrect metadata status", md.Status)
+	}
+}
+
+// timeoutS3 stores each part on its first upload, but reports the upload
+// as failed, as happens when a request times out after S3 stored the
+// object.
+type timeoutS3 struct {
+	*fakeS3
+	puts map[string]int
+}
+
+func (s *timeoutS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	key := aws.StringValue(input.Key)
+	s.m.Lock()
+	s.puts[key]++
+	n := s.puts[key]
+	s.m.Unlock()
+	resp, err := s.fakeS3.PutObject(input)
+	if err == nil && n == 1 && !strings.HasSuffix(key, "meta.json") {
+		return nil, errors.New("request timeout")
+	}
+	return resp, err
+}
+
+// Check that a part upload that succeeded but was reported as failed is
+// retried with the same key, so the part isn't stored or counted twice.
+func TestS3PartRetry(t *testing.T) {
+	defer func(d time.Duration) { partRetryDelay = d }(partRetryDelay)
+	partRetryDelay = 0
+
+	for _, writeOnce := range []bool{false, true} {
+		ts3 := &timeoutS3{fakeS3: newFakeS3(), puts: make(map[string]int)}
+		w := NewS3Writer(ts3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+		w.PartSize = MinPartSize
+		w.MaxParallel = 2
+		w.PartRetries = 1
+		w.WriteOnce = writeOnce
+
+		done := make(chan error)
+		go func() { done <- w.Run() }()
+		for i := 0; i < 3; i++ {
+			if _, err := w.Write(randbytes(i, MinPartSize)); err != nil {
+				t.Fatal("Write failed", err)
+			}
+		}
+		w.Close()
+		if err := <-done; err != nil {
+			t.Fatalf("writeOnce=%t unexpected error from Run: %v", writeOnce, err)
+		}
+
+		if len(ts3.parts) != 3 {
+			t.Errorf("writeOnce=%t incorrect number of parts stored: %d", writeOnce, len(ts3.parts))
+		}
+		expectedPuts := 2
+		if writeOnce {
+			expectedPuts = 1 // the retry finds the stored part
+		}
+		for key := range ts3.parts {
+			if n := ts3.puts[key]; n != expectedPuts {
+				t.Errorf("writeOnce=%t part %q written %d times", writeOnce, key, n)
+			}
+		}
+		var md Metadata
+		if err := json.Unmarshal(ts3.metadata, &md); err != nil {
+			t.Fatal("Failed to decode metadata", err)
+		}
+		if md.Status != StatusCompleted || md.PartCount != 3 || md.ItemCount != 3 {
+			t.Errorf("writeOnce=%t incorrect metadata status=%s parts=%d items=%d",
+				writeOnce, md.Status, md.PartCount, md.ItemCount)
+		}
+	}
+}
+
+// aclS3 records the ACL each key is written with.
+type aclS3 struct {
+	*fakeS3
+	acls map[string]string
+}
+
+func (a *aclS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	a.m.Lock()
+	a.acls[aws.StringValue(input.Key)] = aws.StringValue(input.ACL)
+	a.m.Unlock()
+	return a.fakeS3.PutObject(input)
+}
+
+// Check that ACL is applied to every part and the metadata.
+func TestS3ACL(t *testing.T) {
+	for _, acl := range []string{"", s3.ObjectCannedACLBucketOwnerFullControl} {
+		as3 := &aclS3{fakeS3: newFakeS3(), acls: make(map[string]string)}
+		w := NewS3Writer(as3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+		w.PartSize = MinPartSize
+		w.MaxParallel = 1
+		w.ACL = acl
+
+		done := make(chan error)
+		go func() { done <- w.Run() }()
+		for i := 0; i < 3; i++ {
+			if _, err := w.Write(randbytes(i, MinPartSize)); err != nil {
+				t.Fatal("Write failed", err)
+			}
+		}
+		w.Close()
+		if err := <-done; err != nil {
+			t.Fatal("Unexpected error from Run", err)
+		}
+
+		if len(as3.acls) != 4 {
+			t.Errorf("acl=%q incorrect number of keys written: %d", acl, len(as3.acls))
+		}
+		for key, actual := range as3.acls {
+			if actual != acl {
+				t.Errorf("acl=%q key %q written with acl %q", acl, key, actual)
+			}
+		}
+	}
+}
+
+// sseS3 records the server side encryption parameters each key is
+// written with.
+type sseS3 struct {
+	*fakeS3
+	sse map[string][2]string
+}
+
+func (e *sseS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	e.m.Lock()
+	e.sse[aws.StringValue(input.Key)] = [2]string{aws.StringValue(input.ServerSideEncryption), aws.StringValue(input.SSEKMSKeyId)}
+	e.m.Unlock()
+	return e.fakeS3.PutObject(input)
+}
+
+var sseTests = []struct {
+	sse      string
+	kmsKeyID string
+}{
+	{"", ""},
+	{s3.ServerSideEncryptionAes256, ""},
+	{s3.ServerSideEncryptionAwsKms, ""},
+	{s3.ServerSideEncryptionAwsKms, "arn:aws:kms:us-east-1:111122223333:key/test-key"},
+}
+
+// Check that the encryption settings are applied to every part and the
+// metadata.
+func TestS3ServerSideEncryption(t *testing.T) {
+	for _, test := range sseTests {
+		es3 := &sseS3{fakeS3: newFakeS3(), sse: make(map[string][2]string)}
+		w := NewS3Writer(es3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+		w.PartSize = MinPartSize
+		w.MaxParallel = 1
+		w.ServerSideEncryption = test.sse
+		w.SSEKMSKeyID = test.kmsKeyID
+
+		done := make(chan error)
+		go func() { done <- w.Run() }()
+		for i := 0; i < 3; i++ {
+			if _, err := w.Write(randbytes(i, MinPartSize)); err != nil {
+				t.Fatal("Write failed", err)
+			}
+		}
+		w.Close()
+		if err := <-done; err != nil {
+			t.Fatal("Unexpected error from Run", err)
+		}
+
+		if len(es3.sse) != 4 {
+			t.Errorf("sse=%q incorrect number of keys written: %d", test.sse, len(es3.sse))
+		}
+		expected := [2]string{test.sse, test.kmsKeyID}
+		for key, actual := range es3.sse {
+			if actual != expected {
+				t.Errorf("sse=%q key %q written with %q", test.sse, key, actual)
+			}
+		}
+	}
+}
+
+// A KMS key may only be given with KMS encryption.
+func TestS3ServerSideEncryptionInvalid(t *testing.T) {
+	w := NewS3Writer(newFakeS3(), "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+	w.ServerSideEncryption = s3.ServerSideEncryptionAes256
+	w.SSEKMSKeyID = "test-key"
+	if err := w.Run(); err == nil {
+		t.Error("Expected error for a KMS key without KMS encryption")
+	}
+}
+
+// storageClassS3 records the storage class each key is written with.
+type storageClassS3 struct {
+	*fakeS3
+	classes map[string]string
+}
+
+func (c *storageClassS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	c.m.Lock()
+	c.classes[aws.StringValue(input.Key)] = aws.StringValue(input.StorageClass)
+	c.m.Unlock()
+	return c.fakeS3.PutObject(input)
+}
+
+// Check that StorageClass is applied to every part, but not the metadata.
+func TestS3StorageClass(t *testing.T) {
+	for _, class := range []string{"", s3.StorageClassStandardIa} {
+		cs3 := &storageClassS3{fakeS3: newFakeS3(), classes: make(map[string]string)}
+		w := NewS3Writer(cs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+		w.PartSize = MinPartSize
+		w.MaxParallel = 1
+		w.StorageClass = class
+
+		done := make(chan error)
+		go func() { done <- w.Run() }()
+		for i := 0; i < 3; i++ {
+			if _, err := w.Write(randbytes(i, MinPartSize)); err != nil {
+				t.Fatal("Write failed", err)
+			}
+		}
+		w.Close()
+		if err := <-done; err != nil {
+			t.Fatal("Unexpected error from Run", err)
+		}
+
+		if len(cs3.classes) != 4 {
+			t.Errorf("class=%q incorrect number of keys written: %d", class, len(cs3.classes))
+		}
+		for key, actual := range cs3.classes {
+			expected := class
+			if key == s3MetaKey("test-prefix") {
+				expected = ""
+			}
+			if actual != expected {
+				t.Errorf("class=%q key %q written with class %q", class, key, actual)
+			}
+		}
+	}
+}
+
+// sizeS3 records the compressed size of each part written.
+type sizeS3 struct {
+	*fakeS3
+	sizes []int64
+}
+
+func (s *sizeS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	if strings.Contains(aws.StringValue(input.Key), "-part-") {
+		size, _ := input.Body.Seek(0, io.SeekEnd)
+		input.Body.Seek(0, io.SeekStart)
+		s.m.Lock()
+		s.sizes = append(s.sizes, size)
+		s.m.Unlock()
+	}
+	return s.fakeS3.PutObject(input)
+}
+
+// Check that the compression level is applied to every part.  Go's gzip
+// writer records the fastest and best levels in the header's XFL byte.
+func TestS3CompressionLevel(t *testing.T) {
+	tests := []struct {
+		level int
+		xfl   byte
+	}{
+		{0, 0},
+		{gzip.BestSpeed, 4},
+		{gzip.BestCompression, 2},
+	}
+	compressed := make(map[int]int64)
+	for _, test := range tests {
+		fs3 := &headerS3{fakeS3: newFakeS3()}
+		w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+		w.PartSize = MinPartSize
+		w.MaxParallel = 1
+		w.CompressionLevel = test.level
+
+		done := make(chan error)
+		go func() { done <- w.Run() }()
+		for i := 0; i < 3; i++ {
+			item := fmt.Sprintf(`{"id":{"N":"%d"},"data":{"S":"%x"}}`+"\n", i, randbytes(i, MinPartSize))
+			if _, err := w.Write([]byte(item)); err != nil {
+				t.Fatal("Write failed", err)
+			}
+		}
+		w.Close()
+		if err := <-done; err != nil {
+			t.Fatalf("level=%d unexpected error from Run: %v", test.level, err)
+		}
+		if len(fs3.xfl) != 3 {
+			t.Fatalf("level=%d incorrect part count %d", test.level, len(fs3.xfl))
+		}
+		for i, xfl := range fs3.xfl {
+			if xfl != test.xfl {
+				t.Errorf("level=%d part %d has incorrect XFL %d", test.level, i, xfl)
+			}
+		}
+		compressed[test.level] = w.Stats().CompressedBytes
+	}
+	if compressed[gzip.BestCompression] >= compressed[gzip.BestSpeed] {
+		t.Errorf("BestCompression (%d bytes) not smaller than BestSpeed (%d bytes)",
+			compressed[gzip.BestCompression], compressed[gzip.BestSpeed])
+	}
+
+	for _, level := range []int{-3, 10} {
+		w := NewS3Writer(newFakeS3(), "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+		w.CompressionLevel = level
+		if err := w.Run(); err == nil {
+			t.Errorf("level=%d expected error", level)
+		}
+	}
+}
+
+// headerS3 records the XFL byte of the gzip header of each part.
+type headerS3 struct {
+	*fakeS3
+	xfl []byte
+}
+
+func (s *headerS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	if strings.Contains(aws.StringValue(input.Key), "-part-") {
+		header := make([]byte, 10)
+		if _, err := io.ReadFull(input.Body, header); err != nil {
+			return nil, err
+		}
+		input.Body.Seek(0, io.SeekStart)
+		s.m.Lock()
+		s.xfl = append(s.xfl, header[8])
+		s.m.Unlock()
+	}
+	return s.fakeS3.PutObject(input)
+}
+
+const flushTestPartSize = 20000
+
+var gzipFlushTests = []struct {
+	interval  int
+	tolerance int64 // maximum bytes a part may exceed PartSize by; 0 to skip the check
+}{
+	{0, flushTestPartSize/10 + 1000},
+	{flushTestPartSize / 2, flushTestPartSize/2 + 1000},
+	{-1, 0},
+}
+
+// Check that parts are completed close to PartSize when the compressor is
+// flushed less often than the default, and that they compress no worse.
+func TestS3GzipFlushInterval(t *testing.T) {
+	var defaultTotal int64
+	for _, test := range gzipFlushTests {
+		ss3 := &sizeS3{fakeS3: newFakeS3()}
+		w := NewS3Writer(ss3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+		w.PartSize = flushTestPartSize
+		w.MaxParallel = 1
+		w.GzipFlushInterval = test.interval
+
+		done := make(chan error)
+		go func() { done <- w.Run() }()
+		for i := 0; i < 5000; i++ {
+			item := fmt.Sprintf(`{"k":{"S":"%d"},"v":{"S":"%x"}}`+"\n", i, randbytes(i, 20))
+			if _, err := w.Write([]byte(item)); err != nil {
+				t.Fatal("Write failed", err)
+			}
+		}
+		w.Close()
+		if err := <-done; err != nil {
+			t.Fatal("Unexpected error from Run", err)
+		}
+
+		var total int64
+		for i, size := range ss3.sizes {
+			total += size
+			if i == len(ss3.sizes)-1 {
+				break // the final part holds whatever remains
+			}
+			if size < flushTestPartSize || (test.tolerance > 0 && size > flushTestPartSize+test.tolerance) {
+				t.Errorf("interval=%d part %d has incorrect size %d", test.interval, i, size)
+			}
+		}
+		if test.interval == 0 {
+			defaultTotal = total
+		} else if total > defaultTotal {
+			t.Errorf("interval=%d compressed to %d bytes; default interval compressed to %d",
+				test.interval, total, defaultTotal)
+		}
+	}
+}
+
+// failMetaS3 fails the first failures writes of completed metadata.
+type failMetaS3 struct {
+	*fakeS3
+	failures int
+}
+
+func (f *failMetaS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	if strings.HasSuffix(aws.StringValue(input.Key), "meta.json") {
+		data, err := ioutil.ReadAll(input.Body)
+		if err != nil {
+			return nil, err
+		}
+		var md Metadata
+		if err := json.Unmarshal(data, &md); err != nil {
+			return nil, err
+		}
+		if md.Status == StatusCompleted && f.failures > 0 {
+			f.failures--
+			return nil, errors.New("transient failure")
+		}
+		input.Body = bytes.NewReader(data)
+	}
+	return f.fakeS3.PutObject(input)
+}
+
+// Check that the final metadata write is retried, and that a MetadataError
+// is returned once the retries are exhausted.
+func TestS3MetadataRetry(t *testing.T) {
+	defer func(d time.Duration) { metadataRetryDelay = d }(metadataRetryDelay)
+	metadataRetryDelay = 0
+
+	for _, failures := range []int{0, DefaultMetadataRetries, DefaultMetadataRetries + 1} {
+		fs3 := &failMetaS3{fakeS3: newFakeS3(), failures: failures}
+		w := NewS3Writer(fs3, "test-bucket", "test-prefix", Metadata{TableName: "a_table"})
+		w.PartSize = MinPartSize
+		w.MaxParallel = 1
+
+		done := make(chan error)
+		go func() { done <- w.Run() }()
+		for i := 0; i < 2; i++ {
+			if _, err := w.Write(randbytes(i, MinPartSize)); err != nil {
+				t.Fatal("Write failed", err)
+			}
+		}
+		w.Close()
+		err := <-done
+
+		if failures <= DefaultMetadataRetries {
+			if err != nil {
+				t.Errorf("failures=%d unexpected error from Run: %v", failures, err)
+			}
+			continue
+		}
+		merr, ok := err.(*MetadataError)
+		if !ok {
+			t.Fatalf("failures=%d incorrect error %#v", failures, err)
+		}
+		if merr.Key != s3MetaKey("test-prefix") || merr.Attempts != DefaultMetadataRetries+1 {
+			t.Errorf("Incorrect error key=%q attempts=%d", merr.Key, merr.Attempts)
+		}
+		if merr.Metadata.Status != StatusCompleted || merr.Metadata.PartCount != 2 {
+			t.Errorf("Incorrect error metadata status=%s parts=%d", merr.Metadata.Status, merr.Metadata.PartCount)
+		}
 	}
 }
 
@@ -112,6 +1999,17 @@ func TestS3OK(t *testing.T) {
 	if len(seen) != 256 {
 		t.Error("Incorrect number of seeds seen", len(seen))
 	}
+
+	stats := w.Stats()
+	if stats.PartCount != int64(len(fs3.parts)) {
+		t.Error("Incorrect part count", stats.PartCount)
+	}
+	if stats.UncompressedBytes != 256*(chunkSize+1) {
+		t.Error("Incorrect uncompressed bytes", stats.UncompressedBytes)
+	}
+	if stats.CompressedBytes <= 0 {
+		t.Error("Incorrect compressed bytes", stats.CompressedBytes)
+	}
 }
 
 // Test that a hard put failure results in the writer shutting down
@@ -180,10 +2078,12 @@ type putdata struct {
 	bucket string
 	enc    string
 	ctype  string
+	md     map[string]*string
 }
 
 type fakeS3 struct {
 	m        sync.Mutex
+	metaKey  string
 	metadata []byte
 	parts    map[string]putdata
 }
@@ -202,8 +2102,24 @@ func (fs3 *fakeS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, err
 			return nil, fmt.Errorf("Failed to read body for key %s: %v", k, err)
 		}
 		fs3.m.Lock()
+		fs3.metaKey = k
 		fs3.metadata = data
 		fs3.m.Unlock()
+	} else if enc := aws.StringValue(input.ContentEncoding); enc == "deflate" || enc == "zstd" || enc == "" {
+		// S3 doesn't decompress deflate, zstd or uncompressed data; store it as is
+		data, err := ioutil.ReadAll(input.Body)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read body for key %s: %v", k, err)
+		}
+		fs3.m.Lock()
+		fs3.parts[k] = putdata{
+			data:   data,
+			bucket: bucket,
+			enc:    aws.StringValue(input.ContentEncoding),
+			ctype:  aws.StringValue(input.ContentType),
+			md:     input.Metadata,
+		}
+		fs3.m.Unlock()
 	} else {
 		// gunzip the data and store that
 		gzr, err := gzip.NewReader(input.Body)
@@ -222,23 +2138,114 @@ func (fs3 *fakeS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, err
 			bucket: bucket,
 			enc:    aws.StringValue(input.ContentEncoding),
 			ctype:  aws.StringValue(input.ContentType),
+			md:     input.Metadata,
 		}
 		fs3.m.Unlock()
 	}
 	return nil, nil
 }
 
+func (fs3 *fakeS3) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	fs3.m.Lock()
+	defer fs3.m.Unlock()
+	for _, obj := range input.Delete.Objects {
+		k := aws.StringValue(obj.Key)
+		if k == fs3.metaKey {
+			fs3.metaKey = ""
+			fs3.metadata = nil
+		}
+		delete(fs3.parts, k)
+	}
+	return new(s3.DeleteObjectsOutput), nil
+}
+
+func (fs3 *fakeS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	fs3.m.Lock()
+	defer fs3.m.Unlock()
+	part, ok := fs3.parts[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), 404, "")
+	}
+	// the SDK returns metadata keys in canonical header form
+	return &s3.HeadObjectOutput{Metadata: canonicalMetadata(part.md)}, nil
+}
+
+// canonicalMetadata returns a copy of md with each key in canonical header
+// form.
+func canonicalMetadata(md map[string]*string) map[string]*string {
+	if md == nil {
+		return nil
+	}
+	cmd := make(map[string]*string, len(md))
+	for k, v := range md {
+		cmd[http.CanonicalHeaderKey(k)] = v
+	}
+	return cmd
+}
+
+// getLister returns a fakeS3GetLister that serves the objects previously
+// written to fs3.
+func (fs3 *fakeS3) getLister() *fakeS3GetLister {
+	return &fakeS3GetLister{
+		list: func(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
+			fs3.m.Lock()
+			var keys []string
+			sizes := make(map[string]int64)
+			for k, part := range fs3.parts {
+				if strings.HasPrefix(k, aws.StringValue(input.Prefix)) {
+					keys = append(keys, k)
+					sizes[k] = int64(len(part.data))
+				}
+			}
+			fs3.m.Unlock()
+			sort.Strings(keys)
+			page := new(s3.ListObjectsV2Output)
+			for _, k := range keys {
+				page.Contents = append(page.Contents, &s3.Object{Key: aws.String(k), Size: aws.Int64(sizes[k])})
+			}
+			fn(page, true)
+			return nil
+		},
+		get: func(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+			fs3.m.Lock()
+			defer fs3.m.Unlock()
+			k := aws.StringValue(input.Key)
+			if strings.HasSuffix(k, "meta.json") {
+				if fs3.metaKey != k {
+					return nil, awserr.New(s3.ErrCodeNoSuchKey, fmt.Sprintf("metadata key not found %q", k), nil)
+				}
+				return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(fs3.metadata))}, nil
+			}
+			part, ok := fs3.parts[k]
+			if !ok {
+				return nil, fmt.Errorf("part key not found %q", k)
+			}
+			return &s3.GetObjectOutput{
+				Body:     ioutil.NopCloser(bytes.NewReader(part.data)),
+				Metadata: canonicalMetadata(part.md),
+			}, nil
+		},
+	}
+}
+
 type fakePutObject func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
 
 func (f fakePutObject) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
 	return f(input)
 }
 
+// randbytes returns qty pseudo random bytes ending with the only newline,
+// so that the data counts as a single item.
 func randbytes(seed, qty int) (result []byte) {
 	rnd := rand.New(rand.NewSource(int64(seed)))
 	result = make([]byte, qty)
 	for i := 0; i < qty; i++ {
-		result[i] = byte(rnd.Intn(255))
+		if result[i] = byte(rnd.Intn(255)); result[i] == '\n' {
+			result[i]++
+		}
+	}
+	if qty > 0 {
+		result[qty-1] = '\n'
 	}
 	return result
 }
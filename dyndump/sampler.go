@@ -0,0 +1,110 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// ItemSampler implements the ConditionalItemReader interface, passing on
+// the items read from a source while keeping a uniform random sample of up
+// to a fixed number of them, such as to check that a sample of the items
+// loaded into a table were written correctly once a load has finished.
+//
+// The sample is chosen by reservoir sampling, so only the sampled items
+// are held in memory however many are read.  The choice is determined by
+// the seed, so reading the same items with the same seed selects the same
+// sample.  Sampled items have any SequenceKey attribute removed.
+type ItemSampler struct {
+	src  ItemReader
+	size int
+	rnd  *rand.Rand
+
+	m      sync.Mutex
+	seen   int64
+	sample []map[string]*dynamodb.AttributeValue
+}
+
+// NewItemSampler creates an ItemSampler that reads from src, keeping a
+// sample of up to size items chosen using seed.
+func NewItemSampler(src ItemReader, size int, seed int64) *ItemSampler {
+	return &ItemSampler{
+		src:  src,
+		size: size,
+		rnd:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// ReadItem implements ItemReader.
+func (s *ItemSampler) ReadItem() (map[string]*dynamodb.AttributeValue, error) {
+	item, _, err := s.ReadConditionalItem()
+	return item, err
+}
+
+// ReadConditionalItem implements ConditionalItemReader.  The condition is
+// nil unless the source implements ConditionalItemReader.
+func (s *ItemSampler) ReadConditionalItem() (item map[string]*dynamodb.AttributeValue, cond *ItemCondition, err error) {
+	if cs, ok := s.src.(ConditionalItemReader); ok {
+		item, cond, err = cs.ReadConditionalItem()
+	} else {
+		item, err = s.src.ReadItem()
+	}
+	if err == nil {
+		s.add(item)
+	}
+	return item, cond, err
+}
+
+// add considers an item read for the sample.
+func (s *ItemSampler) add(item map[string]*dynamodb.AttributeValue) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.seen++
+	i := len(s.sample)
+	if i >= s.size {
+		if i = int(s.rnd.Int63n(s.seen)); i >= s.size {
+			return
+		}
+	}
+
+	// the reader's consumer may modify the item, such as a Loader removing
+	// its sequence number, so keep a copy
+	copied := make(map[string]*dynamodb.AttributeValue, len(item))
+	for k, v := range item {
+		copied[k] = v
+	}
+	delete(copied, SequenceKey)
+	if i == len(s.sample) {
+		s.sample = append(s.sample, copied)
+	} else {
+		s.sample[i] = copied
+	}
+}
+
+// Sample returns the items sampled from those read so far.
+func (s *ItemSampler) Sample() []map[string]*dynamodb.AttributeValue {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]map[string]*dynamodb.AttributeValue(nil), s.sample...)
+}
+
+// ItemsRead returns the number of items read from the source so far.
+func (s *ItemSampler) ItemsRead() int64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.seen
+}
+
+// Close closes the source if it implements io.Closer.
+func (s *ItemSampler) Close() error {
+	if c, ok := s.src.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
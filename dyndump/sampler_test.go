@@ -0,0 +1,91 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"io"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// sampleKeys reads count items through a sampler, returning the sorted
+// keys of the items sampled.
+func sampleKeys(t *testing.T, count, size int, seed int64) []int {
+	src := new(loadItems)
+	for _, item := range makeItems(0, count) {
+		item[SequenceKey] = &dynamodb.AttributeValue{N: aws.String("1")}
+		src.items = append(src.items, loadItem{item: item})
+	}
+	s := NewItemSampler(src, size, seed)
+	for {
+		item, err := s.ReadItem()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		delete(item, "key") // the sample must hold a copy
+	}
+	if n := s.ItemsRead(); n != int64(count) {
+		t.Errorf("ItemsRead expected=%d actual=%d", count, n)
+	}
+
+	var keys []int
+	for _, item := range s.Sample() {
+		if _, ok := item[SequenceKey]; ok {
+			t.Error("Sampled item has a sequence number")
+		}
+		keys = append(keys, intItemValue("key", item))
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// Check that the sampler keeps every item when fewer than the sample size
+// are read, and a sample of the requested size otherwise.
+func TestItemSamplerSize(t *testing.T) {
+	tests := []struct {
+		count, size, expected int
+	}{
+		{0, 5, 0},
+		{3, 5, 3},
+		{5, 5, 5},
+		{100, 5, 5},
+		{100, 0, 0},
+	}
+	for _, test := range tests {
+		keys := sampleKeys(t, test.count, test.size, 1)
+		if len(keys) != test.expected {
+			t.Errorf("count=%d size=%d expected=%d actual=%d", test.count, test.size, test.expected, len(keys))
+		}
+		for i := 1; i < len(keys); i++ {
+			if keys[i] == keys[i-1] || keys[i] < 0 {
+				t.Errorf("count=%d size=%d incorrect keys %v", test.count, test.size, keys)
+				break
+			}
+		}
+	}
+}
+
+// Check that the same seed selects the same sample and that the sample is
+// drawn from across the items read.
+func TestItemSamplerSeed(t *testing.T) {
+	a := sampleKeys(t, 1000, 10, 42)
+	b := sampleKeys(t, 1000, 10, 42)
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("Same seed selected different samples %v and %v", a, b)
+	}
+	if c := sampleKeys(t, 1000, 10, 43); reflect.DeepEqual(a, c) {
+		t.Errorf("Different seeds selected the same sample %v", a)
+	}
+	if a[len(a)-1] < 10 {
+		t.Errorf("Sample only holds the first items read %v", a)
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+var (
+	// tablePollInterval is the delay between checks that a newly created
+	// table and its indexes have become active.
+	tablePollInterval = 5 * time.Second
+
+	// maxTablePolls limits the time CreateTable waits for the table to
+	// become active; building indexes on a new table can take some time.
+	maxTablePolls = 360
+)
+
+// DynTableCreator defines the portion of the DynamoDB service that
+// CreateTable requires.
+type DynTableCreator interface {
+	DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error)
+	CreateTable(input *dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error)
+}
+
+// DynTableUpdater defines the portion of the DynamoDB service that
+// ResetCapacity requires.
+type DynTableUpdater interface {
+	DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error)
+	UpdateTable(input *dynamodb.UpdateTableInput) (*dynamodb.UpdateTableOutput, error)
+}
+
+type dynTableDescriber interface {
+	DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error)
+}
+
+// SetTableSchema records the key schema, secondary indexes, capacity and
+// stream settings of the table being backed up, allowing the table to be
+// recreated by CreateTable.
+func (md *Metadata) SetTableSchema(table *dynamodb.TableDescription) {
+	md.KeySchema = table.KeySchema
+	md.GlobalSecondaryIndexes = nil
+	for _, gsi := range table.GlobalSecondaryIndexes {
+		md.GlobalSecondaryIndexes = append(md.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndex{
+			IndexName:             gsi.IndexName,
+			KeySchema:             gsi.KeySchema,
+			Projection:            gsi.Projection,
+			ProvisionedThroughput: provisionedThroughput(gsi.ProvisionedThroughput),
+		})
+	}
+	md.LocalSecondaryIndexes = nil
+	for _, lsi := range table.LocalSecondaryIndexes {
+		md.LocalSecondaryIndexes = append(md.LocalSecondaryIndexes, &dynamodb.LocalSecondaryIndex{
+			IndexName:  lsi.IndexName,
+			KeySchema:  lsi.KeySchema,
+			Projection: lsi.Projection,
+		})
+	}
+
+	// CreateTable rejects definitions of attributes that aren't part of the
+	// table's or an index's key
+	keyAttrs := make(map[string]bool)
+	for _, s := range table.KeySchema {
+		keyAttrs[aws.StringValue(s.AttributeName)] = true
+	}
+	for _, gsi := range table.GlobalSecondaryIndexes {
+		for _, s := range gsi.KeySchema {
+			keyAttrs[aws.StringValue(s.AttributeName)] = true
+		}
+	}
+	for _, lsi := range table.LocalSecondaryIndexes {
+		for _, s := range lsi.KeySchema {
+			keyAttrs[aws.StringValue(s.AttributeName)] = true
+		}
+	}
+	md.AttributeDefinitions = nil
+	for _, def := range table.AttributeDefinitions {
+		if keyAttrs[aws.StringValue(def.AttributeName)] {
+			md.AttributeDefinitions = append(md.AttributeDefinitions, def)
+		}
+	}
+
+	md.BillingMode = dynamodb.BillingModeProvisioned
+	if bm := table.BillingModeSummary; bm != nil && aws.StringValue(bm.BillingMode) == dynamodb.BillingModePayPerRequest {
+		md.BillingMode = dynamodb.BillingModePayPerRequest
+	}
+	md.ProvisionedThroughput = provisionedThroughput(table.ProvisionedThroughput)
+	md.StreamSpecification = nil
+	if ss := table.StreamSpecification; ss != nil && aws.BoolValue(ss.StreamEnabled) {
+		md.StreamSpecification = ss
+	}
+}
+
+func provisionedThroughput(pt *dynamodb.ProvisionedThroughputDescription) *dynamodb.ProvisionedThroughput {
+	if pt == nil {
+		return nil
+	}
+	return &dynamodb.ProvisionedThroughput{
+		ReadCapacityUnits:  pt.ReadCapacityUnits,
+		WriteCapacityUnits: pt.WriteCapacityUnits,
+	}
+}
+
+// CreateTableInput returns the request to create a table with the schema
+// recorded by SetTableSchema.  The secondary indexes are created with the
+// table, in their original order.  If capacity is nil the table is created
+// on-demand, however the backed up table's capacity was set, so that the
+// load isn't limited to, or billed for, a capacity sized for the table's
+// normal traffic.  Otherwise the table and each of its global secondary
+// indexes are provisioned with capacity.
+func (md Metadata) CreateTableInput(tableName string, capacity *dynamodb.ProvisionedThroughput) *dynamodb.CreateTableInput {
+	input := &dynamodb.CreateTableInput{
+		TableName:             aws.String(tableName),
+		KeySchema:             md.KeySchema,
+		AttributeDefinitions:  md.AttributeDefinitions,
+		StreamSpecification:   md.StreamSpecification,
+		BillingMode:           aws.String(dynamodb.BillingModePayPerRequest),
+		LocalSecondaryIndexes: md.LocalSecondaryIndexes,
+	}
+	if capacity != nil {
+		input.BillingMode = aws.String(dynamodb.BillingModeProvisioned)
+		input.ProvisionedThroughput = capacity
+	}
+	for _, gsi := range md.GlobalSecondaryIndexes {
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndex{
+			IndexName:             gsi.IndexName,
+			KeySchema:             gsi.KeySchema,
+			Projection:            gsi.Projection,
+			ProvisionedThroughput: capacity,
+		})
+	}
+	return input
+}
+
+// CreateTable creates a table with the schema recorded in a backup's
+// metadata and waits for the table and its global secondary indexes to
+// become active, returning false if the table already exists.  It fails if
+// an existing table's key schema doesn't match the backup's.
+func CreateTable(dyn DynTableCreator, tableName string, md Metadata) (created bool, err error) {
+	return CreateTableWithCapacity(dyn, tableName, md, nil)
+}
+
+// CreateTableWithCapacity is the same as CreateTable, but provisions the
+// new table and its global secondary indexes with capacity, such as to
+// absorb the writes of the load, or creates it on-demand if nil.
+func CreateTableWithCapacity(dyn DynTableCreator, tableName string, md Metadata, capacity *dynamodb.ProvisionedThroughput) (created bool, err error) {
+	if len(md.KeySchema) == 0 {
+		return false, fmt.Errorf("backup metadata records no key schema for table %q", md.TableName)
+	}
+	resp, err := dyn.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err == nil {
+		return false, md.checkKeySchema(resp.Table)
+	}
+	if !isNotFound(err) {
+		return false, err
+	}
+
+	if _, err := dyn.CreateTable(md.CreateTableInput(tableName, capacity)); err != nil {
+		return false, err
+	}
+	return true, waitTableActive(dyn, tableName)
+}
+
+// ResetCapacity sets a table created by CreateTable to the billing mode
+// and capacity recorded for the backed up table, such as once a load using
+// a higher capacity has completed, and waits for the table and its global
+// secondary indexes to become active.  Tables backed up before their
+// capacity was recorded are set to on-demand.  It returns false, without
+// updating the table, if its capacity already matches the backup's.
+func ResetCapacity(dyn DynTableUpdater, tableName string, md Metadata) (updated bool, err error) {
+	resp, err := dyn.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return false, err
+	}
+	input := md.resetCapacityInput(resp.Table)
+	if input == nil {
+		return false, nil
+	}
+	if _, err := dyn.UpdateTable(input); err != nil {
+		return false, err
+	}
+	return true, waitTableActive(dyn, tableName)
+}
+
+// resetCapacityInput returns the request to set table to the recorded
+// billing mode and capacity, or nil if it already has them.  DynamoDB
+// rejects an update that sets the capacity a table or index already has.
+func (md Metadata) resetCapacityInput(table *dynamodb.TableDescription) *dynamodb.UpdateTableInput {
+	current := dynamodb.BillingModeProvisioned
+	if bm := table.BillingModeSummary; bm != nil && aws.StringValue(bm.BillingMode) == dynamodb.BillingModePayPerRequest {
+		current = dynamodb.BillingModePayPerRequest
+	}
+	input := &dynamodb.UpdateTableInput{TableName: table.TableName}
+
+	if md.BillingMode != dynamodb.BillingModeProvisioned || md.ProvisionedThroughput == nil {
+		if current == dynamodb.BillingModePayPerRequest {
+			return nil
+		}
+		input.BillingMode = aws.String(dynamodb.BillingModePayPerRequest)
+		return input
+	}
+
+	switching := current != dynamodb.BillingModeProvisioned
+	if switching {
+		input.BillingMode = aws.String(dynamodb.BillingModeProvisioned)
+	}
+	if switching || !throughputEqual(table.ProvisionedThroughput, md.ProvisionedThroughput) {
+		input.ProvisionedThroughput = md.ProvisionedThroughput
+	}
+	indexes := make(map[string]*dynamodb.GlobalSecondaryIndexDescription)
+	for _, gsi := range table.GlobalSecondaryIndexes {
+		indexes[aws.StringValue(gsi.IndexName)] = gsi
+	}
+	for _, gsi := range md.GlobalSecondaryIndexes {
+		index, ok := indexes[aws.StringValue(gsi.IndexName)]
+		if !ok {
+			continue
+		}
+		pt := gsi.ProvisionedThroughput
+		if pt == nil {
+			pt = md.ProvisionedThroughput
+		}
+		if switching || !throughputEqual(index.ProvisionedThroughput, pt) {
+			input.GlobalSecondaryIndexUpdates = append(input.GlobalSecondaryIndexUpdates, &dynamodb.GlobalSecondaryIndexUpdate{
+				Update: &dynamodb.UpdateGlobalSecondaryIndexAction{
+					IndexName:             gsi.IndexName,
+					ProvisionedThroughput: pt,
+				},
+			})
+		}
+	}
+	if input.ProvisionedThroughput == nil && len(input.GlobalSecondaryIndexUpdates) == 0 {
+		return nil
+	}
+	return input
+}
+
+func throughputEqual(desc *dynamodb.ProvisionedThroughputDescription, pt *dynamodb.ProvisionedThroughput) bool {
+	return desc != nil &&
+		aws.Int64Value(desc.ReadCapacityUnits) == aws.Int64Value(pt.ReadCapacityUnits) &&
+		aws.Int64Value(desc.WriteCapacityUnits) == aws.Int64Value(pt.WriteCapacityUnits)
+}
+
+// waitTableActive waits for a table and all of its global secondary
+// indexes to become active.
+func waitTableActive(dyn dynTableDescriber, tableName string) error {
+	for i := 0; ; i++ {
+		resp, err := dyn.DescribeTable(&dynamodb.DescribeTableInput{
+			TableName: aws.String(tableName),
+		})
+		// a new table may not be visible immediately
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+		if err == nil && tableActive(resp.Table) {
+			return nil
+		}
+		if i >= maxTablePolls {
+			return fmt.Errorf("timed out waiting for table %q to become active", tableName)
+		}
+		time.Sleep(tablePollInterval)
+	}
+}
+
+func tableActive(table *dynamodb.TableDescription) bool {
+	if aws.StringValue(table.TableStatus) != dynamodb.TableStatusActive {
+		return false
+	}
+	for _, gsi := range table.GlobalSecondaryIndexes {
+		if aws.StringValue(gsi.IndexStatus) != dynamodb.IndexStatusActive {
+			return false
+		}
+	}
+	return true
+}
+
+func isNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeResourceNotFoundException
+}
+
+// checkKeySchema returns an error if a table's key attributes differ in
+// name, key type or attribute type from those recorded in the metadata.
+func (md Metadata) checkKeySchema(table *dynamodb.TableDescription) error {
+	hashKey, rangeKey := KeySchemaNames(table.KeySchema)
+	wantHash, wantRange := KeySchemaNames(md.KeySchema)
+	if hashKey != wantHash || rangeKey != wantRange {
+		return fmt.Errorf("table key schema (hash=%q range=%q) does not match the backup's (hash=%q range=%q)",
+			hashKey, rangeKey, wantHash, wantRange)
+	}
+	types := make(map[string]string)
+	for _, def := range table.AttributeDefinitions {
+		types[aws.StringValue(def.AttributeName)] = aws.StringValue(def.AttributeType)
+	}
+	for _, name := range []string{hashKey, rangeKey} {
+		if name == "" {
+			continue
+		}
+		for _, def := range md.AttributeDefinitions {
+			if aws.StringValue(def.AttributeName) == name && aws.StringValue(def.AttributeType) != types[name] {
+				return fmt.Errorf("table key attribute %q has type %s; the backup's has type %s",
+					name, types[name], aws.StringValue(def.AttributeType))
+			}
+		}
+	}
+	return nil
+}
+
+// KeySchemaNames returns the names of the hash and range key attributes in
+// a table's key schema.
+func KeySchemaNames(schema []*dynamodb.KeySchemaElement) (hashKey, rangeKey string) {
+	for _, s := range schema {
+		switch aws.StringValue(s.KeyType) {
+		case dynamodb.KeyTypeHash:
+			hashKey = aws.StringValue(s.AttributeName)
+		case dynamodb.KeyTypeRange:
+			rangeKey = aws.StringValue(s.AttributeName)
+		}
+	}
+	return hashKey, rangeKey
+}
@@ -0,0 +1,430 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// fakeTableCreator records the CreateTable request and reports the new
+// table as active once it has been described activeAfter times.
+type fakeTableCreator struct {
+	table       *dynamodb.TableDescription
+	input       *dynamodb.CreateTableInput
+	activeAfter int
+	describes   int
+}
+
+func (f *fakeTableCreator) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	if f.table == nil {
+		return nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, "not found", nil)
+	}
+	if f.input != nil {
+		f.describes++
+		if f.describes > f.activeAfter {
+			f.table.TableStatus = aws.String(dynamodb.TableStatusActive)
+		}
+		// the indexes become active after the table
+		if f.describes > f.activeAfter+1 {
+			for _, gsi := range f.table.GlobalSecondaryIndexes {
+				gsi.IndexStatus = aws.String(dynamodb.IndexStatusActive)
+			}
+		}
+	}
+	return &dynamodb.DescribeTableOutput{Table: f.table}, nil
+}
+
+func (f *fakeTableCreator) CreateTable(input *dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error) {
+	f.input = input
+	f.table = &dynamodb.TableDescription{
+		TableName:            input.TableName,
+		TableStatus:          aws.String(dynamodb.TableStatusCreating),
+		KeySchema:            input.KeySchema,
+		AttributeDefinitions: input.AttributeDefinitions,
+	}
+	for _, gsi := range input.GlobalSecondaryIndexes {
+		f.table.GlobalSecondaryIndexes = append(f.table.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndexDescription{
+			IndexName:   gsi.IndexName,
+			IndexStatus: aws.String(dynamodb.IndexStatusCreating),
+		})
+	}
+	return &dynamodb.CreateTableOutput{TableDescription: f.table}, nil
+}
+
+func keyElement(name, keyType string) *dynamodb.KeySchemaElement {
+	return &dynamodb.KeySchemaElement{AttributeName: aws.String(name), KeyType: aws.String(keyType)}
+}
+
+func attrDef(name, attrType string) *dynamodb.AttributeDefinition {
+	return &dynamodb.AttributeDefinition{AttributeName: aws.String(name), AttributeType: aws.String(attrType)}
+}
+
+func throughputDesc(read, write int64) *dynamodb.ProvisionedThroughputDescription {
+	return &dynamodb.ProvisionedThroughputDescription{
+		ReadCapacityUnits:      aws.Int64(read),
+		WriteCapacityUnits:     aws.Int64(write),
+		NumberOfDecreasesToday: aws.Int64(1),
+	}
+}
+
+func throughput(read, write int64) *dynamodb.ProvisionedThroughput {
+	return &dynamodb.ProvisionedThroughput{ReadCapacityUnits: aws.Int64(read), WriteCapacityUnits: aws.Int64(write)}
+}
+
+// indexedTable describes a provisioned table with two global secondary
+// indexes, a local secondary index and a stream.
+func indexedTable() *dynamodb.TableDescription {
+	return &dynamodb.TableDescription{
+		TableName:   aws.String("source"),
+		TableStatus: aws.String(dynamodb.TableStatusActive),
+		KeySchema:   []*dynamodb.KeySchemaElement{keyElement("id", "HASH"), keyElement("ts", "RANGE")},
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			attrDef("id", "S"), attrDef("ts", "N"), attrDef("email", "S"), attrDef("status", "S"), attrDef("score", "N"), attrDef("unused", "S"),
+		},
+		ProvisionedThroughput: throughputDesc(10, 20),
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndexDescription{
+			{
+				IndexName:             aws.String("by_status"),
+				IndexStatus:           aws.String(dynamodb.IndexStatusActive),
+				KeySchema:             []*dynamodb.KeySchemaElement{keyElement("status", "HASH"), keyElement("ts", "RANGE")},
+				Projection:            &dynamodb.Projection{ProjectionType: aws.String("INCLUDE"), NonKeyAttributes: aws.StringSlice([]string{"email"})},
+				ProvisionedThroughput: throughputDesc(3, 4),
+				ItemCount:             aws.Int64(100),
+			},
+			{
+				IndexName:             aws.String("by_email"),
+				IndexStatus:           aws.String(dynamodb.IndexStatusActive),
+				KeySchema:             []*dynamodb.KeySchemaElement{keyElement("email", "HASH")},
+				Projection:            &dynamodb.Projection{ProjectionType: aws.String("KEYS_ONLY")},
+				ProvisionedThroughput: throughputDesc(5, 6),
+			},
+		},
+		LocalSecondaryIndexes: []*dynamodb.LocalSecondaryIndexDescription{
+			{
+				IndexName:  aws.String("by_score"),
+				KeySchema:  []*dynamodb.KeySchemaElement{keyElement("id", "HASH"), keyElement("score", "RANGE")},
+				Projection: &dynamodb.Projection{ProjectionType: aws.String("ALL")},
+				ItemCount:  aws.Int64(100),
+			},
+		},
+		StreamSpecification: &dynamodb.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: aws.String("NEW_AND_OLD_IMAGES"),
+		},
+	}
+}
+
+// recordedSchema returns the metadata for a backup of table, after a round
+// trip through JSON as it would be stored in S3.
+func recordedSchema(t *testing.T, table *dynamodb.TableDescription) Metadata {
+	var md Metadata
+	md.SetTableSchema(table)
+	data, err := json.Marshal(md)
+	if err != nil {
+		t.Fatal("marshal failed", err)
+	}
+	var result Metadata
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatal("unmarshal failed", err)
+	}
+	return result
+}
+
+func TestCreateTableIndexes(t *testing.T) {
+	oldInterval := tablePollInterval
+	tablePollInterval = 0
+	defer func() { tablePollInterval = oldInterval }()
+
+	md := recordedSchema(t, indexedTable())
+	if !reflect.DeepEqual(md.ProvisionedThroughput, throughput(10, 20)) {
+		t.Errorf("incorrect recorded throughput %v", md.ProvisionedThroughput)
+	}
+	if pt := md.GlobalSecondaryIndexes[1].ProvisionedThroughput; !reflect.DeepEqual(pt, throughput(5, 6)) {
+		t.Errorf("incorrect recorded index throughput %v", pt)
+	}
+
+	dyn := &fakeTableCreator{activeAfter: 2}
+	created, err := CreateTable(dyn, "restored", md)
+	if err != nil {
+		t.Fatal("CreateTable failed", err)
+	}
+	if !created {
+		t.Error("table not reported as created")
+	}
+
+	input := dyn.input
+	if name := aws.StringValue(input.TableName); name != "restored" {
+		t.Errorf("incorrect table name %q", name)
+	}
+	// the provisioned table is restored on-demand
+	if bm := aws.StringValue(input.BillingMode); bm != dynamodb.BillingModePayPerRequest {
+		t.Errorf("incorrect billing mode %q", bm)
+	}
+	if input.ProvisionedThroughput != nil {
+		t.Errorf("unexpected table throughput %v", input.ProvisionedThroughput)
+	}
+
+	// an attribute that isn't part of any key isn't defined
+	expectedDefs := []*dynamodb.AttributeDefinition{
+		attrDef("id", "S"), attrDef("ts", "N"), attrDef("email", "S"), attrDef("status", "S"), attrDef("score", "N"),
+	}
+	if !reflect.DeepEqual(input.AttributeDefinitions, expectedDefs) {
+		t.Errorf("incorrect attribute definitions %v", input.AttributeDefinitions)
+	}
+
+	expectedGSIs := []*dynamodb.GlobalSecondaryIndex{
+		{
+			IndexName:  aws.String("by_status"),
+			KeySchema:  []*dynamodb.KeySchemaElement{keyElement("status", "HASH"), keyElement("ts", "RANGE")},
+			Projection: &dynamodb.Projection{ProjectionType: aws.String("INCLUDE"), NonKeyAttributes: aws.StringSlice([]string{"email"})},
+		},
+		{
+			IndexName:  aws.String("by_email"),
+			KeySchema:  []*dynamodb.KeySchemaElement{keyElement("email", "HASH")},
+			Projection: &dynamodb.Projection{ProjectionType: aws.String("KEYS_ONLY")},
+		},
+	}
+	if !reflect.DeepEqual(input.GlobalSecondaryIndexes, expectedGSIs) {
+		t.Errorf("incorrect global secondary indexes %v", input.GlobalSecondaryIndexes)
+	}
+
+	expectedLSIs := []*dynamodb.LocalSecondaryIndex{
+		{
+			IndexName:  aws.String("by_score"),
+			KeySchema:  []*dynamodb.KeySchemaElement{keyElement("id", "HASH"), keyElement("score", "RANGE")},
+			Projection: &dynamodb.Projection{ProjectionType: aws.String("ALL")},
+		},
+	}
+	if !reflect.DeepEqual(input.LocalSecondaryIndexes, expectedLSIs) {
+		t.Errorf("incorrect local secondary indexes %v", input.LocalSecondaryIndexes)
+	}
+
+	if ss := input.StreamSpecification; ss == nil || aws.StringValue(ss.StreamViewType) != "NEW_AND_OLD_IMAGES" {
+		t.Errorf("incorrect stream specification %v", ss)
+	}
+
+	// the table became active after 3 describes and its indexes after 4
+	if dyn.describes != 4 {
+		t.Errorf("expected 4 describes, got %d", dyn.describes)
+	}
+}
+
+func TestCreateTableOnDemand(t *testing.T) {
+	table := indexedTable()
+	table.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: aws.String(dynamodb.BillingModePayPerRequest)}
+	table.ProvisionedThroughput = throughputDesc(0, 0)
+	table.StreamSpecification = &dynamodb.StreamSpecification{StreamEnabled: aws.Bool(false)}
+	md := recordedSchema(t, table)
+
+	input := md.CreateTableInput("restored", nil)
+	if bm := aws.StringValue(input.BillingMode); bm != dynamodb.BillingModePayPerRequest {
+		t.Errorf("incorrect billing mode %q", bm)
+	}
+	if input.ProvisionedThroughput != nil {
+		t.Errorf("unexpected table throughput %v", input.ProvisionedThroughput)
+	}
+	if len(input.GlobalSecondaryIndexes) != 2 {
+		t.Fatalf("expected 2 indexes, got %d", len(input.GlobalSecondaryIndexes))
+	}
+	for _, gsi := range input.GlobalSecondaryIndexes {
+		if gsi.ProvisionedThroughput != nil {
+			t.Errorf("unexpected throughput for index %s", aws.StringValue(gsi.IndexName))
+		}
+	}
+	if input.StreamSpecification != nil {
+		t.Errorf("unexpected stream specification %v", input.StreamSpecification)
+	}
+}
+
+func TestCreateTableWithCapacity(t *testing.T) {
+	oldInterval := tablePollInterval
+	tablePollInterval = 0
+	defer func() { tablePollInterval = oldInterval }()
+
+	md := recordedSchema(t, indexedTable())
+	dyn := &fakeTableCreator{}
+	if _, err := CreateTableWithCapacity(dyn, "restored", md, throughput(100, 500)); err != nil {
+		t.Fatal("CreateTable failed", err)
+	}
+	input := dyn.input
+	if bm := aws.StringValue(input.BillingMode); bm != dynamodb.BillingModeProvisioned {
+		t.Errorf("incorrect billing mode %q", bm)
+	}
+	if !reflect.DeepEqual(input.ProvisionedThroughput, throughput(100, 500)) {
+		t.Errorf("incorrect table throughput %v", input.ProvisionedThroughput)
+	}
+	for _, gsi := range input.GlobalSecondaryIndexes {
+		if !reflect.DeepEqual(gsi.ProvisionedThroughput, throughput(100, 500)) {
+			t.Errorf("incorrect throughput for index %s: %v", aws.StringValue(gsi.IndexName), gsi.ProvisionedThroughput)
+		}
+	}
+}
+
+// fakeTableUpdater records the UpdateTable request for an active table.
+type fakeTableUpdater struct {
+	table *dynamodb.TableDescription
+	input *dynamodb.UpdateTableInput
+}
+
+func (f *fakeTableUpdater) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	return &dynamodb.DescribeTableOutput{Table: f.table}, nil
+}
+
+func (f *fakeTableUpdater) UpdateTable(input *dynamodb.UpdateTableInput) (*dynamodb.UpdateTableOutput, error) {
+	f.input = input
+	return &dynamodb.UpdateTableOutput{TableDescription: f.table}, nil
+}
+
+func TestResetCapacity(t *testing.T) {
+	provisioned := recordedSchema(t, indexedTable())
+	onDemand := indexedTable()
+	onDemand.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: aws.String(dynamodb.BillingModePayPerRequest)}
+
+	indexUpdate := func(name string, pt *dynamodb.ProvisionedThroughput) *dynamodb.GlobalSecondaryIndexUpdate {
+		return &dynamodb.GlobalSecondaryIndexUpdate{
+			Update: &dynamodb.UpdateGlobalSecondaryIndexAction{IndexName: aws.String(name), ProvisionedThroughput: pt},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		md       Metadata
+		modify   func(table *dynamodb.TableDescription)
+		expected *dynamodb.UpdateTableInput
+	}{
+		{
+			name: "on-demand-to-provisioned",
+			md:   provisioned,
+			modify: func(table *dynamodb.TableDescription) {
+				table.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: aws.String(dynamodb.BillingModePayPerRequest)}
+				table.ProvisionedThroughput = throughputDesc(0, 0)
+				for _, gsi := range table.GlobalSecondaryIndexes {
+					gsi.ProvisionedThroughput = throughputDesc(0, 0)
+				}
+			},
+			expected: &dynamodb.UpdateTableInput{
+				TableName:             aws.String("source"),
+				BillingMode:           aws.String(dynamodb.BillingModeProvisioned),
+				ProvisionedThroughput: throughput(10, 20),
+				GlobalSecondaryIndexUpdates: []*dynamodb.GlobalSecondaryIndexUpdate{
+					indexUpdate("by_status", throughput(3, 4)),
+					indexUpdate("by_email", throughput(5, 6)),
+				},
+			},
+		},
+		{
+			name: "restore-capacity",
+			md:   provisioned,
+			modify: func(table *dynamodb.TableDescription) {
+				table.ProvisionedThroughput = throughputDesc(100, 500)
+				table.GlobalSecondaryIndexes[0].ProvisionedThroughput = throughputDesc(100, 500)
+			},
+			expected: &dynamodb.UpdateTableInput{
+				TableName:             aws.String("source"),
+				ProvisionedThroughput: throughput(10, 20),
+				GlobalSecondaryIndexUpdates: []*dynamodb.GlobalSecondaryIndexUpdate{
+					indexUpdate("by_status", throughput(3, 4)),
+				},
+			},
+		},
+		{
+			name:     "unchanged",
+			md:       provisioned,
+			modify:   func(table *dynamodb.TableDescription) {},
+			expected: nil,
+		},
+		{
+			name:   "provisioned-to-on-demand",
+			md:     recordedSchema(t, onDemand),
+			modify: func(table *dynamodb.TableDescription) {},
+			expected: &dynamodb.UpdateTableInput{
+				TableName:   aws.String("source"),
+				BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+			},
+		},
+		{
+			name:     "on-demand-unchanged",
+			md:       recordedSchema(t, onDemand),
+			modify:   func(table *dynamodb.TableDescription) { table.BillingModeSummary = onDemand.BillingModeSummary },
+			expected: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table := indexedTable()
+			test.modify(table)
+			dyn := &fakeTableUpdater{table: table}
+			updated, err := ResetCapacity(dyn, "source", test.md)
+			if err != nil {
+				t.Fatal("ResetCapacity failed", err)
+			}
+			if updated != (test.expected != nil) {
+				t.Errorf("incorrect updated=%t", updated)
+			}
+			if !reflect.DeepEqual(dyn.input, test.expected) {
+				t.Errorf("incorrect update\nexpected=%v\nactual=%v", test.expected, dyn.input)
+			}
+		})
+	}
+}
+
+func TestCreateTableNoSchema(t *testing.T) {
+	// backups made before the schema was recorded can't create a table
+	dyn := &fakeTableCreator{}
+	if _, err := CreateTable(dyn, "restored", Metadata{TableName: "source"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if dyn.input != nil {
+		t.Error("table was created")
+	}
+}
+
+func TestCreateTableExists(t *testing.T) {
+	md := recordedSchema(t, indexedTable())
+
+	tests := []struct {
+		name        string
+		modify      func(table *dynamodb.TableDescription)
+		expectedErr string
+	}{
+		{"same", func(table *dynamodb.TableDescription) {}, ""},
+		{"different-index", func(table *dynamodb.TableDescription) {
+			// only the table's key must match
+			table.GlobalSecondaryIndexes = nil
+		}, ""},
+		{"different-key", func(table *dynamodb.TableDescription) {
+			table.KeySchema = []*dynamodb.KeySchemaElement{keyElement("id", "HASH")}
+		}, "does not match"},
+		{"different-type", func(table *dynamodb.TableDescription) {
+			table.AttributeDefinitions[1] = attrDef("ts", "S")
+		}, `key attribute "ts" has type S`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table := indexedTable()
+			test.modify(table)
+			dyn := &fakeTableCreator{table: table}
+			created, err := CreateTable(dyn, "restored", md)
+			if test.expectedErr == "" && err != nil {
+				t.Fatal("unexpected error", err)
+			}
+			if test.expectedErr != "" && (err == nil || !strings.Contains(err.Error(), test.expectedErr)) {
+				t.Fatalf("expected error containing %q, got %v", test.expectedErr, err)
+			}
+			if created || dyn.input != nil {
+				t.Error("existing table was created")
+			}
+		})
+	}
+}
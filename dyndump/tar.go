@@ -0,0 +1,204 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// PAX records holding the S3 object fields of each tar entry; they're
+	// stored as user extended attributes, which tar understands.
+	tarXattrPrefix        = "SCHILY.xattr.user."
+	tarContentEncodingKey = tarXattrPrefix + "content-encoding"
+)
+
+// TarWriter stores the objects of a backup in a tar archive, in place of
+// S3, by implementing the S3Puter interface.  Passing it to NewS3Writer
+// writes a self contained backup to a single file, with each part and the
+// metadata stored as an entry named by its key, so that the archive
+// mirrors the layout of a backup in S3 once extracted.  The object metadata
+// S3Writer records for each part, such as its hash, is held in PAX records
+// as user extended attributes.
+//
+// The metadata may be written several times as the backup progresses; as
+// when extracting an archive, TarReader uses the last entry of each name.
+//
+// Close must be called once the S3Writer has finished to write the end of
+// the archive.  It doesn't close the underlying writer.
+type TarWriter struct {
+	m  sync.Mutex // guards tw; entries are written one at a time
+	tw *tar.Writer
+}
+
+// NewTarWriter returns a TarWriter that writes an archive to w.
+func NewTarWriter(w io.Writer) *TarWriter {
+	return &TarWriter{tw: tar.NewWriter(w)}
+}
+
+// PutObject implements S3Puter, adding the object to the archive.  The
+// bucket is ignored.
+func (t *TarWriter) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	size, err := input.Body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := input.Body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	hdr := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       aws.StringValue(input.Key),
+		Size:       size,
+		Mode:       0644,
+		ModTime:    time.Now(),
+		Format:     tar.FormatPAX,
+		PAXRecords: make(map[string]string),
+	}
+	if enc := aws.StringValue(input.ContentEncoding); enc != "" {
+		hdr.PAXRecords[tarContentEncodingKey] = enc
+	}
+	for k, v := range input.Metadata {
+		hdr.PAXRecords[tarXattrPrefix+k] = aws.StringValue(v)
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(t.tw, input.Body); err != nil {
+		return nil, fmt.Errorf("failed to write %q to archive: %v", hdr.Name, err)
+	}
+	return &s3.PutObjectOutput{}, nil
+}
+
+// Close writes the end of the archive.
+func (t *TarWriter) Close() error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.tw.Close()
+}
+
+// tarEntry locates the data of an object held in a tar archive.
+type tarEntry struct {
+	offset   int64
+	size     int64
+	encoding string
+	metadata map[string]*string
+}
+
+// TarReader reads a backup from a tar archive written by TarWriter, by
+// implementing the S3GetLister interface for an S3Reader.  Parts stored
+// gzip compressed are decompressed as S3 would, checking the gzip
+// trailer.
+type TarReader struct {
+	r       io.ReaderAt
+	entries map[string]tarEntry
+	keys    []string // sorted
+}
+
+// NewTarReader indexes the entries of the archive of size bytes held by r.
+func NewTarReader(r io.ReaderAt, size int64) (*TarReader, error) {
+	cr := &countingReader{r: io.NewSectionReader(r, 0, size)}
+	tr := tar.NewReader(cr)
+	t := &TarReader{r: r, entries: make(map[string]tarEntry)}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		entry := tarEntry{
+			offset:   cr.n, // the header has been read up to the entry's data
+			size:     hdr.Size,
+			encoding: hdr.PAXRecords[tarContentEncodingKey],
+			metadata: make(map[string]*string),
+		}
+		for k, v := range hdr.PAXRecords {
+			if strings.HasPrefix(k, tarXattrPrefix) && k != tarContentEncodingKey {
+				entry.metadata[strings.TrimPrefix(k, tarXattrPrefix)] = aws.String(v)
+			}
+		}
+		if _, ok := t.entries[hdr.Name]; !ok {
+			t.keys = append(t.keys, hdr.Name)
+		}
+		t.entries[hdr.Name] = entry // later entries replace earlier ones
+	}
+	sort.Strings(t.keys)
+	return t, nil
+}
+
+// GetObject implements S3GetLister, returning the entry named by the key.
+// The bucket is ignored.
+func (t *TarReader) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	key := aws.StringValue(input.Key)
+	entry, ok := t.entries[key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, fmt.Sprintf("%q not found in archive", key), nil)
+	}
+	var body io.Reader = io.NewSectionReader(t.r, entry.offset, entry.size)
+	if entry.encoding == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress %q: %v", key, err)
+		}
+		body = gz
+	}
+	return &s3.GetObjectOutput{
+		Body:     ioutil.NopCloser(body),
+		Metadata: entry.metadata,
+	}, nil
+}
+
+// ListObjectsV2Pages implements S3GetLister, listing the entries beginning
+// with the input's prefix in key order.
+func (t *TarReader) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(p *s3.ListObjectsV2Output, lastPage bool) (shouldContinue bool)) error {
+	prefix := aws.StringValue(input.Prefix)
+	maxKeys := int(maxKeysOrDefault(aws.Int64Value(input.MaxKeys)))
+	var objects []*s3.Object
+	for _, key := range t.keys {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, &s3.Object{Key: aws.String(key), Size: aws.Int64(t.entries[key].size)})
+		}
+	}
+	for len(objects) > maxKeys {
+		if !fn(&s3.ListObjectsV2Output{Contents: objects[:maxKeys]}, false) {
+			return nil
+		}
+		objects = objects[maxKeys:]
+	}
+	fn(&s3.ListObjectsV2Output{Contents: objects}, true)
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// writeTarBackup writes a backup of the given number of parts to a tar
+// archive, returning the archive and the data written.
+func writeTarBackup(t *testing.T, parts int) (archive, data []byte) {
+	var buf bytes.Buffer
+	tw := NewTarWriter(&buf)
+	w := NewS3Writer(tw, "", "backup/", Metadata{TableName: "a_table"})
+	w.KeyNamer = NormalizedKeyNamer{}
+	w.PartSize = MinPartSize
+	w.MaxParallel = 1 // keep the parts in the order written
+
+	done := make(chan error)
+	go func() { done <- w.Run() }()
+
+	for i := 0; i < parts; i++ {
+		chunk := randbytes(i, MinPartSize)
+		data = append(data, chunk...)
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal("Write failed", err)
+		}
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal("Unexpected error from Run", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal("Failed to close archive", err)
+	}
+	return buf.Bytes(), data
+}
+
+// Check that a backup written to a tar archive can be read and verified.
+func TestTarRoundTrip(t *testing.T) {
+	archive, expected := writeTarBackup(t, 3)
+
+	tr, err := NewTarReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal("Failed to read archive", err)
+	}
+	r := &S3Reader{S3: tr, PathPrefix: "backup/", KeyNamer: NormalizedKeyNamer{}}
+	md, err := r.Metadata()
+	if err != nil {
+		t.Fatal("Failed to read metadata", err)
+	}
+	if md.Status != StatusCompleted || md.PartCount != 3 {
+		t.Errorf("Incorrect metadata status=%q parts=%d", md.Status, md.PartCount)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("Read failed", err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Error("Data read doesn't match that written")
+	}
+
+	r = &S3Reader{S3: tr, PathPrefix: "backup/", KeyNamer: NormalizedKeyNamer{}}
+	if err := r.Verify(); err != nil {
+		t.Error("Verify failed", err)
+	}
+}
+
+// Check that a corrupted part in an archive fails the integrity checks.
+func TestTarCorrupt(t *testing.T) {
+	archive, _ := writeTarBackup(t, 3)
+	tr, err := NewTarReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal("Failed to read archive", err)
+	}
+	entry := tr.entries["backup/part-000000002.json.gz"]
+	archive[entry.offset+entry.size/2]++
+
+	r := &S3Reader{S3: tr, PathPrefix: "backup/", KeyNamer: NormalizedKeyNamer{}}
+	_, err = ioutil.ReadAll(r)
+	if err == nil || !strings.Contains(err.Error(), "part-000000002") {
+		t.Error("Incorrect error", err)
+	}
+}
+
+// Check that a missing entry is reported as S3 would.
+func TestTarMissingKey(t *testing.T) {
+	archive, _ := writeTarBackup(t, 1)
+	tr, err := NewTarReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal("Failed to read archive", err)
+	}
+	r := &S3Reader{S3: tr, PathPrefix: "other/", KeyNamer: NormalizedKeyNamer{}}
+	if _, err := r.Metadata(); err == nil || !strings.Contains(err.Error(), "NoSuchKey") {
+		t.Error("Incorrect error", err)
+	}
+}
@@ -5,15 +5,24 @@
 package dyndump
 
 import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/juju/ratelimit"
 )
 
-// this is based on https://docs.aws.amazon.com/amazondynamodb/latest/developerguide/WorkingWithTables.html#ItemSizeCalculations
+// this is based on https://docs.aws.amazon.com/amazondynamodb/latest/developerguide/CapacityUnitCalculations.html
 func calcItemSize(item map[string]*dynamodb.AttributeValue) (size int) {
 	for k, av := range item {
 		size += len(k)
@@ -22,39 +31,45 @@ func calcItemSize(item map[string]*dynamodb.AttributeValue) (size int) {
 	return size
 }
 
+const (
+	// collectionOverhead is the size of a list or map excluding its elements.
+	collectionOverhead = 3
+
+	// elementOverhead is the size added by each element of a list or map.
+	elementOverhead = 1
+)
+
 func calcAttrSize(av *dynamodb.AttributeValue) (size int) {
 	switch {
-	case av.B != nil: // binary
+	case av.B != nil: // binary; the size of the raw bytes, not their base64 encoding
 		size += len(av.B)
 
 	case av.BOOL != nil: // Bool
 		size++
 
 	case av.BS != nil: // binary set
-		size += 3
 		for _, v := range av.BS {
 			size += len(v)
 		}
 
 	case av.L != nil: // list of attributes
-		size += 3
+		size += collectionOverhead
 		for _, v := range av.L {
-			size += calcAttrSize(v)
+			size += elementOverhead + calcAttrSize(v)
 		}
 
 	case av.M != nil: // map of attributes
-		size += 3
+		size += collectionOverhead
 		for k, v := range av.M {
-			size += len(k) + calcAttrSize(v)
+			size += elementOverhead + len(k) + calcAttrSize(v)
 		}
 
 	case av.N != nil: // number
-		size += len(*av.N)
+		size += calcNumberSize(*av.N)
 
 	case av.NS != nil: // number set
-		size += 3
 		for _, v := range av.NS {
-			size += len(*v)
+			size += calcNumberSize(*v)
 		}
 
 	case av.NULL != nil: // null
@@ -64,7 +79,6 @@ func calcAttrSize(av *dynamodb.AttributeValue) (size int) {
 		size += len(*av.S)
 
 	case av.SS != nil: // string set
-		size += 3
 		for _, v := range av.SS {
 			size += len(*v)
 		}
@@ -72,6 +86,90 @@ func calcAttrSize(av *dynamodb.AttributeValue) (size int) {
 	return size
 }
 
+// calcNumberSize returns the size of a number, which is stored using one
+// byte per two significant digits plus one byte.  Leading and trailing
+// zeros aren't significant.
+func calcNumberSize(n string) int {
+	if i := strings.IndexAny(n, "eE"); i >= 0 {
+		n = n[:i] // the exponent doesn't affect the digits stored
+	}
+	var digits int
+	var zeros int // trailing zeros not yet known to be significant
+	for _, c := range n {
+		switch {
+		case c == '0':
+			if digits > 0 {
+				zeros++
+			}
+		case c >= '1' && c <= '9':
+			digits += zeros + 1
+			zeros = 0
+		}
+	}
+	if digits == 0 {
+		digits = 1 // zero
+	}
+	return (digits+1)/2 + 1
+}
+
+// checkItemUTF8 returns an error naming the first attribute, in attribute
+// name order, that holds a string or has a name that isn't valid UTF-8.
+func checkItemUTF8(item map[string]*dynamodb.AttributeValue) error {
+	names := make([]string, 0, len(item))
+	for k := range item {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if err := checkAttrUTF8(k, item[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkAttrUTF8(name string, av *dynamodb.AttributeValue) error {
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("attribute name %q is not valid UTF-8", name)
+	}
+	if av == nil {
+		return nil
+	}
+	switch {
+	case av.S != nil:
+		if !utf8.ValidString(*av.S) {
+			return fmt.Errorf("attribute %q holds a string that is not valid UTF-8", name)
+		}
+
+	case av.SS != nil:
+		for _, v := range av.SS {
+			if v != nil && !utf8.ValidString(*v) {
+				return fmt.Errorf("attribute %q holds a string set value that is not valid UTF-8", name)
+			}
+		}
+
+	case av.L != nil:
+		for i, v := range av.L {
+			if err := checkAttrUTF8(fmt.Sprintf("%s[%d]", name, i), v); err != nil {
+				return err
+			}
+		}
+
+	case av.M != nil:
+		keys := make([]string, 0, len(av.M))
+		for k := range av.M {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := checkAttrUTF8(name+"."+k, av.M[k]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // track recent sizes of items
 type limitCalc struct {
 	m         sync.Mutex
@@ -100,22 +198,106 @@ func (lc *limitCalc) median() int {
 	return lc.itemSizes[len(lc.itemSizes)/2] // close enough to median
 }
 
+// completionTracker counts the items that have completed, in the order
+// they were read, when they may complete out of order.
+type completionTracker struct {
+	m       sync.Mutex
+	next    int64              // index of the first item not yet complete
+	pending map[int64]struct{} // completed items following next
+}
+
+// done marks the item at index as complete.
+func (c *completionTracker) done(index int64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if index != c.next {
+		if c.pending == nil {
+			c.pending = make(map[int64]struct{})
+		}
+		c.pending[index] = struct{}{}
+		return
+	}
+	c.next++
+	for {
+		if _, ok := c.pending[c.next]; !ok {
+			break
+		}
+		delete(c.pending, c.next)
+		c.next++
+	}
+}
+
+// count returns the number of leading items that are complete.
+func (c *completionTracker) count() int64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.next
+}
+
 type rateLimitWaiter struct {
 	*ratelimit.Bucket
 	stopNotify chan struct{}
+	ctxDone    <-chan struct{} // a context's Done channel, if set
 }
 
 // Interruptible rate limit wait
-// Returns true if the stopChan was closed while waiting
+// Returns true if the stopChan was closed, or the context was cancelled,
+// while waiting
 func (w *rateLimitWaiter) waitForRateLimit(usedCapacity int64) bool {
 	d := w.Take(usedCapacity)
 	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
 		select {
-		case <-time.After(d):
+		case <-t.C:
 			return false
 		case <-w.stopNotify:
 			return true
+		case <-w.ctxDone:
+			return true
 		}
 	}
 	return false
 }
+
+// errUploadStopped is returned by a rateLimitedReadSeeker whose stop
+// channel was closed while it waited.
+var errUploadStopped = errors.New("upload stopped")
+
+// rateLimitedReadSeeker limits the rate at which bytes are read from the
+// underlying ReadSeeker, while still allowing it to be rewound for retries.
+// Every pass over the data is charged, so the SDK must be given the
+// payload's hashes, from payloadHashes, rather than reading it to compute
+// them before sending it.
+type rateLimitedReadSeeker struct {
+	io.ReadSeeker
+	bucket *ratelimit.Bucket
+	stop   chan struct{} // closed to abandon a wait
+}
+
+func (r *rateLimitedReadSeeker) Read(p []byte) (n int, err error) {
+	n, err = r.ReadSeeker.Read(p)
+	if n > 0 {
+		waiter := &rateLimitWaiter{Bucket: r.bucket, stopNotify: r.stop}
+		if waiter.waitForRateLimit(int64(n)) {
+			return 0, errUploadStopped
+		}
+	}
+	return n, err
+}
+
+// payloadHashes returns the base64 encoded MD5 and hex encoded SHA-256 of
+// the data, read without charging the rate limit, and rewinds it.
+func (r *rateLimitedReadSeeker) payloadHashes() (contentMD5, sha string, err error) {
+	if _, err := r.ReadSeeker.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+	md5Hash, shaHash := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5Hash, shaHash), r.ReadSeeker); err != nil {
+		return "", "", err
+	}
+	if _, err := r.ReadSeeker.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(md5Hash.Sum(nil)), hex.EncodeToString(shaHash.Sum(nil)), nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package dyndump
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestCompletionTracker(t *testing.T) {
+	var c completionTracker
+	for _, test := range []struct {
+		index    int64
+		expected int64
+	}{
+		{1, 0},
+		{3, 0},
+		{0, 2},
+		{2, 4},
+		{4, 5},
+	} {
+		c.done(test.index)
+		if n := c.count(); n != test.expected {
+			t.Errorf("index=%d expected=%d actual=%d", test.index, test.expected, n)
+		}
+	}
+	if len(c.pending) != 0 {
+		t.Error("Pending items remain", c.pending)
+	}
+}
+
+func TestCalcAttrSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		av       *dynamodb.AttributeValue
+		expected int
+	}{
+		{"string", &dynamodb.AttributeValue{S: aws.String("abc")}, 3},
+		{"empty-string", &dynamodb.AttributeValue{S: aws.String("")}, 0},
+		{"multibyte-string", &dynamodb.AttributeValue{S: aws.String("é世")}, 5},
+		{"binary", &dynamodb.AttributeValue{B: []byte{1, 2, 3}}, 3},
+		{"empty-binary", &dynamodb.AttributeValue{B: []byte{}}, 0},
+		{"large-binary", &dynamodb.AttributeValue{B: make([]byte, 400*1024)}, 400 * 1024},
+		{"bool", &dynamodb.AttributeValue{BOOL: aws.Bool(false)}, 1},
+		{"null", &dynamodb.AttributeValue{NULL: aws.Bool(true)}, 1},
+		{"number", &dynamodb.AttributeValue{N: aws.String("12345")}, 4},
+		{"number-zero", &dynamodb.AttributeValue{N: aws.String("0")}, 2},
+		{"number-trailing-zeros", &dynamodb.AttributeValue{N: aws.String("1000000")}, 2},
+		{"number-leading-zeros", &dynamodb.AttributeValue{N: aws.String("0.0012")}, 2},
+		{"number-inner-zeros", &dynamodb.AttributeValue{N: aws.String("-100.5")}, 3},
+		{"number-exponent", &dynamodb.AttributeValue{N: aws.String("1.5E10")}, 2},
+		{"number-max-digits", &dynamodb.AttributeValue{N: aws.String("12345678901234567890123456789012345678")}, 20},
+		{"string-set", &dynamodb.AttributeValue{SS: aws.StringSlice([]string{"a", "bc"})}, 3},
+		{"number-set", &dynamodb.AttributeValue{NS: aws.StringSlice([]string{"1", "123"})}, 5},
+		{"binary-set", &dynamodb.AttributeValue{BS: [][]byte{{1}, {}, {1, 2}}}, 3},
+		{"empty-list", &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{}}, 3},
+		{"list", &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{
+			{S: aws.String("ab")},
+			{NULL: aws.Bool(true)},
+		}}, 3 + 1 + 2 + 1 + 1},
+		{"empty-map", &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{}}, 3},
+		{"map", &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{
+			"key": {B: []byte{1, 2}},
+		}}, 3 + 1 + 3 + 2},
+		{"nested", &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{
+			{M: map[string]*dynamodb.AttributeValue{"k": {BOOL: aws.Bool(true)}}},
+		}}, 3 + 1 + (3 + 1 + 1 + 1)},
+	}
+
+	for _, test := range tests {
+		if size := calcAttrSize(test.av); size != test.expected {
+			t.Errorf("%s: expected=%d actual=%d", test.name, test.expected, size)
+		}
+	}
+}
+
+func TestCalcItemSize(t *testing.T) {
+	item := map[string]*dynamodb.AttributeValue{
+		"id":    {S: aws.String("abc")},
+		"count": {N: aws.String("42")},
+	}
+	if size := calcItemSize(item); size != 2+3+5+2 {
+		t.Error("Incorrect size", size)
+	}
+}
@@ -1,12 +1,13 @@
 module github.com/gwatts/dyndump
 
-go 1.12
+go 1.22
 
 require (
 	github.com/Bowery/prompt v0.0.0-20180817134258-8a1d5376df1c
 	github.com/aws/aws-sdk-go v1.18.3
 	github.com/jawher/mow.cli v1.0.5
 	github.com/juju/ratelimit v1.0.1
+	github.com/klauspost/compress v1.18.0
 	github.com/mattn/go-runewidth v0.0.4 // indirect
 	github.com/stretchr/objx v0.1.1 // indirect
 	github.com/stretchr/testify v1.3.0 // indirect
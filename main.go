@@ -41,13 +41,23 @@ the following environment variables:
 
 Usage:
 
+  Usage: dyndump [--trace-aws] COMMAND [arg...]
 
-dyndump supports four commands:
+  Options:
+    --trace-aws=false   Set to true to log every AWS request attempt to stderr
+
+The --trace-aws option logs the host, operation, status and duration of
+every AWS request attempt.  All AWS sessions are created by newSession,
+which applies the hooks in sessionHooks; a build may register its own hook
+there, such as one that adds AWS X-Ray tracing.
+
+dyndump supports seven commands: dump, load, info, cat, verify, delete and
+refresh.
 
 
 DUMP
 
-  Usage: dyndump dump [--silent] [--no-progress] [-cmpr] [--filename | --stdout] [(--s3-bucket --s3-prefix)] TABLENAME
+  Usage: dyndump dump [--silent] [--no-progress] [--progress-format] [-cmpr] [--adaptive-capacity] [--precount] [--key-condition] [--filter] [--projection | --print-keys [--hash-key [--range-key]]] [--key-names] [--key-values] [--filename | --stdout] [--compress-cmd] [--file-rotate-items] [--file-rotate-bytes] [(--s3-bucket --s3-prefix [--s3-upload-bandwidth] [--s3-acl] [--sse] [--sse-kms-key-id] [--s3-storage-class] [--s3-compression] [--s3-compression-level] [--cleanup-on-abort] [--checkpoint-file] [--defer-metadata] [--write-once] [--no-gzip-flush-tuning] [--s3-multipart-upload] [--s3-part-retries])] [--table-arn] [--table-name] [--created-by] [--no-checksum] [--date-partition] [--sequence | --buffer-output] [--omit-nulls] [--format [--columns] [--csv-json]] [--format-plugin] [--max-retries] [--size-histogram] [--cardinality] TABLENAME
 
   Dump a table to file or S3
 
@@ -58,18 +68,61 @@ DUMP
     -c, --consistent-read=false   Enable consistent reads (at 2x capacity use)
     -f, --filename=""             Filename to write data to.
     --stdout=false                If true then send the output to stdout
+    --compress-cmd=""             Command to pipe file or stdout output through (eg. "xz -9")
+    --file-rotate-items=0         Number of items to write to each file before starting a new numbered file (set to 0 to disable)
+    --file-rotate-bytes=0         Maximum bytes to write to each file before starting a new numbered file (set to 0 to disable)
     -m, --maxitems=0              Maximum number of items to dump.  Set to 0 to process all items
     -p, --parallel=5              Number of concurrent channels to open to DynamoDB
     -r, --read-capacity=5         Average aggregate read capacity to use for scan (set to 0 for unlimited)
+    --adaptive-capacity=false     Set to true to raise the read capacity by up to 2x while requests aren't throttled
+    --key-condition=""            Key condition expression to query the table with in place of a full scan (eg. "#id = :id")
+    --filter=""                   Filter expression limiting the items dumped; capacity is still used by every item read (eg. "#st = :active")
+    --projection=""               Comma separated list of the attributes to dump; other attributes are omitted from the backup (eg. "id, #n")
+    --print-keys=false            Set to true to dump only the key attributes of each item, as named by the table's key schema
+    --hash-key=""                 Hash key attribute name of the table for --print-keys; if unset the key schema is used
+    --range-key=""                Range key attribute name of the table for --print-keys, if it has one
+    --key-names=""                JSON map of attribute name placeholders used by --key-condition, --filter and --projection (eg. '{"#id": "id"}')
+    --key-values=""               JSON map of attribute values used by --key-condition and --filter (eg. '{":id": {"S": "abc"}}')
+    --precount=false              Set to true to count the table's items with an extra scan first, for accurate progress
     --s3-bucket=""                S3 bucket name to upload to
     --s3-prefix=""                Path prefix to use to store data in S3 (eg. "backups/2016-04-01-12:25-")
+    --s3-upload-bandwidth=0       Maximum bytes per second to upload to S3 (set to 0 for unlimited)
+    --s3-acl=""                   Canned ACL to apply to uploaded S3 objects (eg. "bucket-owner-full-control")
+    --sse=""                      Server side encryption to apply to uploaded S3 objects: AES256 or aws:kms
+    --sse-kms-key-id=""           KMS key ID to encrypt uploaded S3 objects with; implies --sse=aws:kms
+    --s3-storage-class=""         Storage class for uploaded S3 parts (eg. "STANDARD_IA"); the metadata is always stored as STANDARD
+    --s3-compression="gzip"       Compression of uploaded S3 parts: gzip, zlib, zstd or none
+    --s3-compression-level=0     Compression level of uploaded S3 parts, from 1 (fastest) to 9 (smallest); 0 for the default
+    --cleanup-on-abort=false      Set to true to delete an S3 backup's objects if the dump is aborted or fails
+    --checkpoint-file=""          Local file recording uploaded S3 parts, allowing an interrupted dump to be resumed
+    --defer-metadata=false        Set to true to write S3 backup metadata only once the dump completes
+    --write-once=false            Set to true to never overwrite an S3 object, for write-once or Object Lock buckets
+    --no-gzip-flush-tuning=false  Set to true to stop flushing S3 parts to measure their size; compresses better, but parts may exceed their target size
+    --s3-multipart-upload=false   Set to true to stream each S3 part in 5MiB chunks with a multipart upload rather than buffering it in a temporary file
+    --s3-part-retries=2           Number of times to retry a failed S3 part upload, reusing its key so the part is never stored twice
+    --table-arn=""                Table ARN to record in the S3 backup metadata, in place of the source table's ARN
+    --table-name=""               Table name to record in the S3 backup metadata, in place of TABLENAME
+    --created-by=""               User or host to record in the S3 backup metadata (defaults to $USER@$HOSTNAME)
+    --no-checksum=false           Set to true to skip calculating integrity hashes for an S3 backup
+    --date-partition=false        Set to true to store S3 parts beneath a "dt=YYYY-MM-DD/" path for lifecycle rules
+    --sequence=false              Set to true to add a "__seq" sequence number attribute to each item, ignored by load
+    --omit-nulls=false            Set to true to leave NULL attributes out of the dump; they'll be missing from restored items
+    --format="json"               Output format for --filename or --stdout: json, or csv to write the --columns of each item
+    --columns=""                  Comma separated list of the attributes to write as CSV columns, in order (eg. "id,name,email")
+    --csv-json=false              Set to true to write lists, maps and sets as JSON in CSV cells, rather than failing
+    --format-plugin=""            Command to pipe the JSON items through, writing its output to --filename or --stdout (eg. "./to-xml")
+    --buffer-output=false         Set to true to encode items in parallel, writing them in 64KB chunks, for fast multi-segment dumps
+    --max-retries=-1              Maximum number of times to retry a failed DynamoDB request; -1 for the SDK's default
+    --size-histogram=false        Set to true to report a histogram of item sizes, also recorded in S3 backup metadata
+    --cardinality=""              Attribute to report the approximate distinct value count and 10 most frequent values of
     --silent=false                Set to true to disable all non-error output
     --no-progress=false           Set to true to disable the progress bar
+    --progress-format="bar"       Progress to display: bar, or lines to write a machine readable line per interval
 
 
 LOAD
 
-  Usage: dyndump load [--silent] [--no-progress] [-mpw] (--filename | --stdin | (--s3-bucket --s3-prefix)) TABLENAME
+  Usage: dyndump load [--silent] [--no-progress] [--progress-format] [-mpw] (--filename | --stdin | --url | (--s3-bucket --s3-prefix [--verify] [--resume-file] [--s3-parallel])) [--decompress-cmd] [--hash-key [--range-key]] [--max-retries] [--envelope] [--validate-utf8] [--continue-on-error [--dead-letter-file] [--max-failures]] [--force] [--target-region...] [--restore-ttl] [--create-table [--restore-read-capacity --restore-write-capacity] [--reset-capacity]] [--conditional-attr [--conditional-op]] [--batch-size] [--retry-run] [--verify-after [--verify-seed]] (--use-backup-table-name [--table-prefix] [--table-suffix] | TABLENAME)
 
   Load a table dump from S3 or file to a DynamoDB table
 
@@ -77,16 +130,46 @@ LOAD
     TABLENAME=""   Table name to load into
 
   Options:
-    --allow-overwrite=false   Set to true to overwrite any existing rows
-    -f, --filename=""         Filename to read data from.  Set to "-" for stdin
-    --stdin=false             If true then read the dump data from stdin
-    -m, --maxitems=0          Maximum number of items to load.  Set to 0 to process all items
-    -p, --parallel=4          Number of concurrent channels to open to DynamoDB
-    -w, --write-capacity=5    Average aggregate write capacity to use for load (set to 0 for unlimited)
-    --s3-bucket=""            S3 bucket name to read from
-    --s3-prefix=""            Path prefix to use to read data from S3 (eg. "backups/2016-04-01-12:25-")
-    --silent=false            Set to true to disable all non-error output
-    --no-progress=false       Set to true to disable the progress bar
+    --allow-overwrite=false     Set to true to overwrite any existing rows
+    -f, --filename=""           Filename to read data from.  Set to "-" for stdin
+    --stdin=false               If true then read the dump data from stdin
+    --url=""                    HTTP(S) URL to read data from; gzipped data is detected automatically
+    --decompress-cmd=""         Command to pipe file, stdin or URL input through (eg. "xz -d")
+    --hash-key=""               Hash key attribute name of the table; if set the table is not described
+    --range-key=""              Range key attribute name of the table, if it has one
+    --max-retries=-1            Maximum number of times to retry a failed DynamoDB request; -1 for the SDK's default
+    --envelope=false            Set to true if items are wrapped in envelopes carrying write conditions
+    --validate-utf8="none"      Check string attributes for invalid UTF-8 before each put: none, fail or skip
+    --continue-on-error=false   Set to true to record items that fail to load and continue, rather than stopping
+    --dead-letter-file=""       File to write items that fail to load to, with their errors, for reloading with --envelope
+    --max-failures=0            Stop the load once more than this many items have failed with --continue-on-error; 0 for no limit
+    --force=false               Set to true to load even if the table's key schema doesn't match an S3 backup's
+    --target-region=[]          Region to load into; repeat to load into the table in several regions at once (defaults to AWS_REGION)
+    --restore-ttl=false         Set to true to enable TTL on the table using the attribute recorded in an S3 backup
+    --create-table=false        Set to true to create the table if it doesn't exist using the schema recorded in an S3 backup
+    --restore-read-capacity=0   Read capacity to provision the table created by --create-table and its indexes with; created on-demand if unset
+    --restore-write-capacity=0  Write capacity to provision the table created by --create-table and its indexes with; created on-demand if unset
+    --reset-capacity=false      Set to true to set the table created by --create-table to the backed up table's capacity once the load completes
+    --use-backup-table-name=false   Set to true to load into the table named in an S3 backup's metadata in place of TABLENAME
+    --table-prefix=""           Prefix to add to the table name recorded in the backup with --use-backup-table-name
+    --table-suffix=""           Suffix to add to the table name recorded in the backup with --use-backup-table-name
+    --conditional-attr=""       Attribute, such as a timestamp, compared with the existing item's to decide whether to overwrite it
+    --conditional-op="gt"       Overwrite only if the loaded item's --conditional-attr is: gt, ge, lt or le the existing item's
+    --batch-size=1              Number of items to write with each BatchWriteItem request, up to 25; requires --allow-overwrite
+    --retry-run=0               Number of times to run the load again from the start if it fails due to throttling
+    --verify-after=0            Number of the loaded items to sample and check are held by the table once the load completes
+    --verify-seed=0             Seed for choosing the items checked by --verify-after; 0 for a random seed
+    -m, --maxitems=0            Maximum number of items to load.  Set to 0 to process all items
+    -p, --parallel=4            Number of concurrent channels to open to DynamoDB
+    -w, --write-capacity=5      Average aggregate write capacity to use for load (set to 0 for unlimited)
+    --s3-bucket=""              S3 bucket name to read from
+    --s3-prefix=""              Path prefix to use to read data from S3 (eg. "backups/2016-04-01-12:25-")
+    --verify="all"              Integrity checks to perform on an S3 backup: all, parts, master or none
+    --resume-file=""            File recording the S3 parts completely loaded, allowing an interrupted load to be resumed
+    --s3-parallel=1             Number of S3 parts to download concurrently; each is held in memory until it can be loaded in order
+    --silent=false              Set to true to disable all non-error output
+    --no-progress=false         Set to true to disable the progress bar
+    --progress-format="bar"     Progress to display: bar, or lines to write a machine readable line per interval
 
 
 INFO
@@ -100,29 +183,78 @@ INFO
     --s3-prefix=""   Path prefix to use to read data from S3 (eg. "backups/2016-04-01-12:25-")
 
 
+CAT
+
+  Usage: dyndump cat (--filename | (--s3-bucket --s3-prefix)) [-m]
+
+  Write the items held by a backup to stdout
+
+  Options:
+    -f, --filename=""   Filename to read data from; gzipped data is detected automatically
+    --s3-bucket=""      S3 bucket name to read from
+    --s3-prefix=""      Path prefix to use to read data from S3 (eg. "backups/2016-04-01-12:25-")
+    -m, --maxitems=0    Maximum number of items to output.  Set to 0 to output all items
+
+
+VERIFY
+
+  Usage: dyndump verify [--silent] [--no-progress] [--progress-format] --s3-bucket --s3-prefix [--deep]
+
+  Verify the integrity of an S3 backup
+
+  Options:
+    --s3-bucket=""            S3 bucket name to read from
+    --s3-prefix=""            Path prefix to use to read data from S3 (eg. "backups/2016-04-01-12:25-")
+    --deep=false              Set to true to also decode every item in the backup (CPU intensive)
+    --silent=false            Set to true to disable all non-error output
+    --no-progress=false       Set to true to disable the progress bar
+    --progress-format="bar"   Progress to display: bar, or lines to write a machine readable line per interval
+
+
 DELETE
 
-  Usage: dyndump delete [--silent] [--no-progress] --s3-bucket --s3-prefix [--force]
+  Usage: dyndump delete [--silent] [--no-progress] [--progress-format] --s3-bucket --s3-prefix [--force]
 
   Delete a backup from S3
 
   Options:
-    --s3-bucket=""        S3 bucket name to delete from
-    --s3-prefix=""        Path prefix to use to delete from S3 (eg. "backups/2016-04-01-12:25-")
-    --force=false         Set to true to disable the delete prompt
-    --silent=false        Set to true to disable all non-error output
-    --no-progress=false   Set to true to disable the progress bar
+    --s3-bucket=""            S3 bucket name to delete from
+    --s3-prefix=""            Path prefix to use to delete from S3 (eg. "backups/2016-04-01-12:25-")
+    --force=false             Set to true to disable the delete prompt
+    --silent=false            Set to true to disable all non-error output
+    --no-progress=false       Set to true to disable the progress bar
+    --progress-format="bar"   Progress to display: bar, or lines to write a machine readable line per interval
+
+
+REFRESH
+
+  Usage: dyndump refresh [--silent] [--no-progress] [--progress-format] --s3-bucket --s3-prefix [--force]
+
+  Recalculate the part and item counts of an S3 backup's metadata
+
+  Options:
+    --s3-bucket=""            S3 bucket name to read from
+    --s3-prefix=""            Path prefix to use to read data from S3 (eg. "backups/2016-04-01-12:25-")
+    --force=false             Set to true to refresh a backup that's still running or that failed
+    --silent=false            Set to true to disable all non-error output
+    --no-progress=false       Set to true to disable the progress bar
+    --progress-format="bar"   Progress to display: bar, or lines to write a machine readable line per interval
 */
 package main
 
 import (
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/jawher/mow.cli"
 )
 
+// version is recorded in the metadata of S3 backups; it may be overridden
+// at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 const (
 	maxParallel    = 1000
 	statsFrequency = 2 * time.Second
@@ -145,22 +277,100 @@ func checkLTE(value, max int, flag string) {
 	}
 }
 
+// selftest runs the hidden selftest command, which is kept out of the
+// main app so it doesn't appear in its usage.
+func selftest(args []string) {
+	app := cli.App("dyndump selftest", "Check that the read capacity limit is honored using a simulated table")
+	app.Spec = "[-cpr] [--item-size] [--duration]"
+	action := &selfTester{
+		consistentRead: app.BoolOpt("c consistent-read", false, "Simulate consistent reads (at 2x capacity use)"),
+		parallel:       app.IntOpt("p parallel", 5, "Number of concurrent scanners to run"),
+		readCapacity:   app.IntOpt("r read-capacity", 5, "Average aggregate read capacity to target (set to 0 for unlimited)"),
+		itemSize:       app.IntOpt("item-size", 1024, "Size of each simulated item, in bytes"),
+		duration:       app.IntOpt("duration", 30, "Number of seconds to run the test for"),
+	}
+	app.Before = func() {
+		checkGTE(*action.parallel, 1, "--parallel")
+		checkLTE(*action.parallel, maxParallel, "--parallel")
+		checkGTE(*action.readCapacity, 0, "--read-capacity")
+		checkGTE(*action.itemSize, 1, "--item-size")
+		checkLTE(*action.itemSize, 400*1024, "--item-size")
+		checkGTE(*action.duration, 1, "--duration")
+	}
+	app.Action = actionRunner(app.Cmd, action)
+	app.Run(args)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		selftest(os.Args[1:])
+		return
+	}
+
 	app := cli.App("dyndump", "Dump and restore DynamoDB database tables")
 	app.LongDesc = "long desc goes here"
+	app.Spec = "[--trace-aws]"
+	traceAWS := app.BoolOpt("trace-aws", false, "Set to true to log every AWS request attempt to stderr")
+	app.Before = func() {
+		if *traceAWS {
+			sessionHooks = append(sessionHooks, traceRequests)
+		}
+	}
 
 	app.Command("dump", "Dump a table to file or S3", func(cmd *cli.Cmd) {
-		cmd.Spec = "[-cmpr] [--filename | --stdout] [(--s3-bucket --s3-prefix)] TABLENAME"
+		cmd.Spec = "[-cmpr] [--adaptive-capacity] [--precount] [--key-condition] [--filter] [--projection | --print-keys [--hash-key [--range-key]]] [--key-names] [--key-values] [--filename | --stdout] [--compress-cmd] [--file-rotate-items] [--file-rotate-bytes] [(--s3-bucket --s3-prefix [--s3-upload-bandwidth] [--s3-acl] [--sse] [--sse-kms-key-id] [--s3-storage-class] [--s3-compression] [--s3-compression-level] [--cleanup-on-abort] [--checkpoint-file] [--defer-metadata] [--write-once] [--no-gzip-flush-tuning] [--s3-multipart-upload] [--s3-part-retries])] [--table-arn] [--table-name] [--created-by] [--no-checksum] [--date-partition] [--sequence | --buffer-output] [--omit-nulls] [--format [--columns] [--csv-json]] [--format-plugin] [--max-retries] [--size-histogram] [--cardinality] TABLENAME"
 		action := &dumper{
 			tableName:      cmd.StringArg("TABLENAME", "", "Table name to dump from Dynamo"),
 			consistentRead: cmd.BoolOpt("c consistent-read", false, "Enable consistent reads (at 2x capacity use)"),
 			filename:       cmd.StringOpt("f filename", "", "Filename to write data to."),
 			stdout:         cmd.BoolOpt("stdout", false, "If true then send the output to stdout"),
+			compressCmd:    cmd.StringOpt("compress-cmd", "", `Command to pipe file or stdout output through (eg. "xz -9")`),
+			rotateItems:    cmd.IntOpt("file-rotate-items", 0, "Number of items to write to each file before starting a new numbered file (set to 0 to disable)"),
+			rotateBytes:    cmd.IntOpt("file-rotate-bytes", 0, "Maximum bytes to write to each file before starting a new numbered file (set to 0 to disable)"),
 			maxItems:       cmd.IntOpt("m maxitems", 0, "Maximum number of items to dump.  Set to 0 to process all items"),
 			parallel:       cmd.IntOpt("p parallel", 5, "Number of concurrent channels to open to DynamoDB"),
 			readCapacity:   cmd.IntOpt("r read-capacity", 5, "Average aggregate read capacity to use for scan (set to 0 for unlimited)"),
+			adaptive:       cmd.BoolOpt("adaptive-capacity", false, "Set to true to raise the read capacity by up to 2x while requests aren't throttled"),
+			keyCondition:   cmd.StringOpt("key-condition", "", `Key condition expression to query the table with in place of a full scan (eg. "#id = :id")`),
+			filter:         cmd.StringOpt("filter", "", `Filter expression limiting the items dumped; capacity is still used by every item read (eg. "#st = :active")`),
+			projection:     cmd.StringOpt("projection", "", `Comma separated list of the attributes to dump; other attributes are omitted from the backup (eg. "id, #n")`),
+			printKeys:      cmd.BoolOpt("print-keys", false, "Set to true to dump only the key attributes of each item, as named by the table's key schema"),
+			hashKey:        cmd.StringOpt("hash-key", "", "Hash key attribute name of the table for --print-keys; if unset the key schema is used"),
+			rangeKey:       cmd.StringOpt("range-key", "", "Range key attribute name of the table for --print-keys, if it has one"),
+			keyNamesJSON:   cmd.StringOpt("key-names", "", `JSON map of attribute name placeholders used by --key-condition, --filter and --projection (eg. '{"#id": "id"}')`),
+			keyValuesJSON:  cmd.StringOpt("key-values", "", `JSON map of attribute values used by --key-condition and --filter (eg. '{":id": {"S": "abc"}}')`),
+			precount:       cmd.BoolOpt("precount", false, "Set to true to count the table's items with an extra scan first, for accurate progress"),
 			s3BucketName:   cmd.StringOpt("s3-bucket", "", "S3 bucket name to upload to"),
 			s3Prefix:       cmd.StringOpt("s3-prefix", "", `Path prefix to use to store data in S3 (eg. "backups/2016-04-01-12:25-")`),
+			s3Bandwidth:    cmd.IntOpt("s3-upload-bandwidth", 0, "Maximum bytes per second to upload to S3 (set to 0 for unlimited)"),
+			s3ACL:          cmd.StringOpt("s3-acl", "", `Canned ACL to apply to uploaded S3 objects (eg. "bucket-owner-full-control")`),
+			sse:            cmd.StringOpt("sse", "", "Server side encryption to apply to uploaded S3 objects: AES256 or aws:kms"),
+			sseKMSKeyID:    cmd.StringOpt("sse-kms-key-id", "", "KMS key ID to encrypt uploaded S3 objects with; implies --sse=aws:kms"),
+			storageClass:   cmd.StringOpt("s3-storage-class", "", `Storage class for uploaded S3 parts (eg. "STANDARD_IA"); the metadata is always stored as STANDARD`),
+			compression:    cmd.StringOpt("s3-compression", "gzip", "Compression of uploaded S3 parts: gzip, zlib, zstd or none"),
+			compressLevel:  cmd.IntOpt("s3-compression-level", 0, "Compression level of uploaded S3 parts, from 1 (fastest) to 9 (smallest); 0 for the default"),
+			cleanupAbort:   cmd.BoolOpt("cleanup-on-abort", false, "Set to true to delete an S3 backup's objects if the dump is aborted or fails"),
+			checkpointFile: cmd.StringOpt("checkpoint-file", "", "Local file recording uploaded S3 parts, allowing an interrupted dump to be resumed"),
+			deferMetadata:  cmd.BoolOpt("defer-metadata", false, "Set to true to write S3 backup metadata only once the dump completes"),
+			writeOnce:      cmd.BoolOpt("write-once", false, "Set to true to never overwrite an S3 object, for write-once or Object Lock buckets"),
+			noFlushTuning:  cmd.BoolOpt("no-gzip-flush-tuning", false, "Set to true to stop flushing S3 parts to measure their size; compresses better, but parts may exceed their target size"),
+			s3Multipart:    cmd.BoolOpt("s3-multipart-upload", false, "Set to true to stream each S3 part in 5MiB chunks with a multipart upload rather than buffering it in a temporary file"),
+			partRetries:    cmd.IntOpt("s3-part-retries", 2, "Number of times to retry a failed S3 part upload, reusing its key so the part is never stored twice"),
+			mdTableARN:     cmd.StringOpt("table-arn", "", "Table ARN to record in the S3 backup metadata, in place of the source table's ARN"),
+			mdTableName:    cmd.StringOpt("table-name", "", "Table name to record in the S3 backup metadata, in place of TABLENAME"),
+			createdBy:      cmd.StringOpt("created-by", "", "User or host to record in the S3 backup metadata (defaults to $USER@$HOSTNAME)"),
+			noChecksum:     cmd.BoolOpt("no-checksum", false, "Set to true to skip calculating integrity hashes for an S3 backup"),
+			datePartition:  cmd.BoolOpt("date-partition", false, `Set to true to store S3 parts beneath a "dt=YYYY-MM-DD/" path for lifecycle rules`),
+			sequence:       cmd.BoolOpt("sequence", false, `Set to true to add a "__seq" sequence number attribute to each item, ignored by load`),
+			omitNulls:      cmd.BoolOpt("omit-nulls", false, "Set to true to leave NULL attributes out of the dump; they'll be missing from restored items"),
+			format:         cmd.StringOpt("format", "json", "Output format for --filename or --stdout: json, or csv to write the --columns of each item"),
+			columns:        cmd.StringOpt("columns", "", `Comma separated list of the attributes to write as CSV columns, in order (eg. "id,name,email")`),
+			csvJSON:        cmd.BoolOpt("csv-json", false, "Set to true to write lists, maps and sets as JSON in CSV cells, rather than failing"),
+			formatPlugin:   cmd.StringOpt("format-plugin", "", `Command to pipe the JSON items through, writing its output to --filename or --stdout (eg. "./to-xml")`),
+			bufferOutput:   cmd.BoolOpt("buffer-output", false, "Set to true to encode items in parallel, writing them in 64KB chunks, for fast multi-segment dumps"),
+			maxRetries:     cmd.IntOpt("max-retries", -1, "Maximum number of times to retry a failed DynamoDB request; -1 for the SDK's default"),
+			sizeHistogram:  cmd.BoolOpt("size-histogram", false, "Set to true to report a histogram of item sizes, also recorded in S3 backup metadata"),
+			cardinality:    cmd.StringOpt("cardinality", "", "Attribute to report the approximate distinct value count and 10 most frequent values of"),
 		}
 
 		cmd.Before = func() {
@@ -168,26 +378,151 @@ func main() {
 			checkLTE(*action.parallel, maxParallel, "--parallel")
 			checkGTE(*action.maxItems, 0, "--max-items")
 			checkGTE(*action.readCapacity, 0, "--read-capacity")
+			checkGTE(*action.s3Bandwidth, 0, "--s3-upload-bandwidth")
+			checkGTE(*action.compressLevel, 0, "--s3-compression-level")
+			checkLTE(*action.compressLevel, 9, "--s3-compression-level")
+			checkGTE(*action.partRetries, 0, "--s3-part-retries")
+			checkGTE(*action.maxRetries, -1, "--max-retries")
 			if *action.filename == "" && !*action.stdout && *action.s3BucketName == "" {
 				fail("Either --filename/--stdout and/or --s3-bucket and --s3-prefix must be set")
 			}
+			if *action.compressCmd != "" && *action.filename == "" && !*action.stdout {
+				fail("--compress-cmd requires --filename or --stdout")
+			}
+			if *action.keyNamesJSON != "" && *action.keyCondition == "" && *action.filter == "" && *action.projection == "" {
+				fail("--key-names requires --key-condition, --filter or --projection")
+			}
+			if *action.keyValuesJSON != "" && *action.keyCondition == "" && *action.filter == "" {
+				fail("--key-values requires --key-condition or --filter")
+			}
+			checkGTE(*action.rotateItems, 0, "--file-rotate-items")
+			checkGTE(*action.rotateBytes, 0, "--file-rotate-bytes")
+			if (*action.rotateItems > 0 || *action.rotateBytes > 0) && *action.filename == "" {
+				fail("--file-rotate-items and --file-rotate-bytes require --filename")
+			}
+			if (*action.rotateItems > 0 || *action.rotateBytes > 0) && isFifo(*action.filename) {
+				fail("--file-rotate-items and --file-rotate-bytes can't be used with a fifo")
+			}
+			if *action.rotateItems > 0 && *action.bufferOutput {
+				// each chunk written holds many items, so files can't be
+				// rotated after an exact number of them
+				fail("--file-rotate-items can't be used with --buffer-output")
+			}
+			if (*action.mdTableARN != "" || *action.mdTableName != "" || *action.createdBy != "") && *action.s3BucketName == "" && !isTarFilename(*action.filename) {
+				fail("--table-arn, --table-name and --created-by may only be used with --s3-bucket or a tar --filename")
+			}
+			if isTarFilename(*action.filename) {
+				if *action.s3BucketName != "" || *action.compressCmd != "" || *action.rotateItems > 0 || *action.rotateBytes > 0 {
+					fail("A tar --filename may not be used with --s3-bucket, --compress-cmd or file rotation")
+				}
+			}
+			if *action.datePartition && *action.s3BucketName == "" {
+				fail("--date-partition may only be used with --s3-bucket")
+			}
+			switch *action.format {
+			case "json":
+				if *action.columns != "" || *action.csvJSON {
+					fail("--columns and --csv-json require --format=csv")
+				}
+			case "csv":
+				if *action.columns == "" {
+					fail("--format=csv requires --columns")
+				}
+				if *action.s3BucketName != "" || isTarFilename(*action.filename) {
+					fail("--format=csv may only be used with a plain --filename or --stdout")
+				}
+				if *action.sequence || *action.bufferOutput {
+					fail("--format=csv may not be used with --sequence or --buffer-output")
+				}
+				if *action.rotateItems > 0 || *action.rotateBytes > 0 {
+					// the header row is only written at the start of the
+					// first file
+					fail("--format=csv may not be used with --file-rotate-items or --file-rotate-bytes")
+				}
+			default:
+				fail("--format must be one of json or csv")
+			}
+			if *action.formatPlugin != "" {
+				if *action.format != "json" {
+					fail("--format-plugin may not be used with --format=csv")
+				}
+				if *action.s3BucketName != "" || isTarFilename(*action.filename) || (*action.filename == "" && !*action.stdout) {
+					fail("--format-plugin may only be used with a plain --filename or --stdout")
+				}
+				if *action.rotateItems > 0 || *action.rotateBytes > 0 {
+					fail("--format-plugin may not be used with file rotation")
+				}
+			}
+			if *action.adaptive && *action.readCapacity == 0 {
+				fail("--adaptive-capacity requires --read-capacity to be greater than 0")
+			}
+			if *action.checkpointFile != "" && *action.noChecksum {
+				fail("--checkpoint-file may not be used with --no-checksum")
+			}
+			if *action.sse != "" && !isSSEMode(*action.sse) {
+				fail("--sse must be one of %s", strings.Join(s3SSEModes, ", "))
+			}
+			if *action.sseKMSKeyID != "" && *action.sse != "" && *action.sse != "aws:kms" {
+				fail("--sse-kms-key-id requires --sse=aws:kms")
+			}
+			if *action.storageClass != "" && !isStorageClass(*action.storageClass) {
+				fail("--s3-storage-class must be one of %s", strings.Join(s3StorageClasses, ", "))
+			}
+			if !isPartCompression(*action.compression) {
+				fail("--s3-compression must be one of %s", strings.Join(s3Compressions, ", "))
+			}
+			if *action.s3Multipart && *action.writeOnce {
+				fail("--s3-multipart-upload may not be used with --write-once")
+			}
+			if *action.s3ACL != "" && !isCannedACL(*action.s3ACL) {
+				fail("--s3-acl must be one of %s", strings.Join(s3CannedACLs, ", "))
+			}
 		}
 
 		cmd.Action = actionRunner(cmd, action)
 	})
 
 	app.Command("load", "Load a table dump from S3 or file to a DynamoDB table", func(cmd *cli.Cmd) {
-		cmd.Spec = "[-mpw] [--allow-overwrite] (--filename | --stdin | (--s3-bucket --s3-prefix)) TABLENAME"
+		cmd.Spec = "[-mpw] [--allow-overwrite] (--filename | --stdin | --url | (--s3-bucket --s3-prefix [--verify] [--resume-file] [--s3-parallel])) [--decompress-cmd] [--hash-key [--range-key]] [--max-retries] [--envelope] [--validate-utf8] [--continue-on-error [--dead-letter-file] [--max-failures]] [--force] [--target-region...] [--restore-ttl] [--create-table [--restore-read-capacity --restore-write-capacity] [--reset-capacity]] [--conditional-attr [--conditional-op]] [--batch-size] [--retry-run] [--verify-after [--verify-seed]] (--use-backup-table-name [--table-prefix] [--table-suffix] | TABLENAME)"
 		action := &loader{
 			tableName:      cmd.StringArg("TABLENAME", "", "Table name to load into"),
 			allowOverwrite: cmd.BoolOpt("allow-overwrite", false, "Set to true to overwrite any existing rows"),
 			filename:       cmd.StringOpt("f filename", "", "Filename to read data from.  Set to \"-\" for stdin"),
 			stdin:          cmd.BoolOpt("stdin", false, "If true then read the dump data from stdin"),
+			url:            cmd.StringOpt("url", "", "HTTP(S) URL to read data from; gzipped data is detected automatically"),
+			decompressCmd:  cmd.StringOpt("decompress-cmd", "", `Command to pipe file, stdin or URL input through (eg. "xz -d")`),
 			maxItems:       cmd.IntOpt("m maxitems", 0, "Maximum number of items to load.  Set to 0 to process all items"),
 			parallel:       cmd.IntOpt("p parallel", 4, "Number of concurrent channels to open to DynamoDB"),
 			writeCapacity:  cmd.IntOpt("w write-capacity", 5, "Average aggregate write capacity to use for load (set to 0 for unlimited)"),
 			s3BucketName:   cmd.StringOpt("s3-bucket", "", "S3 bucket name to read from"),
 			s3Prefix:       cmd.StringOpt("s3-prefix", "", `Path prefix to use to read data from S3 (eg. "backups/2016-04-01-12:25-")`),
+			hashKey:        cmd.StringOpt("hash-key", "", "Hash key attribute name of the table; if set the table is not described"),
+			rangeKey:       cmd.StringOpt("range-key", "", "Range key attribute name of the table, if it has one"),
+			maxRetries:     cmd.IntOpt("max-retries", -1, "Maximum number of times to retry a failed DynamoDB request; -1 for the SDK's default"),
+			envelope:       cmd.BoolOpt("envelope", false, "Set to true if items are wrapped in envelopes carrying write conditions"),
+			validateUTF8:   cmd.StringOpt("validate-utf8", "none", "Check string attributes for invalid UTF-8 before each put: none, fail or skip"),
+			continueOnErr:  cmd.BoolOpt("continue-on-error", false, "Set to true to record items that fail to load and continue, rather than stopping"),
+			deadLetterFile: cmd.StringOpt("dead-letter-file", "", "File to write items that fail to load to, with their errors, for reloading with --envelope"),
+			maxFailures:    cmd.IntOpt("max-failures", 0, "Stop the load once more than this many items have failed with --continue-on-error; 0 for no limit"),
+			force:          cmd.BoolOpt("force", false, "Set to true to load even if the table's key schema doesn't match an S3 backup's"),
+			targetRegions:  cmd.StringsOpt("target-region", nil, "Region to load into; repeat to load into the table in several regions at once (defaults to AWS_REGION)"),
+			restoreTTL:     cmd.BoolOpt("restore-ttl", false, "Set to true to enable TTL on the table using the attribute recorded in an S3 backup"),
+			createTable:    cmd.BoolOpt("create-table", false, "Set to true to create the table if it doesn't exist using the schema recorded in an S3 backup"),
+			restoreRCU:     cmd.IntOpt("restore-read-capacity", 0, "Read capacity to provision the table created by --create-table and its indexes with; created on-demand if unset"),
+			restoreWCU:     cmd.IntOpt("restore-write-capacity", 0, "Write capacity to provision the table created by --create-table and its indexes with; created on-demand if unset"),
+			resetCapacity:  cmd.BoolOpt("reset-capacity", false, "Set to true to set the table created by --create-table to the backed up table's capacity once the load completes"),
+			useBackupName:  cmd.BoolOpt("use-backup-table-name", false, "Set to true to load into the table named in an S3 backup's metadata in place of TABLENAME"),
+			tablePrefix:    cmd.StringOpt("table-prefix", "", "Prefix to add to the table name recorded in the backup with --use-backup-table-name"),
+			tableSuffix:    cmd.StringOpt("table-suffix", "", "Suffix to add to the table name recorded in the backup with --use-backup-table-name"),
+			condAttr:       cmd.StringOpt("conditional-attr", "", "Attribute, such as a timestamp, compared with the existing item's to decide whether to overwrite it"),
+			condOp:         cmd.StringOpt("conditional-op", "gt", "Overwrite only if the loaded item's --conditional-attr is: gt, ge, lt or le the existing item's"),
+			verify:         cmd.StringOpt("verify", "all", "Integrity checks to perform on an S3 backup: all, parts, master or none"),
+			resumeFile:     cmd.StringOpt("resume-file", "", "File recording the S3 parts completely loaded, allowing an interrupted load to be resumed"),
+			s3Parallel:     cmd.IntOpt("s3-parallel", 1, "Number of S3 parts to download concurrently; each is held in memory until it can be loaded in order"),
+			batchSize:      cmd.IntOpt("batch-size", 1, "Number of items to write with each BatchWriteItem request, up to 25; requires --allow-overwrite"),
+			retryRun:       cmd.IntOpt("retry-run", 0, "Number of times to run the load again from the start if it fails due to throttling"),
+			verifyAfter:    cmd.IntOpt("verify-after", 0, "Number of the loaded items to sample and check are held by the table once the load completes"),
+			verifySeed:     cmd.IntOpt("verify-seed", 0, "Seed for choosing the items checked by --verify-after; 0 for a random seed"),
 		}
 
 		cmd.Before = func() {
@@ -195,6 +530,53 @@ func main() {
 			checkLTE(*action.parallel, maxParallel, "--parallel")
 			checkGTE(*action.maxItems, 0, "--max-items")
 			checkGTE(*action.writeCapacity, 0, "--write-capacity")
+			checkGTE(*action.maxRetries, -1, "--max-retries")
+			checkGTE(*action.s3Parallel, 1, "--s3-parallel")
+			checkLTE(*action.s3Parallel, maxParallel, "--s3-parallel")
+			checkGTE(*action.batchSize, 1, "--batch-size")
+			checkLTE(*action.batchSize, 25, "--batch-size")
+			checkGTE(*action.retryRun, 0, "--retry-run")
+			checkGTE(*action.verifyAfter, 0, "--verify-after")
+			checkGTE(*action.maxFailures, 0, "--max-failures")
+			checkGTE(*action.restoreRCU, 0, "--restore-read-capacity")
+			checkGTE(*action.restoreWCU, 0, "--restore-write-capacity")
+			if (*action.restoreRCU == 0) != (*action.restoreWCU == 0) {
+				fail("--restore-read-capacity and --restore-write-capacity must both be greater than 0")
+			}
+			if *action.decompressCmd != "" && *action.s3BucketName != "" {
+				fail("--decompress-cmd may not be used with --s3-bucket")
+			}
+			hasMetadata := *action.s3BucketName != "" || isTarFilename(*action.filename)
+			if *action.restoreTTL && !hasMetadata {
+				fail("--restore-ttl requires --s3-bucket or a tar --filename")
+			}
+			if *action.createTable && !hasMetadata {
+				fail("--create-table requires --s3-bucket or a tar --filename")
+			}
+			if *action.useBackupName && !hasMetadata {
+				fail("--use-backup-table-name requires --s3-bucket or a tar --filename")
+			}
+			if *action.decompressCmd != "" && isTarFilename(*action.filename) {
+				fail("--decompress-cmd may not be used with a tar --filename")
+			}
+			if _, ok := verifyModes[*action.verify]; !ok {
+				fail("--verify must be one of all, parts, master or none")
+			}
+			if _, ok := utf8Modes[*action.validateUTF8]; !ok {
+				fail("--validate-utf8 must be one of none, fail or skip")
+			}
+			if _, ok := compareOps[*action.condOp]; !ok {
+				fail("--conditional-op must be one of gt, ge, lt or le")
+			}
+			if *action.condAttr != "" && *action.allowOverwrite {
+				fail("--conditional-attr may not be used with --allow-overwrite")
+			}
+			if *action.batchSize > 1 && !*action.allowOverwrite {
+				fail("--batch-size requires --allow-overwrite")
+			}
+			if *action.retryRun > 0 && (*action.stdin || *action.filename == "-") {
+				fail("--retry-run can't be used with --stdin")
+			}
 		}
 
 		cmd.Action = actionRunner(cmd, action)
@@ -209,6 +591,27 @@ func main() {
 		cmd.Action = action.run
 	})
 
+	app.Command("cat", "Write the items held by a backup to stdout", func(cmd *cli.Cmd) {
+		cmd.Spec = "(--filename | (--s3-bucket --s3-prefix)) [-m]"
+		action := &catter{
+			filename:     cmd.StringOpt("f filename", "", "Filename to read data from; gzipped data is detected automatically"),
+			s3BucketName: cmd.StringOpt("s3-bucket", "", "S3 bucket name to read from"),
+			s3Prefix:     cmd.StringOpt("s3-prefix", "", `Path prefix to use to read data from S3 (eg. "backups/2016-04-01-12:25-")`),
+			maxItems:     cmd.IntOpt("m maxitems", 0, "Maximum number of items to output.  Set to 0 to output all items"),
+		}
+		cmd.Action = action.run
+	})
+
+	app.Command("verify", "Verify the integrity of an S3 backup", func(cmd *cli.Cmd) {
+		cmd.Spec = "--s3-bucket --s3-prefix [--deep]"
+		action := &verifier{
+			s3BucketName: cmd.StringOpt("s3-bucket", "", "S3 bucket name to read from"),
+			s3Prefix:     cmd.StringOpt("s3-prefix", "", `Path prefix to use to read data from S3 (eg. "backups/2016-04-01-12:25-")`),
+			deep:         cmd.BoolOpt("deep", false, "Set to true to also decode every item in the backup (CPU intensive)"),
+		}
+		cmd.Action = actionRunner(cmd, action)
+	})
+
 	app.Command("delete", "Delete a backup from S3", func(cmd *cli.Cmd) {
 		cmd.Spec = "--s3-bucket --s3-prefix [--force]"
 		action := &deleter{
@@ -220,5 +623,15 @@ func main() {
 		cmd.Action = actionRunner(cmd, action)
 	})
 
+	app.Command("refresh", "Recalculate the part and item counts of an S3 backup's metadata", func(cmd *cli.Cmd) {
+		cmd.Spec = "--s3-bucket --s3-prefix [--force]"
+		action := &refresher{
+			s3BucketName: cmd.StringOpt("s3-bucket", "", "S3 bucket name to read from"),
+			s3Prefix:     cmd.StringOpt("s3-prefix", "", `Path prefix to use to read data from S3 (eg. "backups/2016-04-01-12:25-")`),
+			force:        cmd.BoolOpt("force", false, "Set to true to refresh a backup that's still running or that failed"),
+		}
+		cmd.Action = actionRunner(cmd, action)
+	})
+
 	app.Run(os.Args)
 }
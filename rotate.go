@@ -0,0 +1,96 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// rotatingWriter writes each item sent to it to a sequence of numbered
+// files, starting a new file once the current one holds maxItems items or
+// would exceed maxBytes bytes.  Each Write must hold a single item.
+type rotatingWriter struct {
+	filename string
+	maxItems int64
+	maxBytes int64
+	open     func(filename string) (io.WriteCloser, error)
+
+	w     io.WriteCloser
+	seq   int
+	items int64
+	bytes int64
+}
+
+// newRotatingWriter opens the first file in the sequence.  Either of
+// maxItems or maxBytes may be 0 to disable that limit.
+func newRotatingWriter(filename string, maxItems, maxBytes int64, open func(filename string) (io.WriteCloser, error)) (*rotatingWriter, error) {
+	rw := &rotatingWriter{
+		filename: filename,
+		maxItems: maxItems,
+		maxBytes: maxBytes,
+		open:     open,
+	}
+	if err := rw.rotate(); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+// rotatedFilename inserts a sequence number before the extensions of
+// filename, eg. "dump.json.xz" becomes "dump.001.json.xz".
+func rotatedFilename(filename string, seq int) string {
+	dir, base := filepath.Split(filename)
+	i := strings.Index(base, ".")
+	if i <= 0 {
+		i = len(base)
+	}
+	return fmt.Sprintf("%s%s.%03d%s", dir, base[:i], seq, base[i:])
+}
+
+// rotate closes the current file, if any, and opens the next.
+func (rw *rotatingWriter) rotate() error {
+	if rw.w != nil {
+		if err := rw.w.Close(); err != nil {
+			return err
+		}
+		rw.w = nil
+	}
+	rw.seq++
+	w, err := rw.open(rotatedFilename(rw.filename, rw.seq))
+	if err != nil {
+		return err
+	}
+	rw.w = w
+	rw.items = 0
+	rw.bytes = 0
+	return nil
+}
+
+func (rw *rotatingWriter) Write(p []byte) (n int, err error) {
+	if rw.items > 0 &&
+		((rw.maxItems > 0 && rw.items >= rw.maxItems) ||
+			(rw.maxBytes > 0 && rw.bytes+int64(len(p)) > rw.maxBytes)) {
+		if err := rw.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = rw.w.Write(p)
+	rw.items++
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// Close closes the current file.
+func (rw *rotatingWriter) Close() error {
+	if rw.w == nil {
+		return nil
+	}
+	err := rw.w.Close()
+	rw.w = nil
+	return err
+}
@@ -21,22 +21,58 @@ type action interface {
 	init() error
 	newProgressBar() (bar *pb.ProgressBar)
 	updateProgress(bar *pb.ProgressBar)
+	progress() progressStats
 	start(w io.Writer) (doneChan chan error, err error)
 	abort()
 	printFinalStats(w io.Writer)
 }
 
+// progressStats holds the totals reported by each line of progress output
+// with --progress-format=lines.  Actions that process S3 parts rather than
+// items report the parts processed as items.
+type progressStats struct {
+	items    int64
+	bytes    int64
+	capacity float64
+
+	// segments is the number of segments a parallel dump is reading, and
+	// slowest is the unfinished segment that has read the fewest bytes.
+	segments int
+	slowest  int64
+}
+
+// writeProgressLine writes a machine readable progress line, using bar to
+// calculate the percentage complete, or -1 if the total is unknown.
+func writeProgressLine(w io.Writer, stats progressStats, bar *pb.ProgressBar) {
+	pct := -1.0
+	if bar != nil && bar.Total > 0 {
+		pct = float64(bar.Get()) / float64(bar.Total) * 100
+	}
+	fmt.Fprintf(w, "progress items=%d bytes=%d capacity=%.1f pct=%.1f",
+		stats.items, stats.bytes, stats.capacity, pct)
+	if stats.segments > 1 {
+		fmt.Fprintf(w, " slowest_segment=%d", stats.slowest)
+	}
+	fmt.Fprintln(w)
+}
+
 // actionRunner handles running an action which may take a while to complete
 // providing progress bars and signal handling.
 func actionRunner(cmd *cli.Cmd, action action) func() {
-	cmd.Spec = "[--silent] [--no-progress] " + cmd.Spec
+	cmd.Spec = "[--silent] [--no-progress] [--progress-format] " + cmd.Spec
 	silent := cmd.BoolOpt("silent", false, "Set to true to disable all non-error output")
 	noProgress := cmd.BoolOpt("no-progress", false, "Set to true to disable the progress bar")
+	progressFormat := cmd.StringOpt("progress-format", "bar", "Progress to display: bar, or lines to write a machine readable line per interval")
 
 	return func() {
 		var infoWriter io.Writer = os.Stderr
 		var ticker <-chan time.Time
 
+		if *progressFormat != "bar" && *progressFormat != "lines" {
+			fail("--progress-format must be one of bar or lines")
+		}
+		progressLines := *progressFormat == "lines"
+
 		if err := action.init(); err != nil {
 			fail("Initialization failed: %v", err)
 		}
@@ -50,7 +86,7 @@ func actionRunner(cmd *cli.Cmd, action action) func() {
 		if !*silent && !*noProgress {
 			ticker = time.Tick(statsFrequency)
 			bar = action.newProgressBar()
-			if bar != nil {
+			if bar != nil && !progressLines {
 				bar.Output = os.Stderr
 				bar.ShowSpeed = true
 				bar.ManualUpdate = true
@@ -70,11 +106,19 @@ func actionRunner(cmd *cli.Cmd, action action) func() {
 		for {
 			select {
 			case <-ticker:
-				action.updateProgress(bar)
-				bar.Update()
+				if bar != nil {
+					action.updateProgress(bar)
+				}
+				if progressLines {
+					writeProgressLine(os.Stderr, action.progress(), bar)
+				} else if bar != nil {
+					bar.Update()
+				}
 
 			case <-sigchan:
-				bar.Finish()
+				if bar != nil && !progressLines {
+					bar.Finish()
+				}
 				fmt.Fprintf(os.Stderr, "\nAborting..")
 				action.abort()
 				<-done
@@ -88,7 +132,7 @@ func actionRunner(cmd *cli.Cmd, action action) func() {
 				break LOOP
 			}
 		}
-		if bar != nil {
+		if bar != nil && !progressLines {
 			bar.Finish()
 		}
 
@@ -0,0 +1,138 @@
+// Copyright 2016 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/gwatts/dyndump/dyndump"
+)
+
+// tarPathPrefix is the path prefix a backup is stored beneath in a tar
+// archive, so that extracting it creates a directory laid out as the
+// backup would be in S3.  Its keys are named by tarKeyNamer, so the
+// metadata is stored as "backup/meta.json".
+const tarPathPrefix = "backup/"
+
+var tarKeyNamer = dyndump.NormalizedKeyNamer{}
+
+// isTarFilename reports whether filename names a tar archive to store a
+// backup in, rather than a file of items.
+func isTarFilename(filename string) bool {
+	return strings.HasSuffix(filename, ".tar") || isTarGzFilename(filename)
+}
+
+// isTarGzFilename reports whether filename names a gzipped tar archive.
+func isTarGzFilename(filename string) bool {
+	return strings.HasSuffix(filename, ".tar.gz") || strings.HasSuffix(filename, ".tgz")
+}
+
+// tarFileWriter writes a backup's objects to a tar archive file,
+// compressing it if the filename calls for it.
+type tarFileWriter struct {
+	*dyndump.TarWriter
+	f  *os.File
+	gz *gzip.Writer
+}
+
+func newTarFileWriter(filename string) (*tarFileWriter, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	tw := &tarFileWriter{f: f}
+	if isTarGzFilename(filename) {
+		tw.gz = gzip.NewWriter(f)
+		tw.TarWriter = dyndump.NewTarWriter(tw.gz)
+	} else {
+		tw.TarWriter = dyndump.NewTarWriter(f)
+	}
+	return tw, nil
+}
+
+// Close completes the archive and closes the file.
+func (tw *tarFileWriter) Close() error {
+	err := tw.TarWriter.Close()
+	if tw.gz != nil {
+		if gerr := tw.gz.Close(); err == nil {
+			err = gerr
+		}
+	}
+	if ferr := tw.f.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// tarFileReader reads a backup from a tar archive file.  A gzipped archive
+// is decompressed to a temporary file first, as the parts are read out of
+// the order they're stored in.
+type tarFileReader struct {
+	*dyndump.S3Reader
+	f      *os.File
+	remove bool // f is a temporary file to remove on Close
+}
+
+func openTarFile(filename string) (*tarFileReader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	tr := &tarFileReader{f: f}
+	if isTarGzFilename(filename) {
+		tr.f, tr.remove = nil, true
+		err = tr.decompress(f)
+		f.Close()
+		if err != nil {
+			tr.Close()
+			return nil, err
+		}
+	}
+	fi, err := tr.f.Stat()
+	if err != nil {
+		tr.Close()
+		return nil, err
+	}
+	s3, err := dyndump.NewTarReader(tr.f, fi.Size())
+	if err != nil {
+		tr.Close()
+		return nil, err
+	}
+	tr.S3Reader = &dyndump.S3Reader{S3: s3, PathPrefix: tarPathPrefix, KeyNamer: tarKeyNamer}
+	return tr, nil
+}
+
+// decompress gunzips r into a temporary file.
+func (tr *tarFileReader) decompress(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	if tr.f, err = ioutil.TempFile("", "dyndump"); err != nil {
+		return err
+	}
+	_, err = io.Copy(tr.f, gz)
+	return err
+}
+
+// Close stops the reader and closes the archive, removing it if it was
+// decompressed to a temporary file.
+func (tr *tarFileReader) Close() error {
+	if tr.S3Reader != nil {
+		tr.S3Reader.Close()
+	}
+	if tr.f == nil {
+		return nil
+	}
+	err := tr.f.Close()
+	if tr.remove {
+		os.Remove(tr.f.Name())
+	}
+	return err
+}
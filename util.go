@@ -7,7 +7,14 @@ package main
 import (
 	"fmt"
 	"io"
+	"os"
 	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 )
 
 const (
@@ -52,3 +59,122 @@ func (r *readWatcher) Read(p []byte) (n int, err error) {
 func (r *readWatcher) BytesRead() int64 {
 	return atomic.LoadInt64(&r.bytesRead)
 }
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// describeTable fetches a table's description.  Throttled requests are
+// retried by the client.  If waitActive is true then it waits, using the
+// SDK's waiter, for a table that doesn't exist yet, as happens briefly after
+// a table is created, or that isn't yet active.
+func describeTable(dyn *dynamodb.DynamoDB, tableName string, waitActive bool) (*dynamodb.TableDescription, error) {
+	input := &dynamodb.DescribeTableInput{TableName: aws.String(tableName)}
+	if waitActive {
+		if err := dyn.WaitUntilTableExists(input); err != nil {
+			return nil, fmt.Errorf("table %q did not become active: %v", tableName, err)
+		}
+	}
+	resp, err := dyn.DescribeTable(input)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Table, nil
+}
+
+// sessionHooks are called with the handlers of every AWS session created by
+// newSession, before any client is created from it.  They provide a single
+// place to add observability to every AWS request made by dyndump; for
+// example a build that includes the AWS X-Ray SDK can trace each request by
+// registering a hook that calls xray.AWS(...) from an init function.
+var sessionHooks []func(h *request.Handlers)
+
+// newSession creates an AWS session, applying any sessionHooks.
+func newSession(cfgs ...*aws.Config) *session.Session {
+	sess := session.New(cfgs...)
+	for _, hook := range sessionHooks {
+		hook(&sess.Handlers)
+	}
+	return sess
+}
+
+// traceRequests logs each attempt of an AWS request to stderr.
+func traceRequests(h *request.Handlers) {
+	h.CompleteAttempt.PushBack(func(r *request.Request) {
+		var status int
+		if r.HTTPResponse != nil {
+			status = r.HTTPResponse.StatusCode
+		}
+		var host string
+		if r.HTTPRequest != nil {
+			host = r.HTTPRequest.URL.Host
+		}
+		fmt.Fprintf(os.Stderr, "aws host=%s op=%s attempt=%d status=%d duration=%s err=%v\n",
+			host, r.Operation.Name, r.RetryCount+1, status,
+			time.Since(r.AttemptTime).Round(time.Millisecond), r.Error)
+	})
+}
+
+// describeTTL returns the table's time to live attribute, or an empty
+// string if TTL isn't enabled.
+func describeTTL(dyn *dynamodb.DynamoDB, tableName string) (string, error) {
+	resp, err := dyn.DescribeTimeToLive(&dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return "", err
+	}
+	ttl := resp.TimeToLiveDescription
+	if ttl == nil {
+		return "", nil
+	}
+	switch aws.StringValue(ttl.TimeToLiveStatus) {
+	case dynamodb.TimeToLiveStatusEnabled, dynamodb.TimeToLiveStatusEnabling:
+		return aws.StringValue(ttl.AttributeName), nil
+	}
+	return "", nil
+}
+
+// enableTTL enables time to live on the table using attrName, returning
+// false if it was already enabled.  It fails if TTL is enabled on another
+// attribute.
+func enableTTL(dyn *dynamodb.DynamoDB, tableName, attrName string) (enabled bool, err error) {
+	current, err := describeTTL(dyn, tableName)
+	if err != nil {
+		return false, err
+	}
+	if current == attrName {
+		return false, nil
+	}
+	if current != "" {
+		return false, fmt.Errorf("TTL is already enabled on attribute %q", current)
+	}
+	_, err = dyn.UpdateTimeToLive(&dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(tableName),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String(attrName),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	return err == nil, err
+}
+
+// throttleCounter counts the requests made by an AWS service client that
+// were throttled, including those that were successfully retried.
+type throttleCounter struct {
+	n int64
+}
+
+// install adds a handler to count throttled requests to a client's handlers.
+func (c *throttleCounter) install(h *request.Handlers) {
+	h.Retry.PushBack(func(r *request.Request) {
+		if r.IsErrorThrottle() {
+			atomic.AddInt64(&c.n, 1)
+		}
+	})
+}
+
+func (c *throttleCounter) Count() int64 {
+	return atomic.LoadInt64(&c.n)
+}